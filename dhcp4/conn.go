@@ -15,6 +15,7 @@
 package dhcp4
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -73,7 +74,15 @@ type Conn struct {
 
 // NewConn creates a Conn bound to the given UDP ip:port.
 func NewConn(addr string) (*Conn, error) {
-	return newConn(addr, newPortableConn)
+	return NewConnWithConfig(addr, &net.ListenConfig{})
+}
+
+// NewConnWithConfig is like NewConn, but creates the UDP socket with
+// lc, e.g. to set socket options before it's bound.
+func NewConnWithConfig(addr string, lc *net.ListenConfig) (*Conn, error) {
+	return newConn(addr, func(port int) (conn, error) {
+		return newPortableConn(lc, port)
+	})
 }
 
 func newConn(addr string, n func(int) (conn, error)) (*Conn, error) {
@@ -222,8 +231,8 @@ type portableConn struct {
 	conn *ipv4.PacketConn
 }
 
-func newPortableConn(port int) (conn, error) {
-	c, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
+func newPortableConn(lc *net.ListenConfig, port int) (conn, error) {
+	c, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
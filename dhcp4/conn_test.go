@@ -123,7 +123,7 @@ func TestPortableConn(t *testing.T) {
 	addr := l.LocalAddr().String()
 	l.Close()
 
-	c, err := newPortableConn(port)
+	c, err := newPortableConn(&net.ListenConfig{}, port)
 	if err != nil {
 		t.Fatalf("creating the conn: %s", err)
 	}
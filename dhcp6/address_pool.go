@@ -1,20 +1,47 @@
 package dhcp6
 
 import (
+	"errors"
 	"net"
 	"time"
 )
 
-// IdentityAssociation associates an ip address with a network interface of a client
+// ErrPoolExhausted is returned by AddressPool implementations when no more addresses are left to hand out
+var ErrPoolExhausted = errors.New("No more free ip addresses are currently available in the pool")
+
+// IdentityAssociation associates one or more ip addresses with a network interface of a client
 type IdentityAssociation struct {
-	IPAddress   net.IP
-	ClientID    []byte
-	InterfaceID []byte
-	CreatedAt   time.Time
+	IPAddress net.IP
+	// AdditionalIPAddresses are handed out alongside IPAddress, for clients that can use several addresses,
+	// see MemoryAddressPool.SetAddressesPerAssociation
+	AdditionalIPAddresses []net.IP
+	ClientID              []byte
+	InterfaceID           []byte
+	CreatedAt             time.Time
+	ExpiresAt             time.Time
+}
+
+// IPAddresses returns all ip addresses in the association, starting with IPAddress
+func (ia *IdentityAssociation) IPAddresses() []net.IP {
+	return append([]net.IP{ia.IPAddress}, ia.AdditionalIPAddresses...)
 }
 
-// AddressPool keeps track of assigned and available ip address in an address pool
+// AddressPool keeps track of assigned and available ip address in an address pool. ReserveAddressesForLink is
+// like ReserveAddresses, for clients relayed from the link with address linkAddr, so that pools spanning several
+// subnets can hand out addresses from the client's subnet. linkAddr is nil for clients that weren't relayed. Pools
+// with a single subnet ignore it.
 type AddressPool interface {
 	ReserveAddresses(clientID []byte, interfaceIds [][]byte) ([]*IdentityAssociation, error)
+	ReserveAddressesForLink(linkAddr net.IP, clientID []byte, interfaceIds [][]byte) ([]*IdentityAssociation, error)
 	ReleaseAddresses(clientID []byte, interfaceIds [][]byte)
+	LookupAddresses(clientID []byte, interfaceIds [][]byte) []*IdentityAssociation
+	ExtendAddresses(clientID []byte, interfaceIds [][]byte) []*IdentityAssociation
+	Contains(ip net.IP) bool
+}
+
+// LeaseStore persists the identity associations of an AddressPool, so that clients keep their addresses across
+// server restarts. Save replaces all previously saved associations.
+type LeaseStore interface {
+	Save(associations []*IdentityAssociation) error
+	Load() ([]*IdentityAssociation, error)
 }
@@ -0,0 +1,72 @@
+package dhcp6
+
+import (
+	"container/list"
+	"sync"
+)
+
+// advertiseCacheSize bounds the number of Advertise messages kept to answer retransmitted Solicits
+const advertiseCacheSize = 256
+
+// advertiseCache keeps the most recent Advertise messages by client ID and transaction ID, so that Solicits
+// retransmitted by a client get the same Advertise, without reserving addresses again. Its zero value is
+// an empty cache.
+type advertiseCache struct {
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   list.List // most recently used first
+}
+
+type advertiseCacheEntry struct {
+	key       string
+	advertise *Packet
+}
+
+func advertiseCacheKey(solicit *Packet) string {
+	return string(solicit.TransactionID[:]) + string(solicit.Options.ClientID())
+}
+
+// get returns a copy of the Advertise sent in response to solicit, or nil if there's none
+func (c *advertiseCache) get(solicit *Packet) *Packet {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, exists := c.entries[advertiseCacheKey(solicit)]
+	if !exists {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return copyPacket(element.Value.(*advertiseCacheEntry).advertise)
+}
+
+// add keeps a copy of the Advertise sent in response to solicit, evicting the least recently used one if the
+// cache is full
+func (c *advertiseCache) add(solicit, advertise *Packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	key := advertiseCacheKey(solicit)
+	if element, exists := c.entries[key]; exists {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&advertiseCacheEntry{key: key, advertise: copyPacket(advertise)})
+	for c.order.Len() > advertiseCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*advertiseCacheEntry).key)
+	}
+}
+
+// copyPacket returns a copy of p that options can be added to or removed from without affecting p. Option
+// values are shared.
+func copyPacket(p *Packet) *Packet {
+	options := make(Options, len(p.Options))
+	for id, multipleOptions := range p.Options {
+		options[id] = append([]*Option(nil), multipleOptions...)
+	}
+	return &Packet{Type: p.Type, TransactionID: p.TransactionID, Options: options,
+		Relays: append([]*RelayMessage(nil), p.Relays...)}
+}
@@ -2,9 +2,42 @@ package dhcp6
 
 import "net"
 
-// BootConfiguration implementation provides values for dhcp options served to dhcp clients
+// BootConfiguration implementation provides values for dhcp options served to dhcp clients. Like GetBootURL,
+// GetPreference and GetRecursiveDNS are given the link-layer address or ID in the client DUID and the client
+// architecture type, so that preference and DNS servers can be client-specific, e.g. to pin some clients to a
+// server in a failover setup, or for split-horizon resolvers. A nil preference omits the Preference Option. A
+// GetRecursiveDNS error, e.g. from an unreachable backend, fails the response only if the PacketBuilder's
+// FailOnDNSError is set, otherwise the client gets its configuration without DNS servers.
 type BootConfiguration interface {
 	GetBootURL(id []byte, clientArchType uint16) ([]byte, error)
-	GetPreference() []byte
-	GetRecursiveDNS() []net.IP
+	GetPreference(id []byte, clientArchType uint16) []byte
+	GetRecursiveDNS(id []byte, clientArchType uint16) ([]net.IP, error)
+	GetDNSSearchList() []string
+	GetNTPServers() []net.IP
+}
+
+// BootParamsConfiguration is implemented by BootConfigurations that also provide boot file parameters, such as a
+// kernel command line, served to dhcp clients in the Boot File Parameters Option
+type BootParamsConfiguration interface {
+	GetBootParams(id []byte, clientArchType uint16) []string
+}
+
+// AlternateBootURLsConfiguration is implemented by BootConfigurations that offer dhcp clients Boot File URLs to
+// fall back to, e.g. an EFI binary for firmwares that can't run the iPXE script of the primary URL. The URLs are
+// served, in the order clients should try them, in a Vendor-specific Information Option, see
+// MakeAlternateBootFileURLsOption.
+type AlternateBootURLsConfiguration interface {
+	GetAlternateBootURLs(id []byte, clientArchType uint16) [][]byte
+}
+
+// TFTPBootConfiguration is implemented by BootConfigurations that boot legacy BIOS clients from a TFTP server,
+// separately from the Boot File URL other clients get. ok is false if the client should get the Boot File URL.
+type TFTPBootConfiguration interface {
+	GetTFTPBoot(id []byte, clientArchType uint16) (server net.IP, bootFile string, ok bool)
+}
+
+// ClientFQDNConfiguration is implemented by BootConfigurations that assign hostnames to dhcp clients, served
+// in the Client FQDN Option to clients that ask for it. ok is false if the client has no assigned hostname.
+type ClientFQDNConfiguration interface {
+	GetClientFQDN(id []byte, clientArchType uint16) (hostname string, ok bool)
 }
@@ -1,27 +1,76 @@
 package dhcp6
 
 import (
+	"errors"
 	"fmt"
 	"golang.org/x/net/ipv6"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// ErrMalformedPacket is wrapped by the errors RecvPacket returns for packets that can't be decoded
+var ErrMalformedPacket = errors.New("malformed packet")
+
 // Conn is dhcpv6-specific socket
 type Conn struct {
-	conn          *ipv6.PacketConn
-	group         net.IP
+	conn  *ipv6.PacketConn
+	group net.IP
+	// mu guards ifi, which RejoinGroup replaces
+	mu            sync.Mutex
 	ifi           *net.Interface
 	listenAddress string
 	listenPort    string
+	tap           PacketTap
 }
 
+// PacketTap is called with the raw bytes of every packet a Conn receives or sends, received packets before they
+// are decoded. src and dst are the packet's source and destination addresses.
+type PacketTap func(received bool, src, dst *net.UDPAddr, bs []byte)
+
 // NewConn creates a new Conn bound to specified address and port
 func NewConn(addr, port string) (*Conn, error) {
 	ifi, err := InterfaceByAddress(addr)
 	if err != nil {
 		return nil, err
 	}
+	return newConn(ifi, addr, port)
+}
+
+// NewConnOnInterface creates a new Conn bound to the named interface and specified port. The interface must
+// have an IPv6 link-local address. If addr is not empty, it must be one of the interface's addresses.
+func NewConnOnInterface(ifName, addr, port string) (*Conn, error) {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't find interface %s: %s", ifName, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting address information for interface %s: %s", ifName, err)
+	}
+
+	hasLinkLocal, hasAddr := false, addr == ""
+	for _, a := range addrs {
+		ip := addrToIP(a)
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			hasLinkLocal = true
+		}
+		if ip.String() == addr {
+			hasAddr = true
+		}
+	}
+	if !hasLinkLocal {
+		return nil, fmt.Errorf("Interface %s has no IPv6 link-local address", ifName)
+	}
+	if !hasAddr {
+		return nil, fmt.Errorf("Interface %s doesn't have address %s", ifName, addr)
+	}
 
+	return newConn(ifi, addr, port)
+}
+
+func newConn(ifi *net.Interface, addr, port string) (*Conn, error) {
 	group := net.ParseIP("ff02::1:2")
 	c, err := net.ListenPacket("udp6", "[::]:"+port)
 	if err != nil {
@@ -47,11 +96,53 @@ func NewConn(addr, port string) (*Conn, error) {
 	}, nil
 }
 
+// SetPacketTap makes Conn call tap with the packets it receives and sends, e.g. to capture them. It must be
+// called before Conn is used.
+func (c *Conn) SetPacketTap(tap PacketTap) {
+	c.tap = tap
+}
+
 // Close closes Conn
 func (c *Conn) Close() error {
 	return c.conn.Close()
 }
 
+// SetReadDeadline sets the deadline for RecvDHCP and RecvPacket, like net.PacketConn's SetReadDeadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// InterfaceName returns the name of the interface Conn listens on
+func (c *Conn) InterfaceName() string {
+	return c.iface().Name
+}
+
+// RejoinGroup joins the All_DHCP_Relay_Agents_and_Servers multicast group again on Conn's interface, which
+// loses its multicast memberships when it goes away and comes back, e.g. when its driver is reloaded. The
+// interface is looked up again by name, in case it came back with a different index.
+func (c *Conn) RejoinGroup() error {
+	old := c.iface()
+	ifi, err := net.InterfaceByName(old.Name)
+	if err != nil {
+		return fmt.Errorf("Couldn't find interface %s: %s", old.Name, err)
+	}
+	// The group may still be joined on the old interface, or not at all
+	c.conn.LeaveGroup(old, &net.UDPAddr{IP: c.group})
+	if err := c.conn.JoinGroup(ifi, &net.UDPAddr{IP: c.group}); err != nil {
+		return fmt.Errorf("Error joining group %s on interface %s: %s", c.group, ifi.Name, err)
+	}
+	c.mu.Lock()
+	c.ifi = ifi
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) iface() *net.Interface {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ifi
+}
+
 // InterfaceByAddress finds the interface bound to an ip address, or returns an error if none were found
 func InterfaceByAddress(ifAddr string) (*net.Interface, error) {
 	allIfis, err := net.Interfaces()
@@ -86,41 +177,84 @@ func addrToIP(a net.Addr) net.IP {
 
 // RecvDHCP reads next available dhcp packet from Conn
 func (c *Conn) RecvDHCP() (*Packet, net.IP, error) {
+	for {
+		pkt, src, err := c.RecvPacket()
+		if errors.Is(err, ErrMalformedPacket) {
+			continue // malformed packet, discard
+		}
+		return pkt, src, err
+	}
+}
+
+// RecvPacket is like RecvDHCP, but returns an error wrapping ErrMalformedPacket, along with the sender's address,
+// for packets that can't be decoded rather than discarding them
+func (c *Conn) RecvPacket() (*Packet, net.IP, error) {
 	b := make([]byte, 1500)
 	for {
-		n, rcm, _, err := c.conn.ReadFrom(b)
+		n, rcm, src, err := c.conn.ReadFrom(b)
 		if err != nil {
 			return nil, nil, err
 		}
-		if c.ifi.Index != 0 && rcm.IfIndex != c.ifi.Index {
+		if ifi := c.iface(); ifi.Index != 0 && rcm.IfIndex != ifi.Index {
 			continue
 		}
-		if !rcm.Dst.IsMulticast() || !rcm.Dst.Equal(c.group) {
+		// relay agents unicast Relay-forward messages to the server, and clients told to with a Server
+		// Unicast Option their other messages
+		if rcm.Dst.IsMulticast() && !rcm.Dst.Equal(c.group) {
 			continue // unknown group, discard
 		}
+		if c.tap != nil {
+			dst := &net.UDPAddr{IP: rcm.Dst}
+			dst.Port, _ = strconv.Atoi(c.listenPort)
+			c.tap(true, src.(*net.UDPAddr), dst, b[:n])
+		}
 		pkt, err := Unmarshal(b, n)
 		if err != nil {
-			return nil, nil, err
+			return nil, rcm.Src, fmt.Errorf("%w: %s", ErrMalformedPacket, err)
 		}
 
 		return pkt, rcm.Src, nil
 	}
 }
 
-// SendDHCP sends a dhcp packet to the specified ip address using Conn
+// SendDHCP sends a dhcp packet to the specified ip address using Conn. Relay-reply messages are sent
+// to the relay agent's server port, everything else to the client port.
 func (c *Conn) SendDHCP(dst net.IP, p []byte) error {
+	port := 546
+	if len(p) > 0 && MessageType(p[0]) == MsgRelayRepl {
+		port = 547
+	}
+	return c.SendDHCPTo(&net.UDPAddr{IP: dst, Port: port}, p)
+}
+
+// SendDHCPTo sends a dhcp packet to the specified address and port using Conn, e.g. one returned by
+// Packet.ReplyAddress
+func (c *Conn) SendDHCPTo(dst *net.UDPAddr, p []byte) error {
 	dstAddr := &net.UDPAddr{
-		IP:   dst,
-		Port: 546,
+		IP:   dst.IP,
+		Port: dst.Port,
+	}
+	// link-local addresses are ambiguous on a multihomed host, reply through the interface Conn listens on
+	if dst.IP.IsLinkLocalUnicast() || dst.IP.IsLinkLocalMulticast() {
+		dstAddr.Zone = c.iface().Name
 	}
 	_, err := c.conn.WriteTo(p, nil, dstAddr)
 	if err != nil {
-		return fmt.Errorf("Error sending a reply to %s: %s", dst.String(), err)
+		return fmt.Errorf("Error sending a reply to %s: %s", dst.IP.String(), err)
+	}
+	if c.tap != nil {
+		// Without a listen address, the source address is left to the kernel, and unknown
+		src := &net.UDPAddr{IP: net.ParseIP(c.listenAddress)}
+		if src.IP == nil {
+			src.IP = net.IPv6unspecified
+		}
+		src.Port, _ = strconv.Atoi(c.listenPort)
+		c.tap(false, src, dstAddr, p)
 	}
 	return nil
 }
 
 // SourceHardwareAddress returns hardware address of the interface used by Conn
 func (c *Conn) SourceHardwareAddress() net.HardwareAddr {
-	return c.ifi.HardwareAddr
+	return c.iface().HardwareAddr
 }
@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package dhcp6
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewConnOnInterface(t *testing.T) {
+	if _, err := NewConnOnInterface("no-such-interface0", "", "0"); err == nil {
+		t.Fatalf("Expected an error for a nonexistent interface")
+	}
+
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Error listing interfaces: %s", err)
+	}
+	var withLinkLocal, withoutLinkLocal *net.Interface
+	for i := range ifis {
+		addrs, err := ifis[i].Addrs()
+		if err != nil {
+			t.Fatalf("Error listing addresses of %s: %s", ifis[i].Name, err)
+		}
+		linkLocal := false
+		for _, addr := range addrs {
+			ip := addrToIP(addr)
+			if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+				linkLocal = true
+			}
+		}
+		if linkLocal && withLinkLocal == nil && ifis[i].Flags&net.FlagMulticast != 0 {
+			withLinkLocal = &ifis[i]
+		} else if !linkLocal && withoutLinkLocal == nil {
+			withoutLinkLocal = &ifis[i]
+		}
+	}
+
+	if withoutLinkLocal != nil {
+		if _, err := NewConnOnInterface(withoutLinkLocal.Name, "", "0"); err == nil {
+			t.Fatalf("Expected an error for interface %s, which has no link-local address", withoutLinkLocal.Name)
+		}
+	}
+
+	if withLinkLocal == nil {
+		t.Skip("no multicast interface with an IPv6 link-local address")
+	}
+	c, err := NewConnOnInterface(withLinkLocal.Name, "", "0")
+	if err != nil {
+		t.Fatalf("Error listening on %s: %s", withLinkLocal.Name, err)
+	}
+	defer c.Close()
+	if c.ifi.Name != withLinkLocal.Name {
+		t.Fatalf("Expected Conn to listen on %s, but it listens on %s", withLinkLocal.Name, c.ifi.Name)
+	}
+
+	if _, err := NewConnOnInterface(withLinkLocal.Name, "2001:db8::1", "0"); err == nil {
+		t.Fatalf("Expected an error for an address not assigned to %s", withLinkLocal.Name)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build go1.18
+// +build go1.18
+
+package dhcp6
+
+import (
+	"net"
+	"testing"
+)
+
+func FuzzParsePacket(f *testing.F) {
+	f.Add(relayedSolicit)
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte{0x0, 0x3, 0x0, 0x1, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}))
+	options.Add(MakeOptionRequestOptions([]uint16{OptBootfileURL}))
+	options.Add(MakeOption(OptClientArchType, []byte{0x0, 0x10}))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0, MakeIaAddrOption(net.ParseIP("2001:db8:f00f:cafe::1"), 0, 0)))
+	options.Add(MakeIaPdOption([]byte("id-2"), 0, 0))
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgConfirm, MsgRenew, MsgRebind, MsgRelease,
+		MsgInformationRequest} {
+		seed, err := (&Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}).Marshal()
+		if err != nil {
+			f.Fatalf("Failed to marshal seed packet: %s", err)
+		}
+		f.Add(seed)
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		pkt, err := ParsePacket(bs)
+		if err != nil {
+			return
+		}
+		pkt.Options.HumanReadable()
+		pkt.Options.IaNaAddresses()
+		pkt.Options.IaPdPrefixes()
+		pkt.Options.VendorClass()
+		pkt.Options.ElapsedTime()
+		if err := pkt.ShouldDiscard([]byte("serverid")); err != nil {
+			return
+		}
+
+		builder := MakePacketBuilder(90, 100)
+		builder.PrefixPool = &fakePrefixPool{}
+		configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl"), bootParams: []string{"console=ttyS0"}}
+		addresses := &fakeAddressPool{prefix: prefix, associations: []*IdentityAssociation{
+			{IPAddress: net.ParseIP("2001:db8:f00f:cafe::1"), InterfaceID: []byte("id-1")}}}
+		response, _ := builder.BuildResponse(pkt, []byte("serverid"), configuration, addresses)
+		if response != nil {
+			if _, err := response.Marshal(); err != nil {
+				t.Fatalf("Failed to marshal response: %s", err)
+			}
+		}
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strings"
+	"time"
 )
 
 // DHCPv6 option IDs
@@ -49,6 +51,16 @@ const (
 	OptReconfAccept = 20
 	// Recursive DNS name servers Option
 	OptRecursiveDNS = 23
+	// Domain Search List Option
+	OptDomainList = 24
+	// Identity Association for Prefix Delegation Option
+	OptIaPd = 25
+	// IA Prefix Option
+	OptIaPrefix = 26
+	// Client FQDN Option
+	OptClientFQDN = 39
+	// NTP Server Option
+	OptNTPServer = 56
 	// Boot File URL Option
 	OptBootfileURL = 59
 	// Boot File Parameters Option
@@ -57,6 +69,49 @@ const (
 	OptClientArchType = 61
 )
 
+// NTP Server Option suboption IDs, see RFC 5908, section 4
+const (
+	// NTP server address suboption
+	NTPSuboptionSrvAddr uint16 = 1
+)
+
+// Vendor-specific Information Option carrying alternate Boot File URLs, see MakeAlternateBootFileURLsOption
+const (
+	// Enterprise number of the option, Intel's, which PXE clients including iPXE send in their Vendor Class
+	// Option
+	AlternateBootURLsEnterpriseNumber uint32 = 343
+	// Alternate Boot File URL suboption
+	VendorSuboptionBootFileURL uint16 = 1
+)
+
+// Client FQDN Option flags, see RFC 4704, section 4.1
+const (
+	// The server should perform the AAAA RR updates
+	FQDNFlagS byte = 0x1
+	// The server overrode the S flag the client asked for
+	FQDNFlagO byte = 0x2
+	// The server should not perform any DNS updates
+	FQDNFlagN byte = 0x4
+)
+
+// DHCPv6 status codes, see RFC 8415, section 21.13
+const (
+	// Success
+	StatusSuccess uint16 = 0
+	// Failure, reason unspecified
+	StatusUnspecFail = 1
+	// Server has no addresses available to assign to the IA(s)
+	StatusNoAddrsAvail = 2
+	// Client record (binding) unavailable
+	StatusNoBinding = 3
+	// The prefix for the address is not appropriate for the link to which the client is attached
+	StatusNotOnLink = 4
+	// Client must use multicast to communicate with the server
+	StatusUseMulticast = 5
+	// Server has no prefixes available to assign to the IA_PD(s)
+	StatusNoPrefixAvail = 6
+)
+
 // Option represents a DHCPv6 Option
 type Option struct {
 	ID     uint16
@@ -88,8 +143,14 @@ func UnmarshalOptions(bs []byte) (Options, error) {
 
 // UnmarshalOption de-serializes an Option
 func UnmarshalOption(bs []byte) (*Option, error) {
+	if len(bs) < 4 {
+		return nil, fmt.Errorf("option header needs 4 bytes, but only has %d bytes", len(bs))
+	}
 	optionLength := binary.BigEndian.Uint16(bs[2:4])
 	optionID := binary.BigEndian.Uint16(bs[0:2])
+	if len(bs[4:]) < int(optionLength) {
+		return nil, fmt.Errorf("option %d claims to have %d bytes of payload, but only has %d bytes", optionID, optionLength, len(bs[4:]))
+	}
 	switch optionID {
 	// parse client_id
 	// parse server_id
@@ -98,11 +159,6 @@ func UnmarshalOption(bs []byte) (*Option, error) {
 		if optionLength%2 != 0 {
 			return nil, fmt.Errorf("OptionID request for options (6) length should be even number of bytes: %d", optionLength)
 		}
-	default:
-		if len(bs[4:]) < int(optionLength) {
-			fmt.Printf("option %d claims to have %d bytes of payload, but only has %d bytes", optionID, optionLength, len(bs[4:]))
-			return nil, fmt.Errorf("option %d claims to have %d bytes of payload, but only has %d bytes", optionID, optionLength, len(bs[4:]))
-		}
 	}
 	return &Option{ID: optionID, Length: optionLength, Value: bs[4 : 4+optionLength]}, nil
 }
@@ -125,27 +181,29 @@ func (o Options) HumanReadable() []string {
 
 func (o Options) humanReadableIaNa(opt Option) []string {
 	ret := make([]string, 0)
+	if len(opt.Value) < 12 {
+		return append(ret, fmt.Sprintf("Option: OptIaNa | len %d | malformed %x\n", opt.Length, opt.Value))
+	}
 	ret = append(ret, fmt.Sprintf("Option: OptIaNa | len %d | iaid %x | t1 %d | t2 %d\n",
 		opt.Length, opt.Value[0:4], binary.BigEndian.Uint32(opt.Value[4:8]), binary.BigEndian.Uint32(opt.Value[8:12])))
 
-	if opt.Length <= 12 {
-		return ret // no options
-	}
-
 	iaOptions := opt.Value[12:]
 	for len(iaOptions) > 0 {
-		l := binary.BigEndian.Uint16(iaOptions[2:4])
-		id := binary.BigEndian.Uint16(iaOptions[0:2])
+		iaOption, err := UnmarshalOption(iaOptions)
+		if err != nil {
+			return append(ret, fmt.Sprintf("\tmalformed options: %s\n", err))
+		}
+		l := iaOption.Length
 
-		switch id {
-		case OptIaAddr:
+		switch {
+		case iaOption.ID == OptIaAddr && l >= 24:
 			ip := make(net.IP, 16)
-			copy(ip, iaOptions[4:20])
+			copy(ip, iaOption.Value[0:16])
 			ret = append(ret, fmt.Sprintf("\tOption: IA_ADDR | len %d | ip %s | preferred %d | valid %d | %v \n",
-				l, ip, binary.BigEndian.Uint32(iaOptions[20:24]), binary.BigEndian.Uint32(iaOptions[24:28]), iaOptions[28:4+l]))
+				l, ip, binary.BigEndian.Uint32(iaOption.Value[16:20]), binary.BigEndian.Uint32(iaOption.Value[20:24]), iaOption.Value[24:]))
 		default:
 			ret = append(ret, fmt.Sprintf("\tOption: id %d | len %d | %s\n",
-				id, l, iaOptions[4:4+l]))
+				iaOption.ID, l, iaOption.Value))
 		}
 
 		iaOptions = iaOptions[4+l:]
@@ -164,21 +222,47 @@ func (o Options) Add(option *Option) {
 }
 
 // MakeIaNaOption creates a Identity Association for Non-temporary Addresses Option
-// with specified interface ID, t1 and t2 times, and an interface-specific option
-// (an IA Address Option or a Status Option)
-func MakeIaNaOption(iaid []byte, t1, t2 uint32, iaOption *Option) *Option {
-	serializedIaOption, _ := iaOption.Marshal()
-	value := make([]byte, 12+len(serializedIaOption))
+// with specified interface ID, t1 and t2 times, and interface-specific options
+// (IA Address Options and/or a Status Option)
+func MakeIaNaOption(iaid []byte, t1, t2 uint32, iaOptions ...*Option) *Option {
+	return MakeOption(OptIaNa, marshalIa(iaid, t1, t2, iaOptions))
+}
+
+// MakeIaPdOption creates an Identity Association for Prefix Delegation Option
+// with specified IAID, t1 and t2 times, and IA_PD-specific options
+// (IA Prefix Options and/or a Status Option)
+func MakeIaPdOption(iaid []byte, t1, t2 uint32, iaPdOptions ...*Option) *Option {
+	return MakeOption(OptIaPd, marshalIa(iaid, t1, t2, iaPdOptions))
+}
+
+// marshalIa serializes the body shared by IA_NA and IA_PD options
+func marshalIa(iaid []byte, t1, t2 uint32, iaOptions []*Option) []byte {
+	value := make([]byte, 12)
 	copy(value[0:], iaid[0:4])
 	binary.BigEndian.PutUint32(value[4:], t1)
 	binary.BigEndian.PutUint32(value[8:], t2)
-	copy(value[12:], serializedIaOption)
-	return MakeOption(OptIaNa, value)
+	for _, iaOption := range iaOptions {
+		if iaOption == nil {
+			continue
+		}
+		serializedIaOption, _ := iaOption.Marshal()
+		value = append(value, serializedIaOption...)
+	}
+	return value
 }
 
+// InfiniteLifetime is the lifetime meaning infinity, for addresses and prefixes that never expire, see
+// RFC 8415, section 7.7
+const InfiniteLifetime = 0xffffffff
+
 // MakeIaAddrOption creates an IA Address Option using IP address,
-// preferred and valid lifetimes
+// preferred and valid lifetimes, in seconds. Clients discard addresses
+// with a preferred lifetime greater than the valid lifetime (RFC 8415,
+// section 21.6), so the preferred lifetime is clamped to the valid
+// lifetime. Zero lifetimes are kept as is: they tell the client to stop
+// using the address.
 func MakeIaAddrOption(addr net.IP, preferredLifetime, validLifetime uint32) *Option {
+	preferredLifetime = clampPreferredLifetime(preferredLifetime, validLifetime)
 	value := make([]byte, 24)
 	copy(value[0:], addr)
 	binary.BigEndian.PutUint32(value[16:], preferredLifetime)
@@ -186,6 +270,29 @@ func MakeIaAddrOption(addr net.IP, preferredLifetime, validLifetime uint32) *Opt
 	return MakeOption(OptIaAddr, value)
 }
 
+// MakeIaPrefixOption creates an IA Prefix Option using the delegated prefix,
+// preferred and valid lifetimes, in seconds. Like in MakeIaAddrOption,
+// the preferred lifetime is clamped to the valid lifetime, see RFC 8415,
+// section 21.22.
+func MakeIaPrefixOption(prefix *net.IPNet, preferredLifetime, validLifetime uint32) *Option {
+	preferredLifetime = clampPreferredLifetime(preferredLifetime, validLifetime)
+	value := make([]byte, 25)
+	binary.BigEndian.PutUint32(value[0:], preferredLifetime)
+	binary.BigEndian.PutUint32(value[4:], validLifetime)
+	ones, _ := prefix.Mask.Size()
+	value[8] = byte(ones)
+	copy(value[9:], prefix.IP.To16())
+	return MakeOption(OptIaPrefix, value)
+}
+
+// clampPreferredLifetime returns the preferred lifetime, or the valid lifetime if it's shorter
+func clampPreferredLifetime(preferredLifetime, validLifetime uint32) uint32 {
+	if preferredLifetime > validLifetime {
+		return validLifetime
+	}
+	return preferredLifetime
+}
+
 // MakeStatusOption creates a Status Option with given status code and message
 func MakeStatusOption(statusCode uint16, message string) *Option {
 	value := make([]byte, 2+len(message))
@@ -194,6 +301,12 @@ func MakeStatusOption(statusCode uint16, message string) *Option {
 	return MakeOption(OptStatusCode, value)
 }
 
+// MakeServerUnicastOption creates a Server Unicast Option, telling clients they may unicast their messages to
+// the server at address, see RFC 8415, section 21.12
+func MakeServerUnicastOption(address net.IP) *Option {
+	return MakeOption(OptUnicast, address.To16())
+}
+
 // MakeDNSServersOption creates a Recursive DNS servers Option with the specified list of IP addresses
 func MakeDNSServersOption(addresses []net.IP) *Option {
 	value := make([]byte, 16*len(addresses))
@@ -203,6 +316,130 @@ func MakeDNSServersOption(addresses []net.IP) *Option {
 	return MakeOption(OptRecursiveDNS, value)
 }
 
+// MakeNTPServersOption creates an NTP Server Option with the specified list of IP addresses, each one in its
+// own server address suboption, see RFC 5908
+func MakeNTPServersOption(servers []net.IP) *Option {
+	value := make([]byte, 20*len(servers))
+	for i, server := range servers {
+		binary.BigEndian.PutUint16(value[i*20:], NTPSuboptionSrvAddr)
+		binary.BigEndian.PutUint16(value[i*20+2:], 16)
+		copy(value[i*20+4:], server.To16())
+	}
+	return MakeOption(OptNTPServer, value)
+}
+
+// MakeDomainSearchListOption creates a Domain Search List Option with the specified domains, see RFC 3646.
+// Domains are encoded as uncompressed RFC 1035 names, domains with labels longer than 63 bytes are skipped.
+func MakeDomainSearchListOption(domains []string) *Option {
+	value := make([]byte, 0)
+	for _, domain := range domains {
+		encodedDomain, ok := encodeDomainName(domain)
+		if !ok {
+			continue
+		}
+		value = append(value, encodedDomain...)
+	}
+	return MakeOption(OptDomainList, value)
+}
+
+// MakeClientFQDNOption creates a Client FQDN Option with the specified flags and hostname, see RFC 4704. A
+// hostname without dots is encoded as a partial name, anything else as a fully qualified domain name. The name
+// is left empty if one of its labels is longer than 63 bytes.
+func MakeClientFQDNOption(hostname string, flags byte) *Option {
+	value := []byte{flags}
+	name, ok := encodeDomainName(hostname)
+	if ok && !strings.Contains(hostname, ".") {
+		// partial names have no terminating root label, see RFC 4704, section 4.2
+		name = name[:len(name)-1]
+	}
+	if ok {
+		value = append(value, name...)
+	}
+	return MakeOption(OptClientFQDN, value)
+}
+
+// MakeAlternateBootFileURLsOption creates a Vendor-specific Information Option, see RFC 8415, section 21.17,
+// with the Boot File URLs clients should fall back to if they can't boot the one in the Boot File URL Option.
+// The option value is the 4 byte AlternateBootURLsEnterpriseNumber, followed by one VendorSuboptionBootFileURL
+// suboption per URL, in the order clients should try them, each one made of the 2 byte suboption code, the 2
+// byte URL length and the URL.
+func MakeAlternateBootFileURLsOption(urls [][]byte) *Option {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, AlternateBootURLsEnterpriseNumber)
+	for _, url := range urls {
+		suboption := make([]byte, 4)
+		binary.BigEndian.PutUint16(suboption, VendorSuboptionBootFileURL)
+		binary.BigEndian.PutUint16(suboption[2:], uint16(len(url)))
+		value = append(value, suboption...)
+		value = append(value, url...)
+	}
+	return MakeOption(OptVendorOpts, value)
+}
+
+// MakeBootfileParamOption creates a Boot File Parameters Option with the specified parameters, each one
+// prefixed with its 2 byte length, see RFC 5970, section 3.2
+func MakeBootfileParamOption(params []string) *Option {
+	value := make([]byte, 0)
+	for _, param := range params {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(param)))
+		value = append(value, length...)
+		value = append(value, param...)
+	}
+	return MakeOption(OptBootfileParam, value)
+}
+
+// MakeReconfigureMessageOption creates a Reconfigure Message Option, telling the client which message type it
+// should respond to a Reconfigure with, see RFC 8415, section 21.19
+func MakeReconfigureMessageOption(msgType MessageType) *Option {
+	return MakeOption(OptReconfMsg, []byte{byte(msgType)})
+}
+
+// Reconfigure Key Authentication Protocol constants, see RFC 8415, section 20.4
+const (
+	authProtocolReconfigureKey = 3
+	authAlgorithmHmacMd5       = 1
+	authRDMMonotonicCounter    = 0
+	reconfigureKeyValue        = 1
+	reconfigureKeyHmacMd5      = 2
+	// ReconfigureKeyLength is the length of reconfigure keys handed out to clients
+	ReconfigureKeyLength = 16
+)
+
+// MakeReconfigureKeyOption creates an Authentication Option handing out the reconfigure key used to
+// authenticate Reconfigure messages to the client. replay must increase with each message sent to the client.
+func MakeReconfigureKeyOption(key []byte, replay uint64) *Option {
+	return makeReconfigureAuthOption(reconfigureKeyValue, key, replay)
+}
+
+func makeReconfigureAuthOption(infoType byte, info []byte, replay uint64) *Option {
+	value := make([]byte, 12+len(info))
+	value[0] = authProtocolReconfigureKey
+	value[1] = authAlgorithmHmacMd5
+	value[2] = authRDMMonotonicCounter
+	binary.BigEndian.PutUint64(value[3:], replay)
+	value[11] = infoType
+	copy(value[12:], info)
+	return MakeOption(OptAuth, value)
+}
+
+// encodeDomainName encodes domain as a sequence of length-prefixed labels terminated by the root label,
+// a trailing dot in a fully qualified domain name is optional
+func encodeDomainName(domain string) ([]byte, bool) {
+	ret := make([]byte, 0, len(domain)+2)
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if len(label) == 0 {
+			continue
+		}
+		if len(label) > 63 {
+			return nil, false
+		}
+		ret = append(ret, byte(len(label)))
+		ret = append(ret, label...)
+	}
+	return append(ret, 0), true
+}
+
 // Marshal serializes Options
 func (o Options) Marshal() ([]byte, error) {
 	buffer := bytes.NewBuffer(make([]byte, 0, 1446))
@@ -239,18 +476,26 @@ func (o *Option) Marshal() ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// OptionRequest returns the option codes in the Option Request Option, in the order the client listed them,
+// or nil if the option doesn't exist, see RFC 8415, section 21.7
+func (o Options) OptionRequest() []uint16 {
+	opt, exists := o[OptOro]
+	if !exists {
+		return nil
+	}
+	value := opt[0].Value
+	ret := make([]uint16, 0, len(value)/2)
+	for i := 0; i+1 < len(value); i += 2 {
+		ret = append(ret, binary.BigEndian.Uint16(value[i:i+2]))
+	}
+	return ret
+}
+
 // UnmarshalOptionRequestOption de-serializes Option Request Option
 func (o Options) UnmarshalOptionRequestOption() map[uint16]bool {
 	ret := make(map[uint16]bool)
-
-	_, present := o[OptOro]
-	if !present {
-		return ret
-	}
-
-	value := o[OptOro][0].Value
-	for i := 0; i < int(o[OptOro][0].Length)/2; i++ {
-		ret[binary.BigEndian.Uint16(value[i*2:(i+1)*2])] = true
+	for _, id := range o.OptionRequest() {
+		ret[id] = true
 	}
 	return ret
 }
@@ -292,6 +537,20 @@ func (o Options) HasClientArchType() bool {
 	return present
 }
 
+// HasRapidCommit returns true if Options contains Rapid Commit Option, meaning the client asks for a Solicit/Reply
+// exchange, see RFC 8415, section 21.14
+func (o Options) HasRapidCommit() bool {
+	_, present := o[OptRapidCommit]
+	return present
+}
+
+// HasReconfigureAccept returns true if Options contains Reconfigure Accept Option, meaning the client is willing
+// to accept Reconfigure messages
+func (o Options) HasReconfigureAccept() bool {
+	_, present := o[OptReconfAccept]
+	return present
+}
+
 // ClientID returns the value in the Client ID Option or nil if the option doesn't exist
 func (o Options) ClientID() []byte {
 	opt, exists := o[OptClientID]
@@ -310,6 +569,16 @@ func (o Options) ServerID() []byte {
 	return nil
 }
 
+// ServerUnicast returns the address in the Server Unicast Option, or nil if the option doesn't exist or is
+// malformed
+func (o Options) ServerUnicast() net.IP {
+	opt, exists := o[OptUnicast]
+	if !exists || len(opt[0].Value) != net.IPv6len {
+		return nil
+	}
+	return net.IP(opt[0].Value)
+}
+
 // IaNaIDs returns a list of interface IDs in all Identity Association for Non-Temporary Addresses Options,
 // or an empty list if none exist
 func (o Options) IaNaIDs() [][]byte {
@@ -317,6 +586,9 @@ func (o Options) IaNaIDs() [][]byte {
 	ret := make([][]byte, 0)
 	if exists {
 		for _, option := range options {
+			if len(option.Value) < 4 {
+				continue
+			}
 			ret = append(ret, option.Value[0:4])
 		}
 		return ret
@@ -324,15 +596,229 @@ func (o Options) IaNaIDs() [][]byte {
 	return ret
 }
 
+// IaNaAddresses returns a list of addresses in IA Address Options nested in all Identity Association for
+// Non-Temporary Addresses Options, or an empty list if none exist
+func (o Options) IaNaAddresses() []net.IP {
+	ret := make([]net.IP, 0)
+	for _, option := range o[OptIaNa] {
+		if len(option.Value) < 12 {
+			continue
+		}
+		iaOptions, err := UnmarshalOptions(option.Value[12:])
+		if err != nil {
+			continue
+		}
+		for _, iaAddrOption := range iaOptions[OptIaAddr] {
+			if len(iaAddrOption.Value) < 16 {
+				continue
+			}
+			ret = append(ret, net.IP(iaAddrOption.Value[0:16]))
+		}
+	}
+	return ret
+}
+
+// IaPdIDs returns a list of IAIDs in all Identity Association for Prefix Delegation Options,
+// or an empty list if none exist
+func (o Options) IaPdIDs() [][]byte {
+	ret := make([][]byte, 0)
+	for _, option := range o[OptIaPd] {
+		if len(option.Value) < 4 {
+			continue
+		}
+		ret = append(ret, option.Value[0:4])
+	}
+	return ret
+}
+
+// IaPdPrefixes returns a list of prefixes in IA Prefix Options nested in all Identity Association for
+// Prefix Delegation Options, or an empty list if none exist
+func (o Options) IaPdPrefixes() []*net.IPNet {
+	ret := make([]*net.IPNet, 0)
+	for _, option := range o[OptIaPd] {
+		if len(option.Value) < 12 {
+			continue
+		}
+		iaPdOptions, err := UnmarshalOptions(option.Value[12:])
+		if err != nil {
+			continue
+		}
+		for _, iaPrefixOption := range iaPdOptions[OptIaPrefix] {
+			if len(iaPrefixOption.Value) < 25 || iaPrefixOption.Value[8] > 128 {
+				continue
+			}
+			ret = append(ret, &net.IPNet{IP: net.IP(iaPrefixOption.Value[9:25]),
+				Mask: net.CIDRMask(int(iaPrefixOption.Value[8]), 128)})
+		}
+	}
+	return ret
+}
+
+// StatusCode returns the code and message in the Status Code Option, see RFC 8415, section 21.13. Without a
+// top-level Status Code Option, the status in the first IA_NA or IA_PD option carrying one is returned, e.g.
+// NoBinding for an IA the server doesn't know about. ok is false if there's no well-formed status.
+func (o Options) StatusCode() (code uint16, msg string, ok bool) {
+	if code, msg, ok := parseStatusCode(o[OptStatusCode]); ok {
+		return code, msg, true
+	}
+	for _, id := range []uint16{OptIaNa, OptIaPd} {
+		for _, option := range o[id] {
+			if len(option.Value) < 12 {
+				continue
+			}
+			iaOptions, err := UnmarshalOptions(option.Value[12:])
+			if err != nil {
+				continue
+			}
+			if code, msg, ok := parseStatusCode(iaOptions[OptStatusCode]); ok {
+				return code, msg, true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+func parseStatusCode(options []*Option) (uint16, string, bool) {
+	if len(options) == 0 || len(options[0].Value) < 2 {
+		return 0, "", false
+	}
+	return binary.BigEndian.Uint16(options[0].Value[0:2]), string(options[0].Value[2:]), true
+}
+
 // ClientArchType returns the value in the Client Architecture Type Option, or 0 if the option doesn't exist
+// or is malformed
 func (o Options) ClientArchType() uint16 {
 	opt, exists := o[OptClientArchType]
-	if exists {
+	if exists && len(opt[0].Value) >= 2 {
 		return binary.BigEndian.Uint16(opt[0].Value)
 	}
 	return 0
 }
 
+// VendorClass returns the enterprise number and the vendor-class-data in the Vendor Class Option, and false if
+// the option doesn't exist or is malformed. The vendor-class-data is returned as is, i.e. as a series of
+// length-prefixed opaque items, see RFC 8415, section 21.16
+func (o Options) VendorClass() (enterpriseNumber uint32, data []byte, ok bool) {
+	opt, exists := o[OptVendorClass]
+	if !exists || len(opt[0].Value) < 4 {
+		return 0, nil, false
+	}
+	enterpriseNumber = binary.BigEndian.Uint32(opt[0].Value[0:4])
+	data = opt[0].Value[4:]
+	for rest := data; len(rest) > 0; {
+		if len(rest) < 2 {
+			return 0, nil, false
+		}
+		l := int(binary.BigEndian.Uint16(rest[0:2]))
+		if len(rest) < 2+l {
+			return 0, nil, false
+		}
+		rest = rest[2+l:]
+	}
+	return enterpriseNumber, data, true
+}
+
+// AlternateBootFileURLs returns the alternate Boot File URLs in the Vendor-specific Information Option, see
+// MakeAlternateBootFileURLsOption. It returns nil if there is no such option, or if it is malformed.
+func (o Options) AlternateBootFileURLs() [][]byte {
+	for _, opt := range o[OptVendorOpts] {
+		if len(opt.Value) < 4 || binary.BigEndian.Uint32(opt.Value[0:4]) != AlternateBootURLsEnterpriseNumber {
+			continue
+		}
+		var urls [][]byte
+		for rest := opt.Value[4:]; len(rest) > 0; {
+			if len(rest) < 4 {
+				return nil
+			}
+			l := int(binary.BigEndian.Uint16(rest[2:4]))
+			if len(rest) < 4+l {
+				return nil
+			}
+			if binary.BigEndian.Uint16(rest[0:2]) == VendorSuboptionBootFileURL {
+				urls = append(urls, rest[4:4+l])
+			}
+			rest = rest[4+l:]
+		}
+		return urls
+	}
+	return nil
+}
+
+// ElapsedTime returns the time the client has been trying to complete the current exchange, as reported
+// in the Elapsed Time Option, and false if the option doesn't exist. The option saturates at 0xffff,
+// so the longest time reported is 655.35s.
+func (o Options) ElapsedTime() (time.Duration, bool) {
+	opt, exists := o[OptElapsedTime]
+	if !exists || len(opt[0].Value) < 2 {
+		return 0, false
+	}
+	// expressed in hundredths of a second
+	return time.Duration(binary.BigEndian.Uint16(opt[0].Value)) * 10 * time.Millisecond, true
+}
+
+// ClientFQDN returns the flags and the domain name in the Client FQDN Option, and false if the option doesn't
+// exist or is malformed. Fully qualified names are returned with a trailing dot, partial names without one,
+// see RFC 4704, section 4.2.
+func (o Options) ClientFQDN() (flags byte, name string, ok bool) {
+	opt, exists := o[OptClientFQDN]
+	if !exists || len(opt[0].Value) < 1 {
+		return 0, "", false
+	}
+	flags = opt[0].Value[0]
+	var labels []string
+	for rest := opt[0].Value[1:]; len(rest) > 0; {
+		l := int(rest[0])
+		if l == 0 {
+			if len(rest) > 1 {
+				return 0, "", false
+			}
+			return flags, strings.Join(labels, ".") + ".", true
+		}
+		if l > 63 || len(rest) < 1+l {
+			return 0, "", false
+		}
+		labels = append(labels, string(rest[1:1+l]))
+		rest = rest[1+l:]
+	}
+	return flags, strings.Join(labels, "."), true
+}
+
+// RecursiveDNS returns the addresses in all DNS Recursive Name Server Options, see RFC 3646, or nil if none
+// exist. Trailing bytes not making up a full address are ignored.
+func (o Options) RecursiveDNS() []net.IP {
+	var ret []net.IP
+	for _, option := range o[OptRecursiveDNS] {
+		for rest := option.Value; len(rest) >= 16; rest = rest[16:] {
+			ret = append(ret, net.IP(rest[0:16]))
+		}
+	}
+	return ret
+}
+
+// DomainSearchList returns the domains in all Domain Search List Options, see RFC 3646, or nil if none exist.
+// Domains are returned fully qualified, with a trailing dot. Parsing stops at the first malformed domain.
+func (o Options) DomainSearchList() []string {
+	var ret []string
+	for _, option := range o[OptDomainList] {
+		var labels []string
+		for rest := option.Value; len(rest) > 0; {
+			l := int(rest[0])
+			if l == 0 {
+				ret = append(ret, strings.Join(labels, ".")+".")
+				labels = nil
+				rest = rest[1:]
+				continue
+			}
+			if l > 63 || len(rest) < 1+l {
+				break
+			}
+			labels = append(labels, string(rest[1:1+l]))
+			rest = rest[1+l:]
+		}
+	}
+	return ret
+}
+
 // BootFileURL returns the value in the Boot File URL Option, or nil if the option doesn't exist
 func (o Options) BootFileURL() []byte {
 	opt, exists := o[OptBootfileURL]
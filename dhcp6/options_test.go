@@ -1,9 +1,11 @@
 package dhcp6
 
 import (
+	"bytes"
 	"encoding/binary"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestMarshalOption(t *testing.T) {
@@ -49,6 +51,31 @@ func TestMakeIaAddrOption(t *testing.T) {
 	}
 }
 
+func TestMakeIaAddrOptionClampsPreferredLifetime(t *testing.T) {
+	ip := net.ParseIP("2001:db8:f00f:cafe::99")
+	_, prefix, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	for _, tc := range []struct {
+		preferred, valid, expectedPreferred uint32
+	}{
+		{2000, 1000, 1000},
+		{InfiniteLifetime, 1000, 1000},
+		{1000, InfiniteLifetime, 1000},
+		{InfiniteLifetime, InfiniteLifetime, InfiniteLifetime},
+		{0, 0, 0},
+	} {
+		iaAddr := MakeIaAddrOption(ip, tc.preferred, tc.valid).Value
+		if preferred, valid := binary.BigEndian.Uint32(iaAddr[16:20]), binary.BigEndian.Uint32(iaAddr[20:24]); preferred != tc.expectedPreferred || valid != tc.valid {
+			t.Errorf("IA Address with lifetimes %d/%d: expected %d/%d, got %d/%d",
+				tc.preferred, tc.valid, tc.expectedPreferred, tc.valid, preferred, valid)
+		}
+		iaPrefix := MakeIaPrefixOption(prefix, tc.preferred, tc.valid).Value
+		if preferred, valid := binary.BigEndian.Uint32(iaPrefix[0:4]), binary.BigEndian.Uint32(iaPrefix[4:8]); preferred != tc.expectedPreferred || valid != tc.valid {
+			t.Errorf("IA Prefix with lifetimes %d/%d: expected %d/%d, got %d/%d",
+				tc.preferred, tc.valid, tc.expectedPreferred, tc.valid, preferred, valid)
+		}
+	}
+}
+
 func TestMakeIaNaOption(t *testing.T) {
 	iaAddrOption := MakeIaAddrOption(net.ParseIP("2001:db8:f00f:cafe::100"), 100, 200)
 	expectedSerializedIaAddrOption, err := iaAddrOption.Marshal()
@@ -121,3 +148,278 @@ func TestMakeDNSServersOption(t *testing.T) {
 		t.Fatalf("Expected dns server address %v, got %v", expectedAddress2, net.IP(dnsServersOption.Value[16:]))
 	}
 }
+
+func TestMakeNTPServersOption(t *testing.T) {
+	// RFC 5908, section 4: each server is an NTP_SUBOPTION_SRV_ADDR suboption, 2 bytes of suboption code (1),
+	// 2 bytes of length (16) and the address
+	expected := []byte{
+		0, 1, 0, 16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x23,
+		0, 1, 0, 16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x24,
+	}
+	option := MakeNTPServersOption([]net.IP{net.ParseIP("2001:db8::123"), net.ParseIP("2001:db8::124")})
+
+	if option.ID != OptNTPServer {
+		t.Fatalf("Expected option id %d, got %d", OptNTPServer, option.ID)
+	}
+	if option.Length != uint16(len(expected)) {
+		t.Fatalf("Expected length %d bytes, got %d", len(expected), option.Length)
+	}
+	if !bytes.Equal(option.Value, expected) {
+		t.Fatalf("Expected value %x, got %x", expected, option.Value)
+	}
+}
+
+func TestElapsedTime(t *testing.T) {
+	options := make(Options)
+	if _, exists := options.ElapsedTime(); exists {
+		t.Fatalf("Expected no elapsed time without the option")
+	}
+
+	options.Add(MakeOption(OptElapsedTime, []byte{0x04, 0xb0}))
+	if elapsed, exists := options.ElapsedTime(); !exists || elapsed != 12*time.Second {
+		t.Fatalf("Expected elapsed time of %v, got %v (exists: %t)", 12*time.Second, elapsed, exists)
+	}
+
+	options = make(Options)
+	options.Add(MakeOption(OptElapsedTime, []byte{0xff, 0xff}))
+	if elapsed, exists := options.ElapsedTime(); !exists || elapsed != 655350*time.Millisecond {
+		t.Fatalf("Expected elapsed time of %v, got %v (exists: %t)", 655350*time.Millisecond, elapsed, exists)
+	}
+}
+
+func TestVendorClass(t *testing.T) {
+	// Vendor Class Option as built by iPXE: Intel's enterprise number followed by the PXEClient string
+	ipxeVendorClass := append([]byte{0x00, 0x00, 0x01, 0x57, 0x00, 0x20}, []byte("PXEClient:Arch:00007:UNDI:003016")...)
+	options := make(Options)
+	options.Add(MakeOption(OptVendorClass, ipxeVendorClass))
+
+	enterpriseNumber, data, ok := options.VendorClass()
+	if !ok {
+		t.Fatalf("Expected vendor class to be parsed")
+	}
+	if enterpriseNumber != 343 {
+		t.Fatalf("Expected enterprise number 343, got %d", enterpriseNumber)
+	}
+	if string(data[2:]) != "PXEClient:Arch:00007:UNDI:003016" {
+		t.Fatalf("Expected vendor class data %s, got %s", "PXEClient:Arch:00007:UNDI:003016", data[2:])
+	}
+}
+
+func TestVendorClassFailsIfMissingOrMalformed(t *testing.T) {
+	options := make(Options)
+	if _, _, ok := options.VendorClass(); ok {
+		t.Fatalf("Expected no vendor class without the option")
+	}
+
+	options.Add(MakeOption(OptVendorClass, []byte{0x00, 0x00, 0x01}))
+	if _, _, ok := options.VendorClass(); ok {
+		t.Fatalf("Expected vendor class without a full enterprise number to be rejected")
+	}
+
+	options = make(Options)
+	options.Add(MakeOption(OptVendorClass, []byte{0x00, 0x00, 0x01, 0x57, 0x00, 0x20, 'P', 'X', 'E'}))
+	if _, _, ok := options.VendorClass(); ok {
+		t.Fatalf("Expected vendor class with truncated data to be rejected")
+	}
+}
+
+func TestMakeAlternateBootFileURLsOption(t *testing.T) {
+	expected := []byte{
+		0x00, 0x00, 0x01, 0x57, // enterprise number 343
+		0x00, 0x01, 0x00, 0x0d, 'h', 't', 't', 'p', ':', '/', '/', 'a', '.', 'e', 'f', 'i', '/',
+		0x00, 0x01, 0x00, 0x08, 't', 'f', 't', 'p', ':', '/', '/', 'b',
+	}
+	option := MakeAlternateBootFileURLsOption([][]byte{[]byte("http://a.efi/"), []byte("tftp://b")})
+	if option.ID != OptVendorOpts {
+		t.Fatalf("Expected option id %d, got %d", OptVendorOpts, option.ID)
+	}
+	if !bytes.Equal(option.Value, expected) {
+		t.Fatalf("Expected option value %v, got %v", expected, option.Value)
+	}
+
+	options := make(Options)
+	options.Add(option)
+	urls := options.AlternateBootFileURLs()
+	if len(urls) != 2 || string(urls[0]) != "http://a.efi/" || string(urls[1]) != "tftp://b" {
+		t.Fatalf("Expected alternate urls [http://a.efi/ tftp://b], got %q", urls)
+	}
+
+	options = make(Options)
+	options.Add(MakeOption(OptVendorOpts, expected[:len(expected)-1]))
+	if urls := options.AlternateBootFileURLs(); urls != nil {
+		t.Fatalf("Expected truncated alternate urls to be rejected, got %q", urls)
+	}
+}
+
+func TestRecursiveDNSAndDomainSearchList(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeDNSServersOption([]net.IP{net.ParseIP("2001:db8::53"), net.ParseIP("2001:db8::54")}))
+	options.Add(MakeDomainSearchListOption([]string{"lab.example.com", "example.com."}))
+
+	servers := options.RecursiveDNS()
+	if len(servers) != 2 || !servers[0].Equal(net.ParseIP("2001:db8::53")) || !servers[1].Equal(net.ParseIP("2001:db8::54")) {
+		t.Fatalf("Expected DNS servers [2001:db8::53 2001:db8::54], got %v", servers)
+	}
+	domains := options.DomainSearchList()
+	if len(domains) != 2 || domains[0] != "lab.example.com." || domains[1] != "example.com." {
+		t.Fatalf("Expected domains [lab.example.com. example.com.], got %q", domains)
+	}
+
+	options = make(Options)
+	if options.RecursiveDNS() != nil || options.DomainSearchList() != nil {
+		t.Fatalf("Expected no DNS servers or domains without the options")
+	}
+}
+
+func TestMakeIaPdOptionRoundTrip(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1200::/40")
+	expected := []byte{
+		0x00, 0x19, 0x00, 0x29, // IA_PD, length 41
+		0x00, 0x00, 0x00, 0x01, // IAID
+		0x00, 0x00, 0x03, 0xe8, // T1 1000
+		0x00, 0x00, 0x07, 0xd0, // T2 2000
+		0x00, 0x1a, 0x00, 0x19, // IAPREFIX, length 25
+		0x00, 0x00, 0x0b, 0xb8, // preferred lifetime 3000
+		0x00, 0x00, 0x0f, 0xa0, // valid lifetime 4000
+		0x28, // prefix length 40
+		0x20, 0x01, 0x0d, 0xb8, 0x12, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+
+	marshalled, err := MakeIaPdOption([]byte{0, 0, 0, 1}, 1000, 2000, MakeIaPrefixOption(prefix, 3000, 4000)).Marshal()
+	if err != nil {
+		t.Fatalf("Unexpected marshalling failure: %s", err)
+	}
+	if string(marshalled) != string(expected) {
+		t.Fatalf("Expected %x, got %x", expected, marshalled)
+	}
+
+	options, err := UnmarshalOptions(expected)
+	if err != nil {
+		t.Fatalf("Unexpected unmarshalling failure: %s", err)
+	}
+	if iaPdIDs := options.IaPdIDs(); len(iaPdIDs) != 1 || string(iaPdIDs[0]) != string([]byte{0, 0, 0, 1}) {
+		t.Fatalf("Expected IAID 00000001, got %x", iaPdIDs)
+	}
+	prefixes := options.IaPdPrefixes()
+	if len(prefixes) != 1 || prefixes[0].String() != prefix.String() {
+		t.Fatalf("Expected prefix %s, got %v", prefix, prefixes)
+	}
+}
+
+func TestMakeDomainSearchListOption(t *testing.T) {
+	expected := []byte{
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		3, 'l', 'a', 'b', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r', 'g', 0,
+	}
+	option := MakeDomainSearchListOption([]string{"example.com", "lab.example.org."})
+
+	if option.ID != OptDomainList {
+		t.Fatalf("Expected option id %d, got %d", OptDomainList, option.ID)
+	}
+	if int(option.Length) != len(expected) {
+		t.Fatalf("Expected length %d bytes, got %d", len(expected), option.Length)
+	}
+	if string(option.Value) != string(expected) {
+		t.Fatalf("Expected %v, got %v", expected, option.Value)
+	}
+}
+
+func TestMakeBootfileParamOption(t *testing.T) {
+	expected := []byte{
+		0, 13, 'c', 'o', 'n', 's', 'o', 'l', 'e', '=', 't', 't', 'y', 'S', '0',
+		0, 0,
+		0, 5, 'q', 'u', 'i', 'e', 't',
+	}
+	option := MakeBootfileParamOption([]string{"console=ttyS0", "", "quiet"})
+
+	if option.ID != OptBootfileParam {
+		t.Fatalf("Expected option id %d, got %d", OptBootfileParam, option.ID)
+	}
+	if int(option.Length) != len(expected) {
+		t.Fatalf("Expected length %d bytes, got %d", len(expected), option.Length)
+	}
+	if string(option.Value) != string(expected) {
+		t.Fatalf("Expected %v, got %v", expected, option.Value)
+	}
+}
+
+func TestMakeClientFQDNOption(t *testing.T) {
+	expected := []byte{
+		FQDNFlagN | FQDNFlagO,
+		4, 'n', 'o', 'd', 'e', 3, 'l', 'a', 'b', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+	}
+	option := MakeClientFQDNOption("node.lab.example.com", FQDNFlagN|FQDNFlagO)
+
+	if option.ID != OptClientFQDN {
+		t.Fatalf("Expected option id %d, got %d", OptClientFQDN, option.ID)
+	}
+	if string(option.Value) != string(expected) {
+		t.Fatalf("Expected %v, got %v", expected, option.Value)
+	}
+
+	options := make(Options)
+	options.Add(option)
+	flags, name, ok := options.ClientFQDN()
+	if !ok || flags != FQDNFlagN|FQDNFlagO || name != "node.lab.example.com." {
+		t.Fatalf("Expected flags %d and name %q, got %d and %q (ok %t)", FQDNFlagN|FQDNFlagO,
+			"node.lab.example.com.", flags, name, ok)
+	}
+}
+
+func TestClientFQDNPartialName(t *testing.T) {
+	option := MakeClientFQDNOption("node", FQDNFlagS)
+	if string(option.Value) != string([]byte{FQDNFlagS, 4, 'n', 'o', 'd', 'e'}) {
+		t.Fatalf("Expected a partial name without the root label, got %v", option.Value)
+	}
+
+	options := make(Options)
+	options.Add(option)
+	if flags, name, ok := options.ClientFQDN(); !ok || flags != FQDNFlagS || name != "node" {
+		t.Fatalf("Expected flags %d and partial name %q, got %d and %q (ok %t)", FQDNFlagS, "node", flags, name, ok)
+	}
+
+	options = make(Options)
+	options.Add(MakeOption(OptClientFQDN, []byte{0, 5, 'n', 'o'}))
+	if _, _, ok := options.ClientFQDN(); ok {
+		t.Fatalf("Expected a truncated label to be rejected")
+	}
+}
+
+func TestOptionRequest(t *testing.T) {
+	options := make(Options)
+	if requested := options.OptionRequest(); requested != nil {
+		t.Fatalf("Expected no requested options without an Option Request Option, got %v", requested)
+	}
+	options.Add(MakeOption(OptOro, []byte{0, OptBootfileURL, 0, OptRecursiveDNS, 0}))
+	requested := options.OptionRequest()
+	if len(requested) != 2 || requested[0] != OptBootfileURL || requested[1] != OptRecursiveDNS {
+		t.Fatalf("Expected requested options [%d %d], got %v", OptBootfileURL, OptRecursiveDNS, requested)
+	}
+}
+
+func TestMakeDomainSearchListOptionSkipsInvalidDomains(t *testing.T) {
+	tooLongLabel := "a123456789b123456789c123456789d123456789e123456789f123456789abcd"
+	option := MakeDomainSearchListOption([]string{tooLongLabel + ".com", "lab"})
+
+	if string(option.Value) != string([]byte{3, 'l', 'a', 'b', 0}) {
+		t.Fatalf("Expected only the valid domain to be encoded, got %v", option.Value)
+	}
+}
+
+func TestStatusCodeFailsIfMissingOrMalformed(t *testing.T) {
+	options := make(Options)
+	if _, _, ok := options.StatusCode(); ok {
+		t.Fatalf("Expected no status code without a Status Code option")
+	}
+
+	options.Add(MakeOption(OptStatusCode, []byte{0}))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0))
+	if _, _, ok := options.StatusCode(); ok {
+		t.Fatalf("Expected no status code with a truncated Status Code option")
+	}
+
+	options.Add(MakeIaNaOption([]byte("id-2"), 0, 0, MakeStatusOption(StatusNoBinding, "No binding.")))
+	if code, msg, ok := options.StatusCode(); !ok || code != StatusNoBinding || msg != "No binding." {
+		t.Fatalf("Expected the IA_NA status %d %q, got %d %q (%v)", StatusNoBinding, "No binding.", code, msg, ok)
+	}
+}
@@ -2,6 +2,8 @@ package dhcp6
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
 	"fmt"
 )
 
@@ -25,15 +27,57 @@ const (
 	MsgRelayRepl
 )
 
+func (t MessageType) String() string {
+	switch t {
+	case MsgSolicit:
+		return "SOLICIT"
+	case MsgAdvertise:
+		return "ADVERTISE"
+	case MsgRequest:
+		return "REQUEST"
+	case MsgConfirm:
+		return "CONFIRM"
+	case MsgRenew:
+		return "RENEW"
+	case MsgRebind:
+		return "REBIND"
+	case MsgReply:
+		return "REPLY"
+	case MsgRelease:
+		return "RELEASE"
+	case MsgDecline:
+		return "DECLINE"
+	case MsgReconfigure:
+		return "RECONFIGURE"
+	case MsgInformationRequest:
+		return "INFORMATION-REQUEST"
+	case MsgRelayForw:
+		return "RELAY-FORW"
+	case MsgRelayRepl:
+		return "RELAY-REPL"
+	default:
+		return fmt.Sprintf("<unknown DHCPv6 message type %d>", t)
+	}
+}
+
 // Packet represents a DHCPv6 packet
 type Packet struct {
 	Type          MessageType
 	TransactionID [3]byte
 	Options       Options
+	// Relays the packet came through, or is to be sent back through, starting with the one closest to the server
+	Relays []*RelayMessage
 }
 
-// Unmarshal creates a Packet out of its serialized representation
+// Unmarshal creates a Packet out of its serialized representation. Packets relayed in Relay-forward messages
+// are unwrapped, with the relay messages kept in Relays.
 func Unmarshal(bs []byte, packetLength int) (*Packet, error) {
+	if packetLength > 0 && MessageType(bs[0]) == MsgRelayForw {
+		return unmarshalRelayedPacket(bs[:packetLength])
+	}
+	if packetLength < 4 {
+		return nil, fmt.Errorf("packet is too short: %d bytes", packetLength)
+	}
 	options, err := UnmarshalOptions(bs[4:packetLength])
 	if err != nil {
 		return nil, fmt.Errorf("packet has malformed options section: %s", err)
@@ -43,8 +87,63 @@ func Unmarshal(bs []byte, packetLength int) (*Packet, error) {
 	return ret, nil
 }
 
-// Marshal serializes the Packet
+// ParsePacket creates a Packet out of its serialized representation, as produced by Marshal. Unlike Unmarshal,
+// it also unwraps packets relayed in Relay-reply messages, so that for any packet p that marshals successfully,
+// ParsePacket(p.Marshal()) returns a packet equal to p.
+func ParsePacket(bs []byte) (*Packet, error) {
+	if len(bs) > 0 && (MessageType(bs[0]) == MsgRelayForw || MessageType(bs[0]) == MsgRelayRepl) {
+		return unmarshalRelayedPacket(bs)
+	}
+	return Unmarshal(bs, len(bs))
+}
+
+// Marshal serializes the Packet, wrapped in its relay messages if any
 func (p *Packet) Marshal() ([]byte, error) {
+	ret, err := p.marshalMessage()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(p.Relays) - 1; i >= 0; i-- {
+		if ret, err = p.Relays[i].marshal(ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// MarshalReconfigure serializes a Reconfigure message like Marshal, authenticating it with an HMAC-MD5 digest
+// keyed with the reconfigure key handed out to the client, see RFC 8415, section 20.4.2
+func (p *Packet) MarshalReconfigure(key []byte, replay uint64) ([]byte, error) {
+	if p.Type != MsgReconfigure {
+		return nil, fmt.Errorf("Packet type %d isn't Reconfigure", p.Type)
+	}
+	if _, exists := p.Options[OptAuth]; exists {
+		return nil, fmt.Errorf("Reconfigure message already has an authentication option")
+	}
+	ret, err := p.marshalMessage()
+	if err != nil {
+		return nil, err
+	}
+	// The digest is computed over the whole message with the digest field zeroed, so the authentication option
+	// goes last, and the digest is filled in over the last bytes of the message
+	auth, err := makeReconfigureAuthOption(reconfigureKeyHmacMd5, make([]byte, md5.Size), replay).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, auth...)
+	mac := hmac.New(md5.New, key)
+	mac.Write(ret)
+	copy(ret[len(ret)-md5.Size:], mac.Sum(nil))
+
+	for i := len(p.Relays) - 1; i >= 0; i-- {
+		if ret, err = p.Relays[i].marshal(ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (p *Packet) marshalMessage() ([]byte, error) {
 	marshalledOptions, err := p.Options.Marshal()
 	if err != nil {
 		return nil, fmt.Errorf("packet has malformed options section: %s", err)
@@ -68,7 +167,13 @@ func (p *Packet) ShouldDiscard(serverDuid []byte) error {
 	case MsgInformationRequest:
 		return shouldDiscardInformationRequest(p, serverDuid)
 	case MsgRelease:
-		return nil // FIX ME!
+		return shouldDiscardRelease(p, serverDuid)
+	case MsgRenew:
+		return shouldDiscardRenew(p, serverDuid)
+	case MsgRebind:
+		return shouldDiscardRebind(p)
+	case MsgConfirm:
+		return shouldDiscardConfirm(p)
 	default:
 		return fmt.Errorf("Unknown packet")
 	}
@@ -105,6 +210,56 @@ func shouldDiscardRequest(p *Packet, serverDuid []byte) error {
 	return nil
 }
 
+func shouldDiscardRenew(p *Packet, serverDuid []byte) error {
+	options := p.Options
+	if !options.HasClientID() {
+		return fmt.Errorf("'Renew' packet has no Client id option")
+	}
+	if !options.HasServerID() {
+		return fmt.Errorf("'Renew' packet has no server id option")
+	}
+	if bytes.Compare(options.ServerID(), serverDuid) != 0 {
+		return fmt.Errorf("'Renew' packet's server id option (%d) is different from ours (%d)", options.ServerID(), serverDuid)
+	}
+	return nil
+}
+
+func shouldDiscardRelease(p *Packet, serverDuid []byte) error {
+	options := p.Options
+	if !options.HasClientID() {
+		return fmt.Errorf("'Release' packet has no Client id option")
+	}
+	if !options.HasServerID() {
+		return fmt.Errorf("'Release' packet has no server id option")
+	}
+	if bytes.Compare(options.ServerID(), serverDuid) != 0 {
+		return fmt.Errorf("'Release' packet's server id option (%d) is different from ours (%d)", options.ServerID(), serverDuid)
+	}
+	return nil
+}
+
+func shouldDiscardRebind(p *Packet) error {
+	options := p.Options
+	if !options.HasClientID() {
+		return fmt.Errorf("'Rebind' packet has no Client id option")
+	}
+	if options.HasServerID() {
+		return fmt.Errorf("'Rebind' packet has server id option")
+	}
+	return nil
+}
+
+func shouldDiscardConfirm(p *Packet) error {
+	options := p.Options
+	if !options.HasClientID() {
+		return fmt.Errorf("'Confirm' packet has no Client id option")
+	}
+	if options.HasServerID() {
+		return fmt.Errorf("'Confirm' packet has server id option")
+	}
+	return nil
+}
+
 func shouldDiscardInformationRequest(p *Packet, serverDuid []byte) error {
 	options := p.Options
 	if !options.HasBootFileURLOption() {
@@ -1,15 +1,90 @@
 package dhcp6
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash/fnv"
 	"net"
+	"strings"
 )
 
+// Default T1 and T2 times, as fractions of the preferred lifetime, see RFC 8415, section 21.4
+const (
+	defaultT1Ratio = 0.5
+	defaultT2Ratio = 0.8
+)
+
+// Default maximum length of Boot File URLs. Some firmwares truncate longer URLs, and fail to boot.
+const defaultMaxBootFileURLLength = 255
+
+// maxOptionLength is the most data an option can hold, its length being 2 bytes
+const maxOptionLength = 0xffff
+
+// httpClientVendorClass is the Vendor Class Option value identifying the server to UEFI HTTP boot clients: an
+// enterprise number of 0, followed by the length-prefixed "HTTPClient" vendor class data
+const httpClientVendorClass = "\x00\x00\x00\x00\x00\x0aHTTPClient"
+
+// biosClientArch is the client architecture type of x86 PCs booting with legacy BIOS, see RFC 4578, section 2.1
+const biosClientArch = 0x00
+
+// isHTTPClientArch returns true for client architecture types that boot over HTTP, see RFC 9140 and the IANA
+// "Processor Architecture Types" registry
+func isHTTPClientArch(arch uint16) bool {
+	switch arch {
+	case 0x0f, // x86 UEFI
+		0x10, // x64 UEFI
+		0x11, // EBC
+		0x12, // ARM 32-bit UEFI
+		0x13, // ARM 64-bit UEFI
+		0x14, // PC/AT BIOS
+		0x17, // ARM 32-bit U-Boot
+		0x18, // ARM 64-bit U-Boot
+		0x1a, // RISC-V 32-bit UEFI
+		0x1c, // RISC-V 64-bit UEFI
+		0x1e, // RISC-V 128-bit UEFI
+		0x26, // LoongArch 32-bit UEFI
+		0x28: // LoongArch 64-bit UEFI
+		return true
+	default:
+		return false
+	}
+}
+
 // PacketBuilder is used for generating responses to requests received from dhcp clients
 type PacketBuilder struct {
+	// PreferredLifetime and ValidLifetime of handed out addresses and prefixes, in seconds, InfiniteLifetime
+	// meaning infinity. A preferred lifetime greater than the valid lifetime is clamped to the valid lifetime.
+	// Zero lifetimes hand out addresses clients must not use.
 	PreferredLifetime uint32
 	ValidLifetime     uint32
+	// T1Ratio and T2Ratio are the fractions of the preferred lifetime after which clients should renew and
+	// rebind their addresses. Zero values default to 0.5 and 0.8 respectively.
+	T1Ratio float64
+	T2Ratio float64
+	// PrefixPool delegates prefixes to clients sending IA_PD options. Prefix delegation is disabled when nil.
+	PrefixPool PrefixPool
+	// MaxBootFileURLLength is the length in bytes of the longest Boot File URL handed out to clients, 255 if
+	// zero. Requests for which the BootConfiguration returns longer URLs fail, rather than have firmwares
+	// truncate the URL. URLs longer than 65535 bytes don't fit in an option, and always fail.
+	MaxBootFileURLLength int
+	// RapidCommit enables the two message exchange of RFC 8415, section 18.3.1: Solicits carrying a Rapid
+	// Commit option get a Reply committing the addresses, instead of an Advertise.
+	RapidCommit bool
+	// FailOnDNSError drops Solicit, Request and Information-request messages for which the BootConfiguration
+	// fails to provide DNS servers. By default, these clients get a response without the DNS Recursive Name
+	// Server Option, along with an error for the caller to log.
+	FailOnDNSError bool
+	// StrictTransactionID drops messages with an all-zero transaction ID, a common sign of a packet mangled by a
+	// buggy relay, with an error for the caller to log. By default, they are answered like any other message.
+	StrictTransactionID bool
+	// ServerUnicastAddress, if set, is sent in a Server Unicast Option in Advertise and Reply messages, so
+	// that clients unicast their later messages, e.g. renewals, to it rather than to the multicast group. It
+	// must be an address the server receives packets on. Relayed clients aren't sent the option, since the
+	// server needs the relays' link addresses to pick their addresses.
+	ServerUnicastAddress net.IP
+
+	advertises advertiseCache
 }
 
 // MakePacketBuilder creates a new PacketBuilder and initializes it with preferred and valid lifetimes
@@ -17,55 +92,186 @@ func MakePacketBuilder(preferredLifetime, validLifetime uint32) *PacketBuilder {
 	return &PacketBuilder{PreferredLifetime: preferredLifetime, ValidLifetime: validLifetime}
 }
 
-// BuildResponse generates a response packet for a packet received from a client
+// BuildResponse generates a response packet for a packet received from a client. Responses to relayed
+// packets are sent back through the same relays. A Solicit retransmitted by the client, with the same
+// transaction ID, gets the same Advertise as the original one, without reserving addresses again. addresses is
+// nil for a stateless server, which only answers Information-request messages, see RFC 8415, section 6.1.
 func (b *PacketBuilder) BuildResponse(in *Packet, serverDUID []byte, configuration BootConfiguration, addresses AddressPool) (*Packet, error) {
+	if b.StrictTransactionID && in.TransactionID == [3]byte{} {
+		return nil, fmt.Errorf("Transaction ID of message type %d from client %x is all zeros", in.Type, in.Options.ClientID())
+	}
+	var response *Packet
+	var err error
+	if in.Type == MsgSolicit {
+		response = b.advertises.get(in)
+	}
+	if response == nil {
+		response, err = b.buildResponseWithDNS(in, serverDUID, configuration, addresses)
+		b.addServerUnicast(in, response)
+		if in.Type == MsgSolicit && response != nil && err == nil {
+			b.advertises.add(in, response)
+		}
+	}
+	if response != nil && len(in.Relays) > 0 {
+		response.Relays = makeRelayReplies(in.Relays)
+	}
+	return response, err
+}
+
+// addServerUnicast adds a Server Unicast Option with ServerUnicastAddress to the response to in, if set, for
+// clients that aren't relayed
+func (b *PacketBuilder) addServerUnicast(in, response *Packet) {
+	if b.ServerUnicastAddress == nil || response == nil || len(in.Relays) > 0 {
+		return
+	}
+	if response.Type != MsgAdvertise && response.Type != MsgReply {
+		return
+	}
+	response.Options.Add(MakeServerUnicastOption(b.ServerUnicastAddress))
+}
+
+// buildResponseWithDNS builds the response to in with the DNS servers the configuration provides for the client.
+// A configuration error fails the response if FailOnDNSError is set, and is returned along with a response
+// without DNS servers otherwise.
+func (b *PacketBuilder) buildResponseWithDNS(in *Packet, serverDUID []byte, configuration BootConfiguration,
+	addresses AddressPool) (*Packet, error) {
+	var dnsServers []net.IP
+	var dnsErr error
+	if in.Type == MsgSolicit || in.Type == MsgRequest || in.Type == MsgInformationRequest {
+		dnsServers, dnsErr = b.getRecursiveDNS(in, configuration)
+		if dnsErr != nil && b.FailOnDNSError {
+			return nil, dnsErr
+		}
+	}
+	response, err := b.buildResponse(in, serverDUID, configuration, addresses, dnsServers)
+	if err == nil && response != nil && dnsErr != nil {
+		return response, fmt.Errorf("%w, responding without DNS servers", dnsErr)
+	}
+	return response, err
+}
+
+func (b *PacketBuilder) buildResponse(in *Packet, serverDUID []byte, configuration BootConfiguration, addresses AddressPool,
+	dnsServers []net.IP) (*Packet, error) {
+	if isAddressedToServer(in.Type) && !bytes.Equal(in.Options.ServerID(), serverDUID) {
+		// RFC 8415, section 16: messages meant for a different server are silently discarded
+		return nil, nil
+	}
+	if addresses == nil && in.Type != MsgInformationRequest {
+		// stateless servers don't assign addresses, and ignore messages about them
+		return nil, nil
+	}
+
 	switch in.Type {
 	case MsgSolicit:
-		bootFileURL, err := configuration.GetBootURL(b.extractLLAddressOrID(in.Options.ClientID()), in.Options.ClientArchType())
+		bootFileURL, err := b.getBootURL(in, configuration)
 		if err != nil {
 			return nil, err
 		}
-		associations, err := addresses.ReserveAddresses(in.Options.ClientID(), in.Options.IaNaIDs())
+		if b.RapidCommit && in.Options.HasRapidCommit() {
+			return b.makeRapidCommitReply(in, serverDUID, configuration, addresses, bootFileURL, dnsServers)
+		}
+		associations, err := addresses.ReserveAddressesForLink(in.LinkAddress(), in.Options.ClientID(), in.Options.IaNaIDs())
 		if err != nil {
-			return b.makeMsgAdvertiseWithNoAddrsAvailable(in.TransactionID, serverDUID, in.Options.ClientID(), err), err
+			return b.makeMsgAdvertiseWithNoAddrsAvailable(in.TransactionID, serverDUID, in.Options.ClientID(), err),
+				fmt.Errorf("Unable to reserve addresses: %w", err)
 		}
-		return b.makeMsgAdvertise(in.TransactionID, serverDUID, in.Options.ClientID(),
-			in.Options.ClientArchType(), associations, bootFileURL, configuration.GetPreference(), configuration.GetRecursiveDNS()), nil
+		advertise := b.makeMsgAdvertise(in.TransactionID, serverDUID, in.Options.ClientID(),
+			in.Options.ClientArchType(), associations, bootFileURL, b.getPreference(in, configuration), dnsServers,
+			getDNSSearchList(in, configuration))
+		b.addDelegatedPrefixes(advertise.Options, in)
+		b.addBootParams(advertise.Options, in, configuration)
+		b.addAlternateBootURLs(advertise.Options, in, configuration)
+		b.addClientFQDN(advertise.Options, in, configuration)
+		addNTPServers(advertise.Options, in, configuration)
+		return advertise, nil
 	case MsgRequest:
-		bootFileURL, err := configuration.GetBootURL(b.extractLLAddressOrID(in.Options.ClientID()), in.Options.ClientArchType())
+		bootFileURL, err := b.getBootURL(in, configuration)
 		if err != nil {
 			return nil, err
 		}
-		associations, err := addresses.ReserveAddresses(in.Options.ClientID(), in.Options.IaNaIDs())
-		return b.makeMsgReply(in.TransactionID, serverDUID, in.Options.ClientID(),
-			in.Options.ClientArchType(), associations, iasWithoutAddesses(associations, in.Options.IaNaIDs()), bootFileURL,
-			configuration.GetRecursiveDNS(), err), err
+		return b.makeReplyWithAddresses(in, serverDUID, configuration, addresses, bootFileURL, dnsServers)
 	case MsgInformationRequest:
-		bootFileURL, err := configuration.GetBootURL(b.extractLLAddressOrID(in.Options.ClientID()), in.Options.ClientArchType())
+		bootFileURL, err := b.getBootURL(in, configuration)
 		if err != nil {
 			return nil, err
 		}
-		return b.makeMsgInformationRequestReply(in.TransactionID, serverDUID, in.Options.ClientID(),
-			in.Options.ClientArchType(), bootFileURL, configuration.GetRecursiveDNS()), nil
+		reply := b.makeMsgInformationRequestReply(in.TransactionID, serverDUID, in.Options.ClientID(),
+			in.Options.ClientArchType(), bootFileURL, dnsServers, getDNSSearchList(in, configuration))
+		b.addBootParams(reply.Options, in, configuration)
+		b.addAlternateBootURLs(reply.Options, in, configuration)
+		b.addClientFQDN(reply.Options, in, configuration)
+		addNTPServers(reply.Options, in, configuration)
+		return reply, nil
 	case MsgRelease:
 		addresses.ReleaseAddresses(in.Options.ClientID(), in.Options.IaNaIDs())
 		return b.makeMsgReleaseReply(in.TransactionID, serverDUID, in.Options.ClientID()), nil
+	case MsgRenew:
+		associations := addresses.ExtendAddresses(in.Options.ClientID(), in.Options.IaNaIDs())
+		return b.makeMsgReplyForRenew(in.TransactionID, serverDUID, in.Options.ClientID(), associations,
+			iasWithoutAddesses(associations, in.Options.IaNaIDs())), nil
+	case MsgRebind:
+		associations := addresses.LookupAddresses(in.Options.ClientID(), in.Options.IaNaIDs())
+		return b.makeMsgReplyForRebind(in.TransactionID, serverDUID, in.Options.ClientID(), associations,
+			iasWithoutAddesses(associations, in.Options.IaNaIDs())), nil
+	case MsgConfirm:
+		addressesToConfirm := in.Options.IaNaAddresses()
+		if len(addressesToConfirm) == 0 {
+			// RFC 8415, section 18.3.3: a Confirm without addresses is not answered
+			return nil, nil
+		}
+		return b.makeMsgConfirmReply(in.TransactionID, serverDUID, in.Options.ClientID(), addressesToConfirm, addresses), nil
 	default:
 		return nil, nil
 	}
 }
 
+// makeReplyWithAddresses reserves addresses for the client that sent in, a Request or a rapid commit Solicit, and
+// creates the Reply committing them
+func (b *PacketBuilder) makeReplyWithAddresses(in *Packet, serverDUID []byte, configuration BootConfiguration,
+	addresses AddressPool, bootFileURL []byte, dnsServers []net.IP) (*Packet, error) {
+	associations, err := addresses.ReserveAddressesForLink(in.LinkAddress(), in.Options.ClientID(), in.Options.IaNaIDs())
+	reply := b.makeMsgReply(in.TransactionID, serverDUID, in.Options.ClientID(),
+		in.Options.ClientArchType(), associations, iasWithoutAddesses(associations, in.Options.IaNaIDs()), bootFileURL,
+		dnsServers, getDNSSearchList(in, configuration), err)
+	b.addDelegatedPrefixes(reply.Options, in)
+	b.addBootParams(reply.Options, in, configuration)
+	b.addAlternateBootURLs(reply.Options, in, configuration)
+	b.addClientFQDN(reply.Options, in, configuration)
+	addNTPServers(reply.Options, in, configuration)
+	if err != nil {
+		return reply, fmt.Errorf("Unable to reserve addresses: %w", err)
+	}
+	return reply, nil
+}
+
+// makeRapidCommitReply answers a Solicit carrying a Rapid Commit option with a Reply, which carries the option
+// too, see RFC 8415, section 18.3.1
+func (b *PacketBuilder) makeRapidCommitReply(in *Packet, serverDUID []byte, configuration BootConfiguration,
+	addresses AddressPool, bootFileURL []byte, dnsServers []net.IP) (*Packet, error) {
+	reply, err := b.makeReplyWithAddresses(in, serverDUID, configuration, addresses, bootFileURL, dnsServers)
+	reply.Options.Add(MakeOption(OptRapidCommit, nil))
+	return reply, err
+}
+
+// isAddressedToServer returns true for message types that carry the DUID of the server they're meant for
+func isAddressedToServer(msgType MessageType) bool {
+	switch msgType {
+	case MsgRequest, MsgRenew, MsgRelease:
+		return true
+	default:
+		return false
+	}
+}
+
 func (b *PacketBuilder) makeMsgAdvertise(transactionID [3]byte, serverDUID, clientID []byte, clientArchType uint16,
-	associations []*IdentityAssociation, bootFileURL, preference []byte, dnsServers []net.IP) *Packet {
+	associations []*IdentityAssociation, bootFileURL, preference []byte, dnsServers []net.IP,
+	dnsSearchList []string) *Packet {
 	retOptions := make(Options)
 	retOptions.Add(MakeOption(OptClientID, clientID))
-	for _, association := range associations {
-		retOptions.Add(MakeIaNaOption(association.InterfaceID, b.calculateT1(), b.calculateT2(),
-			MakeIaAddrOption(association.IPAddress, b.PreferredLifetime, b.ValidLifetime)))
-	}
+	b.addIaNaOptions(retOptions, associations)
 	retOptions.Add(MakeOption(OptServerID, serverDUID))
-	if 0x10 == clientArchType { // HTTPClient
-		retOptions.Add(MakeOption(OptVendorClass, []byte{0, 0, 0, 0, 0, 10, 72, 84, 84, 80, 67, 108, 105, 101, 110, 116})) // HTTPClient
+	if isHTTPClientArch(clientArchType) {
+		retOptions.Add(MakeOption(OptVendorClass, []byte(httpClientVendorClass)))
 	}
 	retOptions.Add(MakeOption(OptBootfileURL, bootFileURL))
 	if preference != nil {
@@ -74,50 +280,70 @@ func (b *PacketBuilder) makeMsgAdvertise(transactionID [3]byte, serverDUID, clie
 	if len(dnsServers) > 0 {
 		retOptions.Add(MakeDNSServersOption(dnsServers))
 	}
+	if len(dnsSearchList) > 0 {
+		retOptions.Add(MakeDomainSearchListOption(dnsSearchList))
+	}
 
 	return &Packet{Type: MsgAdvertise, TransactionID: transactionID, Options: retOptions}
 }
 
 func (b *PacketBuilder) makeMsgReply(transactionID [3]byte, serverDUID, clientID []byte, clientArchType uint16,
-	associations []*IdentityAssociation, iasWithoutAddresses [][]byte, bootFileURL []byte, dnsServers []net.IP, err error) *Packet {
+	associations []*IdentityAssociation, iasWithoutAddresses [][]byte, bootFileURL []byte, dnsServers []net.IP,
+	dnsSearchList []string, err error) *Packet {
 	retOptions := make(Options)
 	retOptions.Add(MakeOption(OptClientID, clientID))
-	for _, association := range associations {
-		retOptions.Add(MakeIaNaOption(association.InterfaceID, b.calculateT1(), b.calculateT2(),
-			MakeIaAddrOption(association.IPAddress, b.PreferredLifetime, b.ValidLifetime)))
-	}
+	b.addIaNaOptions(retOptions, associations)
 	for _, ia := range iasWithoutAddresses {
 		retOptions.Add(MakeIaNaOption(ia, b.calculateT1(), b.calculateT2(),
-			MakeStatusOption(2, err.Error())))
+			MakeStatusOption(StatusNoAddrsAvail, err.Error())))
 	}
 	retOptions.Add(MakeOption(OptServerID, serverDUID))
-	if 0x10 == clientArchType { // HTTPClient
-		retOptions.Add(MakeOption(OptVendorClass, []byte{0, 0, 0, 0, 0, 10, 72, 84, 84, 80, 67, 108, 105, 101, 110, 116})) // HTTPClient
+	if isHTTPClientArch(clientArchType) {
+		retOptions.Add(MakeOption(OptVendorClass, []byte(httpClientVendorClass)))
 	}
 	retOptions.Add(MakeOption(OptBootfileURL, bootFileURL))
 	if len(dnsServers) > 0 {
 		retOptions.Add(MakeDNSServersOption(dnsServers))
 	}
+	if len(dnsSearchList) > 0 {
+		retOptions.Add(MakeDomainSearchListOption(dnsSearchList))
+	}
 
 	return &Packet{Type: MsgReply, TransactionID: transactionID, Options: retOptions}
 }
 
 func (b *PacketBuilder) makeMsgInformationRequestReply(transactionID [3]byte, serverDUID, clientID []byte, clientArchType uint16,
-	bootFileURL []byte, dnsServers []net.IP) *Packet {
+	bootFileURL []byte, dnsServers []net.IP, dnsSearchList []string) *Packet {
 	retOptions := make(Options)
 	retOptions.Add(MakeOption(OptClientID, clientID))
 	retOptions.Add(MakeOption(OptServerID, serverDUID))
-	if 0x10 == clientArchType { // HTTPClient
-		retOptions.Add(MakeOption(OptVendorClass, []byte{0, 0, 0, 0, 0, 10, 72, 84, 84, 80, 67, 108, 105, 101, 110, 116})) // HTTPClient
+	if isHTTPClientArch(clientArchType) {
+		retOptions.Add(MakeOption(OptVendorClass, []byte(httpClientVendorClass)))
 	}
 	retOptions.Add(MakeOption(OptBootfileURL, bootFileURL))
 	if len(dnsServers) > 0 {
 		retOptions.Add(MakeDNSServersOption(dnsServers))
 	}
+	if len(dnsSearchList) > 0 {
+		retOptions.Add(MakeDomainSearchListOption(dnsSearchList))
+	}
 
 	return &Packet{Type: MsgReply, TransactionID: transactionID, Options: retOptions}
 }
 
+// MakeMsgReconfigure creates a Reconfigure message asking the client to send msgType, one of MsgRenew, MsgRebind
+// or MsgInformationRequest, to pick up configuration changes. RFC 8415, section 18.3.11 has servers set
+// transactionID to 0. The message must be serialized with MarshalReconfigure, clients discard Reconfigure
+// messages that aren't authenticated with their reconfigure key.
+func (b *PacketBuilder) MakeMsgReconfigure(transactionID [3]byte, serverDUID, clientID []byte, msgType MessageType) *Packet {
+	retOptions := make(Options)
+	retOptions.Add(MakeOption(OptServerID, serverDUID))
+	retOptions.Add(MakeOption(OptClientID, clientID))
+	retOptions.Add(MakeReconfigureMessageOption(msgType))
+
+	return &Packet{Type: MsgReconfigure, TransactionID: transactionID, Options: retOptions}
+}
+
 func (b *PacketBuilder) makeMsgReleaseReply(transactionID [3]byte, serverDUID, clientID []byte) *Packet {
 	retOptions := make(Options)
 
@@ -130,31 +356,331 @@ func (b *PacketBuilder) makeMsgReleaseReply(transactionID [3]byte, serverDUID, c
 	return &Packet{Type: MsgReply, TransactionID: transactionID, Options: retOptions}
 }
 
+// makeMsgReplyForRebind confirms the associations the address pool still knows about, and reports
+// NoBinding for the remaining IAs, so that the client goes back to soliciting for them
+func (b *PacketBuilder) makeMsgReplyForRebind(transactionID [3]byte, serverDUID, clientID []byte,
+	associations []*IdentityAssociation, iasWithoutAddresses [][]byte) *Packet {
+	retOptions := make(Options)
+	retOptions.Add(MakeOption(OptClientID, clientID))
+	b.addIaNaOptions(retOptions, associations)
+	b.addNoBindingIaNaOptions(retOptions, iasWithoutAddresses)
+	retOptions.Add(MakeOption(OptServerID, serverDUID))
+
+	return &Packet{Type: MsgReply, TransactionID: transactionID, Options: retOptions}
+}
+
+// makeMsgReplyForRenew returns the associations with their lifetimes extended, and reports NoBinding
+// for the IAs the address pool doesn't know about, so that the client solicits only for those
+func (b *PacketBuilder) makeMsgReplyForRenew(transactionID [3]byte, serverDUID, clientID []byte,
+	associations []*IdentityAssociation, iasWithoutAddresses [][]byte) *Packet {
+	retOptions := make(Options)
+	retOptions.Add(MakeOption(OptClientID, clientID))
+	b.addIaNaOptions(retOptions, associations)
+	b.addNoBindingIaNaOptions(retOptions, iasWithoutAddresses)
+	retOptions.Add(MakeOption(OptServerID, serverDUID))
+
+	return &Packet{Type: MsgReply, TransactionID: transactionID, Options: retOptions}
+}
+
+// makeMsgConfirmReply tells the client whether all of its addresses are still appropriate for the link
+// it's attached to, without allocating or extending any of them
+func (b *PacketBuilder) makeMsgConfirmReply(transactionID [3]byte, serverDUID, clientID []byte, addressesToConfirm []net.IP,
+	addresses AddressPool) *Packet {
+	retOptions := make(Options)
+	retOptions.Add(MakeOption(OptClientID, clientID))
+	retOptions.Add(MakeOption(OptServerID, serverDUID))
+	status := MakeStatusOption(StatusSuccess, "All addresses still on link.")
+	for _, address := range addressesToConfirm {
+		if !addresses.Contains(address) {
+			status = MakeStatusOption(StatusNotOnLink, "Some of the addresses are not on link.")
+			break
+		}
+	}
+	retOptions.Add(status)
+
+	return &Packet{Type: MsgReply, TransactionID: transactionID, Options: retOptions}
+}
+
 func (b *PacketBuilder) makeMsgAdvertiseWithNoAddrsAvailable(transactionID [3]byte, serverDUID, clientID []byte, err error) *Packet {
 	retOptions := make(Options)
 	retOptions.Add(MakeOption(OptClientID, clientID))
 	retOptions.Add(MakeOption(OptServerID, serverDUID))
-	retOptions.Add(MakeStatusOption(2, err.Error())) // NoAddrAvailable
+	retOptions.Add(MakeStatusOption(StatusNoAddrsAvail, err.Error()))
 	return &Packet{Type: MsgAdvertise, TransactionID: transactionID, Options: retOptions}
 }
 
+func (b *PacketBuilder) addIaNaOptions(options Options, associations []*IdentityAssociation) {
+	for _, association := range associations {
+		iaAddrOptions := make([]*Option, 0, 1+len(association.AdditionalIPAddresses))
+		for _, ip := range association.IPAddresses() {
+			iaAddrOptions = append(iaAddrOptions, MakeIaAddrOption(ip, b.PreferredLifetime, b.ValidLifetime))
+		}
+		options.Add(MakeIaNaOption(association.InterfaceID, b.calculateT1(), b.calculateT2(), iaAddrOptions...))
+	}
+}
+
+// addDelegatedPrefixes reserves prefixes for the IA_PDs in the client's message, and reports NoPrefixAvail
+// for the ones that couldn't get a prefix
+func (b *PacketBuilder) addDelegatedPrefixes(options Options, in *Packet) {
+	iaPdIDs := in.Options.IaPdIDs()
+	if b.PrefixPool == nil || len(iaPdIDs) == 0 {
+		return
+	}
+
+	delegations, err := b.PrefixPool.ReservePrefixes(in.Options.ClientID(), iaPdIDs)
+	delegated := make(map[string]bool)
+	for _, delegation := range delegations {
+		options.Add(MakeIaPdOption(delegation.InterfaceID, b.calculateT1(), b.calculateT2(),
+			MakeIaPrefixOption(delegation.Prefix, b.PreferredLifetime, b.ValidLifetime)))
+		delegated[string(delegation.InterfaceID)] = true
+	}
+
+	message := "No prefixes available for this identity association."
+	if err != nil {
+		message = err.Error()
+	}
+	for _, iaPdID := range iaPdIDs {
+		if !delegated[string(iaPdID)] {
+			options.Add(MakeIaPdOption(iaPdID, 0, 0, MakeStatusOption(StatusNoPrefixAvail, message)))
+		}
+	}
+}
+
+// getBootURL asks the configuration for the boot file URL of the client that sent in, and checks that it isn't
+// longer than MaxBootFileURLLength
+func (b *PacketBuilder) getBootURL(in *Packet, configuration BootConfiguration) ([]byte, error) {
+	id, err := b.extractLLAddressOrID(in.Options.ClientID())
+	if err != nil {
+		return nil, err
+	}
+	url, err := b.getTFTPBootURL(id, in.Options.ClientArchType(), configuration)
+	if err == nil && url == nil {
+		url, err = configuration.GetBootURL(id, in.Options.ClientArchType())
+	}
+	if err != nil {
+		return nil, err
+	}
+	maxLength := b.maxBootFileURLLength()
+	if len(url) > maxLength {
+		return nil, fmt.Errorf("Boot file url for client %x is %d bytes long, longer than the maximum of %d bytes",
+			in.Options.ClientID(), len(url), maxLength)
+	}
+	return url, nil
+}
+
+// maxBootFileURLLength returns the length in bytes of the longest Boot File URL handed out to clients
+func (b *PacketBuilder) maxBootFileURLLength() int {
+	maxLength := b.MaxBootFileURLLength
+	if maxLength == 0 {
+		maxLength = defaultMaxBootFileURLLength
+	}
+	if maxLength > maxOptionLength {
+		maxLength = maxOptionLength
+	}
+	return maxLength
+}
+
+// addAlternateBootURLs adds the Vendor-specific Information Option with the alternate Boot File URLs the
+// configuration provides for the client. URLs longer than the maximum Boot File URL length, or not fitting in
+// the option anymore, are left out.
+func (b *PacketBuilder) addAlternateBootURLs(options Options, in *Packet, configuration BootConfiguration) {
+	alternatesConfiguration, ok := configuration.(AlternateBootURLsConfiguration)
+	if !ok {
+		return
+	}
+	id, err := b.extractLLAddressOrID(in.Options.ClientID())
+	if err != nil {
+		return
+	}
+	var urls [][]byte
+	length := 4
+	for _, url := range alternatesConfiguration.GetAlternateBootURLs(id, in.Options.ClientArchType()) {
+		if len(url) > b.maxBootFileURLLength() || length+4+len(url) > maxOptionLength {
+			continue
+		}
+		urls = append(urls, url)
+		length += 4 + len(url)
+	}
+	if len(urls) == 0 {
+		return
+	}
+	options.Add(MakeAlternateBootFileURLsOption(urls))
+}
+
+// getTFTPBootURL returns the tftp:// Boot File URL of a BIOS client, if the configuration boots it from a TFTP
+// server, see RFC 5970, section 3.1. It returns nil for all other clients.
+func (b *PacketBuilder) getTFTPBootURL(id []byte, clientArchType uint16, configuration BootConfiguration) ([]byte, error) {
+	tftpConfiguration, ok := configuration.(TFTPBootConfiguration)
+	if !ok || clientArchType != biosClientArch {
+		return nil, nil
+	}
+	server, bootFile, ok := tftpConfiguration.GetTFTPBoot(id, clientArchType)
+	if !ok {
+		return nil, nil
+	}
+	if server.To16() == nil || server.To4() != nil {
+		return nil, fmt.Errorf("TFTP server %s for client %x is not an IPv6 address", server, id)
+	}
+	return []byte(fmt.Sprintf("tftp://[%s]/%s", server, strings.TrimPrefix(bootFile, "/"))), nil
+}
+
+// getPreference asks the configuration for the server preference to advertise to the client that sent in
+func (b *PacketBuilder) getPreference(in *Packet, configuration BootConfiguration) []byte {
+	id, err := b.extractLLAddressOrID(in.Options.ClientID())
+	if err != nil {
+		return nil
+	}
+	return configuration.GetPreference(id, in.Options.ClientArchType())
+}
+
+// getRecursiveDNS asks the configuration for the DNS servers of the client that sent in
+func (b *PacketBuilder) getRecursiveDNS(in *Packet, configuration BootConfiguration) ([]net.IP, error) {
+	if !isRequested(in, OptRecursiveDNS) {
+		return nil, nil
+	}
+	id, err := b.extractLLAddressOrID(in.Options.ClientID())
+	if err != nil {
+		return nil, nil
+	}
+	servers, err := configuration.GetRecursiveDNS(id, in.Options.ClientArchType())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get DNS servers: %w", err)
+	}
+	return servers, nil
+}
+
+// addBootParams adds the Boot File Parameters Option, if the configuration provides parameters for the client
+func (b *PacketBuilder) addBootParams(options Options, in *Packet, configuration BootConfiguration) {
+	paramsConfiguration, ok := configuration.(BootParamsConfiguration)
+	if !ok {
+		return
+	}
+	id, err := b.extractLLAddressOrID(in.Options.ClientID())
+	if err != nil {
+		return
+	}
+	params := paramsConfiguration.GetBootParams(id, in.Options.ClientArchType())
+	if len(params) == 0 {
+		return
+	}
+	options.Add(MakeBootfileParamOption(params))
+}
+
+// addClientFQDN adds the Client FQDN Option with the hostname the configuration assigns to the client. Like
+// RFC 4704, section 6 requires, the option is only sent to clients that sent and requested it. We don't update
+// DNS, so the N flag is always set, along with the O flag if the client asked us to update AAAA records.
+func (b *PacketBuilder) addClientFQDN(options Options, in *Packet, configuration BootConfiguration) {
+	fqdnConfiguration, ok := configuration.(ClientFQDNConfiguration)
+	if !ok {
+		return
+	}
+	clientFlags, _, ok := in.Options.ClientFQDN()
+	if !ok || !isRequested(in, OptClientFQDN) {
+		return
+	}
+	id, err := b.extractLLAddressOrID(in.Options.ClientID())
+	if err != nil {
+		return
+	}
+	hostname, ok := fqdnConfiguration.GetClientFQDN(id, in.Options.ClientArchType())
+	if !ok {
+		return
+	}
+	flags := FQDNFlagN
+	if clientFlags&FQDNFlagS != 0 {
+		flags |= FQDNFlagO
+	}
+	options.Add(MakeClientFQDNOption(hostname, flags))
+}
+
+// isRequested returns true if the client that sent in listed option id in its Option Request Option. Optional
+// configuration is only sent to clients that ask for it, see RFC 8415, section 21.7.
+func isRequested(in *Packet, id uint16) bool {
+	for _, requested := range in.Options.OptionRequest() {
+		if requested == id {
+			return true
+		}
+	}
+	return false
+}
+
+// getDNSSearchList returns the domain search list for clients that requested it
+func getDNSSearchList(in *Packet, configuration BootConfiguration) []string {
+	if !isRequested(in, OptDomainList) {
+		return nil
+	}
+	return configuration.GetDNSSearchList()
+}
+
+// addNTPServers adds the NTP Server Option, if the client requested it and the configuration provides NTP servers
+func addNTPServers(options Options, in *Packet, configuration BootConfiguration) {
+	if !isRequested(in, OptNTPServer) {
+		return
+	}
+	if servers := configuration.GetNTPServers(); len(servers) > 0 {
+		options.Add(MakeNTPServersOption(servers))
+	}
+}
+
+func (b *PacketBuilder) addNoBindingIaNaOptions(options Options, interfaceIDs [][]byte) {
+	for _, ia := range interfaceIDs {
+		options.Add(MakeIaNaOption(ia, 0, 0,
+			MakeStatusOption(StatusNoBinding, "No binding for this identity association.")))
+	}
+}
+
 func (b *PacketBuilder) calculateT1() uint32 {
-	return b.PreferredLifetime / 2
+	t1 := b.scaleLifetime(b.T1Ratio, defaultT1Ratio)
+	if t2 := b.calculateT2(); t1 > t2 {
+		return t2
+	}
+	return t1
 }
 
 func (b *PacketBuilder) calculateT2() uint32 {
-	return (b.PreferredLifetime * 4) / 5
+	return b.scaleLifetime(b.T2Ratio, defaultT2Ratio)
+}
+
+// scaleLifetime returns the preferred lifetime scaled by ratio, never exceeding the preferred lifetime itself.
+// An infinite preferred lifetime stays infinite, see RFC 8415, section 21.4.
+func (b *PacketBuilder) scaleLifetime(ratio, defaultRatio float64) uint32 {
+	preferredLifetime := clampPreferredLifetime(b.PreferredLifetime, b.ValidLifetime)
+	if ratio <= 0 {
+		ratio = defaultRatio
+	}
+	if ratio >= 1 || preferredLifetime == InfiniteLifetime {
+		return preferredLifetime
+	}
+	return uint32(float64(preferredLifetime) * ratio)
 }
 
-func (b *PacketBuilder) extractLLAddressOrID(optClientID []byte) []byte {
+// extractLLAddressOrID returns the link-layer address in a client DUID if it has one, or the rest of the DUID
+// otherwise. It returns an error if the DUID is too short for its type.
+func (b *PacketBuilder) extractLLAddressOrID(optClientID []byte) ([]byte, error) {
+	if len(optClientID) < 2 {
+		return nil, fmt.Errorf("Client id is too short: %d bytes", len(optClientID))
+	}
 	idType := binary.BigEndian.Uint16(optClientID[0:2])
 	switch idType {
 	case 1:
-		return optClientID[8:]
+		if len(optClientID) < 8 {
+			return nil, fmt.Errorf("DUID-LLT client id is too short: %d bytes", len(optClientID))
+		}
+		return optClientID[8:], nil
 	case 3:
-		return optClientID[4:]
+		if len(optClientID) < 4 {
+			return nil, fmt.Errorf("DUID-LL client id is too short: %d bytes", len(optClientID))
+		}
+		return optClientID[4:], nil
+	case 4:
+		// DUID-UUID, see RFC 6355. Sent by most UEFI firmware, the UUID is the machine's SMBIOS system UUID.
+		// The DUID is exactly 18 bytes long.
+		if len(optClientID) != 18 {
+			return nil, fmt.Errorf("DUID-UUID client id must be 18 bytes, got %d", len(optClientID))
+		}
+		return optClientID[2:], nil
 	default:
-		return optClientID[2:]
+		return optClientID[2:], nil
 	}
 }
 
@@ -1,9 +1,14 @@
 package dhcp6
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -20,7 +25,7 @@ func TestMakeMsgAdvertise(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgAdvertise(transactionID, expectedServerID, expectedClientID, 0x11,
-		[]*IdentityAssociation{identityAssociation}, expectedBootFileURL, nil, []net.IP{expectedDNSServerIP})
+		[]*IdentityAssociation{identityAssociation}, expectedBootFileURL, nil, []net.IP{expectedDNSServerIP}, nil)
 
 	if msg.Type != MsgAdvertise {
 		t.Fatalf("Expected message type %d, got %d", MsgAdvertise, msg.Type)
@@ -84,7 +89,7 @@ func TestMakeMsgAdvertiseShouldSkipDnsServersIfNoneConfigured(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgAdvertise(transactionID, expectedServerID, expectedClientID, 0x11,
-		[]*IdentityAssociation{identityAssociation}, expectedBootFileURL, nil, []net.IP{})
+		[]*IdentityAssociation{identityAssociation}, expectedBootFileURL, nil, []net.IP{}, nil)
 
 	_, exists := msg.Options[OptRecursiveDNS]
 	if exists {
@@ -99,7 +104,7 @@ func TestShouldSetPreferenceOptionWhenSpecified(t *testing.T) {
 
 	expectedPreference := []byte{128}
 	msg := builder.makeMsgAdvertise([3]byte{'t', 'i', 'd'}, []byte("serverid"), []byte("clientid"), 0x11,
-		[]*IdentityAssociation{identityAssociation}, []byte("http://bootfileurl"), expectedPreference, []net.IP{})
+		[]*IdentityAssociation{identityAssociation}, []byte("http://bootfileurl"), expectedPreference, []net.IP{}, nil)
 
 	preferenceOption := msg.Options[OptPreference]
 	if preferenceOption == nil {
@@ -121,7 +126,7 @@ func TestMakeMsgAdvertiseWithHttpClientArch(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgAdvertise(transactionID, expectedServerID, expectedClientID, 0x10,
-		[]*IdentityAssociation{identityAssociation}, expectedBootFileURL, nil, []net.IP{})
+		[]*IdentityAssociation{identityAssociation}, expectedBootFileURL, nil, []net.IP{}, nil)
 
 	vendorClassOption := msg.Options[OptVendorClass]
 	if vendorClassOption == nil {
@@ -194,7 +199,7 @@ func TestMakeMsgReply(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgReply(transactionID, expectedServerID, expectedClientID, 0x11,
-		[]*IdentityAssociation{identityAssociation}, make([][]byte, 0), expectedBootFileURL, []net.IP{expectedDNSServerIP}, nil)
+		[]*IdentityAssociation{identityAssociation}, make([][]byte, 0), expectedBootFileURL, []net.IP{expectedDNSServerIP}, nil, nil)
 
 	if msg.Type != MsgReply {
 		t.Fatalf("Expected message type %d, got %d", MsgAdvertise, msg.Type)
@@ -258,7 +263,7 @@ func TestMakeMsgReplyShouldSkipDnsServersIfNoneWereConfigured(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgReply(transactionID, expectedServerID, expectedClientID, 0x11,
-		[]*IdentityAssociation{identityAssociation}, make([][]byte, 0), expectedBootFileURL, []net.IP{}, nil)
+		[]*IdentityAssociation{identityAssociation}, make([][]byte, 0), expectedBootFileURL, []net.IP{}, nil, nil)
 
 	_, exists := msg.Options[OptRecursiveDNS]
 	if exists {
@@ -277,7 +282,7 @@ func TestMakeMsgReplyWithHttpClientArch(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgReply(transactionID, expectedServerID, expectedClientID, 0x10,
-		[]*IdentityAssociation{identityAssociation}, make([][]byte, 0), expectedBootFileURL, []net.IP{}, nil)
+		[]*IdentityAssociation{identityAssociation}, make([][]byte, 0), expectedBootFileURL, []net.IP{}, nil, nil)
 
 	vendorClassOption := msg.Options[OptVendorClass]
 	if vendorClassOption == nil {
@@ -305,7 +310,7 @@ func TestMakeMsgReplyWithNoAddrsAvailable(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgReply(transactionID, expectedServerID, expectedClientID, 0x10,
-		[]*IdentityAssociation{identityAssociation}, [][]byte{[]byte("id-2")}, expectedBootFileURL, []net.IP{},
+		[]*IdentityAssociation{identityAssociation}, [][]byte{[]byte("id-2")}, expectedBootFileURL, []net.IP{}, nil,
 		fmt.Errorf(expectedErrorMessage))
 
 	iaNaOption := msg.Options[OptIaNa]
@@ -357,7 +362,7 @@ func TestMakeMsgInformationRequestReply(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgInformationRequestReply(transactionID, expectedServerID, expectedClientID, 0x11,
-		expectedBootFileURL, []net.IP{expectedDNSServerIP})
+		expectedBootFileURL, []net.IP{expectedDNSServerIP}, nil)
 
 	if msg.Type != MsgReply {
 		t.Fatalf("Expected message type %d, got %d", MsgAdvertise, msg.Type)
@@ -414,7 +419,7 @@ func TestMakeMsgInformationRequestReplyShouldSkipDnsServersIfNoneWereConfigured(
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgInformationRequestReply(transactionID, expectedServerID, expectedClientID, 0x11,
-		expectedBootFileURL, []net.IP{})
+		expectedBootFileURL, []net.IP{}, nil)
 
 	_, exists := msg.Options[OptRecursiveDNS]
 	if exists {
@@ -431,7 +436,7 @@ func TestMakeMsgInformationRequestReplyWithHttpClientArch(t *testing.T) {
 	builder := MakePacketBuilder(90, 100)
 
 	msg := builder.makeMsgInformationRequestReply(transactionID, expectedServerID, expectedClientID, 0x10,
-		expectedBootFileURL, []net.IP{})
+		expectedBootFileURL, []net.IP{}, nil)
 
 	vendorClassOption := msg.Options[OptVendorClass]
 	if vendorClassOption == nil {
@@ -486,10 +491,77 @@ func TestMakeMsgReleaseReply(t *testing.T) {
 	}
 }
 
+func TestCalculateT1AndT2WithDefaultRatios(t *testing.T) {
+	builder := MakePacketBuilder(1000, 1200)
+
+	if t1 := builder.calculateT1(); t1 != 500 {
+		t.Fatalf("Expected t1 of 500, got %d", t1)
+	}
+	if t2 := builder.calculateT2(); t2 != 800 {
+		t.Fatalf("Expected t2 of 800, got %d", t2)
+	}
+}
+
+func TestCalculateT1AndT2WithCustomRatios(t *testing.T) {
+	builder := MakePacketBuilder(1000, 1200)
+	builder.T1Ratio = 0.25
+	builder.T2Ratio = 0.5
+
+	if t1 := builder.calculateT1(); t1 != 250 {
+		t.Fatalf("Expected t1 of 250, got %d", t1)
+	}
+	if t2 := builder.calculateT2(); t2 != 500 {
+		t.Fatalf("Expected t2 of 500, got %d", t2)
+	}
+}
+
+func TestCalculateT1AndT2AreClamped(t *testing.T) {
+	builder := MakePacketBuilder(1000, 1200)
+	builder.T1Ratio = 0.9
+	builder.T2Ratio = 1.5
+
+	if t2 := builder.calculateT2(); t2 != 1000 {
+		t.Fatalf("Expected t2 to be clamped to the preferred lifetime of 1000, got %d", t2)
+	}
+
+	builder.T2Ratio = 0.6
+	if t1 := builder.calculateT1(); t1 != 600 {
+		t.Fatalf("Expected t1 to be clamped to t2 of 600, got %d", t1)
+	}
+}
+
+func TestMisorderedLifetimesAreClamped(t *testing.T) {
+	builder := MakePacketBuilder(2000, 1000)
+	options := make(Options)
+	builder.addIaNaOptions(options, []*IdentityAssociation{
+		{IPAddress: net.ParseIP("2001:db8:f00f:cafe::1"), InterfaceID: []byte("id-1")},
+	})
+
+	iaNa := options[OptIaNa][0].Value
+	if t1, t2 := binary.BigEndian.Uint32(iaNa[4:8]), binary.BigEndian.Uint32(iaNa[8:12]); t1 != 500 || t2 != 800 {
+		t.Fatalf("Expected t1 and t2 based on the valid lifetime of 1000, got %d and %d", t1, t2)
+	}
+	iaAddr, err := UnmarshalOption(iaNa[12:])
+	if err != nil {
+		t.Fatalf("Error unmarshalling IA Address option: %s", err)
+	}
+	if preferred := binary.BigEndian.Uint32(iaAddr.Value[16:20]); preferred != 1000 {
+		t.Fatalf("Expected preferred lifetime to be clamped to 1000, got %d", preferred)
+	}
+
+	builder = MakePacketBuilder(InfiniteLifetime, InfiniteLifetime)
+	if t1, t2 := builder.calculateT1(), builder.calculateT2(); t1 != InfiniteLifetime || t2 != InfiniteLifetime {
+		t.Fatalf("Expected infinite t1 and t2 for an infinite preferred lifetime, got %d and %d", t1, t2)
+	}
+}
+
 func TestExtractLLAddressOrIdWithDUIDLLT(t *testing.T) {
 	builder := &PacketBuilder{}
 	expectedLLAddress := []byte{0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}
-	llAddress := builder.extractLLAddressOrID([]byte{0x0, 0x1, 0x0, 0x1, 0x1, 0x2, 0x3, 0x4, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37})
+	llAddress, err := builder.extractLLAddressOrID([]byte{0x0, 0x1, 0x0, 0x1, 0x1, 0x2, 0x3, 0x4, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 	if string(expectedLLAddress) != string(llAddress) {
 		t.Fatalf("Expected ll address %x, got: %x", expectedLLAddress, llAddress)
 	}
@@ -498,7 +570,10 @@ func TestExtractLLAddressOrIdWithDUIDLLT(t *testing.T) {
 func TestExtractLLAddressOrIdWithDUIDEN(t *testing.T) {
 	builder := &PacketBuilder{}
 	expectedID := []byte{0x0, 0x1, 0x2, 0x3, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}
-	id := builder.extractLLAddressOrID([]byte{0x0, 0x2, 0x0, 0x1, 0x2, 0x3, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37})
+	id, err := builder.extractLLAddressOrID([]byte{0x0, 0x2, 0x0, 0x1, 0x2, 0x3, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 	if string(expectedID) != string(id) {
 		t.Fatalf("Expected id %x, got: %x", expectedID, id)
 	}
@@ -507,8 +582,1270 @@ func TestExtractLLAddressOrIdWithDUIDEN(t *testing.T) {
 func TestExtractLLAddressOrIdWithDUIDLL(t *testing.T) {
 	builder := &PacketBuilder{}
 	expectedLLAddress := []byte{0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}
-	llAddress := builder.extractLLAddressOrID([]byte{0x0, 0x3, 0x0, 0x1, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37})
+	llAddress, err := builder.extractLLAddressOrID([]byte{0x0, 0x3, 0x0, 0x1, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 	if string(expectedLLAddress) != string(llAddress) {
 		t.Fatalf("Expected ll address %x, got: %x", expectedLLAddress, llAddress)
 	}
 }
+
+func TestExtractLLAddressOrIdWithDUIDUUID(t *testing.T) {
+	builder := &PacketBuilder{}
+	// Hand-built DUID-UUID, as UEFI firmware sends it, with the SMBIOS UUID 8b5a4f3e-2c1d-4b6a-9e8f-0a1b2c3d4e5f
+	expectedUUID := []byte{0x8b, 0x5a, 0x4f, 0x3e, 0x2c, 0x1d, 0x4b, 0x6a, 0x9e, 0x8f, 0x0a, 0x1b, 0x2c, 0x3d, 0x4e, 0x5f}
+	id, err := builder.extractLLAddressOrID([]byte{0x0, 0x4, 0x8b, 0x5a, 0x4f, 0x3e, 0x2c, 0x1d, 0x4b, 0x6a, 0x9e, 0x8f, 0x0a,
+		0x1b, 0x2c, 0x3d, 0x4e, 0x5f})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(expectedUUID) != string(id) {
+		t.Fatalf("Expected uuid %x, got: %x", expectedUUID, id)
+	}
+}
+
+func TestExtractLLAddressOrIdWithMalformedDUIDs(t *testing.T) {
+	builder := &PacketBuilder{}
+	for _, clientID := range [][]byte{
+		nil,
+		{0x0},
+		{0x0, 0x1, 0x0, 0x1, 0x1, 0x2},
+		{0x0, 0x3, 0x0},
+		{0x0, 0x4, 0x8b, 0x5a, 0x4f, 0x3e},
+		// DUID-UUIDs are exactly 18 bytes
+		{0x0, 0x4, 0x8b, 0x5a, 0x4f, 0x3e, 0x2c, 0x1d, 0x4b, 0x6a, 0x9e, 0x8f, 0x0a, 0x1b, 0x2c, 0x3d, 0x4e, 0x5f, 0x0},
+	} {
+		if id, err := builder.extractLLAddressOrID(clientID); err == nil {
+			t.Fatalf("Expected an error for malformed client id %x, got %x", clientID, id)
+		}
+	}
+}
+
+func TestIsHTTPClientArch(t *testing.T) {
+	httpArchs := map[uint16]bool{0x0f: true, 0x10: true, 0x11: true, 0x12: true, 0x13: true, 0x14: true, 0x17: true,
+		0x18: true, 0x1a: true, 0x1c: true, 0x1e: true, 0x26: true, 0x28: true}
+	for arch := uint16(0); arch <= 0x30; arch++ {
+		if isHTTPClientArch(arch) != httpArchs[arch] {
+			t.Errorf("Expected isHTTPClientArch(0x%x) to be %t", arch, httpArchs[arch])
+		}
+	}
+}
+
+func TestMakeMsgAdvertiseForHTTPClientArchs(t *testing.T) {
+	builder := MakePacketBuilder(90, 100)
+	expectedVendorClass := []byte{0, 0, 0, 0, 0, 10, 'H', 'T', 'T', 'P', 'C', 'l', 'i', 'e', 'n', 't'}
+
+	for _, arch := range []uint16{0x10, 0x13, 0x1c, 0x07} {
+		msg := builder.makeMsgAdvertise([3]byte{'t', 'i', 'd'}, []byte("serverid"), []byte("clientid"), arch,
+			[]*IdentityAssociation{}, []byte("http://bootfile"), nil, nil, nil)
+		vendorClass := msg.Options[OptVendorClass]
+		if !isHTTPClientArch(arch) {
+			if vendorClass != nil {
+				t.Errorf("Expected no vendor class option for arch 0x%x", arch)
+			}
+			continue
+		}
+		if vendorClass == nil || string(vendorClass[0].Value) != string(expectedVendorClass) {
+			t.Errorf("Expected HTTPClient vendor class option for arch 0x%x, got: %v", arch, vendorClass)
+		}
+	}
+}
+
+func TestMakeMsgReplyWithMultipleAddressesPerIA(t *testing.T) {
+	expectedIP1 := net.ParseIP("2001:db8:f00f:cafe::1")
+	expectedIP2 := net.ParseIP("2001:db8:f00f:cafe::2")
+	identityAssociation := &IdentityAssociation{IPAddress: expectedIP1, AdditionalIPAddresses: []net.IP{expectedIP2},
+		InterfaceID: []byte("id-1")}
+
+	builder := MakePacketBuilder(90, 100)
+
+	msg := builder.makeMsgReply([3]byte{'1', '2', '3'}, []byte("serverid"), []byte("clientid"), 0x11,
+		[]*IdentityAssociation{identityAssociation}, [][]byte{}, []byte("http://bootfileurl"), nil, nil, nil)
+
+	marshalled, err := msg.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal reply: %s", err)
+	}
+	options, err := UnmarshalOptions(marshalled[4:])
+	if err != nil {
+		t.Fatalf("Failed to unmarshal reply options: %s", err)
+	}
+	if len(options[OptIaNa]) != 1 {
+		t.Fatalf("Expected 1 identity association, got %d", len(options[OptIaNa]))
+	}
+	addresses := options.IaNaAddresses()
+	if len(addresses) != 2 {
+		t.Fatalf("Expected 2 addresses, got %d", len(addresses))
+	}
+	if !addresses[0].Equal(expectedIP1) || !addresses[1].Equal(expectedIP2) {
+		t.Fatalf("Expected addresses %s and %s, got %s and %s", expectedIP1, expectedIP2, addresses[0], addresses[1])
+	}
+}
+
+func TestMakeMsgReplyForRebind(t *testing.T) {
+	expectedClientID := []byte("clientid")
+	expectedServerID := []byte("serverid")
+	transactionID := [3]byte{'1', '2', '3'}
+	expectedIP := net.ParseIP("2001:db8:f00f:cafe::1")
+	identityAssociation := &IdentityAssociation{IPAddress: expectedIP, InterfaceID: []byte("id-1")}
+
+	builder := MakePacketBuilder(90, 100)
+
+	msg := builder.makeMsgReplyForRebind(transactionID, expectedServerID, expectedClientID,
+		[]*IdentityAssociation{identityAssociation}, [][]byte{[]byte("id-2")})
+
+	if msg.Type != MsgReply {
+		t.Fatalf("Expected message type %d, got %d", MsgReply, msg.Type)
+	}
+	if transactionID != msg.TransactionID {
+		t.Fatalf("Expected transaction ID %v, got %v", transactionID, msg.TransactionID)
+	}
+	if string(expectedClientID) != string(msg.Options.ClientID()) {
+		t.Fatalf("Expected Client id %v, got %v", expectedClientID, msg.Options.ClientID())
+	}
+	if string(expectedServerID) != string(msg.Options.ServerID()) {
+		t.Fatalf("Expected server id %v, got %v", expectedServerID, msg.Options.ServerID())
+	}
+
+	iaNaOption := msg.Options[OptIaNa]
+	if len(iaNaOption) != 2 {
+		t.Fatalf("Expected 2 identity associations, got %d", len(iaNaOption))
+	}
+	var okIaNaOption, failedIaNaOption []byte
+	if string(iaNaOption[0].Value[0:4]) == string("id-1") {
+		okIaNaOption = iaNaOption[0].Value
+		failedIaNaOption = iaNaOption[1].Value
+	} else {
+		okIaNaOption = iaNaOption[1].Value
+		failedIaNaOption = iaNaOption[0].Value
+	}
+
+	possiblyIaAddrOption, err := UnmarshalOption(okIaNaOption[12:])
+	if err != nil {
+		t.Fatalf("Failed to unmarshal IaNa options: %s", err)
+	}
+	if possiblyIaAddrOption.ID != OptIaAddr {
+		t.Fatalf("Expected option 5 (ia address), got %d", possiblyIaAddrOption.ID)
+	}
+	if string(possiblyIaAddrOption.Value[0:16]) != string(expectedIP) {
+		t.Fatalf("Expected address %v, got %v", expectedIP, net.IP(possiblyIaAddrOption.Value[0:16]))
+	}
+
+	possiblyStatusOption, err := UnmarshalOption(failedIaNaOption[12:])
+	if err != nil {
+		t.Fatalf("Failed to unmarshal IaNa options: %s", err)
+	}
+	if possiblyStatusOption.ID != OptStatusCode {
+		t.Fatalf("Expected option 13 (status code), got %d", possiblyStatusOption.ID)
+	}
+	if binary.BigEndian.Uint16(possiblyStatusOption.Value[0:2]) != StatusNoBinding {
+		t.Fatalf("Expected status code %d, got %d", StatusNoBinding, binary.BigEndian.Uint16(possiblyStatusOption.Value[0:2]))
+	}
+}
+
+func TestBuildResponseToRebindWithUnknownIAs(t *testing.T) {
+	clientID := []byte{0x0, 0x3, 0x0, 0x1, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, clientID))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0, MakeIaAddrOption(net.ParseIP("2001:db8:f00f:cafe::1"), 0, 0)))
+	rebind := &Packet{Type: MsgRebind, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	builder := MakePacketBuilder(90, 100)
+
+	msg, err := builder.BuildResponse(rebind, []byte("serverid"), nil, &fakeAddressPool{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg == nil {
+		t.Fatalf("Expected a reply to rebind, got nothing")
+	}
+	if msg.Type != MsgReply {
+		t.Fatalf("Expected message type %d, got %d", MsgReply, msg.Type)
+	}
+	if _, err := msg.Marshal(); err != nil {
+		t.Fatalf("Failed to marshal reply: %s", err)
+	}
+	iaNaOption := msg.Options[OptIaNa]
+	if len(iaNaOption) != 1 {
+		t.Fatalf("Expected 1 identity association, got %d", len(iaNaOption))
+	}
+	statusOption, err := UnmarshalOption(iaNaOption[0].Value[12:])
+	if err != nil {
+		t.Fatalf("Failed to unmarshal IaNa options: %s", err)
+	}
+	if statusOption.ID != OptStatusCode || binary.BigEndian.Uint16(statusOption.Value[0:2]) != StatusNoBinding {
+		t.Fatalf("Expected NoBinding status for unknown IA, got option %d: %v", statusOption.ID, statusOption.Value)
+	}
+}
+
+func TestBuildResponseToRenew(t *testing.T) {
+	clientID := []byte{0x0, 0x3, 0x0, 0x1, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}
+	expectedIP := net.ParseIP("2001:db8:f00f:cafe::1")
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, clientID))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0, MakeIaAddrOption(expectedIP, 0, 0)))
+	options.Add(MakeIaNaOption([]byte("id-2"), 0, 0, MakeIaAddrOption(net.ParseIP("2001:db8:f00f:cafe::2"), 0, 0)))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	renew := &Packet{Type: MsgRenew, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+	addresses := &fakeAddressPool{associations: []*IdentityAssociation{
+		{IPAddress: expectedIP, ClientID: clientID, InterfaceID: []byte("id-1")},
+	}}
+
+	builder := MakePacketBuilder(90, 100)
+
+	msg, err := builder.BuildResponse(renew, []byte("serverid"), nil, addresses)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg.Type != MsgReply {
+		t.Fatalf("Expected message type %d, got %d", MsgReply, msg.Type)
+	}
+
+	for _, iaNaOption := range msg.Options[OptIaNa] {
+		iaOption, err := UnmarshalOption(iaNaOption.Value[12:])
+		if err != nil {
+			t.Fatalf("Failed to unmarshal IaNa options: %s", err)
+		}
+		switch string(iaNaOption.Value[0:4]) {
+		case "id-1":
+			if iaOption.ID != OptIaAddr {
+				t.Fatalf("Expected option 5 (ia address), got %d", iaOption.ID)
+			}
+			if t1 := binary.BigEndian.Uint32(iaNaOption.Value[4:8]); t1 != builder.calculateT1() {
+				t.Fatalf("Expected t1 of %d, got %d", builder.calculateT1(), t1)
+			}
+			if validLifetime := binary.BigEndian.Uint32(iaOption.Value[20:24]); validLifetime != 100 {
+				t.Fatalf("Expected valid lifetime of 100, got %d", validLifetime)
+			}
+		case "id-2":
+			if iaOption.ID != OptStatusCode || binary.BigEndian.Uint16(iaOption.Value[0:2]) != StatusNoBinding {
+				t.Fatalf("Expected NoBinding status for unknown IA, got option %d: %v", iaOption.ID, iaOption.Value)
+			}
+		default:
+			t.Fatalf("Unexpected identity association %x", iaNaOption.Value[0:4])
+		}
+	}
+	if len(msg.Options[OptIaNa]) != 2 {
+		t.Fatalf("Expected 2 identity associations, got %d", len(msg.Options[OptIaNa]))
+	}
+}
+
+func TestBuildResponseWrapsPoolExhaustedError(t *testing.T) {
+	transactionID := [3]byte{'1', '2', '3'}
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptIaNa, []byte{'i', 'd', '-', '1', 0, 0, 0, 0, 0, 0, 0, 0}))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+	addresses := &fakeAddressPool{reserveErr: ErrPoolExhausted}
+
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest} {
+		in := &Packet{Type: msgType, TransactionID: transactionID, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, addresses)
+		if !errors.Is(err, ErrPoolExhausted) {
+			t.Fatalf("Expected error wrapping ErrPoolExhausted for message type %d, got %v", msgType, err)
+		}
+		if msg == nil {
+			t.Fatalf("Expected a response notifying the client for message type %d, got nothing", msgType)
+		}
+	}
+}
+
+func TestBuildResponseAddsBootParams(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte{0x0, 0x3, 0x0, 0x1, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	options.Add(MakeOption(OptIaNa, []byte{'i', 'd', '-', '1', 0, 0, 0, 0, 0, 0, 0, 0}))
+	expectedParams := MakeBootfileParamOption([]string{"console=ttyS0", "root=/dev/nfs"})
+	addresses := &fakeAddressPool{associations: []*IdentityAssociation{
+		{IPAddress: net.ParseIP("2001:db8:f00f:cafe::1"), InterfaceID: []byte("id-1")}}}
+
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl"),
+			bootParams: []string{"console=ttyS0", "root=/dev/nfs"}}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, addresses)
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		params := msg.Options[OptBootfileParam]
+		if len(params) != 1 || string(params[0].Value) != string(expectedParams.Value) {
+			t.Fatalf("Expected boot file parameters %v for message type %d, got %v", expectedParams, msgType, params)
+		}
+
+		// a new exchange, not a retransmission answered from the Advertise cache
+		in = &Packet{Type: msgType, TransactionID: [3]byte{'4', '5', '6'}, Options: options}
+		configuration.bootParams = nil
+		msg, err = builder.BuildResponse(in, []byte("serverid"), configuration, addresses)
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		if _, exists := msg.Options[OptBootfileParam]; exists {
+			t.Fatalf("Expected no boot file parameters option for message type %d without parameters", msgType)
+		}
+	}
+}
+
+func TestBuildResponseAddsAlternateBootURLs(t *testing.T) {
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://boot/script.ipxe"),
+		alternateURLs: [][]byte{[]byte("http://boot/ipxe.efi"), []byte(strings.Repeat("x", 256)), []byte("http://boot/snp.efi")}}
+	builder := MakePacketBuilder(90, 100)
+
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		if url := msg.Options.BootFileURL(); string(url) != "http://boot/script.ipxe" {
+			t.Fatalf("Expected primary boot file url %q for message type %d, got %q", "http://boot/script.ipxe", msgType, url)
+		}
+		// the overlong alternate is left out
+		alternates := msg.Options.AlternateBootFileURLs()
+		if len(alternates) != 2 || string(alternates[0]) != "http://boot/ipxe.efi" || string(alternates[1]) != "http://boot/snp.efi" {
+			t.Fatalf("Expected alternate boot file urls [http://boot/ipxe.efi http://boot/snp.efi] for message type %d, got %q",
+				msgType, alternates)
+		}
+	}
+
+	configuration.alternateURLs = nil
+	in := &Packet{Type: MsgInformationRequest, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+	msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg.Options[OptVendorOpts] != nil {
+		t.Fatalf("Expected no vendor-specific information option without alternate urls")
+	}
+}
+
+func TestBuildResponseAddsClientFQDN(t *testing.T) {
+	mac := []byte{0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, append([]byte{0x0, 0x3, 0x0, 0x1}, mac...)))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	options.Add(MakeOption(OptIaNa, []byte{'i', 'd', '-', '1', 0, 0, 0, 0, 0, 0, 0, 0}))
+	options.Add(MakeOption(OptOro, []byte{0, OptClientFQDN}))
+	options.Add(MakeClientFQDNOption("", FQDNFlagS))
+	addresses := &fakeAddressPool{associations: []*IdentityAssociation{
+		{IPAddress: net.ParseIP("2001:db8:f00f:cafe::1"), InterfaceID: []byte("id-1")}}}
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl"),
+		hostnames: map[string]string{string(mac): "node1.example.com"}}
+
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, addresses)
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		flags, name, ok := msg.Options.ClientFQDN()
+		if !ok || name != "node1.example.com." {
+			t.Fatalf("Expected hostname %q for message type %d, got %q (ok %t)", "node1.example.com.", msgType, name, ok)
+		}
+		if flags != FQDNFlagN|FQDNFlagO {
+			t.Fatalf("Expected flags N and O for message type %d, got %d", msgType, flags)
+		}
+	}
+
+	// clients that don't send the option don't get one back
+	delete(options, OptClientFQDN)
+	in := &Packet{Type: MsgInformationRequest, TransactionID: [3]byte{'4', '5', '6'}, Options: options}
+	msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, addresses)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, exists := msg.Options[OptClientFQDN]; exists {
+		t.Fatalf("Expected no Client FQDN option for a client that didn't send one")
+	}
+}
+
+func TestMakeMsgConfirmReply(t *testing.T) {
+	transactionID := [3]byte{'1', '2', '3'}
+	_, prefix, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	addresses := &fakeAddressPool{prefix: prefix}
+
+	builder := MakePacketBuilder(90, 100)
+
+	msg := builder.makeMsgConfirmReply(transactionID, []byte("serverid"), []byte("clientid"),
+		[]net.IP{net.ParseIP("2001:db8:f00f:cafe::1"), net.ParseIP("2001:db8:f00f:cafe::2")}, addresses)
+	if msg.Type != MsgReply {
+		t.Fatalf("Expected message type %d, got %d", MsgReply, msg.Type)
+	}
+	if string(msg.Options.ClientID()) != "clientid" {
+		t.Fatalf("Expected client id %s, got %s", "clientid", msg.Options.ClientID())
+	}
+	if string(msg.Options.ServerID()) != "serverid" {
+		t.Fatalf("Expected server id %s, got %s", "serverid", msg.Options.ServerID())
+	}
+	if status := binary.BigEndian.Uint16(msg.Options[OptStatusCode][0].Value[0:2]); status != StatusSuccess {
+		t.Fatalf("Expected status code %d, got %d", StatusSuccess, status)
+	}
+
+	msg = builder.makeMsgConfirmReply(transactionID, []byte("serverid"), []byte("clientid"),
+		[]net.IP{net.ParseIP("2001:db8:f00f:cafe::1"), net.ParseIP("2001:db8:f00f:beef::1")}, addresses)
+	if status := binary.BigEndian.Uint16(msg.Options[OptStatusCode][0].Value[0:2]); status != StatusNotOnLink {
+		t.Fatalf("Expected status code %d, got %d", StatusNotOnLink, status)
+	}
+}
+
+func TestBuildResponseToConfirm(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0, MakeIaAddrOption(net.ParseIP("2001:db8:f00f:beef::1"), 0, 0)))
+	confirm := &Packet{Type: MsgConfirm, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	builder := MakePacketBuilder(90, 100)
+
+	msg, err := builder.BuildResponse(confirm, []byte("serverid"), nil, &fakeAddressPool{prefix: prefix})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg == nil {
+		t.Fatalf("Expected a reply to confirm, got nothing")
+	}
+	if len(msg.Options[OptIaNa]) != 0 {
+		t.Fatalf("Expected no identity associations in reply to confirm, got %d", len(msg.Options[OptIaNa]))
+	}
+	if status := binary.BigEndian.Uint16(msg.Options[OptStatusCode][0].Value[0:2]); status != StatusNotOnLink {
+		t.Fatalf("Expected status code %d, got %d", StatusNotOnLink, status)
+	}
+}
+
+func TestStatusCodeOfBuiltResponses(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+	builder := MakePacketBuilder(90, 100)
+	builder.PrefixPool = &fakePrefixPool{}
+
+	packet := func(msgType MessageType, options ...*Option) *Packet {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: make(Options)}
+		in.Options.Add(MakeOption(OptClientID, []byte("clientid")))
+		if isAddressedToServer(msgType) {
+			in.Options.Add(MakeOption(OptServerID, []byte("serverid")))
+		}
+		for _, option := range options {
+			in.Options.Add(option)
+		}
+		return in
+	}
+
+	for _, tc := range []struct {
+		name         string
+		in           *Packet
+		addresses    *fakeAddressPool
+		expectedCode uint16
+	}{
+		{"advertise without addresses", packet(MsgSolicit, MakeIaNaOption([]byte("id-1"), 0, 0)),
+			&fakeAddressPool{reserveErr: ErrPoolExhausted}, StatusNoAddrsAvail},
+		{"reply without addresses", packet(MsgRequest, MakeIaNaOption([]byte("id-1"), 0, 0)),
+			&fakeAddressPool{reserveErr: ErrPoolExhausted}, StatusNoAddrsAvail},
+		{"renew without binding", packet(MsgRenew, MakeIaNaOption([]byte("id-1"), 0, 0)),
+			&fakeAddressPool{}, StatusNoBinding},
+		{"rebind without binding", packet(MsgRebind, MakeIaNaOption([]byte("id-1"), 0, 0)),
+			&fakeAddressPool{}, StatusNoBinding},
+		{"advertise without prefixes", packet(MsgSolicit, MakeIaPdOption([]byte("pd-1"), 0, 0)),
+			&fakeAddressPool{}, StatusNoPrefixAvail},
+		{"release", packet(MsgRelease, MakeIaNaOption([]byte("id-1"), 0, 0)),
+			&fakeAddressPool{}, StatusSuccess},
+		{"confirm on link", packet(MsgConfirm, MakeIaNaOption([]byte("id-1"), 0, 0,
+			MakeIaAddrOption(net.ParseIP("2001:db8:f00f:cafe::1"), 0, 0))), &fakeAddressPool{prefix: prefix}, StatusSuccess},
+		{"confirm not on link", packet(MsgConfirm, MakeIaNaOption([]byte("id-1"), 0, 0,
+			MakeIaAddrOption(net.ParseIP("2001:db8:f00f:beef::1"), 0, 0))), &fakeAddressPool{prefix: prefix}, StatusNotOnLink},
+	} {
+		msg, _ := builder.BuildResponse(tc.in, []byte("serverid"), configuration, tc.addresses)
+		if msg == nil {
+			t.Fatalf("%s: expected a response, got nothing", tc.name)
+		}
+		bs, err := msg.Marshal()
+		if err != nil {
+			t.Fatalf("%s: error marshalling response: %s", tc.name, err)
+		}
+		parsed, err := ParsePacket(bs)
+		if err != nil {
+			t.Fatalf("%s: error parsing response: %s", tc.name, err)
+		}
+		code, statusMsg, ok := parsed.Options.StatusCode()
+		if !ok {
+			t.Fatalf("%s: expected a status code, got none", tc.name)
+		}
+		if code != tc.expectedCode {
+			t.Fatalf("%s: expected status code %d, got %d (%q)", tc.name, tc.expectedCode, code, statusMsg)
+		}
+		if statusMsg == "" {
+			t.Fatalf("%s: expected a status message", tc.name)
+		}
+	}
+}
+
+func TestBuildResponseToConfirmWithoutAddresses(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	confirm := &Packet{Type: MsgConfirm, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	builder := MakePacketBuilder(90, 100)
+
+	msg, err := builder.BuildResponse(confirm, []byte("serverid"), nil, &fakeAddressPool{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg != nil {
+		t.Fatalf("Expected confirm without addresses to be ignored, got %v", msg)
+	}
+}
+
+func TestBuildResponseIgnoresMessagesForOtherServers(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("otherserverid")))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0, MakeIaAddrOption(net.ParseIP("2001:db8:f00f:cafe::1"), 0, 0)))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgRequest, MsgRenew, MsgRelease} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		if msg != nil {
+			t.Fatalf("Expected message type %d addressed to another server to be ignored, got %v", msgType, msg)
+		}
+	}
+}
+
+func TestBuildResponseToSolicitWithIaPd(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1200::/56")
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeIaPdOption([]byte("pd-1"), 0, 0))
+	options.Add(MakeIaPdOption([]byte("pd-2"), 0, 0))
+	solicit := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+
+	builder := MakePacketBuilder(90, 100)
+	builder.PrefixPool = &fakePrefixPool{delegations: []*PrefixDelegation{
+		{Prefix: prefix, ClientID: []byte("clientid"), InterfaceID: []byte("pd-1")},
+	}}
+
+	msg, err := builder.BuildResponse(solicit, []byte("serverid"), configuration, &fakeAddressPool{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(msg.Options[OptIaPd]) != 2 {
+		t.Fatalf("Expected 2 prefix delegation identity associations, got %d", len(msg.Options[OptIaPd]))
+	}
+	for _, iaPdOption := range msg.Options[OptIaPd] {
+		iaPdSubOption, err := UnmarshalOption(iaPdOption.Value[12:])
+		if err != nil {
+			t.Fatalf("Failed to unmarshal IaPd options: %s", err)
+		}
+		switch string(iaPdOption.Value[0:4]) {
+		case "pd-1":
+			if iaPdSubOption.ID != OptIaPrefix {
+				t.Fatalf("Expected option 26 (ia prefix), got %d", iaPdSubOption.ID)
+			}
+		case "pd-2":
+			if iaPdSubOption.ID != OptStatusCode || binary.BigEndian.Uint16(iaPdSubOption.Value[0:2]) != StatusNoPrefixAvail {
+				t.Fatalf("Expected NoPrefixAvail status for IA_PD without prefix, got option %d: %v", iaPdSubOption.ID, iaPdSubOption.Value)
+			}
+		default:
+			t.Fatalf("Unexpected prefix delegation identity association %x", iaPdOption.Value[0:4])
+		}
+	}
+	if prefixes := msg.Options.IaPdPrefixes(); len(prefixes) != 1 || prefixes[0].String() != prefix.String() {
+		t.Fatalf("Expected delegated prefix %s, got %v", prefix, prefixes)
+	}
+}
+
+func TestBuildResponseFailsForOverlongBootURL(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl/" + strings.Repeat("a", 300))}
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err == nil || msg != nil {
+			t.Fatalf("Expected an error and no response for message type %d, got %v, %v", msgType, msg, err)
+		}
+		if !strings.Contains(err.Error(), "319 bytes long") {
+			t.Fatalf("Expected the error to give the URL length, got %q", err)
+		}
+	}
+
+	builder.MaxBootFileURLLength = 1024
+	in := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'4', '5', '6'}, Options: options}
+	if _, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{}); err != nil {
+		t.Fatalf("Unexpected error with a raised maximum length: %s", err)
+	}
+
+	configuration.bootURL = make([]byte, maxOptionLength+1)
+	builder.MaxBootFileURLLength = maxOptionLength + 10
+	in = &Packet{Type: MsgSolicit, TransactionID: [3]byte{'7', '8', '9'}, Options: options}
+	if _, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{}); err == nil {
+		t.Fatalf("Expected an error for a URL that doesn't fit in an option")
+	}
+}
+
+func TestBuildResponseWithoutAddressPool(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+	builder := MakePacketBuilder(90, 100)
+
+	in := &Packet{Type: MsgInformationRequest, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+	msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg == nil || msg.Type != MsgReply {
+		t.Fatalf("Expected a Reply to an Information-request, got %v", msg)
+	}
+	if string(msg.Options.ServerID()) != "serverid" || string(msg.Options[OptBootfileURL][0].Value) != "http://bootfileurl" {
+		t.Fatalf("Expected the server id and boot file url in the response, got %v", msg.Options)
+	}
+	if len(msg.Options.IaNaAddresses()) != 0 {
+		t.Fatalf("Expected no addresses in the response, got %v", msg.Options.IaNaAddresses())
+	}
+
+	withServerID := make(Options)
+	withServerID.Add(MakeOption(OptClientID, []byte("clientid")))
+	withServerID.Add(MakeOption(OptServerID, []byte("serverid")))
+	withServerID.Add(MakeIaNaOption([]byte("id-1"), 0, 0))
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgRenew, MsgRebind, MsgRelease, MsgConfirm} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'4', '5', '6'}, Options: withServerID}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, nil)
+		if err != nil || msg != nil {
+			t.Fatalf("Expected message type %d to be dropped without an address pool, got %v, %v", msgType, msg, err)
+		}
+	}
+}
+
+func TestBuildResponseIncludesNTPServers(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	options.Add(MakeOption(OptOro, []byte{0, OptNTPServer}))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl"),
+		ntpServers: []net.IP{net.ParseIP("2001:db8::123")}}
+
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		if len(msg.Options[OptNTPServer]) != 1 {
+			t.Fatalf("Expected NTP server option in response to message type %d", msgType)
+		}
+	}
+
+	configuration.ntpServers = nil
+	in := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'4', '5', '6'}, Options: options}
+	msg, _ := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+	if _, exists := msg.Options[OptNTPServer]; exists {
+		t.Fatalf("Expected no NTP server option without NTP servers")
+	}
+}
+
+func TestBuildResponseIncludesDNSSearchList(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	options.Add(MakeOption(OptOro, []byte{0, OptDomainList}))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl"), dnsSearchList: []string{"example.com"}}
+
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		if len(msg.Options[OptDomainList]) != 1 {
+			t.Fatalf("Expected domain search list option in response to message type %d", msgType)
+		}
+	}
+
+	configuration.dnsSearchList = nil
+	in := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'4', '5', '6'}, Options: options}
+	msg, _ := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+	if _, exists := msg.Options[OptDomainList]; exists {
+		t.Fatalf("Expected no domain search list option with an empty list")
+	}
+}
+
+func TestBuildResponseIncludesClientSpecificDNSServers(t *testing.T) {
+	configuration := &fakeBootConfiguration{
+		bootURL: []byte("http://bootfileurl"),
+		dnsServers: map[string][]net.IP{
+			"\x01\x02\x03\x04\x05\x06": {net.ParseIP("2001:db8::53")},
+			"\x0a\x0b\x0c\x0d\x0e\x0f": {net.ParseIP("2001:db8:1::53"), net.ParseIP("2001:db8:1::54")},
+		},
+	}
+	builder := MakePacketBuilder(90, 100)
+
+	for _, tc := range []struct {
+		clientID   []byte
+		dnsServers []net.IP
+	}{
+		{[]byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6}, []net.IP{net.ParseIP("2001:db8::53")}},
+		{[]byte{0, 3, 0, 1, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf}, []net.IP{net.ParseIP("2001:db8:1::53"), net.ParseIP("2001:db8:1::54")}},
+	} {
+		options := make(Options)
+		options.Add(MakeOption(OptClientID, tc.clientID))
+		options.Add(MakeOption(OptServerID, []byte("serverid")))
+		options.Add(MakeOption(OptOro, []byte{0, OptRecursiveDNS}))
+		for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+			in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+			msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+			if err != nil {
+				t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+			}
+			dnsOption := msg.Options[OptRecursiveDNS]
+			if len(dnsOption) != 1 || !bytes.Equal(dnsOption[0].Value, MakeDNSServersOption(tc.dnsServers).Value) {
+				t.Fatalf("Expected DNS servers %v for client %x in response to message type %d, got %v",
+					tc.dnsServers, tc.clientID, msgType, dnsOption)
+			}
+		}
+	}
+}
+
+func TestBuildResponseStrictTransactionID(t *testing.T) {
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+	builder := MakePacketBuilder(90, 100)
+
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err != nil || msg == nil {
+			t.Fatalf("Expected message type %d with a zero transaction ID to be answered by default, got %v, %v",
+				msgType, msg, err)
+		}
+	}
+
+	builder = MakePacketBuilder(90, 100)
+	builder.StrictTransactionID = true
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err == nil || msg != nil {
+			t.Fatalf("Expected an error and no response for message type %d with a zero transaction ID, got %v, %v",
+				msgType, msg, err)
+		}
+
+		in = &Packet{Type: msgType, TransactionID: [3]byte{0, 0, 1}, Options: options}
+		msg, err = builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err != nil || msg == nil {
+			t.Fatalf("Expected message type %d with a non-zero transaction ID to be answered, got %v, %v", msgType, msg, err)
+		}
+	}
+}
+
+func TestBuildResponseWithoutDNSServersOnDNSError(t *testing.T) {
+	dnsErr := errors.New("backend unavailable")
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl"), dnsErr: dnsErr}
+	builder := MakePacketBuilder(90, 100)
+
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	options.Add(MakeOption(OptOro, []byte{0, OptRecursiveDNS}))
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if !errors.Is(err, dnsErr) {
+			t.Fatalf("Expected error wrapping %q for message type %d, got %v", dnsErr, msgType, err)
+		}
+		if msg == nil {
+			t.Fatalf("Expected a response to message type %d despite the DNS error", msgType)
+		}
+		if url := msg.Options.BootFileURL(); string(url) != "http://bootfileurl" {
+			t.Fatalf("Expected boot file url %q for message type %d, got %q", "http://bootfileurl", msgType, url)
+		}
+		if msg.Options[OptRecursiveDNS] != nil {
+			t.Fatalf("Expected no DNS servers option for message type %d, got %v", msgType, msg.Options[OptRecursiveDNS])
+		}
+	}
+
+	builder.FailOnDNSError = true
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'4', '5', '6'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if !errors.Is(err, dnsErr) || msg != nil {
+			t.Fatalf("Expected an error and no response for message type %d, got %v, %v", msgType, msg, err)
+		}
+	}
+}
+
+func TestBuildResponseBootsBIOSClientsOverTFTP(t *testing.T) {
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl"),
+		tftpServer: net.ParseIP("2001:db8::69"), tftpBootFile: "undionly.kpxe"}
+	builder := MakePacketBuilder(90, 100)
+
+	for _, tc := range []struct {
+		arch        byte
+		bootFileURL string
+	}{
+		{0x00, "tftp://[2001:db8::69]/undionly.kpxe"},
+		{0x07, "http://bootfileurl"},
+	} {
+		options := make(Options)
+		options.Add(MakeOption(OptClientID, []byte("clientid")))
+		options.Add(MakeOption(OptServerID, []byte("serverid")))
+		options.Add(MakeOption(OptClientArchType, []byte{0, tc.arch}))
+		for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+			in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', tc.arch}, Options: options}
+			msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+			if err != nil {
+				t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+			}
+			if got := string(msg.Options.BootFileURL()); got != tc.bootFileURL {
+				t.Fatalf("Expected boot file url %q for arch %#x in response to message type %d, got %q",
+					tc.bootFileURL, tc.arch, msgType, got)
+			}
+		}
+	}
+
+	configuration.tftpServer = net.ParseIP("192.0.2.69")
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptClientArchType, []byte{0, 0}))
+	in := &Packet{Type: MsgInformationRequest, TransactionID: [3]byte{'4', '5', '6'}, Options: options}
+	if _, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{}); err == nil {
+		t.Fatalf("Expected an error for an IPv4 TFTP server")
+	}
+}
+
+func TestBuildResponseOmitsOptionsNotRequested(t *testing.T) {
+	clientID := []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6}
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, clientID))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	options.Add(MakeOption(OptOro, []byte{0, OptRecursiveDNS}))
+	configuration := &fakeBootConfiguration{
+		bootURL:       []byte("http://bootfileurl"),
+		dnsServers:    map[string][]net.IP{"\x01\x02\x03\x04\x05\x06": {net.ParseIP("2001:db8::53")}},
+		dnsSearchList: []string{"example.com"},
+		ntpServers:    []net.IP{net.ParseIP("2001:db8::123")},
+	}
+
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		if len(msg.Options[OptRecursiveDNS]) != 1 {
+			t.Fatalf("Expected the requested DNS servers option in response to message type %d", msgType)
+		}
+		if _, exists := msg.Options[OptNTPServer]; exists {
+			t.Fatalf("Expected no NTP server option in response to message type %d, it wasn't requested", msgType)
+		}
+		if _, exists := msg.Options[OptDomainList]; exists {
+			t.Fatalf("Expected no domain search list option in response to message type %d, it wasn't requested", msgType)
+		}
+		if !bytes.Equal(msg.Options.ClientID(), clientID) || msg.Options.BootFileURL() == nil {
+			t.Fatalf("Expected mandatory options in response to message type %d, got %v", msgType, msg.Options)
+		}
+	}
+}
+
+func TestBuildResponseIncludesClientSpecificPreference(t *testing.T) {
+	configuration := &fakeBootConfiguration{
+		bootURL: []byte("http://bootfileurl"),
+		preferences: map[string][]byte{
+			"\x01\x02\x03\x04\x05\x06": {255},
+			"\x0a\x0b\x0c\x0d\x0e\x0f": {10},
+		},
+	}
+	builder := MakePacketBuilder(90, 100)
+
+	for _, tc := range []struct {
+		clientID   []byte
+		preference []byte
+	}{
+		{[]byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6}, []byte{255}},
+		{[]byte{0, 3, 0, 1, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf}, []byte{10}},
+		{[]byte{0, 3, 0, 1, 0xf, 0xe, 0xd, 0xc, 0xb, 0xa}, nil},
+	} {
+		options := make(Options)
+		options.Add(MakeOption(OptClientID, tc.clientID))
+		in := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+		if err != nil {
+			t.Fatalf("Unexpected error for client %x: %s", tc.clientID, err)
+		}
+		preference, exists := msg.Options[OptPreference]
+		if tc.preference == nil {
+			if exists {
+				t.Fatalf("Expected no preference option for client %x, got %v", tc.clientID, preference)
+			}
+			continue
+		}
+		if len(preference) != 1 || !bytes.Equal(preference[0].Value, tc.preference) {
+			t.Fatalf("Expected preference %v for client %x, got %v", tc.preference, tc.clientID, preference)
+		}
+	}
+}
+
+func TestBuildResponseToRetransmittedSolicit(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+	addresses := &countingAddressPool{next: net.ParseIP("2001:db8:f00f:cafe::1")}
+	builder := MakePacketBuilder(90, 100)
+
+	solicit := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+	first, err := builder.BuildResponse(solicit, []byte("serverid"), configuration, addresses)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// responses can be changed by the caller, e.g. to add options, without affecting retransmissions
+	first.Options.Add(MakeOption(OptReconfAccept, nil))
+
+	retransmitted := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+	second, err := builder.BuildResponse(retransmitted, []byte("serverid"), configuration, addresses)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if addresses.reservations != 1 {
+		t.Fatalf("Expected addresses to be reserved once, got %d reservations", addresses.reservations)
+	}
+	if firstIPs, secondIPs := first.Options.IaNaAddresses(), second.Options.IaNaAddresses(); len(firstIPs) != 1 ||
+		len(secondIPs) != 1 || !firstIPs[0].Equal(secondIPs[0]) {
+		t.Fatalf("Expected the same address in both Advertise messages, got %v and %v", firstIPs, secondIPs)
+	}
+	if second.Options.HasReconfigureAccept() {
+		t.Fatalf("Option added to the first Advertise leaked into the retransmitted one")
+	}
+
+	next := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'4', '5', '6'}, Options: options}
+	if _, err := builder.BuildResponse(next, []byte("serverid"), configuration, addresses); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if addresses.reservations != 2 {
+		t.Fatalf("Expected a Solicit with a new transaction id to reserve addresses again")
+	}
+}
+
+func TestBuildResponseToRapidCommitSolicit(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0))
+	options.Add(MakeOption(OptRapidCommit, nil))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+
+	for _, test := range []struct {
+		rapidCommit  bool
+		expectedType MessageType
+	}{
+		{false, MsgAdvertise},
+		{true, MsgReply},
+	} {
+		addresses := &countingAddressPool{next: net.ParseIP("2001:db8:f00f:cafe::1")}
+		builder := MakePacketBuilder(90, 100)
+		builder.RapidCommit = test.rapidCommit
+
+		solicit := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(solicit, []byte("serverid"), configuration, addresses)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if msg.Type != test.expectedType {
+			t.Fatalf("Expected message type %d with rapid commit %t, got %d", test.expectedType, test.rapidCommit, msg.Type)
+		}
+		if msg.Options.HasRapidCommit() != test.rapidCommit {
+			t.Fatalf("Expected rapid commit option in the response: %t", test.rapidCommit)
+		}
+		if addresses.reservations != 1 || len(msg.Options.IaNaAddresses()) != 1 {
+			t.Fatalf("Expected an address to be reserved and handed out, got %v", msg.Options.IaNaAddresses())
+		}
+		if string(msg.Options.ServerID()) != "serverid" || string(msg.Options[OptBootfileURL][0].Value) != "http://bootfileurl" {
+			t.Fatalf("Expected the server id and boot file url in the response, got %v", msg.Options)
+		}
+	}
+}
+
+func TestBuildResponsePassesRelayLinkAddress(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+	expectedIP := net.ParseIP("2001:db8:f00f:cafe::1")
+
+	for _, test := range []struct {
+		name             string
+		relays           []*RelayMessage
+		expectedLinkAddr net.IP
+	}{
+		{"not relayed", nil, nil},
+		{"relayed", []*RelayMessage{
+			{Type: MsgRelayForw, LinkAddress: net.IPv6unspecified, PeerAddress: net.ParseIP("2001:db8:1::1")},
+			{Type: MsgRelayForw, HopCount: 1, LinkAddress: net.ParseIP("2001:db8:2::1"), PeerAddress: net.ParseIP("fe80::1")},
+		}, net.ParseIP("2001:db8:2::1")},
+		{"relayed from an unknown link", []*RelayMessage{
+			{Type: MsgRelayForw, LinkAddress: net.IPv6unspecified, PeerAddress: net.ParseIP("fe80::1")},
+		}, nil},
+	} {
+		addresses := &fakeAddressPool{associations: []*IdentityAssociation{{IPAddress: expectedIP,
+			InterfaceID: []byte("id-1")}}}
+		builder := MakePacketBuilder(90, 100)
+		solicit := &Packet{Type: MsgSolicit, TransactionID: [3]byte{'1', '2', '3'}, Options: options, Relays: test.relays}
+		if _, err := builder.BuildResponse(solicit, []byte("serverid"), configuration, addresses); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if !addresses.linkAddr.Equal(test.expectedLinkAddr) {
+			t.Fatalf("%s: expected addresses reserved for link %s, got %s", test.name, test.expectedLinkAddr,
+				addresses.linkAddr)
+		}
+	}
+}
+
+func TestBuildResponseAddsServerUnicast(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+	unicastAddr := net.ParseIP("2001:db8:f00f:cafe::4")
+	relays := []*RelayMessage{{Type: MsgRelayForw, LinkAddress: net.ParseIP("2001:db8:1::1"),
+		PeerAddress: net.ParseIP("fe80::1")}}
+
+	for _, test := range []struct {
+		name            string
+		address         net.IP
+		relays          []*RelayMessage
+		expectedUnicast net.IP
+	}{
+		{"not configured", nil, nil, nil},
+		{"direct", unicastAddr, nil, unicastAddr},
+		{"relayed", unicastAddr, relays, nil},
+	} {
+		builder := MakePacketBuilder(90, 100)
+		builder.ServerUnicastAddress = test.address
+		for _, msgType := range []MessageType{MsgSolicit, MsgRequest} {
+			addresses := &fakeAddressPool{associations: []*IdentityAssociation{{
+				IPAddress: net.ParseIP("2001:db8:f00f:cafe::1"), InterfaceID: []byte("id-1")}}}
+			in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options, Relays: test.relays}
+			msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, addresses)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", test.name, err)
+			}
+			if unicast := msg.Options.ServerUnicast(); !unicast.Equal(test.expectedUnicast) {
+				t.Fatalf("%s: expected server unicast address %s in response to message type %d, got %s",
+					test.name, test.expectedUnicast, msgType, unicast)
+			}
+		}
+	}
+}
+
+func TestAdvertiseCacheIsBounded(t *testing.T) {
+	var cache advertiseCache
+	advertise := &Packet{Type: MsgAdvertise, Options: make(Options)}
+	solicit := func(i int) *Packet {
+		options := make(Options)
+		options.Add(MakeOption(OptClientID, []byte(fmt.Sprintf("client-%d", i))))
+		return &Packet{Type: MsgSolicit, Options: options}
+	}
+	for i := 0; i < advertiseCacheSize+1; i++ {
+		cache.add(solicit(i), advertise)
+	}
+	if cache.order.Len() != advertiseCacheSize || len(cache.entries) != advertiseCacheSize {
+		t.Fatalf("Expected %d cached Advertise messages, got %d", advertiseCacheSize, cache.order.Len())
+	}
+	if cache.get(solicit(0)) != nil {
+		t.Fatalf("Expected the least recently used Advertise to be evicted")
+	}
+	if cache.get(solicit(advertiseCacheSize)) == nil {
+		t.Fatalf("Expected the most recent Advertise to be cached")
+	}
+}
+
+// countingAddressPool hands out a fresh address on every reservation
+type countingAddressPool struct {
+	fakeAddressPool
+	next         net.IP
+	reservations int
+}
+
+func (p *countingAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]byte) ([]*IdentityAssociation, error) {
+	p.reservations++
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.next)
+	p.next[15]++
+	return []*IdentityAssociation{{IPAddress: ip, ClientID: clientID, InterfaceID: interfaceIDs[0]}}, nil
+}
+
+func (p *countingAddressPool) ReserveAddressesForLink(linkAddr net.IP, clientID []byte, interfaceIDs [][]byte) ([]*IdentityAssociation, error) {
+	return p.ReserveAddresses(clientID, interfaceIDs)
+}
+
+type fakePrefixPool struct {
+	delegations []*PrefixDelegation
+}
+
+func (p *fakePrefixPool) ReservePrefixes(clientID []byte, iaPdIDs [][]byte) ([]*PrefixDelegation, error) {
+	return p.delegations, nil
+}
+
+type fakeAddressPool struct {
+	associations []*IdentityAssociation
+	reserveErr   error
+	prefix       *net.IPNet
+	linkAddr     net.IP // of the last reservation
+}
+
+func (p *fakeAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]byte) ([]*IdentityAssociation, error) {
+	return p.associations, p.reserveErr
+}
+
+func (p *fakeAddressPool) ReserveAddressesForLink(linkAddr net.IP, clientID []byte, interfaceIDs [][]byte) ([]*IdentityAssociation, error) {
+	p.linkAddr = linkAddr
+	return p.ReserveAddresses(clientID, interfaceIDs)
+}
+
+func (p *fakeAddressPool) ReleaseAddresses(clientID []byte, interfaceIDs [][]byte) {}
+
+func (p *fakeAddressPool) LookupAddresses(clientID []byte, interfaceIDs [][]byte) []*IdentityAssociation {
+	return p.associations
+}
+
+func (p *fakeAddressPool) ExtendAddresses(clientID []byte, interfaceIDs [][]byte) []*IdentityAssociation {
+	return p.associations
+}
+
+func (p *fakeAddressPool) Contains(ip net.IP) bool {
+	return p.prefix != nil && p.prefix.Contains(ip)
+}
+
+type fakeBootConfiguration struct {
+	bootURL       []byte
+	preferences   map[string][]byte   // keyed by client link-layer address or ID
+	dnsServers    map[string][]net.IP // keyed by client link-layer address or ID
+	dnsErr        error
+	dnsSearchList []string
+	ntpServers    []net.IP
+	bootParams    []string
+	alternateURLs [][]byte
+	hostnames     map[string]string // keyed by client link-layer address or ID
+	tftpServer    net.IP
+	tftpBootFile  string
+}
+
+func (c *fakeBootConfiguration) GetBootURL(id []byte, clientArchType uint16) ([]byte, error) {
+	return c.bootURL, nil
+}
+
+func (c *fakeBootConfiguration) GetPreference(id []byte, clientArchType uint16) []byte {
+	return c.preferences[string(id)]
+}
+
+func (c *fakeBootConfiguration) GetRecursiveDNS(id []byte, clientArchType uint16) ([]net.IP, error) {
+	if c.dnsErr != nil {
+		return nil, c.dnsErr
+	}
+	return c.dnsServers[string(id)], nil
+}
+
+func (c *fakeBootConfiguration) GetDNSSearchList() []string {
+	return c.dnsSearchList
+}
+
+func (c *fakeBootConfiguration) GetNTPServers() []net.IP {
+	return c.ntpServers
+}
+
+func (c *fakeBootConfiguration) GetBootParams(id []byte, clientArchType uint16) []string {
+	return c.bootParams
+}
+
+func (c *fakeBootConfiguration) GetAlternateBootURLs(id []byte, clientArchType uint16) [][]byte {
+	return c.alternateURLs
+}
+
+func (c *fakeBootConfiguration) GetTFTPBoot(id []byte, clientArchType uint16) (net.IP, string, bool) {
+	return c.tftpServer, c.tftpBootFile, c.tftpServer != nil
+}
+
+func (c *fakeBootConfiguration) GetClientFQDN(id []byte, clientArchType uint16) (string, bool) {
+	hostname, ok := c.hostnames[string(id)]
+	return hostname, ok
+}
+
+func TestMakeMsgReconfigure(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	builder := MakePacketBuilder(90, 100)
+
+	msg := builder.MakeMsgReconfigure([3]byte{}, []byte("serverid"), []byte("clientid"), MsgRenew)
+	bs, err := msg.MarshalReconfigure(key, 42)
+	if err != nil {
+		t.Fatalf("Error marshalling Reconfigure: %s", err)
+	}
+	parsed, err := ParsePacket(bs)
+	if err != nil {
+		t.Fatalf("Error parsing marshalled Reconfigure: %s", err)
+	}
+
+	if parsed.Type != MsgReconfigure {
+		t.Fatalf("Expected message type %d, got %d", MsgReconfigure, parsed.Type)
+	}
+	if parsed.TransactionID != [3]byte{} {
+		t.Fatalf("Expected a zero transaction id, got %x", parsed.TransactionID)
+	}
+	if string(parsed.Options.ServerID()) != "serverid" || string(parsed.Options.ClientID()) != "clientid" {
+		t.Fatalf("Expected server id 'serverid' and client id 'clientid', got %s and %s",
+			parsed.Options.ServerID(), parsed.Options.ClientID())
+	}
+	if reconfMsg := parsed.Options[OptReconfMsg]; len(reconfMsg) != 1 || !bytes.Equal(reconfMsg[0].Value, []byte{byte(MsgRenew)}) {
+		t.Fatalf("Expected a Reconfigure Message option asking for a Renew, got %v", reconfMsg)
+	}
+
+	auth := parsed.Options[OptAuth]
+	if len(auth) != 1 || len(auth[0].Value) != 12+md5.Size {
+		t.Fatalf("Expected one authentication option with an HMAC-MD5 digest, got %v", auth)
+	}
+	value := auth[0].Value
+	if value[0] != 3 || value[1] != 1 || value[2] != 0 || binary.BigEndian.Uint64(value[3:]) != 42 || value[11] != 2 {
+		t.Fatalf("Unexpected authentication option header: %x", value[:12])
+	}
+	// The digest covers the message with the digest field zeroed, and is at its end
+	unsigned := append([]byte(nil), bs...)
+	copy(unsigned[len(unsigned)-md5.Size:], make([]byte, md5.Size))
+	mac := hmac.New(md5.New, key)
+	mac.Write(unsigned)
+	if !hmac.Equal(mac.Sum(nil), value[12:]) {
+		t.Fatalf("Reconfigure digest %x doesn't match the message", value[12:])
+	}
+}
+
+func TestMarshalReconfigureRejectsOtherMessages(t *testing.T) {
+	msg := &Packet{Type: MsgReply, Options: make(Options)}
+	if _, err := msg.MarshalReconfigure([]byte("0123456789abcdef"), 1); err == nil {
+		t.Fatalf("Expected an error authenticating a Reply as a Reconfigure")
+	}
+}
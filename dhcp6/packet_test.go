@@ -2,6 +2,8 @@ package dhcp6
 
 import (
 	"encoding/binary"
+	"net"
+	"reflect"
 	"testing"
 )
 
@@ -91,6 +93,54 @@ func TestShouldDiscardRequestWithWrongServerId(t *testing.T) {
 	}
 }
 
+func TestShouldDiscardRenewWithWrongServerId(t *testing.T) {
+	clientID := []byte("clientid")
+	serverID := []byte("serverid")
+	options := make(Options)
+	options.Add(&Option{ID: OptClientID, Length: uint16(len(clientID)), Value: clientID})
+	options.Add(&Option{ID: OptServerID, Length: uint16(len(serverID)), Value: serverID})
+	renew := &Packet{Type: MsgRenew, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	if err := shouldDiscardRenew(renew, []byte("wrongid")); err == nil {
+		t.Fatalf("Should discard renew packet with wrong server id option, but didn't")
+	}
+	if err := shouldDiscardRenew(renew, serverID); err != nil {
+		t.Fatalf("Shouldn't discard renew packet addressed to us: %s", err)
+	}
+}
+
+func TestShouldDiscardReleaseWithWrongServerId(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("otherserverid")))
+	release := &Packet{Type: MsgRelease, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	if err := release.ShouldDiscard([]byte("serverid")); err == nil {
+		t.Fatalf("Release packet with a different server id should be discarded")
+	}
+}
+
+func TestShouldDiscardRebindWithServerIdOption(t *testing.T) {
+	serverID := []byte("serverid")
+	clientID := []byte("clientid")
+	options := make(Options)
+	options.Add(&Option{ID: OptClientID, Length: uint16(len(clientID)), Value: clientID})
+	options.Add(&Option{ID: OptServerID, Length: uint16(len(serverID)), Value: serverID})
+	rebind := &Packet{Type: MsgRebind, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	if err := shouldDiscardRebind(rebind); err == nil {
+		t.Fatalf("Should discard rebind packet with server id option, but didn't")
+	}
+}
+
+func TestShouldDiscardRebindWithoutClientIdOption(t *testing.T) {
+	rebind := &Packet{Type: MsgRebind, TransactionID: [3]byte{'1', '2', '3'}, Options: make(Options)}
+
+	if err := shouldDiscardRebind(rebind); err == nil {
+		t.Fatalf("Should discard rebind packet without client id option, but didn't")
+	}
+}
+
 func MakeOptionRequestOptions(options []uint16) *Option {
 	value := make([]byte, len(options)*2)
 	for i, option := range options {
@@ -99,3 +149,97 @@ func MakeOptionRequestOptions(options []uint16) *Option {
 
 	return &Option{ID: OptOro, Length: uint16(len(options) * 2), Value: value}
 }
+
+func TestShouldDiscardConfirmWithServerIdOption(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	confirm := &Packet{Type: MsgConfirm, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	if err := confirm.ShouldDiscard([]byte("serverid")); err == nil {
+		t.Fatalf("Confirm packet with server id option should be discarded")
+	}
+}
+
+func TestParsePacketRoundTripsBuiltResponses(t *testing.T) {
+	clientID := []byte{0x0, 0x3, 0x0, 0x1, 0xac, 0xbc, 0x32, 0xae, 0x86, 0x37}
+	ip := net.ParseIP("2001:db8:f00f:cafe::1")
+	_, prefix, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, clientID))
+	options.Add(MakeOption(OptServerID, []byte("serverid")))
+	options.Add(MakeIaNaOption([]byte("id-1"), 0, 0, MakeIaAddrOption(ip, 0, 0)))
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl"),
+		dnsSearchList: []string{"example.com"}, bootParams: []string{"console=ttyS0"}}
+	addresses := &fakeAddressPool{prefix: prefix, associations: []*IdentityAssociation{
+		{IPAddress: ip, ClientID: clientID, InterfaceID: []byte("id-1")}}}
+
+	builder := MakePacketBuilder(90, 100)
+
+	for _, msgType := range []MessageType{MsgSolicit, MsgRequest, MsgRenew, MsgRelease, MsgInformationRequest} {
+		in := &Packet{Type: msgType, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+		msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, addresses)
+		if err != nil {
+			t.Fatalf("Unexpected error for message type %d: %s", msgType, err)
+		}
+		assertRoundTrips(t, msg)
+	}
+
+	confirmOptions := make(Options)
+	confirmOptions.Add(MakeOption(OptClientID, clientID))
+	confirmOptions.Add(MakeIaNaOption([]byte("id-1"), 0, 0, MakeIaAddrOption(ip, 0, 0)))
+	confirm := &Packet{Type: MsgConfirm, TransactionID: [3]byte{'1', '2', '3'}, Options: confirmOptions}
+	msg, err := builder.BuildResponse(confirm, []byte("serverid"), configuration, addresses)
+	if err != nil {
+		t.Fatalf("Unexpected error for message type %d: %s", MsgConfirm, err)
+	}
+	assertRoundTrips(t, msg)
+}
+
+func TestParsePacketRoundTripsRelayedResponses(t *testing.T) {
+	in, err := ParsePacket(relayedSolicit)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(in.Relays) != 2 {
+		t.Fatalf("Expected 2 relay messages, got %d", len(in.Relays))
+	}
+	builder := MakePacketBuilder(90, 100)
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+
+	msg, err := builder.BuildResponse(in, []byte("serverid"), configuration, &fakeAddressPool{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assertRoundTrips(t, msg)
+}
+
+func TestParsePacketRejectsTruncatedPackets(t *testing.T) {
+	options := make(Options)
+	options.Add(MakeOption(OptClientID, []byte("clientid")))
+	marshalled, err := (&Packet{Type: MsgReply, TransactionID: [3]byte{'1', '2', '3'}, Options: options}).Marshal()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for _, length := range []int{0, 3, 6, len(marshalled) - 1} {
+		if _, err := ParsePacket(marshalled[:length]); err == nil {
+			t.Fatalf("Expected an error for a packet truncated to %d bytes", length)
+		}
+	}
+}
+
+func assertRoundTrips(t *testing.T, p *Packet) {
+	t.Helper()
+	marshalled, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal message type %d: %s", p.Type, err)
+	}
+	parsed, err := ParsePacket(marshalled)
+	if err != nil {
+		t.Fatalf("Failed to parse message type %d: %s", p.Type, err)
+	}
+	if !reflect.DeepEqual(parsed, p) {
+		t.Fatalf("Message type %d doesn't round-trip, expected %+v, got %+v", p.Type, p, parsed)
+	}
+}
@@ -0,0 +1,58 @@
+package pool
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// EUI64AddressPool hands out addresses derived from the client's link-layer address, with the modified EUI-64
+// interface identifier of RFC 4291, appendix A, within a /64 prefix, so that addresses are predictable, e.g. for
+// firewall rules. Like with StaticAddressPool, each client gets its derived address in the first identity
+// association it asks an address for. Additional identity associations, and clients whose DUID doesn't carry a
+// link-layer address (DUID-EN, DUID-UUID), fall through to another pool, if any.
+type EUI64AddressPool struct {
+	fixedAddressPool
+	prefix *net.IPNet
+}
+
+// NewEUI64AddressPool creates a new EUI64AddressPool handing out addresses in prefix, which must be an IPv6 /64,
+// with associations valid for lifetime unless extended. Other clients get addresses from fallback, or
+// ErrPoolExhausted if fallback is nil. fallback's range must be outside of prefix.
+func NewEUI64AddressPool(prefix *net.IPNet, fallback dhcp6.AddressPool, lifetime time.Duration) (*EUI64AddressPool, error) {
+	if ones, bits := prefix.Mask.Size(); ones != 64 || bits != 128 || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("EUI-64 addresses need an IPv6 /64 prefix, got %s", prefix)
+	}
+	ret := &EUI64AddressPool{
+		fixedAddressPool: newFixedAddressPool(fallback, lifetime),
+		prefix:           prefix,
+	}
+	ret.address = ret.eui64Address
+	return ret, nil
+}
+
+// eui64Address returns the address of the client within the prefix, or nil if its DUID doesn't carry a 6 byte
+// MAC address or an 8 byte EUI-64
+func (p *EUI64AddressPool) eui64Address(clientID []byte) net.IP {
+	mac := duidLinkLayerAddress(clientID)
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.prefix.IP.To16()[:8])
+	switch len(mac) {
+	case 6:
+		copy(ip[8:], []byte{mac[0], mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]})
+	case 8:
+		copy(ip[8:], mac)
+	default:
+		return nil
+	}
+	// modified EUI-64 identifiers have the universal/local bit inverted
+	ip[8] ^= 0x02
+	return ip
+}
+
+// Contains returns true if ip falls within the prefix, or within the range of the fallback pool
+func (p *EUI64AddressPool) Contains(ip net.IP) bool {
+	return p.prefix.Contains(ip) || (p.fallback != nil && p.fallback.Contains(ip))
+}
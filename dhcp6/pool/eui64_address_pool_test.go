@@ -0,0 +1,51 @@
+package pool
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEUI64AddressPoolDerivesAddressFromMAC(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1:2::/64")
+	_, fallbackPrefix, _ := net.ParseCIDR("2001:db8:1:3::/120")
+	pool, err := NewEUI64AddressPool(prefix, NewMemoryAddressPool(fallbackPrefix, 100*time.Second), 100*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for _, test := range []struct {
+		clientID   []byte
+		expectedIP string
+	}{
+		// DUID-LLT with link-layer address 52:54:00:12:34:56, whose universal/local bit gets set
+		{[]byte{0, 1, 0, 1, 0x5e, 0x41, 0x3f, 0x10, 0x52, 0x54, 0x00, 0x12, 0x34, 0x56}, "2001:db8:1:2:5054:ff:fe12:3456"},
+		// DUID-LL with universally administered link-layer address 00:1b:21:aa:bb:cc, whose bit gets cleared
+		{[]byte{0, 3, 0, 1, 0x00, 0x1b, 0x21, 0xaa, 0xbb, 0xcc}, "2001:db8:1:2:21b:21ff:feaa:bbcc"},
+	} {
+		ias, err := pool.ReserveAddresses(test.clientID, [][]byte{[]byte("id-1")})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(ias) != 1 || !ias[0].IPAddress.Equal(net.ParseIP(test.expectedIP)) {
+			t.Fatalf("Expected address %s for client %x, got %v", test.expectedIP, test.clientID, ias)
+		}
+		if !pool.Contains(ias[0].IPAddress) {
+			t.Fatalf("Expected the pool to contain %s", ias[0].IPAddress)
+		}
+	}
+
+	// DUID-EN carries no link-layer address
+	ias, err := pool.ReserveAddresses([]byte{0, 2, 0, 0, 0xab, 0x11, 1, 2, 3}, [][]byte{[]byte("id-1")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(ias) != 1 || !fallbackPrefix.Contains(ias[0].IPAddress) {
+		t.Fatalf("Expected an address from the fallback pool for a DUID-EN, got %v", ias)
+	}
+
+	_, prefix, _ = net.ParseCIDR("2001:db8:1:2::/56")
+	if _, err := NewEUI64AddressPool(prefix, nil, 100*time.Second); err == nil {
+		t.Fatalf("Expected an error for a /56 prefix")
+	}
+}
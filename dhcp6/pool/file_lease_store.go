@@ -0,0 +1,113 @@
+package pool
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// FileLeaseStore saves identity associations to a JSON file. The file is replaced atomically on every save, so
+// that it's never left half written.
+type FileLeaseStore struct {
+	path string
+}
+
+// fileLease is an identity association as saved in the file
+type fileLease struct {
+	ClientID              string    `json:"client_id"`
+	InterfaceID           string    `json:"interface_id"`
+	IPAddress             net.IP    `json:"ip_address"`
+	AdditionalIPAddresses []net.IP  `json:"additional_ip_addresses,omitempty"`
+	CreatedAt             time.Time `json:"created_at"`
+	ExpiresAt             time.Time `json:"expires_at"`
+}
+
+// NewFileLeaseStore creates a new FileLeaseStore saving identity associations to the file at path
+func NewFileLeaseStore(path string) *FileLeaseStore {
+	return &FileLeaseStore{path: path}
+}
+
+// Save writes associations to the file
+func (s *FileLeaseStore) Save(associations []*dhcp6.IdentityAssociation) error {
+	leases := make([]fileLease, 0, len(associations))
+	for _, ia := range associations {
+		leases = append(leases, fileLease{
+			ClientID:              hex.EncodeToString(ia.ClientID),
+			InterfaceID:           hex.EncodeToString(ia.InterfaceID),
+			IPAddress:             ia.IPAddress,
+			AdditionalIPAddresses: ia.AdditionalIPAddresses,
+			CreatedAt:             ia.CreatedAt,
+			ExpiresAt:             ia.ExpiresAt,
+		})
+	}
+	bs, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding leases: %s", err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Error saving leases: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(bs, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("Error saving leases: %s", err)
+	}
+	return nil
+}
+
+// Load reads the associations saved in the file. A missing file holds no associations.
+func (s *FileLeaseStore) Load() ([]*dhcp6.IdentityAssociation, error) {
+	bs, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error loading leases: %s", err)
+	}
+	var leases []fileLease
+	if err := json.Unmarshal(bs, &leases); err != nil {
+		return nil, fmt.Errorf("Error loading leases from %s: %s", s.path, err)
+	}
+
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(leases))
+	for _, lease := range leases {
+		clientID, err := hex.DecodeString(lease.ClientID)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading leases from %s: invalid client id %q", s.path, lease.ClientID)
+		}
+		interfaceID, err := hex.DecodeString(lease.InterfaceID)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading leases from %s: invalid interface id %q", s.path, lease.InterfaceID)
+		}
+		if lease.IPAddress == nil {
+			return nil, fmt.Errorf("Error loading leases from %s: lease of client %s has no ip address", s.path, lease.ClientID)
+		}
+		ret = append(ret, &dhcp6.IdentityAssociation{
+			ClientID:              clientID,
+			InterfaceID:           interfaceID,
+			IPAddress:             lease.IPAddress,
+			AdditionalIPAddresses: lease.AdditionalIPAddresses,
+			CreatedAt:             lease.CreatedAt,
+			ExpiresAt:             lease.ExpiresAt,
+		})
+	}
+	return ret, nil
+}
@@ -0,0 +1,144 @@
+package pool
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+func TestFileLeaseStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileLeaseStore(filepath.Join(dir, "leases.json"))
+	associations, err := store.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error loading missing file: %s", err)
+	}
+	if len(associations) != 0 {
+		t.Fatalf("Expected no associations in missing file, got %d", len(associations))
+	}
+
+	expiresAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	expected := &dhcp6.IdentityAssociation{
+		ClientID:    []byte("client-id"),
+		InterfaceID: []byte{0, 1, 2, 3},
+		IPAddress:   net.ParseIP("2001:db8:f00f:cafe::1"),
+		CreatedAt:   expiresAt.Add(-time.Hour),
+		ExpiresAt:   expiresAt,
+	}
+	if err := store.Save([]*dhcp6.IdentityAssociation{expected}); err != nil {
+		t.Fatalf("Unexpected error saving: %s", err)
+	}
+
+	associations, err = store.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error loading: %s", err)
+	}
+	if len(associations) != 1 {
+		t.Fatalf("Expected 1 association, got %d", len(associations))
+	}
+	got := associations[0]
+	if !bytes.Equal(got.ClientID, expected.ClientID) || !bytes.Equal(got.InterfaceID, expected.InterfaceID) {
+		t.Fatalf("Expected client id %x and interface id %x, got %x and %x", expected.ClientID,
+			expected.InterfaceID, got.ClientID, got.InterfaceID)
+	}
+	if !got.IPAddress.Equal(expected.IPAddress) {
+		t.Fatalf("Expected ip address %s, got %s", expected.IPAddress, got.IPAddress)
+	}
+	if !got.CreatedAt.Equal(expected.CreatedAt) || !got.ExpiresAt.Equal(expected.ExpiresAt) {
+		t.Fatalf("Expected lease from %s to %s, got %s to %s", expected.CreatedAt, expected.ExpiresAt,
+			got.CreatedAt, got.ExpiresAt)
+	}
+}
+
+func TestMemoryPoolRestoresLeasesFromStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/125")
+	path := filepath.Join(dir, "leases.json")
+
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+	if err := pool.SetLeaseStore(NewFileLeaseStore(path), nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ias, err := pool.ReserveAddresses([]byte("client-1"), [][]byte{[]byte("id-1")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	restarted := NewMemoryAddressPool(cidr, 100*time.Second)
+	if err := restarted.SetLeaseStore(NewFileLeaseStore(path), nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	restored := restarted.LookupAddresses([]byte("client-1"), [][]byte{[]byte("id-1")})
+	if len(restored) != 1 || !restored[0].IPAddress.Equal(ias[0].IPAddress) {
+		t.Fatalf("Expected restored lease for %s, got %v", ias[0].IPAddress, restored)
+	}
+	other, err := restarted.ReserveAddresses([]byte("client-2"), [][]byte{[]byte("id-1")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if other[0].IPAddress.Equal(ias[0].IPAddress) {
+		t.Fatalf("Restored address %s was handed out again", ias[0].IPAddress)
+	}
+}
+
+func TestMemoryPoolRecoversFromTruncatedLeaseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/125")
+	path := filepath.Join(dir, "leases.json")
+
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+	if err := pool.SetLeaseStore(NewFileLeaseStore(path), nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := pool.ReserveAddresses([]byte("client-1"), [][]byte{[]byte("id-1")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := ioutil.WriteFile(path, bs[:len(bs)/2], 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if _, err := NewFileLeaseStore(path).Load(); err == nil {
+		t.Fatalf("Expected an error loading a truncated file")
+	}
+
+	restarted := NewMemoryAddressPool(cidr, 100*time.Second)
+	if err := restarted.SetLeaseStore(NewFileLeaseStore(path), nil); err == nil {
+		t.Fatalf("Expected the pool to report the truncated file")
+	}
+	if restored := restarted.LookupAddresses([]byte("client-1"), [][]byte{[]byte("id-1")}); len(restored) != 0 {
+		t.Fatalf("Expected the pool to start empty, got %v", restored)
+	}
+	if _, err := restarted.ReserveAddresses([]byte("client-2"), [][]byte{[]byte("id-1")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	associations, err := NewFileLeaseStore(path).Load()
+	if err != nil {
+		t.Fatalf("Expected the truncated file to be replaced, got: %s", err)
+	}
+	if len(associations) != 1 || !bytes.Equal(associations[0].ClientID, []byte("client-2")) {
+		t.Fatalf("Expected the lease of client-2 to be saved, got %v", associations)
+	}
+}
@@ -0,0 +1,150 @@
+package pool
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// fixedAddressPool hands out one fixed address per client, in the first identity association the client asks an
+// address for, and falls through to another pool, if any, for additional identity associations and clients
+// without a fixed address. It's the part of StaticAddressPool and EUI64AddressPool that doesn't depend on how
+// fixed addresses are picked.
+type fixedAddressPool struct {
+	fallback dhcp6.AddressPool
+	lifetime time.Duration
+	// address returns the fixed address of a client, or nil if it has none. It's called from under the lock.
+	address      func(clientID []byte) net.IP
+	associations map[string]*dhcp6.IdentityAssociation // keyed by client ID
+	timeNow      func() time.Time
+	lock         sync.Mutex
+}
+
+// newFixedAddressPool creates a new fixedAddressPool, with associations valid for lifetime unless extended.
+// Clients without a fixed address get addresses from fallback, or ErrPoolExhausted if fallback is nil.
+func newFixedAddressPool(fallback dhcp6.AddressPool, lifetime time.Duration) fixedAddressPool {
+	return fixedAddressPool{
+		fallback:     fallback,
+		lifetime:     lifetime,
+		associations: make(map[string]*dhcp6.IdentityAssociation),
+		timeNow:      func() time.Time { return time.Now() },
+	}
+}
+
+// ReserveAddresses creates new or retrieves active associations for interfaces in interfaceIDs list.
+func (p *fixedAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	return p.ReserveAddressesForLink(nil, clientID, interfaceIDs)
+}
+
+// ReserveAddressesForLink is like ReserveAddresses, for a client on the link with address linkAddr. Fixed
+// addresses are handed out whatever the link, linkAddr is passed on to the fallback pool.
+func (p *fixedAddressPool) ReserveAddressesForLink(linkAddr net.IP, clientID []byte,
+	interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	p.lock.Lock()
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	remaining := make([][]byte, 0, len(interfaceIDs))
+	if ip := p.address(clientID); ip != nil {
+		association := p.activeAssociation(clientID)
+		for _, interfaceID := range interfaceIDs {
+			if association == nil {
+				timeNow := p.timeNow()
+				association = &dhcp6.IdentityAssociation{ClientID: clientID,
+					InterfaceID: interfaceID,
+					IPAddress:   ip,
+					CreatedAt:   timeNow,
+					ExpiresAt:   timeNow.Add(p.lifetime)}
+				p.associations[string(clientID)] = association
+				ret = append(ret, association)
+			} else if bytes.Equal(association.InterfaceID, interfaceID) {
+				ret = append(ret, association)
+			} else {
+				remaining = append(remaining, interfaceID)
+			}
+		}
+	} else {
+		remaining = interfaceIDs
+	}
+	p.lock.Unlock()
+
+	if len(remaining) == 0 {
+		return ret, nil
+	}
+	if p.fallback == nil {
+		return ret, dhcp6.ErrPoolExhausted
+	}
+	associations, err := p.fallback.ReserveAddressesForLink(linkAddr, clientID, remaining)
+	return append(ret, associations...), err
+}
+
+// ReleaseAddresses forgets associations with ClientID and interfaceIDs
+func (p *fixedAddressPool) ReleaseAddresses(clientID []byte, interfaceIDs [][]byte) {
+	remaining := p.splitInterfaceIDs(clientID, interfaceIDs, func(*dhcp6.IdentityAssociation) {
+		delete(p.associations, string(clientID))
+	})
+	if p.fallback != nil && len(remaining) > 0 {
+		p.fallback.ReleaseAddresses(clientID, remaining)
+	}
+}
+
+// LookupAddresses returns active associations for interfaces in interfaceIDs list, without creating new ones.
+// Interfaces with no active association are left out of the result.
+func (p *fixedAddressPool) LookupAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	remaining := p.splitInterfaceIDs(clientID, interfaceIDs, func(association *dhcp6.IdentityAssociation) {
+		ret = append(ret, association)
+	})
+	if p.fallback != nil && len(remaining) > 0 {
+		ret = append(ret, p.fallback.LookupAddresses(clientID, remaining)...)
+	}
+	return ret
+}
+
+// ExtendAddresses resets the valid lifetime of active associations for interfaces in interfaceIDs list.
+// Interfaces with no active association are left out of the result.
+func (p *fixedAddressPool) ExtendAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	remaining := p.splitInterfaceIDs(clientID, interfaceIDs, func(association *dhcp6.IdentityAssociation) {
+		association.ExpiresAt = p.timeNow().Add(p.lifetime)
+		ret = append(ret, association)
+	})
+	if p.fallback != nil && len(remaining) > 0 {
+		ret = append(ret, p.fallback.ExtendAddresses(clientID, remaining)...)
+	}
+	return ret
+}
+
+// splitInterfaceIDs calls static, from under the fixedAddressPool.lock, with the client's active association
+// of a fixed address if it's for one of the interfaces in interfaceIDs list, and returns the other interfaces
+func (p *fixedAddressPool) splitInterfaceIDs(clientID []byte, interfaceIDs [][]byte,
+	static func(*dhcp6.IdentityAssociation)) [][]byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	association := p.activeAssociation(clientID)
+	remaining := make([][]byte, 0, len(interfaceIDs))
+	for _, interfaceID := range interfaceIDs {
+		if association != nil && bytes.Equal(association.InterfaceID, interfaceID) {
+			static(association)
+			continue
+		}
+		remaining = append(remaining, interfaceID)
+	}
+	return remaining
+}
+
+// activeAssociation returns the client's association of its fixed address if it hasn't expired yet. Note it
+// should be called from under the fixedAddressPool.lock.
+func (p *fixedAddressPool) activeAssociation(clientID []byte) *dhcp6.IdentityAssociation {
+	association, exists := p.associations[string(clientID)]
+	if !exists {
+		return nil
+	}
+	if !p.timeNow().Before(association.ExpiresAt) {
+		delete(p.associations, string(clientID))
+		return nil
+	}
+	return association
+}
@@ -0,0 +1,121 @@
+package pool
+
+import (
+	"net"
+	"sync"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// LinkAddressPool hands out addresses on several subnets, picking the pool of the subnet a client is on by the
+// link-address of the relay it came through. Clients that weren't relayed, or were relayed from a link with no
+// pool, get addresses from the default pool.
+type LinkAddressPool struct {
+	defaultPool dhcp6.AddressPool
+	links       []linkPool
+	lock        sync.Mutex
+}
+
+// linkPool is the pool of the subnet of a link
+type linkPool struct {
+	prefix *net.IPNet
+	pool   dhcp6.AddressPool
+}
+
+// NewLinkAddressPool creates a new LinkAddressPool, with defaultPool for clients on links with no pool of their
+// own. defaultPool may be nil, clients on other links then get dhcp6.ErrPoolExhausted.
+func NewLinkAddressPool(defaultPool dhcp6.AddressPool) *LinkAddressPool {
+	return &LinkAddressPool{defaultPool: defaultPool}
+}
+
+// AddLink makes clients relayed from links whose link-address is within prefix get addresses from pool
+func (p *LinkAddressPool) AddLink(prefix *net.IPNet, pool dhcp6.AddressPool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.links = append(p.links, linkPool{prefix: prefix, pool: pool})
+}
+
+// Contains returns true if ip falls within any of the pools
+func (p *LinkAddressPool) Contains(ip net.IP) bool {
+	for _, pool := range p.pools() {
+		if pool.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReserveAddresses creates new or retrieves active associations in the default pool for interfaces in
+// interfaceIDs list.
+func (p *LinkAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	return p.ReserveAddressesForLink(nil, clientID, interfaceIDs)
+}
+
+// ReserveAddressesForLink creates new or retrieves active associations for interfaces in interfaceIDs list, in the
+// pool of the link with address linkAddr.
+func (p *LinkAddressPool) ReserveAddressesForLink(linkAddr net.IP, clientID []byte,
+	interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	pool := p.poolForLink(linkAddr)
+	if pool == nil {
+		return nil, dhcp6.ErrPoolExhausted
+	}
+	return pool.ReserveAddressesForLink(linkAddr, clientID, interfaceIDs)
+}
+
+// ReleaseAddresses forgets associations with ClientID and interfaceIDs, in whichever pool they are
+func (p *LinkAddressPool) ReleaseAddresses(clientID []byte, interfaceIDs [][]byte) {
+	for _, pool := range p.pools() {
+		pool.ReleaseAddresses(clientID, interfaceIDs)
+	}
+}
+
+// LookupAddresses returns active associations for interfaces in interfaceIDs list, in whichever pool they are.
+// Interfaces with no active association are left out of the result.
+func (p *LinkAddressPool) LookupAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	for _, pool := range p.pools() {
+		ret = append(ret, pool.LookupAddresses(clientID, interfaceIDs)...)
+	}
+	return ret
+}
+
+// ExtendAddresses resets the valid lifetime of active associations for interfaces in interfaceIDs list, in
+// whichever pool they are. Interfaces with no active association are left out of the result.
+func (p *LinkAddressPool) ExtendAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	for _, pool := range p.pools() {
+		ret = append(ret, pool.ExtendAddresses(clientID, interfaceIDs)...)
+	}
+	return ret
+}
+
+// poolForLink returns the pool of the link with address linkAddr, or the default pool
+func (p *LinkAddressPool) poolForLink(linkAddr net.IP) dhcp6.AddressPool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if linkAddr != nil {
+		for _, link := range p.links {
+			if link.prefix.Contains(linkAddr) {
+				return link.pool
+			}
+		}
+	}
+	return p.defaultPool
+}
+
+// pools returns all the pools, starting with the default one
+func (p *LinkAddressPool) pools() []dhcp6.AddressPool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret := make([]dhcp6.AddressPool, 0, len(p.links)+1)
+	if p.defaultPool != nil {
+		ret = append(ret, p.defaultPool)
+	}
+	for _, link := range p.links {
+		ret = append(ret, link.pool)
+	}
+	return ret
+}
@@ -0,0 +1,53 @@
+package pool
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLinkAddressPoolSelectsPoolByLinkAddress(t *testing.T) {
+	_, defaultPrefix, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	_, link1, _ := net.ParseCIDR("2001:db8:1::/64")
+	_, link2, _ := net.ParseCIDR("2001:db8:2::/64")
+	_, pool1Prefix, _ := net.ParseCIDR("2001:db8:1:100::/120")
+	_, pool2Prefix, _ := net.ParseCIDR("2001:db8:2:100::/120")
+
+	pool := NewLinkAddressPool(NewMemoryAddressPool(defaultPrefix, 100*time.Second))
+	pool.AddLink(link1, NewMemoryAddressPool(pool1Prefix, 100*time.Second))
+	pool.AddLink(link2, NewMemoryAddressPool(pool2Prefix, 100*time.Second))
+
+	for _, test := range []struct {
+		linkAddr       net.IP
+		clientID       string
+		expectedPrefix *net.IPNet
+	}{
+		{net.ParseIP("2001:db8:1::1"), "client-1", pool1Prefix},
+		{net.ParseIP("2001:db8:2::1"), "client-2", pool2Prefix},
+		{net.ParseIP("2001:db8:3::1"), "client-3", defaultPrefix},
+		{nil, "client-4", defaultPrefix},
+	} {
+		clientID := []byte(test.clientID)
+		interfaceIDs := [][]byte{[]byte("id-1")}
+		ias, err := pool.ReserveAddressesForLink(test.linkAddr, clientID, interfaceIDs)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(ias) != 1 || !test.expectedPrefix.Contains(ias[0].IPAddress) {
+			t.Fatalf("Expected an address in %s for link %s, got %v", test.expectedPrefix, test.linkAddr, ias)
+		}
+		if !pool.Contains(ias[0].IPAddress) {
+			t.Fatalf("Expected the pool to contain %s", ias[0].IPAddress)
+		}
+
+		// Later messages of the client don't carry the link-address
+		lookedUp := pool.LookupAddresses(clientID, interfaceIDs)
+		if len(lookedUp) != 1 || !lookedUp[0].IPAddress.Equal(ias[0].IPAddress) {
+			t.Fatalf("Expected lookup to find %s, got %v", ias[0].IPAddress, lookedUp)
+		}
+		pool.ReleaseAddresses(clientID, interfaceIDs)
+		if lookedUp := pool.LookupAddresses(clientID, interfaceIDs); len(lookedUp) != 0 {
+			t.Fatalf("Expected no associations after release, got %v", lookedUp)
+		}
+	}
+}
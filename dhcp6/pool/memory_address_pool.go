@@ -0,0 +1,305 @@
+package pool
+
+import (
+	"hash/fnv"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// MemoryAddressPool hands out addresses from a CIDR range in sequential order. Associations that outlive
+// their valid lifetime are reclaimed the next time addresses are reserved.
+type MemoryAddressPool struct {
+	prefix       *net.IPNet
+	prefixStart  *big.Int
+	prefixSize   *big.Int
+	nextOffset   *big.Int
+	lifetime     time.Duration
+	associations map[uint64]*dhcp6.IdentityAssociation
+	usedIps      map[string]struct{}
+	store        dhcp6.LeaseStore
+	logError     func(error)
+	timeNow      func() time.Time
+	lock         sync.Mutex
+
+	// addressesPerAssociation is how many addresses each identity association gets, at least 1
+	addressesPerAssociation int
+}
+
+// NewMemoryAddressPool creates a new MemoryAddressPool handing out addresses from cidr, with associations
+// valid for lifetime unless extended
+func NewMemoryAddressPool(cidr *net.IPNet, lifetime time.Duration) *MemoryAddressPool {
+	ones, bits := cidr.Mask.Size()
+	ret := &MemoryAddressPool{}
+	ret.prefix = cidr
+	ret.prefixStart = big.NewInt(0).SetBytes(cidr.IP.Mask(cidr.Mask).To16())
+	ret.prefixSize = big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones))
+	// offset 0 is the subnet-router anycast address, see RFC 4291, section 2.6.1
+	ret.nextOffset = big.NewInt(1)
+	ret.lifetime = lifetime
+	ret.addressesPerAssociation = 1
+	ret.associations = make(map[uint64]*dhcp6.IdentityAssociation)
+	ret.usedIps = make(map[string]struct{})
+	ret.timeNow = func() time.Time { return time.Now() }
+	return ret
+}
+
+// SetAddressesPerAssociation makes the pool hand out n addresses in each identity association, the first one in
+// IPAddress and the others in AdditionalIPAddresses, for clients that can use several addresses on an interface.
+// n must be at least 1, the default. It must be called before the pool is used.
+func (p *MemoryAddressPool) SetAddressesPerAssociation(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if n < 1 {
+		n = 1
+	}
+	p.addressesPerAssociation = n
+}
+
+// SetLeaseStore makes the pool save its associations to store whenever they change, and loads the associations
+// saved in store, leaving out expired ones and ones outside of the pool's prefix. logError, if not nil, is
+// called with errors saving associations. If the associations can't be loaded, e.g. because the store is
+// corrupt, the pool starts empty, and the error is returned for the caller to log. It must be called before
+// the pool is used.
+func (p *MemoryAddressPool) SetLeaseStore(store dhcp6.LeaseStore, logError func(error)) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.store = store
+	p.logError = logError
+	associations, err := store.Load()
+	if err != nil {
+		return err
+	}
+	timeNow := p.timeNow()
+	for _, association := range associations {
+		if !timeNow.Before(association.ExpiresAt) || !p.usable(association.IPAddresses()) {
+			continue
+		}
+		association.IPAddress = association.IPAddress.To16()
+		for i, ip := range association.AdditionalIPAddresses {
+			association.AdditionalIPAddresses[i] = ip.To16()
+		}
+		p.associations[p.calculateIAIDHash(association.ClientID, association.InterfaceID)] = association
+		p.markUsed(association, true)
+	}
+	return nil
+}
+
+// usable returns true if ips are all within the pool's prefix, distinct, and not handed out yet. Note it should
+// be called from under the MemoryAddressPool.lock.
+func (p *MemoryAddressPool) usable(ips []net.IP) bool {
+	seen := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		key := string(ip.To16())
+		if _, used := p.usedIps[key]; used || seen[key] || !p.prefix.Contains(ip) {
+			return false
+		}
+		seen[key] = true
+	}
+	return true
+}
+
+// markUsed marks all addresses in association as handed out, or as free again if used is false. Note it should
+// be called from under the MemoryAddressPool.lock.
+func (p *MemoryAddressPool) markUsed(association *dhcp6.IdentityAssociation, used bool) {
+	for _, ip := range association.IPAddresses() {
+		if used {
+			p.usedIps[string(ip.To16())] = struct{}{}
+		} else {
+			delete(p.usedIps, string(ip.To16()))
+		}
+	}
+}
+
+// save saves the associations to the lease store, if any. Note it should be called from under the
+// MemoryAddressPool.lock.
+func (p *MemoryAddressPool) save() {
+	if p.store == nil {
+		return
+	}
+	associations := make([]*dhcp6.IdentityAssociation, 0, len(p.associations))
+	for _, association := range p.associations {
+		associations = append(associations, association)
+	}
+	if err := p.store.Save(associations); err != nil && p.logError != nil {
+		p.logError(err)
+	}
+}
+
+// Contains returns true if ip falls within the pool's prefix
+func (p *MemoryAddressPool) Contains(ip net.IP) bool {
+	return p.prefix.Contains(ip)
+}
+
+// ReserveAddresses creates new or retrieves active associations for interfaces in interfaceIDs list.
+func (p *MemoryAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	changed := p.reclaimExpiredAddresses()
+	defer func() {
+		if changed {
+			p.save()
+		}
+	}()
+
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	for _, interfaceID := range interfaceIDs {
+		clientIDHash := p.calculateIAIDHash(clientID, interfaceID)
+		association, exists := p.associations[clientIDHash]
+		if exists {
+			ret = append(ret, association)
+			continue
+		}
+
+		ips := make([]net.IP, 0, p.addressesPerAssociation)
+		for len(ips) < p.addressesPerAssociation {
+			ip, err := p.nextFreeAddress()
+			if err != nil {
+				// don't hand out a partial association
+				for _, ip := range ips {
+					delete(p.usedIps, string(ip))
+				}
+				return ret, err
+			}
+			p.usedIps[string(ip)] = struct{}{}
+			ips = append(ips, ip)
+		}
+		changed = true
+		timeNow := p.timeNow()
+		association = &dhcp6.IdentityAssociation{ClientID: clientID,
+			InterfaceID: interfaceID,
+			IPAddress:   ips[0],
+			CreatedAt:   timeNow,
+			ExpiresAt:   timeNow.Add(p.lifetime)}
+		if len(ips) > 1 {
+			association.AdditionalIPAddresses = ips[1:]
+		}
+		p.associations[clientIDHash] = association
+		ret = append(ret, association)
+	}
+
+	return ret, nil
+}
+
+// ReserveAddressesForLink is the same as ReserveAddresses, the pool has a single prefix for all links
+func (p *MemoryAddressPool) ReserveAddressesForLink(linkAddr net.IP, clientID []byte,
+	interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	return p.ReserveAddresses(clientID, interfaceIDs)
+}
+
+// ReleaseAddresses returns IP addresses associated with ClientID and interfaceIDs back into the address pool
+func (p *MemoryAddressPool) ReleaseAddresses(clientID []byte, interfaceIDs [][]byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	changed := false
+
+	for _, interfaceID := range interfaceIDs {
+		clientIDHash := p.calculateIAIDHash(clientID, interfaceID)
+		association, exists := p.associations[clientIDHash]
+		if !exists {
+			continue
+		}
+		p.markUsed(association, false)
+		delete(p.associations, clientIDHash)
+		changed = true
+	}
+	if changed {
+		p.save()
+	}
+}
+
+// LookupAddresses returns active associations for interfaces in interfaceIDs list, without creating new ones.
+// Interfaces with no active association are left out of the result.
+func (p *MemoryAddressPool) LookupAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.activeAssociations(clientID, interfaceIDs)
+}
+
+// ExtendAddresses resets the valid lifetime of active associations for interfaces in interfaceIDs list.
+// Interfaces with no active association are left out of the result.
+func (p *MemoryAddressPool) ExtendAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret := p.activeAssociations(clientID, interfaceIDs)
+	expiresAt := p.timeNow().Add(p.lifetime)
+	for _, association := range ret {
+		association.ExpiresAt = expiresAt
+	}
+	if len(ret) > 0 {
+		p.save()
+	}
+	return ret
+}
+
+// activeAssociations returns associations for interfaces in interfaceIDs list that haven't expired yet.
+// Note it should be called from under the MemoryAddressPool.lock.
+func (p *MemoryAddressPool) activeAssociations(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	timeNow := p.timeNow()
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	for _, interfaceID := range interfaceIDs {
+		association, exists := p.associations[p.calculateIAIDHash(clientID, interfaceID)]
+		if exists && timeNow.Before(association.ExpiresAt) {
+			ret = append(ret, association)
+		}
+	}
+	return ret
+}
+
+// reclaimExpiredAddresses releases IP addresses in identity associations that reached the end of valid lifetime
+// back into the address pool, and returns true if there were any. Note it should be called from under the
+// MemoryAddressPool.lock.
+func (p *MemoryAddressPool) reclaimExpiredAddresses() bool {
+	reclaimed := false
+	timeNow := p.timeNow()
+	for clientIDHash, association := range p.associations {
+		if timeNow.Before(association.ExpiresAt) {
+			continue
+		}
+		p.markUsed(association, false)
+		delete(p.associations, clientIDHash)
+		reclaimed = true
+	}
+	return reclaimed
+}
+
+// nextFreeAddress returns the first unused address following the last one handed out, wrapping around
+// at the end of the prefix. Note it should be called from under the MemoryAddressPool.lock.
+func (p *MemoryAddressPool) nextFreeAddress() (net.IP, error) {
+	// all addresses but the subnet-router anycast one can be handed out
+	if big.NewInt(int64(len(p.usedIps)+1)).Cmp(p.prefixSize) >= 0 {
+		return nil, dhcp6.ErrPoolExhausted
+	}
+
+	// at most len(p.usedIps) addresses are skipped before a free one turns up
+	for {
+		offset := p.nextOffset
+		p.nextOffset = big.NewInt(0).Add(offset, big.NewInt(1))
+		if p.nextOffset.Cmp(p.prefixSize) >= 0 {
+			p.nextOffset = big.NewInt(1)
+		}
+
+		ip := make(net.IP, net.IPv6len)
+		addr := big.NewInt(0).Add(p.prefixStart, offset).Bytes()
+		copy(ip[net.IPv6len-len(addr):], addr)
+		if _, used := p.usedIps[string(ip)]; !used {
+			return ip, nil
+		}
+	}
+}
+
+func (p *MemoryAddressPool) calculateIAIDHash(clientID, interfaceID []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(clientID)
+	h.Write(interfaceID)
+	return h.Sum64()
+}
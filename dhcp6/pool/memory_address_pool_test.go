@@ -0,0 +1,210 @@
+package pool
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+func TestMemoryPoolReserveExhaustReleaseAndReserveAgain(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/125")
+	expectedClientID := []byte("Client-id")
+	interfaceIDs := [][]byte{[]byte("id-1"), []byte("id-2"), []byte("id-3"), []byte("id-4"), []byte("id-5"),
+		[]byte("id-6"), []byte("id-7")}
+
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+	ias, err := pool.ReserveAddresses(expectedClientID, interfaceIDs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(ias) != 7 {
+		t.Fatalf("Expected 7 identity associations but received %d", len(ias))
+	}
+	for i, ia := range ias {
+		expectedIP := net.IP{0x20, 0x01, 0x0d, 0xb8, 0xf0, 0x0f, 0xca, 0xfe, 0, 0, 0, 0, 0, 0, 0, byte(i + 1)}
+		if !ia.IPAddress.Equal(expectedIP) {
+			t.Fatalf("Expected ip address %s, but got: %s", expectedIP, ia.IPAddress)
+		}
+	}
+
+	_, err = pool.ReserveAddresses(expectedClientID, [][]byte{[]byte("id-8")})
+	if err != dhcp6.ErrPoolExhausted {
+		t.Fatalf("Expected ErrPoolExhausted when reserving an address from an exhausted pool, got: %v", err)
+	}
+
+	pool.ReleaseAddresses(expectedClientID, [][]byte{[]byte("id-3")})
+	ias, err = pool.ReserveAddresses(expectedClientID, [][]byte{[]byte("id-8")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !ias[0].IPAddress.Equal(net.ParseIP("2001:db8:f00f:cafe::3")) {
+		t.Fatalf("Expected the released address to be reserved again, but got: %s", ias[0].IPAddress)
+	}
+}
+
+func TestMemoryPoolReserveReturnsExistingAssociation(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/125")
+	expectedClientID := []byte("Client-id")
+	expectedIAID := []byte("interface-id")
+
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+	ias1, _ := pool.ReserveAddresses(expectedClientID, [][]byte{expectedIAID})
+	ias2, _ := pool.ReserveAddresses(expectedClientID, [][]byte{expectedIAID})
+
+	if ias1[0] != ias2[0] {
+		t.Fatalf("Expected the same association to be returned, but got %v and %v", ias1[0], ias2[0])
+	}
+}
+
+func TestMemoryPoolReclaimsExpiredAddressesOnReserve(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/127")
+	expectedClientID := []byte("Client-id")
+	expectedTime := time.Now()
+
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+	pool.timeNow = func() time.Time { return expectedTime }
+	pool.ReserveAddresses(expectedClientID, [][]byte{[]byte("id-1")})
+
+	pool.timeNow = func() time.Time { return expectedTime.Add(101 * time.Second) }
+	ias, err := pool.ReserveAddresses(expectedClientID, [][]byte{[]byte("id-2")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !ias[0].IPAddress.Equal(net.ParseIP("2001:db8:f00f:cafe::1")) {
+		t.Fatalf("Expected the expired address to be reclaimed, but got: %s", ias[0].IPAddress)
+	}
+	if len(pool.LookupAddresses(expectedClientID, [][]byte{[]byte("id-1")})) != 0 {
+		t.Fatalf("Expected the expired association to be gone")
+	}
+}
+
+func TestMemoryPoolExtendAddresses(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/125")
+	expectedClientID := []byte("Client-id")
+	expectedIAID := []byte("interface-id")
+	expectedTime := time.Now()
+
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+	pool.timeNow = func() time.Time { return expectedTime }
+	pool.ReserveAddresses(expectedClientID, [][]byte{expectedIAID})
+
+	pool.timeNow = func() time.Time { return expectedTime.Add(90 * time.Second) }
+	ias := pool.ExtendAddresses(expectedClientID, [][]byte{expectedIAID, []byte("unknown-id")})
+	if len(ias) != 1 {
+		t.Fatalf("Expected 1 identity association but received %d", len(ias))
+	}
+	if ias[0].ExpiresAt != expectedTime.Add(190*time.Second) {
+		t.Fatalf("Expected expiration time: %v, but got: %v", expectedTime.Add(190*time.Second), ias[0].ExpiresAt)
+	}
+
+	pool.timeNow = func() time.Time { return expectedTime.Add(150 * time.Second) }
+	if len(pool.LookupAddresses(expectedClientID, [][]byte{expectedIAID})) != 1 {
+		t.Fatalf("Expected the extended association to still be active")
+	}
+}
+
+func TestMemoryPoolContains(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/125")
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+
+	if !pool.Contains(net.ParseIP("2001:db8:f00f:cafe::7")) {
+		t.Fatalf("Expected 2001:db8:f00f:cafe::7 to be in the pool")
+	}
+	if pool.Contains(net.ParseIP("2001:db8:f00f:cafe::8")) {
+		t.Fatalf("Expected 2001:db8:f00f:cafe::8 not to be in the pool")
+	}
+}
+
+func TestMemoryPoolSeveralAddressesPerAssociation(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/125")
+	expectedClientID := []byte("Client-id")
+
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+	pool.SetAddressesPerAssociation(2)
+	ias, err := pool.ReserveAddresses(expectedClientID, [][]byte{[]byte("id-1"), []byte("id-2"), []byte("id-3")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i, ia := range ias {
+		ips := ia.IPAddresses()
+		if len(ips) != 2 {
+			t.Fatalf("Expected 2 addresses in association %d, got %v", i, ips)
+		}
+		for j, ip := range ips {
+			expectedIP := net.IP{0x20, 0x01, 0x0d, 0xb8, 0xf0, 0x0f, 0xca, 0xfe, 0, 0, 0, 0, 0, 0, 0, byte(2*i + j + 1)}
+			if !ip.Equal(expectedIP) {
+				t.Fatalf("Expected ip address %s in association %d, but got: %s", expectedIP, i, ip)
+			}
+		}
+	}
+
+	// a single address is left, not enough for another association
+	if _, err := pool.ReserveAddresses(expectedClientID, [][]byte{[]byte("id-4")}); err != dhcp6.ErrPoolExhausted {
+		t.Fatalf("Expected ErrPoolExhausted when reserving from a nearly exhausted pool, got: %v", err)
+	}
+
+	pool.ReleaseAddresses(expectedClientID, [][]byte{[]byte("id-2")})
+	ias, err = pool.ReserveAddresses(expectedClientID, [][]byte{[]byte("id-4")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ips := ias[0].IPAddresses()
+	if len(ips) != 2 || ips[0].Equal(ips[1]) {
+		t.Fatalf("Expected 2 distinct addresses after releasing an association, got: %v", ips)
+	}
+	for _, ip := range ips {
+		if ip[15] != 3 && ip[15] != 4 && ip[15] != 7 {
+			t.Fatalf("Expected only free addresses to be reserved, got: %s", ip)
+		}
+	}
+}
+
+type bootURLConfiguration string
+
+func (c bootURLConfiguration) GetBootURL(id []byte, clientArchType uint16) ([]byte, error) {
+	return []byte(c), nil
+}
+func (c bootURLConfiguration) GetPreference(id []byte, clientArchType uint16) []byte {
+	return nil
+}
+func (c bootURLConfiguration) GetRecursiveDNS(id []byte, clientArchType uint16) ([]net.IP, error) {
+	return nil, nil
+}
+func (c bootURLConfiguration) GetDNSSearchList() []string { return nil }
+func (c bootURLConfiguration) GetNTPServers() []net.IP    { return nil }
+
+func TestMemoryPoolSeveralAddressesPerAssociationInReply(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	pool := NewMemoryAddressPool(cidr, 100*time.Second)
+	pool.SetAddressesPerAssociation(2)
+
+	options := make(dhcp6.Options)
+	options.Add(dhcp6.MakeOption(dhcp6.OptClientID, []byte{0x0, 0x3, 0x0, 0x1, 0x2, 0x42, 0xac, 0x11, 0x0, 0x2}))
+	options.Add(dhcp6.MakeOption(dhcp6.OptServerID, []byte("serverid")))
+	options.Add(dhcp6.MakeIaNaOption([]byte("id-1"), 0, 0))
+	request := &dhcp6.Packet{Type: dhcp6.MsgRequest, TransactionID: [3]byte{'1', '2', '3'}, Options: options}
+
+	builder := dhcp6.MakePacketBuilder(90, 100)
+	reply, err := builder.BuildResponse(request, []byte("serverid"), bootURLConfiguration("http://bootfileurl"), pool)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	marshalled, err := reply.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal reply: %s", err)
+	}
+	decoded, err := dhcp6.Unmarshal(marshalled, len(marshalled))
+	if err != nil {
+		t.Fatalf("Failed to unmarshal reply: %s", err)
+	}
+	if ids := decoded.Options.IaNaIDs(); len(ids) != 1 || string(ids[0]) != "id-1" {
+		t.Fatalf("Expected a single identity association id-1, got %q", ids)
+	}
+	addresses := decoded.Options.IaNaAddresses()
+	if len(addresses) != 2 || !addresses[0].Equal(net.ParseIP("2001:db8:f00f:cafe::1")) ||
+		!addresses[1].Equal(net.ParseIP("2001:db8:f00f:cafe::2")) {
+		t.Fatalf("Expected both reserved addresses in the reply, got %v", addresses)
+	}
+}
@@ -0,0 +1,177 @@
+package pool
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// AddressPoolStats counts the addresses handed out by a MeteredAddressPool
+type AddressPoolStats struct {
+	// Allocations and Releases are the numbers of addresses handed out to, and released by, clients since the
+	// pool was created. Addresses handed out again to the same client don't count as new allocations.
+	Allocations uint64
+	Releases    uint64
+	// Expirations is the number of addresses that went back to the pool because their lease expired
+	Expirations uint64
+	// InUse is the number of addresses currently handed out, and HighWater the highest it has been
+	InUse     int
+	HighWater int
+}
+
+// MeteredAddressPool wraps an AddressPool, keeping count of the addresses it hands out, see Stats
+type MeteredAddressPool struct {
+	// OnAllocate and OnRelease, if set, are called with the client ID and address every time an address is handed
+	// out to a client, and every time it goes back to the pool, released by the client or expired. They are
+	// called without locks held, so they may call Stats.
+	OnAllocate func(clientID []byte, ip net.IP)
+	OnRelease  func(clientID []byte, ip net.IP)
+
+	pool    dhcp6.AddressPool
+	inUse   map[string]*meteredAddress
+	stats   AddressPoolStats
+	timeNow func() time.Time
+	lock    sync.Mutex
+}
+
+// meteredAddress is an address handed out by the wrapped pool
+type meteredAddress struct {
+	ip        net.IP
+	clientID  []byte
+	expiresAt time.Time
+}
+
+// meteredEvent is a call to OnAllocate or OnRelease, made once the lock is released
+type meteredEvent struct {
+	callback func(clientID []byte, ip net.IP)
+	clientID []byte
+	ip       net.IP
+}
+
+// NewMeteredAddressPool creates a new MeteredAddressPool handing out addresses from pool
+func NewMeteredAddressPool(pool dhcp6.AddressPool) *MeteredAddressPool {
+	return &MeteredAddressPool{
+		pool:    pool,
+		inUse:   make(map[string]*meteredAddress),
+		timeNow: time.Now,
+	}
+}
+
+// Stats returns the address counts of the pool
+func (p *MeteredAddressPool) Stats() AddressPoolStats {
+	p.lock.Lock()
+	events := p.expire()
+	stats := p.stats
+	p.lock.Unlock()
+
+	p.run(events)
+	return stats
+}
+
+// Contains returns true if ip belongs to the wrapped pool
+func (p *MeteredAddressPool) Contains(ip net.IP) bool {
+	return p.pool.Contains(ip)
+}
+
+// ReserveAddresses reserves addresses in the wrapped pool, counting the ones new to the client as allocations
+func (p *MeteredAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	return p.ReserveAddressesForLink(nil, clientID, interfaceIDs)
+}
+
+// ReserveAddressesForLink reserves addresses in the wrapped pool, counting the ones new to the client as
+// allocations
+func (p *MeteredAddressPool) ReserveAddressesForLink(linkAddr net.IP, clientID []byte,
+	interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	associations, err := p.pool.ReserveAddressesForLink(linkAddr, clientID, interfaceIDs)
+	p.track(associations)
+	return associations, err
+}
+
+// ReleaseAddresses releases addresses in the wrapped pool, counting the ones that were in use as releases
+func (p *MeteredAddressPool) ReleaseAddresses(clientID []byte, interfaceIDs [][]byte) {
+	released := p.pool.LookupAddresses(clientID, interfaceIDs)
+	p.pool.ReleaseAddresses(clientID, interfaceIDs)
+
+	p.lock.Lock()
+	events := p.expire()
+	for _, association := range released {
+		for _, ip := range association.IPAddresses() {
+			address, exists := p.inUse[string(ip.To16())]
+			if !exists {
+				continue
+			}
+			delete(p.inUse, string(ip.To16()))
+			p.stats.Releases++
+			p.stats.InUse--
+			events = append(events, meteredEvent{p.OnRelease, address.clientID, address.ip})
+		}
+	}
+	p.lock.Unlock()
+
+	p.run(events)
+}
+
+// LookupAddresses returns active associations in the wrapped pool
+func (p *MeteredAddressPool) LookupAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	return p.pool.LookupAddresses(clientID, interfaceIDs)
+}
+
+// ExtendAddresses extends associations in the wrapped pool, keeping their addresses counted as in use
+func (p *MeteredAddressPool) ExtendAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	associations := p.pool.ExtendAddresses(clientID, interfaceIDs)
+	p.track(associations)
+	return associations
+}
+
+// track counts the addresses in associations as in use, until they expire
+func (p *MeteredAddressPool) track(associations []*dhcp6.IdentityAssociation) {
+	p.lock.Lock()
+	events := p.expire()
+	for _, association := range associations {
+		for _, ip := range association.IPAddresses() {
+			key := string(ip.To16())
+			if address, exists := p.inUse[key]; exists {
+				address.expiresAt = association.ExpiresAt
+				continue
+			}
+			p.inUse[key] = &meteredAddress{ip: ip, clientID: association.ClientID, expiresAt: association.ExpiresAt}
+			p.stats.Allocations++
+			p.stats.InUse++
+			if p.stats.InUse > p.stats.HighWater {
+				p.stats.HighWater = p.stats.InUse
+			}
+			events = append(events, meteredEvent{p.OnAllocate, association.ClientID, ip})
+		}
+	}
+	p.lock.Unlock()
+
+	p.run(events)
+}
+
+// expire stops counting addresses whose lease expired as in use, and returns the OnRelease calls to make. Leases
+// with no expiration time never expire. Must be called with the lock held.
+func (p *MeteredAddressPool) expire() []meteredEvent {
+	var events []meteredEvent
+	now := p.timeNow()
+	for key, address := range p.inUse {
+		if address.expiresAt.IsZero() || now.Before(address.expiresAt) {
+			continue
+		}
+		delete(p.inUse, key)
+		p.stats.Expirations++
+		p.stats.InUse--
+		events = append(events, meteredEvent{p.OnRelease, address.clientID, address.ip})
+	}
+	return events
+}
+
+// run makes the callback calls in events
+func (p *MeteredAddressPool) run(events []meteredEvent) {
+	for _, event := range events {
+		if event.callback != nil {
+			event.callback(event.clientID, event.ip)
+		}
+	}
+}
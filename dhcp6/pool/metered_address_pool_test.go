@@ -0,0 +1,72 @@
+package pool
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMeteredAddressPoolCountsReserveReleaseCycles(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("2001:db8:f00f:cafe::/64")
+	expectedTime := time.Now()
+	memoryPool := NewMemoryAddressPool(cidr, 100*time.Second)
+	memoryPool.timeNow = func() time.Time { return expectedTime }
+	pool := NewMeteredAddressPool(memoryPool)
+	pool.timeNow = memoryPool.timeNow
+
+	var allocated, released []string
+	pool.OnAllocate = func(clientID []byte, ip net.IP) { allocated = append(allocated, string(clientID)+" "+ip.String()) }
+	pool.OnRelease = func(clientID []byte, ip net.IP) { released = append(released, string(clientID)+" "+ip.String()) }
+
+	expectStats := func(step string, expected AddressPoolStats) {
+		t.Helper()
+		if stats := pool.Stats(); stats != expected {
+			t.Fatalf("%s: expected stats %+v, got %+v", step, expected, stats)
+		}
+	}
+
+	ias1, err := pool.ReserveAddresses([]byte("client-1"), [][]byte{[]byte("id-1"), []byte("id-2")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := pool.ReserveAddresses([]byte("client-2"), [][]byte{[]byte("id-1")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectStats("After reserving", AddressPoolStats{Allocations: 3, InUse: 3, HighWater: 3})
+
+	// Retransmissions get the same addresses, which aren't new allocations
+	if _, err := pool.ReserveAddresses([]byte("client-1"), [][]byte{[]byte("id-1")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectStats("After reserving again", AddressPoolStats{Allocations: 3, InUse: 3, HighWater: 3})
+
+	pool.ReleaseAddresses([]byte("client-1"), [][]byte{[]byte("id-1"), []byte("id-2")})
+	expectStats("After releasing", AddressPoolStats{Allocations: 3, Releases: 2, InUse: 1, HighWater: 3})
+	if len(released) != 2 || released[0] != "client-1 "+ias1[0].IPAddress.String() {
+		t.Fatalf("Expected 2 releases of client-1, starting with %s, got %v", ias1[0].IPAddress, released)
+	}
+
+	// Releasing addresses again, or addresses that were never handed out, changes nothing
+	pool.ReleaseAddresses([]byte("client-1"), [][]byte{[]byte("id-1"), []byte("id-3")})
+	expectStats("After releasing again", AddressPoolStats{Allocations: 3, Releases: 2, InUse: 1, HighWater: 3})
+
+	if _, err := pool.ReserveAddresses([]byte("client-3"), [][]byte{[]byte("id-1")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectStats("After reserving after release", AddressPoolStats{Allocations: 4, Releases: 2, InUse: 2, HighWater: 3})
+	if len(allocated) != 4 {
+		t.Fatalf("Expected 4 allocation callbacks, got %v", allocated)
+	}
+
+	// Extending client-2's lease keeps its address in use past client-3's expiration
+	memoryPool.timeNow = func() time.Time { return expectedTime.Add(90 * time.Second) }
+	pool.timeNow = memoryPool.timeNow
+	if ias := pool.ExtendAddresses([]byte("client-2"), [][]byte{[]byte("id-1")}); len(ias) != 1 {
+		t.Fatalf("Expected client-2's lease to be extended, got %v", ias)
+	}
+	pool.timeNow = func() time.Time { return expectedTime.Add(101 * time.Second) }
+	expectStats("After expiration", AddressPoolStats{Allocations: 4, Releases: 2, Expirations: 1, InUse: 1, HighWater: 3})
+	if len(released) != 3 || released[2][:len("client-3")] != "client-3" {
+		t.Fatalf("Expected client-3's address to be released on expiration, got %v", released)
+	}
+}
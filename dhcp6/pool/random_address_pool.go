@@ -1,7 +1,6 @@
 package pool
 
 import (
-	"fmt"
 	"go.universe.tf/netboot/dhcp6"
 	"hash/fnv"
 	"math/big"
@@ -70,6 +69,16 @@ func NewRandomAddressPool(poolStartAddress net.IP, poolSize uint64, validLifetim
 	return ret
 }
 
+// Contains returns true if ip falls within the range of addresses handed out by the pool
+func (p *RandomAddressPool) Contains(ip net.IP) bool {
+	addr := big.NewInt(0).SetBytes(ip.To16())
+	if addr.Cmp(p.poolStartAddress) < 0 {
+		return false
+	}
+	poolEndAddress := big.NewInt(0).Add(p.poolStartAddress, big.NewInt(0).SetUint64(p.poolSize))
+	return addr.Cmp(poolEndAddress) < 0
+}
+
 // ReserveAddresses creates new or retrieves active associations for interfaces in interfaceIDs list.
 func (p *RandomAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
 	p.lock.Lock()
@@ -89,7 +98,7 @@ func (p *RandomAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]b
 			continue
 		}
 		if uint64(len(p.usedIps)) == p.poolSize {
-			return ret, fmt.Errorf("No more free ip addresses are currently available in the pool")
+			return ret, dhcp6.ErrPoolExhausted
 		}
 
 		for {
@@ -102,10 +111,11 @@ func (p *RandomAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]b
 				association := &dhcp6.IdentityAssociation{ClientID: clientID,
 					InterfaceID: interfaceID,
 					IPAddress:   newIP.Bytes(),
-					CreatedAt:   timeNow}
+					CreatedAt:   timeNow,
+					ExpiresAt:   p.calculateAssociationExpiration(timeNow)}
 				p.identityAssociations[clientIDHash] = association
 				p.usedIps[newIP.Uint64()] = struct{}{}
-				p.identityAssociationExpirations.Push(&associationExpiration{expiresAt: p.calculateAssociationExpiration(timeNow), ia: association})
+				p.identityAssociationExpirations.Push(&associationExpiration{expiresAt: association.ExpiresAt, ia: association})
 				ret = append(ret, association)
 				break
 			}
@@ -115,6 +125,12 @@ func (p *RandomAddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]b
 	return ret, nil
 }
 
+// ReserveAddressesForLink is the same as ReserveAddresses, the pool has a single range for all links
+func (p *RandomAddressPool) ReserveAddressesForLink(linkAddr net.IP, clientID []byte,
+	interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	return p.ReserveAddresses(clientID, interfaceIDs)
+}
+
 // ReleaseAddresses returns IP addresses associated with ClientID and interfaceIDs back into the address pool
 func (p *RandomAddressPool) ReleaseAddresses(clientID []byte, interfaceIDs [][]byte) {
 	p.lock.Lock()
@@ -130,6 +146,45 @@ func (p *RandomAddressPool) ReleaseAddresses(clientID []byte, interfaceIDs [][]b
 	}
 }
 
+// LookupAddresses returns active associations for interfaces in interfaceIDs list, without creating new ones.
+// Interfaces with no active association are left out of the result.
+func (p *RandomAddressPool) LookupAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.expireIdentityAssociations()
+
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	for _, interfaceID := range interfaceIDs {
+		association, exists := p.identityAssociations[p.calculateIAIDHash(clientID, interfaceID)]
+		if exists {
+			ret = append(ret, association)
+		}
+	}
+	return ret
+}
+
+// ExtendAddresses resets the valid lifetime of active associations for interfaces in interfaceIDs list.
+// Interfaces with no active association are left out of the result.
+func (p *RandomAddressPool) ExtendAddresses(clientID []byte, interfaceIDs [][]byte) []*dhcp6.IdentityAssociation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.expireIdentityAssociations()
+
+	ret := make([]*dhcp6.IdentityAssociation, 0, len(interfaceIDs))
+	for _, interfaceID := range interfaceIDs {
+		association, exists := p.identityAssociations[p.calculateIAIDHash(clientID, interfaceID)]
+		if !exists {
+			continue
+		}
+		association.ExpiresAt = p.calculateAssociationExpiration(p.timeNow())
+		p.identityAssociationExpirations.Push(&associationExpiration{expiresAt: association.ExpiresAt, ia: association})
+		ret = append(ret, association)
+	}
+	return ret
+}
+
 // expireIdentityAssociations releases IP addresses in identity associations that reached the end of valid lifetime
 // back into the address pool. Note it should be called from under the RandomAddressPool.lock.
 func (p *RandomAddressPool) expireIdentityAssociations() {
@@ -142,7 +197,12 @@ func (p *RandomAddressPool) expireIdentityAssociations() {
 			break
 		}
 		p.identityAssociationExpirations.Shift()
-		delete(p.identityAssociations, p.calculateIAIDHash(expiration.ia.ClientID, expiration.ia.InterfaceID))
+		clientIDHash := p.calculateIAIDHash(expiration.ia.ClientID, expiration.ia.InterfaceID)
+		if p.identityAssociations[clientIDHash] != expiration.ia || p.timeNow().Before(expiration.ia.ExpiresAt) {
+			// association was released or extended since this expiration was scheduled
+			continue
+		}
+		delete(p.identityAssociations, clientIDHash)
 		delete(p.usedIps, big.NewInt(0).SetBytes(expiration.ia.IPAddress).Uint64())
 	}
 }
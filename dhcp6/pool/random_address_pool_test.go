@@ -145,3 +145,86 @@ func TestReleaseAddress(t *testing.T) {
 		t.Fatalf("identity association for %v should've been removed, but is still available", a[0].IPAddress)
 	}
 }
+
+func TestLookupAddress(t *testing.T) {
+	expectedClientID := []byte("Client-id")
+	expectedIAID := []byte("interface-id")
+	unknownIAID := []byte("unknown-id")
+	expectedTime := time.Now()
+	expectedMaxLifetime := uint32(100)
+
+	pool := NewRandomAddressPool(net.ParseIP("2001:db8:f00f:cafe::1"), 1, expectedMaxLifetime)
+	pool.timeNow = func() time.Time { return expectedTime }
+	reserved, _ := pool.ReserveAddresses(expectedClientID, [][]byte{expectedIAID})
+
+	found := pool.LookupAddresses(expectedClientID, [][]byte{expectedIAID, unknownIAID})
+	if len(found) != 1 {
+		t.Fatalf("Expected 1 identity association, got %d", len(found))
+	}
+	if string(found[0].IPAddress) != string(reserved[0].IPAddress) {
+		t.Fatalf("Expected ip address %v, got %v", reserved[0].IPAddress, found[0].IPAddress)
+	}
+	if len(pool.identityAssociations) != 1 {
+		t.Fatalf("LookupAddresses shouldn't create new identity associations")
+	}
+}
+
+func TestExtendAddressResetsValidLifetime(t *testing.T) {
+	expectedClientID := []byte("Client-id")
+	expectedIAID := []byte("interface-id")
+	now := time.Now()
+	expectedMaxLifetime := uint32(100)
+
+	pool := NewRandomAddressPool(net.ParseIP("2001:db8:f00f:cafe::1"), 1, expectedMaxLifetime)
+	pool.timeNow = func() time.Time { return now }
+	reserved, _ := pool.ReserveAddresses(expectedClientID, [][]byte{expectedIAID})
+
+	for i := 0; i < 2; i++ {
+		now = now.Add(80 * time.Second)
+		extended := pool.ExtendAddresses(expectedClientID, [][]byte{expectedIAID})
+		if len(extended) != 1 {
+			t.Fatalf("Expected 1 identity association, got %d", len(extended))
+		}
+		if string(extended[0].IPAddress) != string(reserved[0].IPAddress) {
+			t.Fatalf("Expected ip address %v, got %v", reserved[0].IPAddress, extended[0].IPAddress)
+		}
+		if extended[0].ExpiresAt != pool.calculateAssociationExpiration(now) {
+			t.Fatalf("Expected association to expire at %v, but got %v",
+				pool.calculateAssociationExpiration(now), extended[0].ExpiresAt)
+		}
+	}
+
+	// past the original expiration, but within the extended one
+	now = now.Add(50 * time.Second)
+	if found := pool.LookupAddresses(expectedClientID, [][]byte{expectedIAID}); len(found) != 1 {
+		t.Fatalf("Extended identity association shouldn't have expired")
+	}
+
+	now = now.Add(60 * time.Second)
+	if found := pool.LookupAddresses(expectedClientID, [][]byte{expectedIAID}); len(found) != 0 {
+		t.Fatalf("Identity association should have expired")
+	}
+}
+
+func TestExtendAddressSkipsUnknownInterfaces(t *testing.T) {
+	pool := NewRandomAddressPool(net.ParseIP("2001:db8:f00f:cafe::1"), 1, 100)
+
+	extended := pool.ExtendAddresses([]byte("Client-id"), [][]byte{[]byte("interface-id")})
+	if len(extended) != 0 {
+		t.Fatalf("Expected no identity associations, got %d", len(extended))
+	}
+}
+
+func TestContains(t *testing.T) {
+	pool := NewRandomAddressPool(net.ParseIP("2001:db8:f00f:cafe::1"), 2, 100)
+
+	if !pool.Contains(net.ParseIP("2001:db8:f00f:cafe::2")) {
+		t.Fatalf("Expected 2001:db8:f00f:cafe::2 to be in the pool")
+	}
+	if pool.Contains(net.ParseIP("2001:db8:f00f:cafe::3")) {
+		t.Fatalf("Expected 2001:db8:f00f:cafe::3 not to be in the pool")
+	}
+	if pool.Contains(net.ParseIP("2001:db8:f00f:cafe::")) {
+		t.Fatalf("Expected 2001:db8:f00f:cafe:: not to be in the pool")
+	}
+}
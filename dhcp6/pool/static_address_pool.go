@@ -0,0 +1,157 @@
+package pool
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// StaticAddressPool hands out fixed addresses to clients listed in a file, and falls through to another pool,
+// if any, for other clients. Each client gets its fixed address in the first identity association it asks an
+// address for, additional identity associations are handled like those of unlisted clients.
+//
+// The file has one "<client> <ip>" pair per line. The client is either a 6 byte link-layer address, e.g.
+// 52:54:00:12:34:56, matched against the link-layer address in DUID-LLT and DUID-LL client IDs, or a full DUID
+// in hex, with or without colons between bytes. Empty lines and lines starting with # are ignored.
+type StaticAddressPool struct {
+	fixedAddressPool
+	path string
+	// byMAC and byDUID hold fixed addresses keyed by link-layer address and DUID
+	byMAC  map[string]net.IP
+	byDUID map[string]net.IP
+}
+
+// NewStaticAddressPool creates a new StaticAddressPool handing out the fixed addresses listed in the file at
+// path, with associations valid for lifetime unless extended. Unlisted clients get addresses from fallback,
+// or ErrPoolExhausted if fallback is nil. Fixed addresses must be outside of fallback's range.
+func NewStaticAddressPool(path string, fallback dhcp6.AddressPool, lifetime time.Duration) (*StaticAddressPool, error) {
+	ret := &StaticAddressPool{
+		fixedAddressPool: newFixedAddressPool(fallback, lifetime),
+		path:             path,
+	}
+	ret.address = ret.staticAddress
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Reload reads the file of fixed addresses again. Associations of clients whose fixed address changed or that
+// are no longer listed are dropped, so that those clients get their new address when they next ask for one.
+// If the file can't be read or parsed, the current addresses are kept.
+func (p *StaticAddressPool) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("Error reading static addresses: %s", err)
+	}
+	defer f.Close()
+	byMAC, byDUID, err := p.parse(f)
+	if err != nil {
+		return fmt.Errorf("Error reading static addresses from %s: %s", p.path, err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.byMAC, p.byDUID = byMAC, byDUID
+	for clientID, association := range p.associations {
+		if ip := p.staticAddress([]byte(clientID)); ip == nil || !ip.Equal(association.IPAddress) {
+			delete(p.associations, clientID)
+		}
+	}
+	return nil
+}
+
+func (p *StaticAddressPool) parse(r io.Reader) (byMAC, byDUID map[string]net.IP, err error) {
+	byMAC = make(map[string]net.IP)
+	byDUID = make(map[string]net.IP)
+	usedIps := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("line %d: expected \"<client> <ip>\", got %q", lineNo, line)
+		}
+		client, err := hex.DecodeString(strings.Replace(fields[0], ":", "", -1))
+		if err != nil || len(client) < 3 {
+			return nil, nil, fmt.Errorf("line %d: %q is neither a link-layer address nor a DUID", lineNo, fields[0])
+		}
+		ip := net.ParseIP(fields[1])
+		if ip == nil || ip.To4() != nil {
+			return nil, nil, fmt.Errorf("line %d: %q isn't an IPv6 address", lineNo, fields[1])
+		}
+		if _, used := usedIps[string(ip)]; used {
+			return nil, nil, fmt.Errorf("line %d: address %s is assigned more than once", lineNo, ip)
+		}
+		if p.fallback != nil && p.fallback.Contains(ip) {
+			return nil, nil, fmt.Errorf("line %d: address %s is in the range of the fallback pool", lineNo, ip)
+		}
+		usedIps[string(ip)] = struct{}{}
+
+		entries := byDUID
+		if len(client) == 6 {
+			entries = byMAC
+		}
+		if _, exists := entries[string(client)]; exists {
+			return nil, nil, fmt.Errorf("line %d: client %s is listed more than once", lineNo, fields[0])
+		}
+		entries[string(client)] = ip
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return byMAC, byDUID, nil
+}
+
+// staticAddress returns the fixed address of the client, or nil if it isn't listed. A DUID match takes
+// precedence over a link-layer address match. Note it should be called from under the StaticAddressPool.lock.
+func (p *StaticAddressPool) staticAddress(clientID []byte) net.IP {
+	if ip, exists := p.byDUID[string(clientID)]; exists {
+		return ip
+	}
+	if mac := duidLinkLayerAddress(clientID); mac != nil {
+		return p.byMAC[string(mac)]
+	}
+	return nil
+}
+
+// duidLinkLayerAddress returns the link-layer address in DUID-LLT and DUID-LL DUIDs, see RFC 8415, sections
+// 11.2 and 11.4, or nil for other DUIDs
+func duidLinkLayerAddress(duid []byte) []byte {
+	if len(duid) < 2 {
+		return nil
+	}
+	switch {
+	case duid[1] == 1 && duid[0] == 0 && len(duid) > 8:
+		return duid[8:]
+	case duid[1] == 3 && duid[0] == 0 && len(duid) > 4:
+		return duid[4:]
+	default:
+		return nil
+	}
+}
+
+// Contains returns true if ip is one of the fixed addresses, or falls within the range of the fallback pool
+func (p *StaticAddressPool) Contains(ip net.IP) bool {
+	p.lock.Lock()
+	for _, entries := range []map[string]net.IP{p.byMAC, p.byDUID} {
+		for _, staticIP := range entries {
+			if staticIP.Equal(ip) {
+				p.lock.Unlock()
+				return true
+			}
+		}
+	}
+	p.lock.Unlock()
+	return p.fallback != nil && p.fallback.Contains(ip)
+}
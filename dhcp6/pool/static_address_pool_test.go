@@ -0,0 +1,152 @@
+package pool
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// writeStaticAddresses writes contents to a temporary file, which the caller should remove
+func writeStaticAddresses(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "static-addresses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestStaticAddressPoolReservesStaticAddress(t *testing.T) {
+	path := writeStaticAddresses(t, `# lab machines
+52:54:00:12:34:56 2001:db8:1::10
+
+00:02:00:00:ab:11:01:02:03 2001:db8:1::20
+`)
+	defer os.Remove(path)
+	pool, err := NewStaticAddressPool(path, nil, 100*time.Second)
+	if err != nil {
+		t.Fatalf("Error loading static addresses: %s", err)
+	}
+
+	// DUID-LLT with link-layer address 52:54:00:12:34:56
+	duidLLT := []byte{0, 1, 0, 1, 0x5e, 0x41, 0x3f, 0x10, 0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	ias, err := pool.ReserveAddresses(duidLLT, [][]byte{[]byte("id-1")})
+	if err != nil {
+		t.Fatalf("Error reserving static address: %s", err)
+	}
+	if len(ias) != 1 || !ias[0].IPAddress.Equal(net.ParseIP("2001:db8:1::10")) {
+		t.Fatalf("Expected static address 2001:db8:1::10, got %v", ias)
+	}
+
+	ias, err = pool.ReserveAddresses([]byte{0, 2, 0, 0, 0xab, 0x11, 1, 2, 3}, [][]byte{[]byte("id-1")})
+	if err != nil {
+		t.Fatalf("Error reserving static address: %s", err)
+	}
+	if len(ias) != 1 || !ias[0].IPAddress.Equal(net.ParseIP("2001:db8:1::20")) {
+		t.Fatalf("Expected static address 2001:db8:1::20, got %v", ias)
+	}
+
+	// the fixed address goes in the first identity association only
+	ias, err = pool.ReserveAddresses(duidLLT, [][]byte{[]byte("id-1"), []byte("id-2")})
+	if err != dhcp6.ErrPoolExhausted {
+		t.Fatalf("Expected ErrPoolExhausted for a second identity association, got %s", err)
+	}
+	if len(ias) != 1 || string(ias[0].InterfaceID) != "id-1" {
+		t.Fatalf("Expected the association of id-1 only, got %v", ias)
+	}
+	if !pool.Contains(net.ParseIP("2001:db8:1::10")) || pool.Contains(net.ParseIP("2001:db8:1::30")) {
+		t.Fatalf("Contains doesn't match the static addresses")
+	}
+
+	pool.ReleaseAddresses(duidLLT, [][]byte{[]byte("id-1")})
+	if ias := pool.LookupAddresses(duidLLT, [][]byte{[]byte("id-1")}); len(ias) != 0 {
+		t.Fatalf("Expected no associations after release, got %v", ias)
+	}
+}
+
+func TestStaticAddressPoolFallsThrough(t *testing.T) {
+	path := writeStaticAddresses(t, "52:54:00:12:34:56 2001:db8:1::10\n")
+	defer os.Remove(path)
+	fallback := NewRandomAddressPool(net.ParseIP("2001:db8:2::1"), 1, 100)
+	pool, err := NewStaticAddressPool(path, fallback, 100*time.Second)
+	if err != nil {
+		t.Fatalf("Error loading static addresses: %s", err)
+	}
+
+	clientID := []byte{0, 3, 0, 1, 0x52, 0x54, 0x00, 0xaa, 0xbb, 0xcc}
+	ias, err := pool.ReserveAddresses(clientID, [][]byte{[]byte("id-1")})
+	if err != nil {
+		t.Fatalf("Error reserving address from the fallback pool: %s", err)
+	}
+	if len(ias) != 1 || !ias[0].IPAddress.Equal(net.ParseIP("2001:db8:2::1")) {
+		t.Fatalf("Expected the fallback pool's address 2001:db8:2::1, got %v", ias)
+	}
+	if ias := pool.ExtendAddresses(clientID, [][]byte{[]byte("id-1")}); len(ias) != 1 {
+		t.Fatalf("Expected the fallback pool's association to be extended, got %v", ias)
+	}
+	if !pool.Contains(net.ParseIP("2001:db8:2::1")) {
+		t.Fatalf("Contains doesn't cover the fallback pool's range")
+	}
+}
+
+func TestStaticAddressPoolReload(t *testing.T) {
+	path := writeStaticAddresses(t, "52:54:00:12:34:56 2001:db8:1::10\n")
+	defer os.Remove(path)
+	pool, err := NewStaticAddressPool(path, nil, 100*time.Second)
+	if err != nil {
+		t.Fatalf("Error loading static addresses: %s", err)
+	}
+	clientID := []byte{0, 3, 0, 1, 0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	if _, err := pool.ReserveAddresses(clientID, [][]byte{[]byte("id-1")}); err != nil {
+		t.Fatalf("Error reserving static address: %s", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("52:54:00:12:34:56 2001:db8:1::11\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Reload(); err != nil {
+		t.Fatalf("Error reloading static addresses: %s", err)
+	}
+	if ias := pool.LookupAddresses(clientID, [][]byte{[]byte("id-1")}); len(ias) != 0 {
+		t.Fatalf("Expected the association of the old address to be dropped, got %v", ias)
+	}
+	ias, err := pool.ReserveAddresses(clientID, [][]byte{[]byte("id-1")})
+	if err != nil || len(ias) != 1 || !ias[0].IPAddress.Equal(net.ParseIP("2001:db8:1::11")) {
+		t.Fatalf("Expected new static address 2001:db8:1::11, got %v (%v)", ias, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not a mapping\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Reload(); err == nil {
+		t.Fatalf("Expected an error reloading a malformed file")
+	}
+	if !pool.Contains(net.ParseIP("2001:db8:1::11")) {
+		t.Fatalf("Static addresses were lost after a failed reload")
+	}
+}
+
+func TestStaticAddressPoolRejectsMalformedFiles(t *testing.T) {
+	fallback := NewRandomAddressPool(net.ParseIP("2001:db8:2::1"), 10, 100)
+	for _, contents := range []string{
+		"52:54:00:12:34:56\n",
+		"zz:54:00:12:34:56 2001:db8:1::10\n",
+		"52:54:00:12:34:56 192.0.2.1\n",
+		"52:54:00:12:34:56 2001:db8:1::10\n52:54:00:12:34:57 2001:db8:1::10\n",
+		"52:54:00:12:34:56 2001:db8:1::10\n52:54:00:12:34:56 2001:db8:1::11\n",
+		"52:54:00:12:34:56 2001:db8:2::5\n",
+	} {
+		path := writeStaticAddresses(t, contents)
+		defer os.Remove(path)
+		if _, err := NewStaticAddressPool(path, fallback, time.Second); err == nil {
+			t.Errorf("Expected an error loading %q", contents)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package dhcp6
+
+import (
+	"net"
+	"time"
+)
+
+// PrefixDelegation associates a delegated prefix with an IA_PD of a client
+type PrefixDelegation struct {
+	Prefix      *net.IPNet
+	ClientID    []byte
+	InterfaceID []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// PrefixPool keeps track of delegated and available prefixes
+type PrefixPool interface {
+	ReservePrefixes(clientID []byte, iaPdIDs [][]byte) ([]*PrefixDelegation, error)
+}
@@ -0,0 +1,120 @@
+package dhcp6
+
+import (
+	"fmt"
+	"net"
+)
+
+// Relay-forward and Relay-reply messages carry 1 byte of message type, 1 byte of hop count, and the link and
+// peer addresses before their options, see RFC 8415, section 9
+const relayMessageHeaderLength = 34
+
+// RelayMessage represents a Relay-forward or Relay-reply message a client message was relayed in.
+// Options don't include the Relay Message Option, which holds the relayed message itself.
+type RelayMessage struct {
+	Type        MessageType
+	HopCount    uint8
+	LinkAddress net.IP
+	PeerAddress net.IP
+	Options     Options
+}
+
+// unmarshalRelayedPacket unwraps a message from one or more nested Relay-forward or Relay-reply messages
+func unmarshalRelayedPacket(bs []byte) (*Packet, error) {
+	relays := make([]*RelayMessage, 0)
+	for len(bs) > 0 && (MessageType(bs[0]) == MsgRelayForw || MessageType(bs[0]) == MsgRelayRepl) {
+		if len(bs) < relayMessageHeaderLength {
+			return nil, fmt.Errorf("relay message is too short: %d bytes", len(bs))
+		}
+		options, err := UnmarshalOptions(bs[relayMessageHeaderLength:])
+		if err != nil {
+			return nil, fmt.Errorf("relay message has malformed options section: %s", err)
+		}
+		relayedMessage, exists := options[OptRelayMessage]
+		if !exists {
+			return nil, fmt.Errorf("relay message has no relay message option")
+		}
+		delete(options, OptRelayMessage)
+
+		relays = append(relays, &RelayMessage{
+			Type:        MessageType(bs[0]),
+			HopCount:    bs[1],
+			LinkAddress: net.IP(bs[2:18]),
+			PeerAddress: net.IP(bs[18:34]),
+			Options:     options,
+		})
+		bs = relayedMessage[0].Value
+	}
+
+	if len(bs) < 4 {
+		return nil, fmt.Errorf("relayed message is too short: %d bytes", len(bs))
+	}
+	ret, err := Unmarshal(bs, len(bs))
+	if err != nil {
+		return nil, err
+	}
+	ret.Relays = relays
+	return ret, nil
+}
+
+// LinkAddress returns the link-address of the relay closest to the client that set one, which identifies the
+// link the client is on, or nil if the packet wasn't relayed. Relays that can't tell the link set it to ::.
+func (p *Packet) LinkAddress() net.IP {
+	for i := len(p.Relays) - 1; i >= 0; i-- {
+		if linkAddr := p.Relays[i].LinkAddress; linkAddr != nil && !linkAddr.IsUnspecified() {
+			return linkAddr
+		}
+	}
+	return nil
+}
+
+// ReplyAddress returns where to send the response to p, received from src. Responses to relayed messages go,
+// wrapped in Relay-reply messages, to the server port of the relay agent that sent the outermost Relay-forward
+// message, src, which forwards them to the peer-address it recorded. Responses to messages sent directly by
+// clients go to their client port, at the link-local address they send multicast messages from, or at the
+// address they unicast the message from, see RFC 8415, sections 18.3 and 19.
+func (p *Packet) ReplyAddress(src net.IP) *net.UDPAddr {
+	if len(p.Relays) > 0 {
+		return &net.UDPAddr{IP: src, Port: 547}
+	}
+	return &net.UDPAddr{IP: src, Port: 546}
+}
+
+// makeRelayReplies returns the Relay-reply messages needed to send a response back through the relays
+// a client message came through. Hop counts, addresses and relay options are preserved.
+func makeRelayReplies(relays []*RelayMessage) []*RelayMessage {
+	ret := make([]*RelayMessage, 0, len(relays))
+	for _, relay := range relays {
+		ret = append(ret, &RelayMessage{
+			Type:        MsgRelayRepl,
+			HopCount:    relay.HopCount,
+			LinkAddress: relay.LinkAddress,
+			PeerAddress: relay.PeerAddress,
+			Options:     relay.Options,
+		})
+	}
+	return ret
+}
+
+// marshal serializes the RelayMessage wrapped around relayedMessage
+func (r *RelayMessage) marshal(relayedMessage []byte) ([]byte, error) {
+	options := make(Options)
+	for id, multipleOptions := range r.Options {
+		if id != OptRelayMessage {
+			options[id] = multipleOptions
+		}
+	}
+	options.Add(MakeOption(OptRelayMessage, relayedMessage))
+	marshalledOptions, err := options.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("relay message has malformed options section: %s", err)
+	}
+
+	ret := make([]byte, relayMessageHeaderLength+len(marshalledOptions))
+	ret[0] = byte(r.Type)
+	ret[1] = r.HopCount
+	copy(ret[2:18], r.LinkAddress.To16())
+	copy(ret[18:34], r.PeerAddress.To16())
+	copy(ret[relayMessageHeaderLength:], marshalledOptions)
+	return ret, nil
+}
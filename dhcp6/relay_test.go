@@ -0,0 +1,133 @@
+package dhcp6
+
+import (
+	"net"
+	"testing"
+)
+
+// relayedSolicit is a Solicit relayed through two relay agents, the one closest to the client
+// adding an Interface-ID option
+var relayedSolicit = []byte{
+	0x0c, 0x01, // Relay-forward, hop count 1
+	0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // link address
+	0xfe, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, // peer address
+	0x00, 0x09, 0x00, 0x4c, // Relay Message, length 76
+	0x0c, 0x00, // Relay-forward, hop count 0
+	0x20, 0x01, 0x0d, 0xb8, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // link address
+	0xfe, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x42, 0xac, 0xff, 0xfe, 0x11, 0x00, 0x02, // peer address
+	0x00, 0x12, 0x00, 0x04, 'e', 't', 'h', '0', // Interface-ID
+	0x00, 0x09, 0x00, 0x1e, // Relay Message, length 30
+	0x01, 0x95, 0x8a, 0x89, // Solicit, transaction id
+	0x00, 0x01, 0x00, 0x0a, 0x00, 0x03, 0x00, 0x01, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02, // Client ID
+	0x00, 0x06, 0x00, 0x02, 0x00, 0x3b, // ORO: Boot File URL
+	0x00, 0x08, 0x00, 0x02, 0x00, 0x00, // Elapsed Time
+}
+
+func TestUnmarshalRelayedPacket(t *testing.T) {
+	pkt, err := Unmarshal(relayedSolicit, len(relayedSolicit))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if pkt.Type != MsgSolicit {
+		t.Fatalf("Expected message type %d, got %d", MsgSolicit, pkt.Type)
+	}
+	if pkt.TransactionID != [3]byte{0x95, 0x8a, 0x89} {
+		t.Fatalf("Unexpected transaction id: %x", pkt.TransactionID)
+	}
+	if string(pkt.Options.ClientID()) != string([]byte{0x00, 0x03, 0x00, 0x01, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02}) {
+		t.Fatalf("Unexpected client id: %x", pkt.Options.ClientID())
+	}
+	if len(pkt.Relays) != 2 {
+		t.Fatalf("Expected 2 relays, got %d", len(pkt.Relays))
+	}
+	if pkt.Relays[0].HopCount != 1 || !pkt.Relays[0].LinkAddress.Equal(net.ParseIP("2001:db8:1::1")) {
+		t.Fatalf("Unexpected outer relay: %+v", pkt.Relays[0])
+	}
+	if pkt.Relays[1].HopCount != 0 || !pkt.Relays[1].PeerAddress.Equal(net.ParseIP("fe80::242:acff:fe11:2")) {
+		t.Fatalf("Unexpected inner relay: %+v", pkt.Relays[1])
+	}
+	if interfaceID := pkt.Relays[1].Options[OptInterfaceID]; len(interfaceID) != 1 || string(interfaceID[0].Value) != "eth0" {
+		t.Fatalf("Expected the inner relay's interface id option to be kept")
+	}
+	if _, exists := pkt.Relays[1].Options[OptRelayMessage]; exists {
+		t.Fatalf("Expected the relay message option to be removed from relay options")
+	}
+}
+
+func TestReplyAddress(t *testing.T) {
+	relayed, err := Unmarshal(relayedSolicit, len(relayedSolicit))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	direct := &Packet{Type: MsgSolicit, Options: make(Options)}
+
+	for _, test := range []struct {
+		name         string
+		pkt          *Packet
+		src          net.IP
+		expectedIP   net.IP
+		expectedPort int
+	}{
+		// the relay agent that sent the Relay-forward, not the peer-address it recorded
+		{"relayed", relayed, net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8:1::1"), 547},
+		{"direct", direct, net.ParseIP("fe80::242:acff:fe11:2"), net.ParseIP("fe80::242:acff:fe11:2"), 546},
+		{"direct unicast", direct, net.ParseIP("2001:db8:f00f:cafe::1"), net.ParseIP("2001:db8:f00f:cafe::1"), 546},
+	} {
+		dst := test.pkt.ReplyAddress(test.src)
+		if !dst.IP.Equal(test.expectedIP) || dst.Port != test.expectedPort {
+			t.Fatalf("%s: expected reply to [%s]:%d, got %s", test.name, test.expectedIP, test.expectedPort, dst)
+		}
+	}
+}
+
+func TestUnmarshalRelayForwardWithoutRelayMessage(t *testing.T) {
+	bs := make([]byte, relayMessageHeaderLength)
+	bs[0] = byte(MsgRelayForw)
+
+	if _, err := Unmarshal(bs, len(bs)); err == nil {
+		t.Fatalf("Expected an error for a relay message without relayed message")
+	}
+}
+
+func TestBuildResponseToRelayedPacket(t *testing.T) {
+	pkt, err := Unmarshal(relayedSolicit, len(relayedSolicit))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	builder := MakePacketBuilder(90, 100)
+	configuration := &fakeBootConfiguration{bootURL: []byte("http://bootfileurl")}
+
+	response, err := builder.BuildResponse(pkt, []byte("serverid"), configuration, &fakeAddressPool{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	marshalled, err := response.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal response: %s", err)
+	}
+
+	for i, expectedHopCount := range []uint8{1, 0} {
+		if MessageType(marshalled[0]) != MsgRelayRepl {
+			t.Fatalf("Expected relay level %d to be a Relay-reply, got message type %d", i, marshalled[0])
+		}
+		if marshalled[1] != expectedHopCount {
+			t.Fatalf("Expected hop count %d at relay level %d, got %d", expectedHopCount, i, marshalled[1])
+		}
+		if i == 0 && string(marshalled[2:34]) != string(relayedSolicit[2:34]) {
+			t.Fatalf("Expected link and peer addresses of the outer relay to be preserved")
+		}
+		options, err := UnmarshalOptions(marshalled[relayMessageHeaderLength:])
+		if err != nil {
+			t.Fatalf("Failed to unmarshal relay options: %s", err)
+		}
+		if i == 1 && string(options[OptInterfaceID][0].Value) != "eth0" {
+			t.Fatalf("Expected interface id option to be preserved")
+		}
+		marshalled = options[OptRelayMessage][0].Value
+	}
+
+	if MessageType(marshalled[0]) != MsgAdvertise {
+		t.Fatalf("Expected relayed message type %d, got %d", MsgAdvertise, marshalled[0])
+	}
+}
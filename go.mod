@@ -3,11 +3,13 @@ module go.universe.tf/netboot
 require (
 	github.com/google/go-cmp v0.5.9
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/prometheus/client_golang v1.14.0
 	github.com/spf13/afero v1.9.4 // indirect
 	github.com/spf13/cobra v1.6.1
 	github.com/spf13/viper v1.15.0
 	golang.org/x/crypto v0.6.0
 	golang.org/x/net v0.7.0
+	golang.org/x/sys v0.5.0
 )
 
 go 1.13
@@ -2,23 +2,41 @@ package pixiecore
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 const x86HTTPClient = 0x10
 
+// Delay before the first retry of a failed request to the API server, doubled on every subsequent retry
+const defaultAPIRetryBackoff = 100 * time.Millisecond
+
 // StaticBootConfiguration provides values for dhcp options that remain unchanged until restart
 type StaticBootConfiguration struct {
 	HTTPBootURL   []byte
 	IPxeBootURL   []byte
 	RecursiveDNS  []net.IP
+	DNSSearchList []string
+	NTPServers    []net.IP
 	Preference    []byte
 	UsePreference bool
+	// If set, legacy BIOS clients boot TFTPBootFile from this TFTP
+	// server instead of the iPXE boot URL
+	TFTPServer   net.IP
+	TFTPBootFile string
+	// Boot File URLs clients can fall back to, in order, if they
+	// can't boot the primary one
+	AlternateBootURLs [][]byte
 }
 
 // MakeStaticBootConfiguration creates a new StaticBootConfiguration with provided values
@@ -41,14 +59,84 @@ func (bc *StaticBootConfiguration) GetBootURL(id []byte, clientArchType uint16)
 	return bc.IPxeBootURL, nil
 }
 
-// GetPreference returns server's Preference, see RFC 3315
-func (bc *StaticBootConfiguration) GetPreference() []byte {
+// GetAlternateBootURLs returns the Boot File URLs clients can fall back to. All clients get the same URLs.
+func (bc *StaticBootConfiguration) GetAlternateBootURLs(id []byte, clientArchType uint16) [][]byte {
+	return bc.AlternateBootURLs
+}
+
+// GetTFTPBoot returns the TFTP server and boot file of legacy BIOS clients, if set
+func (bc *StaticBootConfiguration) GetTFTPBoot(id []byte, clientArchType uint16) (net.IP, string, bool) {
+	return bc.TFTPServer, bc.TFTPBootFile, bc.TFTPServer != nil && bc.TFTPBootFile != ""
+}
+
+// GetPreference returns server's Preference, see RFC 3315. All clients get the same preference.
+func (bc *StaticBootConfiguration) GetPreference(id []byte, clientArchType uint16) []byte {
+	return bc.Preference
+}
+
+// GetRecursiveDNS returns list of addresses of recursive DNS servers, see RFC 3646. All clients get the same
+// servers.
+func (bc *StaticBootConfiguration) GetRecursiveDNS(id []byte, clientArchType uint16) ([]net.IP, error) {
+	return bc.RecursiveDNS, nil
+}
+
+// GetDNSSearchList returns list of domains for resolving short hostnames, see RFC 3646
+func (bc *StaticBootConfiguration) GetDNSSearchList() []string {
+	return bc.DNSSearchList
+}
+
+// GetNTPServers returns list of addresses of NTP servers, see RFC 5908
+func (bc *StaticBootConfiguration) GetNTPServers() []net.IP {
+	return bc.NTPServers
+}
+
+// ArchBootConfiguration provides Boot File URLs from a static mapping of client architecture types
+type ArchBootConfiguration struct {
+	BootURLs      map[uint16][]byte
+	RecursiveDNS  []net.IP
+	DNSSearchList []string
+	NTPServers    []net.IP
+	Preference    []byte
+}
+
+// MakeArchBootConfiguration creates a new ArchBootConfiguration serving the Boot File URL in byArch
+// matching the client architecture type, see RFC 4578 for the list of types
+func MakeArchBootConfiguration(byArch map[uint16]string) *ArchBootConfiguration {
+	ret := &ArchBootConfiguration{BootURLs: make(map[uint16][]byte)}
+	for arch, url := range byArch {
+		ret.BootURLs[arch] = []byte(url)
+	}
+	return ret
+}
+
+// GetBootURL returns Boot File URL, see RFC 5970
+func (bc *ArchBootConfiguration) GetBootURL(id []byte, clientArchType uint16) ([]byte, error) {
+	url, exists := bc.BootURLs[clientArchType]
+	if !exists {
+		return nil, fmt.Errorf("No boot file url configured for client architecture type %d", clientArchType)
+	}
+	return url, nil
+}
+
+// GetPreference returns server's Preference, see RFC 3315. All clients get the same preference.
+func (bc *ArchBootConfiguration) GetPreference(id []byte, clientArchType uint16) []byte {
 	return bc.Preference
 }
 
-// GetRecursiveDNS returns list of addresses of recursive DNS servers, see RFC 3646
-func (bc *StaticBootConfiguration) GetRecursiveDNS() []net.IP {
-	return bc.RecursiveDNS
+// GetRecursiveDNS returns list of addresses of recursive DNS servers, see RFC 3646. All clients get the same
+// servers.
+func (bc *ArchBootConfiguration) GetRecursiveDNS(id []byte, clientArchType uint16) ([]net.IP, error) {
+	return bc.RecursiveDNS, nil
+}
+
+// GetDNSSearchList returns list of domains for resolving short hostnames, see RFC 3646
+func (bc *ArchBootConfiguration) GetDNSSearchList() []string {
+	return bc.DNSSearchList
+}
+
+// GetNTPServers returns list of addresses of NTP servers, see RFC 5908
+func (bc *ArchBootConfiguration) GetNTPServers() []net.IP {
+	return bc.NTPServers
 }
 
 // APIBootConfiguration provides an interface to retrieve Boot File URL from an external server based on
@@ -57,8 +145,69 @@ type APIBootConfiguration struct {
 	Client        *http.Client
 	URLPrefix     string
 	RecursiveDNS  []net.IP
+	DNSSearchList []string
+	NTPServers    []net.IP
 	Preference    []byte
 	UsePreference bool
+	// MaxRetries is the number of times a request failing with a connection error or a 5xx response
+	// is retried, with exponential backoff. All attempts together are bounded by the client's timeout.
+	MaxRetries int
+	// Authorization, if set, is sent as the Authorization header of requests to the API server, e.g.
+	// "Bearer <token>" or "Basic <base64 of user:password>", see BearerAuthorization and BasicAuthorization.
+	Authorization string
+	// Header holds extra headers sent with requests to the API server, e.g. for an API gateway.
+	Header http.Header
+
+	retryBackoff time.Duration
+}
+
+// SetTLSConfig makes requests to the API server use config, e.g. to present a client certificate and check the
+// server's certificate against a private CA, see LoadAPITLSConfig
+func (bc *APIBootConfiguration) SetTLSConfig(config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	bc.Client.Transport = transport
+}
+
+// LoadAPITLSConfig creates a TLS configuration for requests to the API server, presenting the client certificate
+// in certFile with the private key in keyFile, and checking the server's certificate against the CA certificates
+// in caFile. All files are PEM encoded. certFile and keyFile must be given together, and may be empty for no
+// client certificate. If caFile is empty, the system's CAs are used.
+func LoadAPITLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("Both a client certificate and a private key are needed, got certificate %q and key %q",
+			certFile, keyFile)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate %s with key %s: %s", certFile, keyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading CA certificates: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Error loading CA certificates: no PEM certificates in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// BearerAuthorization returns the APIBootConfiguration.Authorization for a bearer token
+func BearerAuthorization(token string) string {
+	return "Bearer " + token
+}
+
+// BasicAuthorization returns the APIBootConfiguration.Authorization for HTTP basic authentication
+func BasicAuthorization(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
 }
 
 // MakeAPIBootConfiguration creates a new APIBootConfiguration initialized with provided values
@@ -71,6 +220,7 @@ func MakeAPIBootConfiguration(url string, timeout time.Duration, preference uint
 		Client:        &http.Client{Timeout: timeout},
 		URLPrefix:     url + "v1",
 		UsePreference: usePreference,
+		retryBackoff:  defaultAPIRetryBackoff,
 	}
 	if usePreference {
 		ret.Preference = make([]byte, 1)
@@ -84,21 +234,59 @@ func MakeAPIBootConfiguration(url string, timeout time.Duration, preference uint
 // GetBootURL returns Boot File URL, see RFC 5970
 func (bc *APIBootConfiguration) GetBootURL(id []byte, clientArchType uint16) ([]byte, error) {
 	reqURL := fmt.Sprintf("%s/boot/%x/%d", bc.URLPrefix, id, clientArchType)
-	resp, err := bc.Client.Get(reqURL)
+
+	ctx := context.Background()
+	if bc.Client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bc.Client.Timeout)
+		defer cancel()
+	}
+
+	backoff := bc.retryBackoff
+	for attempt := 0; ; attempt++ {
+		body, retry, err := bc.requestBootURL(ctx, reqURL)
+		if err == nil {
+			url, _ := bc.makeURLAbsolute(body)
+			return []byte(url), nil
+		}
+		if !retry || attempt >= bc.MaxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// requestBootURL makes a single request to the API server, and reports whether a failed request is worth retrying
+func (bc *APIBootConfiguration) requestBootURL(ctx context.Context, reqURL string) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
-		return nil, err
+		return "", false, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("%s: %s", reqURL, http.StatusText(resp.StatusCode))
+	for name, values := range bc.Header {
+		req.Header[name] = values
+	}
+	if bc.Authorization != "" {
+		req.Header.Set("Authorization", bc.Authorization)
+	}
+	resp, err := bc.Client.Do(req)
+	if err != nil {
+		return "", true, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// 4xx responses won't change on retry
+		return "", resp.StatusCode >= 500, fmt.Errorf("%s: %s", reqURL, http.StatusText(resp.StatusCode))
+	}
 
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(resp.Body)
-	url, _ := bc.makeURLAbsolute(buf.String())
-
-	return []byte(url), nil
+	return buf.String(), false, nil
 }
 
 func (bc *APIBootConfiguration) makeURLAbsolute(urlStr string) (string, error) {
@@ -116,12 +304,89 @@ func (bc *APIBootConfiguration) makeURLAbsolute(urlStr string) (string, error) {
 	return u.String(), nil
 }
 
-// GetPreference returns server's Preference, see RFC 3315
-func (bc *APIBootConfiguration) GetPreference() []byte {
+// GetPreference returns server's Preference, see RFC 3315. All clients get the same preference.
+func (bc *APIBootConfiguration) GetPreference(id []byte, clientArchType uint16) []byte {
 	return bc.Preference
 }
 
-// GetRecursiveDNS returns list of addresses of recursive DNS servers, see RFC 3646
-func (bc *APIBootConfiguration) GetRecursiveDNS() []net.IP {
-	return bc.RecursiveDNS
+// GetRecursiveDNS returns list of addresses of recursive DNS servers, see RFC 3646. All clients get the same
+// servers.
+func (bc *APIBootConfiguration) GetRecursiveDNS(id []byte, clientArchType uint16) ([]net.IP, error) {
+	return bc.RecursiveDNS, nil
+}
+
+// GetDNSSearchList returns list of domains for resolving short hostnames, see RFC 3646
+func (bc *APIBootConfiguration) GetDNSSearchList() []string {
+	return bc.DNSSearchList
+}
+
+// GetNTPServers returns list of addresses of NTP servers, see RFC 5908
+func (bc *APIBootConfiguration) GetNTPServers() []net.IP {
+	return bc.NTPServers
+}
+
+// CachedAPIBootConfiguration is an APIBootConfiguration that reuses Boot File URLs retrieved from the API
+// server for the same client ID and architecture type until they are older than TTL
+type CachedAPIBootConfiguration struct {
+	*APIBootConfiguration
+	TTL time.Duration
+
+	cache   map[cachedBootURLKey]cachedBootURL
+	timeNow func() time.Time
+	lock    sync.Mutex
+}
+
+type cachedBootURLKey struct {
+	id             string
+	clientArchType uint16
+}
+
+type cachedBootURL struct {
+	url       []byte
+	expiresAt time.Time
+}
+
+// MakeCachedAPIBootConfiguration creates a new CachedAPIBootConfiguration initialized with provided values
+func MakeCachedAPIBootConfiguration(url string, timeout, ttl time.Duration) *CachedAPIBootConfiguration {
+	return CacheAPIBootConfiguration(MakeAPIBootConfiguration(url, timeout, 0, false, nil), ttl)
+}
+
+// CacheAPIBootConfiguration creates a new CachedAPIBootConfiguration caching the Boot File URLs of bc for ttl,
+// for configurations with a preference, DNS servers or other settings already set up
+func CacheAPIBootConfiguration(bc *APIBootConfiguration, ttl time.Duration) *CachedAPIBootConfiguration {
+	return &CachedAPIBootConfiguration{
+		APIBootConfiguration: bc,
+		TTL:                  ttl,
+		cache:                make(map[cachedBootURLKey]cachedBootURL),
+		timeNow:              time.Now,
+	}
+}
+
+// GetBootURL returns Boot File URL, see RFC 5970. Only successful responses from the API server are cached.
+func (bc *CachedAPIBootConfiguration) GetBootURL(id []byte, clientArchType uint16) ([]byte, error) {
+	key := cachedBootURLKey{id: string(id), clientArchType: clientArchType}
+
+	bc.lock.Lock()
+	entry, exists := bc.cache[key]
+	if exists && bc.timeNow().Before(entry.expiresAt) {
+		bc.lock.Unlock()
+		return entry.url, nil
+	}
+	bc.lock.Unlock()
+
+	url, err := bc.APIBootConfiguration.GetBootURL(id, clientArchType)
+	if err != nil {
+		return nil, err
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	now := bc.timeNow()
+	for k, v := range bc.cache {
+		if !now.Before(v.expiresAt) {
+			delete(bc.cache, k)
+		}
+	}
+	bc.cache[key] = cachedBootURL{url: url, expiresAt: now.Add(bc.TTL)}
+	return url, nil
 }
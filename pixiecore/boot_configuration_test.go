@@ -0,0 +1,276 @@
+package pixiecore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchBootConfiguration(t *testing.T) {
+	bc := MakeArchBootConfiguration(map[uint16]string{
+		0x07: "http://[2001:db8:f00f:cafe::4]/ipxe.efi",
+		0x10: "http://[2001:db8:f00f:cafe::4]/bootx64.efi",
+	})
+
+	url, err := bc.GetBootURL([]byte("id"), 0x10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(url) != "http://[2001:db8:f00f:cafe::4]/bootx64.efi" {
+		t.Fatalf("Expected boot url for HTTPClient, got %s", url)
+	}
+	url, err = bc.GetBootURL([]byte("id"), 0x07)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(url) != "http://[2001:db8:f00f:cafe::4]/ipxe.efi" {
+		t.Fatalf("Expected boot url for EFI x64, got %s", url)
+	}
+
+	if _, err = bc.GetBootURL([]byte("id"), 0x00); err == nil {
+		t.Fatalf("Expected an error for an architecture without a boot url")
+	}
+}
+
+func TestCachedAPIBootConfiguration(t *testing.T) {
+	requests := 0
+	failing := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failing {
+			http.Error(w, "backend down", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "http://[2001:db8:f00f:cafe::4]/boot.ipxe")
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+	bc := MakeCachedAPIBootConfiguration(ts.URL, time.Second, time.Minute)
+	bc.timeNow = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		url, err := bc.GetBootURL([]byte{1, 2, 3}, 0x07)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if string(url) != "http://[2001:db8:f00f:cafe::4]/boot.ipxe" {
+			t.Fatalf("Unexpected boot url: %s", url)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("Expected 1 request to the API server, got %d", requests)
+	}
+
+	if _, err := bc.GetBootURL([]byte{1, 2, 3}, 0x10); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if requests != 2 {
+		t.Fatalf("Expected a different architecture to miss the cache, got %d requests", requests)
+	}
+
+	failing = true
+	now = now.Add(2 * time.Minute)
+	if _, err := bc.GetBootURL([]byte{1, 2, 3}, 0x07); err == nil {
+		t.Fatalf("Expected the API error once the cached entry expired, not a stale boot url")
+	}
+	if _, err := bc.GetBootURL([]byte{1, 2, 3}, 0x07); err == nil {
+		t.Fatalf("Expected API errors not to be cached")
+	}
+	if requests != 4 {
+		t.Fatalf("Expected 4 requests to the API server, got %d", requests)
+	}
+}
+
+func TestAPIBootConfigurationRetriesServerErrors(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= 2 {
+			http.Error(w, "backend blip", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "http://[2001:db8:f00f:cafe::4]/boot.ipxe")
+	}))
+	defer ts.Close()
+
+	bc := MakeAPIBootConfiguration(ts.URL, 5*time.Second, 0, false, nil)
+	bc.MaxRetries = 2
+	bc.retryBackoff = time.Millisecond
+
+	url, err := bc.GetBootURL([]byte{1, 2, 3}, 0x07)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(url) != "http://[2001:db8:f00f:cafe::4]/boot.ipxe" {
+		t.Fatalf("Unexpected boot url: %s", url)
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests to the API server, got %d", requests)
+	}
+}
+
+func TestAPIBootConfigurationSendsAuthorization(t *testing.T) {
+	var authorization, gateway string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		gateway = r.Header.Get("X-Gateway-Key")
+		fmt.Fprintf(w, "http://[2001:db8:f00f:cafe::4]/boot.ipxe")
+	}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		authorization string
+		expected      string
+	}{
+		{BearerAuthorization("s3cr3t"), "Bearer s3cr3t"},
+		{BasicAuthorization("user", "password"), "Basic dXNlcjpwYXNzd29yZA=="},
+		{"", ""},
+	} {
+		bc := MakeAPIBootConfiguration(ts.URL, 5*time.Second, 0, false, nil)
+		bc.Authorization = test.authorization
+		bc.Header = http.Header{"X-Gateway-Key": {"gw"}}
+		if _, err := bc.GetBootURL([]byte{1, 2, 3}, 0x07); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if authorization != test.expected {
+			t.Fatalf("Expected Authorization header %q, got %q", test.expected, authorization)
+		}
+		if gateway != "gw" {
+			t.Fatalf("Expected X-Gateway-Key header %q, got %q", "gw", gateway)
+		}
+	}
+}
+
+func TestAPIBootConfigurationDoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "unknown machine", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	bc := MakeAPIBootConfiguration(ts.URL, 5*time.Second, 0, false, nil)
+	bc.MaxRetries = 2
+	bc.retryBackoff = time.Millisecond
+
+	if _, err := bc.GetBootURL([]byte{1, 2, 3}, 0x07); err == nil {
+		t.Fatalf("Expected an error for a 404 response")
+	}
+	if requests != 1 {
+		t.Fatalf("Expected 1 request to the API server, got %d", requests)
+	}
+}
+
+// writeTestCertificate writes a self-signed client certificate and its key to dir, and returns their paths
+func writeTestCertificate(t *testing.T, dir, name string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Creating certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Parsing certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Marshaling key: %s", err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Writing certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Writing key: %s", err)
+	}
+	return cert, certFile, keyFile
+}
+
+func TestAPIBootConfigurationClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-tls")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientCert, certFile, keyFile := writeTestCertificate(t, dir, "client")
+	_, otherCertFile, otherKeyFile := writeTestCertificate(t, dir, "other")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "http://[2001:db8:f00f:cafe::4]/boot.ipxe")
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600); err != nil {
+		t.Fatalf("Writing CA certificate: %s", err)
+	}
+
+	getBootURL := func(certFile, keyFile string) error {
+		config, err := LoadAPITLSConfig(certFile, keyFile, caFile)
+		if err != nil {
+			t.Fatalf("Unexpected error loading TLS config: %s", err)
+		}
+		bc := MakeAPIBootConfiguration(ts.URL, 5*time.Second, 0, false, nil)
+		bc.SetTLSConfig(config)
+		_, err = bc.GetBootURL([]byte{1, 2, 3}, 0x07)
+		return err
+	}
+	if err := getBootURL(certFile, keyFile); err != nil {
+		t.Fatalf("Unexpected error with a trusted client certificate: %s", err)
+	}
+	if err := getBootURL("", ""); err == nil {
+		t.Fatalf("Expected an error without a client certificate")
+	}
+	if err := getBootURL(otherCertFile, otherKeyFile); err == nil {
+		t.Fatalf("Expected an error with an untrusted client certificate")
+	}
+
+	for _, test := range []struct {
+		name                  string
+		certFile, keyFile, ca string
+		expectedError         string
+	}{
+		{"mismatched key", certFile, otherKeyFile, caFile, "private key does not match public key"},
+		{"missing key", certFile, "", caFile, "Both a client certificate and a private key are needed"},
+		{"missing certificate file", filepath.Join(dir, "nope.crt"), keyFile, caFile, "Error loading client certificate"},
+		{"CA file without certificates", certFile, keyFile, keyFile, "no PEM certificates"},
+	} {
+		_, err := LoadAPITLSConfig(test.certFile, test.keyFile, test.ca)
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Fatalf("%s: expected error containing %q, got %v", test.name, test.expectedError, err)
+		}
+	}
+}
@@ -15,18 +15,22 @@
 package pixiecore
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
@@ -37,8 +41,13 @@ func StaticBooter(spec *Spec) (Booter, error) {
 	ret := &staticBooter{
 		kernel: string(spec.Kernel),
 		spec: &Spec{
-			Kernel:  "kernel",
-			Message: spec.Message,
+			Kernel:            "kernel",
+			KernelHash:        spec.KernelHash,
+			InitrdHashes:      spec.InitrdHashes,
+			Message:           spec.Message,
+			IpxePreamble:      spec.IpxePreamble,
+			BootFlags:         spec.BootFlags,
+			CmdlineViaImgargs: spec.CmdlineViaImgargs,
 		},
 	}
 	for i, initrd := range spec.Initrd {
@@ -46,16 +55,38 @@ func StaticBooter(spec *Spec) (Booter, error) {
 		ret.spec.Initrd = append(ret.spec.Initrd, ID(fmt.Sprintf("initrd-%d", i)))
 	}
 
-	f := func(id string) string {
+	other := func(id string) ID {
 		ret.otherIDs = append(ret.otherIDs, id)
-		return fmt.Sprintf("{{ ID \"other-%d\" }}", len(ret.otherIDs)-1)
+		return ID(fmt.Sprintf("other-%d", len(ret.otherIDs)-1))
+	}
+	f := func(id string) string {
+		return fmt.Sprintf("{{ ID %q }}", other(id))
 	}
-	cmdline, err := expandCmdline(spec.Cmdline, template.FuncMap{"ID": f})
+	funcs := machineFuncPlaceholders()
+	funcs["ID"] = f
+	cmdline, err := expandCmdline(spec.Cmdline, funcs)
 	if err != nil {
 		return nil, err
 	}
 	ret.spec.Cmdline = cmdline
 
+	// Menu entries' files are served like files in the cmdline.
+	for _, entry := range spec.Menu {
+		e := MenuEntry{
+			Label:        entry.Label,
+			Kernel:       other(string(entry.Kernel)),
+			KernelHash:   entry.KernelHash,
+			InitrdHashes: entry.InitrdHashes,
+		}
+		for _, initrd := range entry.Initrd {
+			e.Initrd = append(e.Initrd, other(string(initrd)))
+		}
+		if e.Cmdline, err = expandCmdline(entry.Cmdline, funcs); err != nil {
+			return nil, err
+		}
+		ret.spec.Menu = append(ret.spec.Menu, e)
+	}
+
 	return ret, nil
 }
 
@@ -95,34 +126,479 @@ func (s *staticBooter) serveFile(path string) (io.ReadCloser, int64, error) {
 	return f, fi.Size(), nil
 }
 
-func (s *staticBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+func (s *staticBooter) filePath(id ID) (string, error) {
 	path := string(id)
 	switch {
 	case path == "kernel":
-		return s.serveFile(s.kernel)
+		return s.kernel, nil
 
 	case strings.HasPrefix(path, "initrd-"):
 		i, err := strconv.Atoi(path[7:])
 		if err != nil || i < 0 || i >= len(s.initrd) {
-			return nil, -1, fmt.Errorf("no file with ID %q", id)
+			return "", fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
 		}
-		return s.serveFile(s.initrd[i])
+		return s.initrd[i], nil
 
 	case strings.HasPrefix(path, "other-"):
 		i, err := strconv.Atoi(path[6:])
 		if err != nil || i < 0 || i >= len(s.otherIDs) {
-			return nil, -1, fmt.Errorf("no file with ID %q", id)
+			return "", fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
 		}
-		return s.serveFile(s.otherIDs[i])
+		return s.otherIDs[i], nil
+	}
+
+	return "", fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+}
+
+func (s *staticBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	path, err := s.filePath(id)
+	if err != nil {
+		return nil, -1, err
 	}
+	return s.serveFile(path)
+}
 
-	return nil, -1, fmt.Errorf("no file with ID %q", id)
+func (s *staticBooter) Stat(id ID) (int64, time.Time, error) {
+	path, err := s.filePath(id)
+	if err != nil {
+		return -1, time.Time{}, err
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return -1, time.Time{}, fmt.Errorf("can't stat remote file %q", path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1, time.Time{}, err
+	}
+	return fi.Size(), fi.ModTime(), nil
 }
 
 func (s *staticBooter) WriteBootFile(ID, io.Reader) error {
 	return nil
 }
 
+// DirectoryBooter boots all machines with files from a local
+// directory.
+//
+// The file named "kernel" is the kernel, and files whose names start
+// with "initrd" are the init ramdisks, in lexical order. IDs in
+// cmdline are names of files in dir. Files outside of dir can't be
+// read.
+func DirectoryBooter(dir string, cmdline string) (Booter, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", dir)
+	}
+	return &directoryBooter{dir: dir, cmdline: cmdline}, nil
+}
+
+type directoryBooter struct {
+	dir     string
+	cmdline string
+}
+
+func (d *directoryBooter) BootSpec(m Machine) (*Spec, error) {
+	fis, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &Spec{Cmdline: d.cmdline}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		switch {
+		case fi.Name() == "kernel":
+			spec.Kernel = ID(fi.Name())
+		case strings.HasPrefix(fi.Name(), "initrd"):
+			spec.Initrd = append(spec.Initrd, ID(fi.Name()))
+		}
+	}
+	if spec.Kernel == "" {
+		return nil, fmt.Errorf("no kernel in %q", d.dir)
+	}
+	return spec, nil
+}
+
+func (d *directoryBooter) filePath(id ID) (string, error) {
+	name := string(id)
+	// IDs are plain file names, anything with a path in it could
+	// escape the directory.
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	return filepath.Join(d.dir, name), nil
+}
+
+func (d *directoryBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	path, err := d.filePath(id)
+	if err != nil {
+		return nil, -1, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, -1, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, -1, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, -1, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	return f, fi.Size(), nil
+}
+
+func (d *directoryBooter) Stat(id ID) (int64, time.Time, error) {
+	path, err := d.filePath(id)
+	if err != nil {
+		return -1, time.Time{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1, time.Time{}, err
+	}
+	if fi.IsDir() {
+		return -1, time.Time{}, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+func (d *directoryBooter) WriteBootFile(ID, io.Reader) error {
+	return nil
+}
+
+// ProxyBooter boots all machines with the same Spec, and streams boot
+// files from an upstream HTTP(S) server rather than local disk.
+//
+// IDs in spec are paths relative to the upstream URL, e.g. the ID
+// "images/vmlinuz" with upstream "https://artifacts.example/netboot"
+// is fetched from "https://artifacts.example/netboot/images/vmlinuz".
+// header is added to every upstream request, e.g. to authenticate
+// with an Authorization header. IDs can't leave the upstream
+// directory, nor carry a query string or fragment.
+//
+// Upstream requests are made with client, or if nil with a client
+// that gives up after 5 minutes, so that a stalled upstream doesn't
+// hold a file transfer slot forever.
+func ProxyBooter(spec *Spec, upstream string, header http.Header, client *http.Client) (Booter, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream URL %q: %s", upstream, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("upstream URL %q must be an absolute http or https URL", upstream)
+	}
+	u.RawQuery, u.Fragment = "", ""
+	if client == nil {
+		client = &http.Client{Timeout: defaultProxyTimeout}
+	}
+	return &proxyBooter{
+		spec:     spec,
+		upstream: u,
+		header:   header,
+		client:   client,
+	}, nil
+}
+
+// defaultProxyTimeout bounds ProxyBooter's upstream requests, reading
+// the file included, when it isn't given an http.Client.
+const defaultProxyTimeout = 5 * time.Minute
+
+type proxyBooter struct {
+	spec     *Spec
+	upstream *url.URL
+	header   http.Header
+	client   *http.Client
+}
+
+func (p *proxyBooter) BootSpec(m Machine) (*Spec, error) {
+	return p.spec, nil
+}
+
+func (p *proxyBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	// IDs come from booting machines, don't let them wander out of
+	// the upstream directory, or add to the upstream request. Escapes
+	// could smuggle in ".." segments the upstream decodes.
+	for _, elem := range strings.Split(string(id), "/") {
+		if elem == ".." {
+			return nil, -1, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+		}
+	}
+	if strings.ContainsAny(string(id), "%?#\\") {
+		return nil, -1, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	u := *p.upstream
+	u.Path = path.Join(p.upstream.Path, path.Clean("/"+string(id)))
+	u.RawPath = ""
+	reqURL := u.String()
+
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, -1, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	for k, vs := range p.header {
+		req.Header[k] = vs
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, -1, fmt.Errorf("%s: %s: %w", reqURL, err, ErrUpstream)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, -1, fmt.Errorf("%s: %w", reqURL, ErrBootFileNotFound)
+	case resp.StatusCode >= 500:
+		resp.Body.Close()
+		return nil, -1, fmt.Errorf("%s: %s: %w", reqURL, http.StatusText(resp.StatusCode), ErrUpstream)
+	default:
+		resp.Body.Close()
+		return nil, -1, fmt.Errorf("%s: %s", reqURL, http.StatusText(resp.StatusCode))
+	}
+}
+
+func (p *proxyBooter) WriteBootFile(ID, io.Reader) error {
+	return nil
+}
+
+// ChainBooter boots machines with the first of booters that wants to
+// boot them.
+//
+// BootSpec asks booters in order, a nil Spec meaning "not mine, try
+// the next one". An error stops the search and is returned, so that a
+// failing booter doesn't let machines fall through to a catch-all
+// booter. If no booter wants to boot the machine, BootSpec returns a
+// nil Spec.
+//
+// ReadBootFile and Stat also try booters in order, moving on to the
+// next one when a booter's error wraps ErrBootFileNotFound or
+// os.ErrNotExist. Other errors are returned right away.
+func ChainBooter(booters ...Booter) (Booter, error) {
+	if len(booters) == 0 {
+		return nil, errors.New("no booters to chain")
+	}
+	for i, b := range booters {
+		if b == nil {
+			return nil, fmt.Errorf("booter %d is nil", i)
+		}
+	}
+	return &chainBooter{booters: booters}, nil
+}
+
+type chainBooter struct {
+	booters []Booter
+}
+
+// isNotFound returns true if err means a booter has no file for an ID.
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrBootFileNotFound) || errors.Is(err, os.ErrNotExist)
+}
+
+func (c *chainBooter) BootSpec(m Machine) (*Spec, error) {
+	return c.BootSpecContext(context.Background(), m)
+}
+
+func (c *chainBooter) BootSpecContext(ctx context.Context, m Machine) (*Spec, error) {
+	for _, b := range c.booters {
+		spec, err := bootSpec(ctx, b, m)
+		if err != nil {
+			return nil, err
+		}
+		if spec != nil {
+			return spec, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *chainBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	for _, b := range c.booters {
+		f, sz, err := b.ReadBootFile(id)
+		if err == nil {
+			return f, sz, nil
+		}
+		if !isNotFound(err) {
+			return nil, -1, err
+		}
+	}
+	return nil, -1, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+}
+
+func (c *chainBooter) Stat(id ID) (int64, time.Time, error) {
+	for _, b := range c.booters {
+		stater, ok := b.(BootFileStater)
+		if !ok {
+			// The booter may well have the file, but can't say.
+			return -1, time.Time{}, fmt.Errorf("can't stat file with ID %q", id)
+		}
+		sz, modTime, err := stater.Stat(id)
+		if err == nil {
+			return sz, modTime, nil
+		}
+		if !isNotFound(err) {
+			return -1, time.Time{}, err
+		}
+	}
+	return -1, time.Time{}, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+}
+
+func (c *chainBooter) WriteBootFile(id ID, body io.Reader) error {
+	for _, b := range c.booters {
+		err := b.WriteBootFile(id, body)
+		if err == nil || !isNotFound(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+}
+
+func (c *chainBooter) setLog(log logFunc) {
+	for _, b := range c.booters {
+		if lb, ok := b.(logBooter); ok {
+			lb.setLog(log)
+		}
+	}
+}
+
+// NewFallbackBooter boots machines with primary, or with fallbackSpec
+// when primary fails, e.g. so that machines boot a rescue image
+// rather than nothing while the API server is down. A nil Spec from
+// primary still means "don't boot this machine".
+//
+// IDs in fallbackSpec are local file paths or HTTP/HTTPS URLs, as
+// with StaticBooter, in menu entries too. The fallback's files are
+// served under IDs with a "fallback-" prefix, all others are read from
+// primary.
+func NewFallbackBooter(primary Booter, fallbackSpec *Spec) (Booter, error) {
+	if primary == nil {
+		return nil, errors.New("primary booter is nil")
+	}
+	if fallbackSpec == nil {
+		return nil, errors.New("fallback spec is nil")
+	}
+	fallback, err := StaticBooter(fallbackSpec)
+	if err != nil {
+		return nil, err
+	}
+	spec, _ := fallback.BootSpec(Machine{})
+
+	// Everything but the file IDs carries over as is. StaticBooter
+	// leaves out raw iPXE scripts, which don't refer to its files.
+	fb := *spec
+	fb.IpxeScript = fallbackSpec.IpxeScript
+	fb.Kernel = fallbackID(spec.Kernel)
+	fb.Initrd = fallbackIDs(spec.Initrd)
+	funcs := machineFuncPlaceholders()
+	funcs["ID"] = func(id string) string {
+		return fmt.Sprintf("{{ ID %q }}", fallbackID(ID(id)))
+	}
+	if fb.Cmdline, err = expandCmdline(spec.Cmdline, funcs); err != nil {
+		return nil, err
+	}
+	fb.Menu = nil
+	for _, entry := range spec.Menu {
+		entry.Kernel = fallbackID(entry.Kernel)
+		entry.Initrd = fallbackIDs(entry.Initrd)
+		if entry.Cmdline, err = expandCmdline(entry.Cmdline, funcs); err != nil {
+			return nil, err
+		}
+		fb.Menu = append(fb.Menu, entry)
+	}
+
+	return &fallbackBooter{
+		primary:  primary,
+		fallback: fallback,
+		spec:     &fb,
+	}, nil
+}
+
+// fallbackIDPrefix marks the IDs of a fallbackBooter's own files.
+const fallbackIDPrefix = "fallback-"
+
+func fallbackID(id ID) ID {
+	return ID(fallbackIDPrefix + string(id))
+}
+
+func fallbackIDs(ids []ID) []ID {
+	var ret []ID
+	for _, id := range ids {
+		ret = append(ret, fallbackID(id))
+	}
+	return ret
+}
+
+type fallbackBooter struct {
+	primary  Booter
+	fallback Booter
+	spec     *Spec
+	log      logFunc
+}
+
+func (f *fallbackBooter) setLog(log logFunc) {
+	f.log = log
+	if lb, ok := f.primary.(logBooter); ok {
+		lb.setLog(log)
+	}
+}
+
+func (f *fallbackBooter) BootSpec(m Machine) (*Spec, error) {
+	return f.BootSpecContext(context.Background(), m)
+}
+
+func (f *fallbackBooter) BootSpecContext(ctx context.Context, m Machine) (*Spec, error) {
+	spec, err := bootSpec(ctx, f.primary, m)
+	if err == nil {
+		return spec, nil
+	}
+	if f.log != nil {
+		f.log("Booter", "Booting %s with the fallback spec, primary booter failed: %s", m.MAC, err)
+	}
+	return f.spec, nil
+}
+
+// fallbackFile returns the ID of the fallback's file for id, or false
+// if id is one of primary's files.
+func (f *fallbackBooter) fallbackFile(id ID) (ID, bool) {
+	if !strings.HasPrefix(string(id), fallbackIDPrefix) {
+		return "", false
+	}
+	return ID(strings.TrimPrefix(string(id), fallbackIDPrefix)), true
+}
+
+func (f *fallbackBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	if fid, ok := f.fallbackFile(id); ok {
+		return f.fallback.ReadBootFile(fid)
+	}
+	return f.primary.ReadBootFile(id)
+}
+
+func (f *fallbackBooter) Stat(id ID) (int64, time.Time, error) {
+	b := f.primary
+	if fid, ok := f.fallbackFile(id); ok {
+		b, id = f.fallback, fid
+	}
+	stater, ok := b.(BootFileStater)
+	if !ok {
+		return -1, time.Time{}, fmt.Errorf("can't stat file with ID %q", id)
+	}
+	return stater.Stat(id)
+}
+
+func (f *fallbackBooter) WriteBootFile(id ID, body io.Reader) error {
+	if fid, ok := f.fallbackFile(id); ok {
+		return f.fallback.WriteBootFile(fid, body)
+	}
+	return f.primary.WriteBootFile(id, body)
+}
+
 // APIBooter gets a BootSpec from a remote server over HTTP.
 //
 // The API is described in README.api.md
@@ -147,9 +623,16 @@ type apibooter struct {
 	key       [32]byte
 }
 
-func (b *apibooter) getAPIResponse(hw net.HardwareAddr) (io.ReadCloser, error) {
+func (b *apibooter) getAPIResponse(ctx context.Context, hw net.HardwareAddr) (io.ReadCloser, error) {
 	reqURL := fmt.Sprintf("%s/boot/%s", b.urlPrefix, hw)
-	resp, err := b.client.Get(reqURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if bootID, ok := BootIDFromContext(ctx); ok {
+		req.Header.Set(bootIDHeader, bootID)
+	}
+	resp, err := b.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -162,7 +645,11 @@ func (b *apibooter) getAPIResponse(hw net.HardwareAddr) (io.ReadCloser, error) {
 }
 
 func (b *apibooter) BootSpec(m Machine) (*Spec, error) {
-	body, err := b.getAPIResponse(m.MAC)
+	return b.BootSpecContext(context.Background(), m)
+}
+
+func (b *apibooter) BootSpecContext(ctx context.Context, m Machine) (*Spec, error) {
+	body, err := b.getAPIResponse(ctx, m.MAC)
 	if body != nil {
 		defer body.Close()
 	}
@@ -171,11 +658,24 @@ func (b *apibooter) BootSpec(m Machine) (*Spec, error) {
 	}
 
 	r := struct {
-		Kernel     string      `json:"kernel"`
-		Initrd     []string    `json:"initrd"`
-		Cmdline    interface{} `json:"cmdline"`
-		Message    string      `json:"message"`
-		IpxeScript string      `json:"ipxe-script"`
+		Kernel            string      `json:"kernel"`
+		KernelHash        string      `json:"kernel-hash"`
+		Initrd            []string    `json:"initrd"`
+		InitrdHashes      []string    `json:"initrd-hashes"`
+		Cmdline           interface{} `json:"cmdline"`
+		Message           string      `json:"message"`
+		IpxePreamble      []string    `json:"ipxe-preamble"`
+		BootFlags         string      `json:"boot-flags"`
+		CmdlineViaImgargs bool        `json:"cmdline-via-imgargs"`
+		Menu              []struct {
+			Label        string      `json:"label"`
+			Kernel       string      `json:"kernel"`
+			KernelHash   string      `json:"kernel-hash"`
+			Initrd       []string    `json:"initrd"`
+			InitrdHashes []string    `json:"initrd-hashes"`
+			Cmdline      interface{} `json:"cmdline"`
+		} `json:"menu"`
+		IpxeScript string `json:"ipxe-script"`
 	}{}
 	if err = json.NewDecoder(body).Decode(&r); err != nil {
 		return nil, err
@@ -187,43 +687,81 @@ func (b *apibooter) BootSpec(m Machine) (*Spec, error) {
 		}, nil
 	}
 
-	r.Kernel, err = b.makeURLAbsolute(r.Kernel)
-	if err != nil {
-		return nil, err
-	}
-	for i, img := range r.Initrd {
-		r.Initrd[i], err = b.makeURLAbsolute(img)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	ret := Spec{
-		Message: r.Message,
-	}
-	if ret.Kernel, err = signURL(r.Kernel, &b.key); err != nil {
+		KernelHash:        r.KernelHash,
+		InitrdHashes:      r.InitrdHashes,
+		Message:           r.Message,
+		IpxePreamble:      r.IpxePreamble,
+		BootFlags:         r.BootFlags,
+		CmdlineViaImgargs: r.CmdlineViaImgargs,
+	}
+	if ret.Kernel, err = b.fileID(r.Kernel); err != nil {
 		return nil, err
 	}
 	for _, img := range r.Initrd {
-		initrd, err := signURL(img, &b.key)
+		initrd, err := b.fileID(img)
 		if err != nil {
 			return nil, err
 		}
 		ret.Initrd = append(ret.Initrd, initrd)
 	}
+	if ret.Cmdline, err = b.cmdline(r.Cmdline); err != nil {
+		return nil, err
+	}
 
-	if r.Cmdline != nil {
-		switch c := r.Cmdline.(type) {
-		case string:
-			ret.Cmdline = c
-		case map[string]interface{}:
-			ret.Cmdline, err = b.constructCmdline(c)
+	for _, entry := range r.Menu {
+		e := MenuEntry{
+			Label:        entry.Label,
+			KernelHash:   entry.KernelHash,
+			InitrdHashes: entry.InitrdHashes,
+		}
+		if e.Kernel, err = b.fileID(entry.Kernel); err != nil {
+			return nil, err
+		}
+		for _, img := range entry.Initrd {
+			initrd, err := b.fileID(img)
 			if err != nil {
 				return nil, err
 			}
-		default:
-			return nil, fmt.Errorf("API server returned unknown type %T for kernel cmdline", r.Cmdline)
+			e.Initrd = append(e.Initrd, initrd)
 		}
+		if e.Cmdline, err = b.cmdline(entry.Cmdline); err != nil {
+			return nil, err
+		}
+		ret.Menu = append(ret.Menu, e)
+	}
+
+	return &ret, nil
+}
+
+// fileID returns the ID of the file at urlStr, which may be relative
+// to the API server's URL.
+func (b *apibooter) fileID(urlStr string) (ID, error) {
+	urlStr, err := b.makeURLAbsolute(urlStr)
+	if err != nil {
+		return "", err
+	}
+	return signURL(urlStr, &b.key)
+}
+
+// cmdline turns a kernel commandline returned by the API server,
+// either a string or a deprecated object, into a Spec.Cmdline.
+func (b *apibooter) cmdline(c interface{}) (string, error) {
+	var (
+		ret string
+		err error
+	)
+	switch c := c.(type) {
+	case nil:
+	case string:
+		ret = c
+	case map[string]interface{}:
+		ret, err = b.constructCmdline(c)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("API server returned unknown type %T for kernel cmdline", c)
 	}
 
 	f := func(u string) (string, error) {
@@ -237,18 +775,16 @@ func (b *apibooter) BootSpec(m Machine) (*Spec, error) {
 		}
 		return fmt.Sprintf("{{ ID %q }}", id), nil
 	}
-	ret.Cmdline, err = expandCmdline(ret.Cmdline, template.FuncMap{"URL": f})
-	if err != nil {
-		return nil, err
-	}
-
-	return &ret, nil
+	funcs := machineFuncPlaceholders()
+	funcs["URL"] = f
+	return expandCmdline(ret, funcs)
 }
 
 func (b *apibooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
 	urlStr, err := getURL(id, &b.key)
 	if err != nil {
-		return nil, -1, err
+		// Not an ID this booter handed out.
+		return nil, -1, fmt.Errorf("no file with ID %q: %s: %w", id, err, ErrBootFileNotFound)
 	}
 
 	u, err := url.Parse(urlStr)
@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.16
+// +build go1.16
+
+package pixiecore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// NewEmbedBooter boots all machines with the same Spec, with files
+// from fsys, e.g. an embed.FS that ships the kernel and initrds inside
+// the Pixiecore binary.
+//
+// IDs in spec are paths of files in fsys, like "boot/vmlinuz". Files
+// in an embed.FS have no modification time, so HTTP clients can't
+// cache them.
+func NewEmbedBooter(fsys fs.FS, spec Spec) (Booter, error) {
+	if spec.Kernel == "" {
+		return nil, errors.New("spec is missing Kernel")
+	}
+	for _, id := range append([]ID{spec.Kernel}, spec.Initrd...) {
+		if _, err := fs.Stat(fsys, string(id)); err != nil {
+			return nil, err
+		}
+	}
+	ret := &embedBooter{
+		fsys: fsys,
+		spec: spec,
+	}
+	return ret, nil
+}
+
+type embedBooter struct {
+	fsys fs.FS
+	spec Spec
+}
+
+func (e *embedBooter) BootSpec(m Machine) (*Spec, error) {
+	spec := e.spec
+	return &spec, nil
+}
+
+func (e *embedBooter) stat(id ID) (fs.FileInfo, error) {
+	if !fs.ValidPath(string(id)) {
+		return nil, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	fi, err := fs.Stat(e.fsys, string(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	return fi, nil
+}
+
+func (e *embedBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	fi, err := e.stat(id)
+	if err != nil {
+		return nil, -1, err
+	}
+	f, err := e.fsys.Open(string(id))
+	if err != nil {
+		return nil, -1, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (e *embedBooter) Stat(id ID) (int64, time.Time, error) {
+	fi, err := e.stat(id)
+	if err != nil {
+		return -1, time.Time{}, err
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+func (e *embedBooter) WriteBootFile(ID, io.Reader) error {
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.16
+// +build go1.16
+
+package pixiecore
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbedBooter(t *testing.T) {
+	fsys := fstest.MapFS{
+		"boot/vmlinuz":   {Data: []byte("kernel")},
+		"boot/initrd.gz": {Data: []byte("initrd")},
+	}
+	spec := Spec{
+		Kernel:  "boot/vmlinuz",
+		Initrd:  []ID{"boot/initrd.gz"},
+		Cmdline: "console=ttyS0",
+	}
+	b, err := NewEmbedBooter(fsys, spec)
+	if err != nil {
+		t.Fatalf("Creating embed booter: %s", err)
+	}
+
+	got, err := b.BootSpec(Machine{MAC: []byte{1, 2, 3, 4, 5, 6}, Arch: ArchX64})
+	if err != nil {
+		t.Fatalf("Getting boot spec: %s", err)
+	}
+	if got.Kernel != spec.Kernel || len(got.Initrd) != 1 || got.Initrd[0] != spec.Initrd[0] || got.Cmdline != spec.Cmdline {
+		t.Fatalf("Wrong boot spec, want %#v, got %#v", spec, got)
+	}
+
+	for id, want := range map[ID]string{"boot/vmlinuz": "kernel", "boot/initrd.gz": "initrd"} {
+		f, sz, err := b.ReadBootFile(id)
+		if err != nil {
+			t.Fatalf("Reading %q: %s", id, err)
+		}
+		bs, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Reading %q: %s", id, err)
+		}
+		if string(bs) != want || sz != int64(len(want)) {
+			t.Fatalf("Wrong contents for %q, want %q (%d bytes), got %q (%d bytes)", id, want, len(want), bs, sz)
+		}
+	}
+
+	for _, id := range []ID{"boot/missing", "boot", "../boot/vmlinuz", "/boot/vmlinuz"} {
+		if _, _, err := b.ReadBootFile(id); !errors.Is(err, ErrBootFileNotFound) {
+			t.Fatalf("Reading %q: expected ErrBootFileNotFound, got %v", id, err)
+		}
+	}
+
+	if _, err := NewEmbedBooter(fsys, Spec{Kernel: "boot/missing"}); err == nil {
+		t.Fatalf("Embed booter with a missing kernel was created")
+	}
+}
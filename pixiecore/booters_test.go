@@ -15,12 +15,14 @@
 package pixiecore
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -75,8 +77,13 @@ func TestStaticBooter(t *testing.T) {
 			ID(filepath.Join(dir, "bar")),
 			ID(filepath.Join(dir, "baz")),
 		},
-		Cmdline: fmt.Sprintf(`test={{ ID "%s" }} thing=other`, filepath.Join(dir, "quux")),
-		Message: "Hello from testing world!",
+		Cmdline:           fmt.Sprintf(`test={{ ID "%s" }} thing=other`, filepath.Join(dir, "quux")),
+		KernelHash:        strings.Repeat("1", 64),
+		InitrdHashes:      []string{strings.Repeat("2", 64), strings.Repeat("3", 64)},
+		Message:           "Hello from testing world!",
+		IpxePreamble:      []string{"console --x 1024 --y 768"},
+		BootFlags:         "--autofree",
+		CmdlineViaImgargs: true,
 	}
 
 	b, err := StaticBooter(s)
@@ -95,10 +102,15 @@ func TestStaticBooter(t *testing.T) {
 	}
 
 	expected := &Spec{
-		Kernel:  ID("kernel"),
-		Initrd:  []ID{"initrd-0", "initrd-1"},
-		Cmdline: `test={{ ID "other-0" }} thing=other`,
-		Message: "Hello from testing world!",
+		Kernel:            ID("kernel"),
+		Initrd:            []ID{"initrd-0", "initrd-1"},
+		Cmdline:           `test={{ ID "other-0" }} thing=other`,
+		KernelHash:        strings.Repeat("1", 64),
+		InitrdHashes:      []string{strings.Repeat("2", 64), strings.Repeat("3", 64)},
+		Message:           "Hello from testing world!",
+		IpxePreamble:      []string{"console --x 1024 --y 768"},
+		BootFlags:         "--autofree",
+		CmdlineViaImgargs: true,
 	}
 
 	if !reflect.DeepEqual(spec, expected) {
@@ -132,6 +144,131 @@ func TestStaticBooter(t *testing.T) {
 	}
 }
 
+func TestStaticBooterMenu(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-static-booter-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mustWrite(dir, "foo", "foo file")
+	mustWrite(dir, "bar", "bar file")
+	mustWrite(dir, "baz", "baz file")
+	mustWrite(dir, "quux", "quux file")
+
+	s := &Spec{
+		Cmdline: fmt.Sprintf(`test={{ ID "%s" }}`, filepath.Join(dir, "foo")),
+		Menu: []MenuEntry{
+			{
+				Label:        "Install",
+				Kernel:       ID(filepath.Join(dir, "bar")),
+				Initrd:       []ID{ID(filepath.Join(dir, "baz"))},
+				Cmdline:      fmt.Sprintf(`config={{ ID "%s" }} hostname={{ MAC "-" }}`, filepath.Join(dir, "quux")),
+				KernelHash:   strings.Repeat("2", 64),
+				InitrdHashes: []string{strings.Repeat("3", 64)},
+			},
+			{
+				Label:  "Rescue",
+				Kernel: ID(filepath.Join(dir, "quux")),
+			},
+		},
+	}
+
+	b, err := StaticBooter(s)
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	spec, err := b.BootSpec(Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: ArchX64})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+
+	expected := []MenuEntry{
+		{
+			Label:        "Install",
+			Kernel:       "other-1",
+			Initrd:       []ID{"other-2"},
+			Cmdline:      `config={{ ID "other-3" }} hostname={{ MAC "-" }}`,
+			KernelHash:   strings.Repeat("2", 64),
+			InitrdHashes: []string{strings.Repeat("3", 64)},
+		},
+		{
+			Label:  "Rescue",
+			Kernel: "other-4",
+		},
+	}
+	if !reflect.DeepEqual(spec.Menu, expected) {
+		t.Fatalf("Wrong menu:\nwant: %#v\ngot:  %#v", expected, spec.Menu)
+	}
+
+	fs := map[ID]string{
+		"other-0": "foo file",
+		"other-1": "bar file",
+		"other-2": "baz file",
+		"other-3": "quux file",
+		"other-4": "quux file",
+	}
+	for id, contents := range fs {
+		v := mustRead(b.ReadBootFile(id))
+		if v != contents {
+			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
+		}
+	}
+}
+
+func TestDirectoryBooter(t *testing.T) {
+	parent, err := ioutil.TempDir("", "pixiecore-directory-booter-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "boot")
+	if err = os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(parent, "secret", "secret file")
+	mustWrite(dir, "kernel", "kernel file")
+	mustWrite(dir, "initrd-b", "second initrd file")
+	mustWrite(dir, "initrd-a", "first initrd file")
+	mustWrite(dir, "config", "config file")
+
+	b, err := DirectoryBooter(dir, `config={{ ID "config" }}`)
+	if err != nil {
+		t.Fatalf("Constructing DirectoryBooter: %s", err)
+	}
+
+	spec, err := b.BootSpec(Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: ArchIA32})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	expected := &Spec{
+		Kernel:  "kernel",
+		Initrd:  []ID{"initrd-a", "initrd-b"},
+		Cmdline: `config={{ ID "config" }}`,
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("Expected equal specs, but they differed:\nwant: %#v\ngot:  %#v", expected, spec)
+	}
+
+	fs := map[ID]string{
+		"kernel":   "kernel file",
+		"initrd-a": "first initrd file",
+		"config":   "config file",
+	}
+	for id, contents := range fs {
+		v := mustRead(b.ReadBootFile(id))
+		if v != contents {
+			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
+		}
+	}
+
+	for _, id := range []ID{"../secret", "..", ID(filepath.Join(parent, "secret")), "sub/../../secret", ""} {
+		if f, _, err := b.ReadBootFile(id); err == nil {
+			f.Close()
+			t.Fatalf("Expected reading %q to be rejected", id)
+		}
+	}
+}
+
 func TestAPIBooter(t *testing.T) {
 	// Set up an HTTP server to act as a (terrible) API server
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -197,3 +334,474 @@ func TestAPIBooter(t *testing.T) {
 		}
 	}
 }
+
+func TestAPIBooterOptionalFields(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/boot/01:02:03:04:05:06":
+			w.Write([]byte(`{
+  "kernel": "/foo",
+  "kernel-hash": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+  "initrd": ["/bar"],
+  "initrd-hashes": ["bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"],
+  "ipxe-preamble": ["console --x 1024 --y 768", "set net0/ip 192.168.0.10"],
+  "boot-flags": "--replace",
+  "cmdline-via-imgargs": true,
+  "menu": [
+    {
+      "label": "Install",
+      "kernel": "/bar",
+      "kernel-hash": "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+      "initrd": ["/baz"],
+      "initrd-hashes": ["aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"],
+      "cmdline": "config={{ URL \"/quux\" }}"
+    },
+    {"label": "Rescue", "kernel": "/quux", "cmdline": {"rescue": true}}
+  ]
+}`))
+		default:
+			fmt.Fprintf(w, "%s file", r.URL.Path[1:])
+		}
+	}))
+	defer api.Close()
+
+	b, err := APIBooter(api.URL+"/", time.Second)
+	if err != nil {
+		t.Fatalf("Constructing APIBooter: %s", err)
+	}
+	spec, err := b.BootSpec(Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: ArchX64})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+
+	if want := []string{"console --x 1024 --y 768", "set net0/ip 192.168.0.10"}; !reflect.DeepEqual(spec.IpxePreamble, want) {
+		t.Errorf("Wrong iPXE preamble %q, want %q", spec.IpxePreamble, want)
+	}
+	if spec.BootFlags != "--replace" {
+		t.Errorf("Wrong boot flags %q", spec.BootFlags)
+	}
+	if !spec.CmdlineViaImgargs {
+		t.Error("CmdlineViaImgargs not set")
+	}
+
+	if want := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"; spec.KernelHash != want {
+		t.Errorf("Wrong kernel hash %q, want %q", spec.KernelHash, want)
+	}
+	if want := []string{"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}; !reflect.DeepEqual(spec.InitrdHashes, want) {
+		t.Errorf("Wrong initrd hashes %q, want %q", spec.InitrdHashes, want)
+	}
+	if len(spec.Menu) != 2 {
+		t.Fatalf("Wrong number of menu entries: %d", len(spec.Menu))
+	}
+	install, rescue := spec.Menu[0], spec.Menu[1]
+	if install.Label != "Install" || rescue.Label != "Rescue" {
+		t.Errorf("Wrong menu labels %q and %q", install.Label, rescue.Label)
+	}
+	if want := "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"; install.KernelHash != want {
+		t.Errorf("Wrong install kernel hash %q, want %q", install.KernelHash, want)
+	}
+	if want := []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}; !reflect.DeepEqual(install.InitrdHashes, want) {
+		t.Errorf("Wrong install initrd hashes %q, want %q", install.InitrdHashes, want)
+	}
+	if rescue.Cmdline != "rescue" {
+		t.Errorf("Wrong rescue cmdline %q", rescue.Cmdline)
+	}
+	if len(install.Initrd) != 1 {
+		t.Fatalf("Wrong number of initrds: %d", len(install.Initrd))
+	}
+	if !strings.HasPrefix(install.Cmdline, `config={{ ID "`) || !strings.HasSuffix(install.Cmdline, `" }}`) {
+		t.Fatalf("Wrong install cmdline %q", install.Cmdline)
+	}
+
+	quuxID := ID(install.Cmdline[14 : len(install.Cmdline)-4])
+	fs := map[ID]string{
+		install.Kernel:    "bar file",
+		install.Initrd[0]: "baz file",
+		rescue.Kernel:     "quux file",
+		quuxID:            "quux file",
+	}
+	for id, contents := range fs {
+		v := mustRead(b.ReadBootFile(id))
+		if v != contents {
+			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
+		}
+	}
+}
+
+func TestProxyBooter(t *testing.T) {
+	var requested []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.RequestURI())
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/netboot/images/vmlinuz":
+			w.Write([]byte("kernel file"))
+		case "/netboot/broken":
+			http.Error(w, "oops", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	spec := &Spec{Kernel: "images/vmlinuz"}
+	b, err := ProxyBooter(spec, upstream.URL+"/netboot/", http.Header{"Authorization": {"Bearer s3cr3t"}}, nil)
+	if err != nil {
+		t.Fatalf("Constructing ProxyBooter: %s", err)
+	}
+
+	if got, err := b.BootSpec(Machine{MAC: mustMAC("01:02:03:04:05:06")}); err != nil || got != spec {
+		t.Fatalf("Wrong bootspec, got %v (err %v)", got, err)
+	}
+
+	f, sz, err := b.ReadBootFile("images/vmlinuz")
+	if sz != int64(len("kernel file")) {
+		t.Errorf("Wrong size for kernel, want %d, got %d", len("kernel file"), sz)
+	}
+	if got := mustRead(f, sz, err); got != "kernel file" {
+		t.Errorf("Wrong kernel contents, want %q, got %q", "kernel file", got)
+	}
+
+	tests := []struct {
+		id   ID
+		want error
+	}{
+		{"missing", ErrBootFileNotFound},
+		{"../netboot/images/vmlinuz", ErrBootFileNotFound},
+		{"images/../../secret", ErrBootFileNotFound},
+		{"a/%2e%2e/%2e%2e/secret", ErrBootFileNotFound},
+		{"images/vmlinuz?x=1", ErrBootFileNotFound},
+		{"images/vmlinuz#x", ErrBootFileNotFound},
+		{"images\\vmlinuz", ErrBootFileNotFound},
+		{"broken", ErrUpstream},
+	}
+	for _, test := range tests {
+		if _, _, err := b.ReadBootFile(test.id); !errors.Is(err, test.want) {
+			t.Errorf("ReadBootFile(%q) returned %v, expected an error wrapping %v", test.id, err, test.want)
+		}
+	}
+	for _, uri := range requested {
+		if !strings.HasPrefix(uri, "/netboot/") || strings.Contains(uri, "?") || strings.Contains(uri, "..") {
+			t.Errorf("Upstream got a request for %q, outside of /netboot/ or with a query", uri)
+		}
+	}
+
+	// Leading and duplicate slashes stay within the upstream directory.
+	requested = nil
+	if got := mustRead(b.ReadBootFile("//images//vmlinuz")); got != "kernel file" {
+		t.Errorf("Wrong kernel contents, want %q, got %q", "kernel file", got)
+	}
+	if len(requested) != 1 || requested[0] != "/netboot/images/vmlinuz" {
+		t.Errorf("Expected a single upstream request for /netboot/images/vmlinuz, got %q", requested)
+	}
+
+	b, err = ProxyBooter(spec, upstream.URL+"/netboot/", nil, nil)
+	if err != nil {
+		t.Fatalf("Constructing ProxyBooter: %s", err)
+	}
+	if _, _, err := b.ReadBootFile("images/vmlinuz"); err == nil || errors.Is(err, ErrBootFileNotFound) || errors.Is(err, ErrUpstream) {
+		t.Errorf("Expected a plain error for an unauthenticated request, got %v", err)
+	}
+
+	upstream.Close()
+	if _, _, err := b.ReadBootFile("images/vmlinuz"); !errors.Is(err, ErrUpstream) {
+		t.Errorf("Expected an error wrapping %v for an unreachable upstream, got %v", ErrUpstream, err)
+	}
+
+	if _, err := ProxyBooter(spec, "/netboot", nil, nil); err == nil {
+		t.Errorf("Expected an error for a relative upstream URL")
+	}
+}
+
+func TestProxyBooterTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	b, err := ProxyBooter(&Spec{Kernel: "k"}, upstream.URL, nil, &http.Client{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Constructing ProxyBooter: %s", err)
+	}
+	if _, _, err := b.ReadBootFile("k"); !errors.Is(err, ErrUpstream) {
+		t.Errorf("Expected an error wrapping %v from a stalled upstream, got %v", ErrUpstream, err)
+	}
+}
+
+// chainTestBooter boots with spec and serves files, failing with err
+// if it's set.
+type chainTestBooter struct {
+	spec  *Spec
+	files map[ID]string
+	err   error
+}
+
+func (b *chainTestBooter) BootSpec(m Machine) (*Spec, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.spec, nil
+}
+
+func (b *chainTestBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	if b.err != nil {
+		return nil, -1, b.err
+	}
+	f, ok := b.files[id]
+	if !ok {
+		return nil, -1, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	return ioutil.NopCloser(strings.NewReader(f)), int64(len(f)), nil
+}
+
+func (b *chainTestBooter) WriteBootFile(id ID, body io.Reader) error {
+	return errors.New("no")
+}
+
+func TestChainBooterFallthrough(t *testing.T) {
+	first := &chainTestBooter{files: map[ID]string{"a": "first a"}}
+	second := &chainTestBooter{
+		spec:  &Spec{Kernel: ID("b")},
+		files: map[ID]string{"a": "second a", "b": "second b"},
+	}
+	b, err := ChainBooter(first, second)
+	if err != nil {
+		t.Fatalf("Constructing ChainBooter: %s", err)
+	}
+
+	m := Machine{MAC: mustMAC("01:02:03:04:05:06")}
+	spec, err := b.BootSpec(m)
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if spec != second.spec {
+		t.Fatalf("Expected the second booter's spec, got %#v", spec)
+	}
+
+	if got := mustRead(b.ReadBootFile("a")); got != "first a" {
+		t.Errorf("Wrong contents for file a, want %q, got %q", "first a", got)
+	}
+	if got := mustRead(b.ReadBootFile("b")); got != "second b" {
+		t.Errorf("Wrong contents for file b, want %q, got %q", "second b", got)
+	}
+}
+
+func TestChainBooterShortCircuitsOnError(t *testing.T) {
+	failing := &chainTestBooter{err: errors.New("backend is down")}
+	catchAll := &chainTestBooter{
+		spec:  &Spec{Kernel: ID("k")},
+		files: map[ID]string{"k": "kernel"},
+	}
+	b, err := ChainBooter(failing, catchAll)
+	if err != nil {
+		t.Fatalf("Constructing ChainBooter: %s", err)
+	}
+
+	m := Machine{MAC: mustMAC("01:02:03:04:05:06")}
+	if spec, err := b.BootSpec(m); err != failing.err {
+		t.Errorf("Expected error %q from BootSpec, got spec %#v, err %v", failing.err, spec, err)
+	}
+	if _, _, err := b.ReadBootFile("k"); err != failing.err {
+		t.Errorf("Expected error %q from ReadBootFile, got %v", failing.err, err)
+	}
+}
+
+func TestChainBooterAllMiss(t *testing.T) {
+	b, err := ChainBooter(&chainTestBooter{}, &chainTestBooter{})
+	if err != nil {
+		t.Fatalf("Constructing ChainBooter: %s", err)
+	}
+
+	m := Machine{MAC: mustMAC("01:02:03:04:05:06")}
+	spec, err := b.BootSpec(m)
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if spec != nil {
+		t.Errorf("Expected no bootspec, got %#v", spec)
+	}
+	if _, _, err := b.ReadBootFile("k"); !errors.Is(err, ErrBootFileNotFound) {
+		t.Errorf("Expected ErrBootFileNotFound, got %v", err)
+	}
+
+	if _, err := ChainBooter(); err == nil {
+		t.Error("ChainBooter with no booters should have failed")
+	}
+}
+
+func TestFallbackBooter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-fallback-booter-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mustWrite(dir, "rescue-kernel", "rescue kernel")
+	mustWrite(dir, "rescue-initrd", "rescue initrd")
+	mustWrite(dir, "rescue-config", "rescue config")
+
+	primary := &chainTestBooter{
+		spec:  &Spec{Kernel: ID("k")},
+		files: map[ID]string{"k": "primary kernel"},
+	}
+	b, err := NewFallbackBooter(primary, &Spec{
+		Kernel:  ID(filepath.Join(dir, "rescue-kernel")),
+		Initrd:  []ID{ID(filepath.Join(dir, "rescue-initrd"))},
+		Cmdline: fmt.Sprintf(`rescue config={{ ID "%s" }}`, filepath.Join(dir, "rescue-config")),
+	})
+	if err != nil {
+		t.Fatalf("Constructing FallbackBooter: %s", err)
+	}
+	var logged []string
+	b.(logBooter).setLog(func(subsystem, format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+	m := Machine{MAC: mustMAC("01:02:03:04:05:06")}
+
+	spec, err := b.BootSpec(m)
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if spec != primary.spec {
+		t.Fatalf("Expected the primary booter's spec, got %#v", spec)
+	}
+	if got := mustRead(b.ReadBootFile("k")); got != "primary kernel" {
+		t.Errorf("Wrong contents for file k, want %q, got %q", "primary kernel", got)
+	}
+
+	primary.spec = nil
+	if spec, err := b.BootSpec(m); spec != nil || err != nil {
+		t.Errorf("Expected no bootspec when the primary booter doesn't boot the machine, got %#v, %v", spec, err)
+	}
+	if len(logged) != 0 {
+		t.Errorf("Expected no fallback logged, got %q", logged)
+	}
+
+	primary.err = errors.New("backend is down")
+	spec, err = b.BootSpec(m)
+	if err != nil {
+		t.Fatalf("Getting bootspec with a failing primary booter: %s", err)
+	}
+	expected := &Spec{
+		Kernel:  ID("fallback-kernel"),
+		Initrd:  []ID{"fallback-initrd-0"},
+		Cmdline: `rescue config={{ ID "fallback-other-0" }}`,
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("Expected equal specs, but they differed:\nwant: %#v\ngot:  %#v", expected, spec)
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "backend is down") {
+		t.Errorf("Expected the fallback to be logged with the primary booter's error, got %q", logged)
+	}
+
+	fs := map[ID]string{
+		"fallback-kernel":   "rescue kernel",
+		"fallback-initrd-0": "rescue initrd",
+		"fallback-other-0":  "rescue config",
+	}
+	for id, contents := range fs {
+		if got := mustRead(b.ReadBootFile(id)); got != contents {
+			t.Errorf("Wrong file contents for %q: wanted %q, got %q", id, contents, got)
+		}
+	}
+	if _, _, err := b.ReadBootFile("k"); err != primary.err {
+		t.Errorf("Expected error %q reading a primary file, got %v", primary.err, err)
+	}
+}
+
+func TestFallbackBooterMenu(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-fallback-booter-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mustWrite(dir, "rescue-kernel", "rescue kernel")
+	mustWrite(dir, "rescue-initrd", "rescue initrd")
+	mustWrite(dir, "rescue-config", "rescue config")
+	mustWrite(dir, "memtest", "memtest")
+
+	primary := &chainTestBooter{err: errors.New("backend is down")}
+	b, err := NewFallbackBooter(primary, &Spec{
+		Message:           "API server is down",
+		IpxePreamble:      []string{"console --x 1024 --y 768"},
+		BootFlags:         "--autofree",
+		CmdlineViaImgargs: true,
+		Menu: []MenuEntry{
+			{
+				Label:        "Rescue",
+				Kernel:       ID(filepath.Join(dir, "rescue-kernel")),
+				Initrd:       []ID{ID(filepath.Join(dir, "rescue-initrd"))},
+				Cmdline:      fmt.Sprintf(`rescue config={{ ID "%s" }}`, filepath.Join(dir, "rescue-config")),
+				KernelHash:   strings.Repeat("1", 64),
+				InitrdHashes: []string{strings.Repeat("2", 64)},
+			},
+			{
+				Label:  "Memtest",
+				Kernel: ID(filepath.Join(dir, "memtest")),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Constructing FallbackBooter: %s", err)
+	}
+
+	spec, err := b.BootSpec(Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec with a failing primary booter: %s", err)
+	}
+	expected := &Spec{
+		Kernel:            ID("fallback-kernel"),
+		Message:           "API server is down",
+		IpxePreamble:      []string{"console --x 1024 --y 768"},
+		BootFlags:         "--autofree",
+		CmdlineViaImgargs: true,
+		Menu: []MenuEntry{
+			{
+				Label:        "Rescue",
+				Kernel:       "fallback-other-0",
+				Initrd:       []ID{"fallback-other-1"},
+				Cmdline:      `rescue config={{ ID "fallback-other-2" }}`,
+				KernelHash:   strings.Repeat("1", 64),
+				InitrdHashes: []string{strings.Repeat("2", 64)},
+			},
+			{
+				Label:  "Memtest",
+				Kernel: "fallback-other-3",
+			},
+		},
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("Expected equal specs, but they differed:\nwant: %#v\ngot:  %#v", expected, spec)
+	}
+
+	fs := map[ID]string{
+		"fallback-other-0": "rescue kernel",
+		"fallback-other-1": "rescue initrd",
+		"fallback-other-2": "rescue config",
+		"fallback-other-3": "memtest",
+	}
+	for id, contents := range fs {
+		if got := mustRead(b.ReadBootFile(id)); got != contents {
+			t.Errorf("Wrong file contents for %q: wanted %q, got %q", id, contents, got)
+		}
+	}
+}
+
+func TestFallbackBooterIpxeScript(t *testing.T) {
+	primary := &chainTestBooter{err: errors.New("backend is down")}
+	b, err := NewFallbackBooter(primary, &Spec{IpxeScript: "#!ipxe\nshell\n"})
+	if err != nil {
+		t.Fatalf("Constructing FallbackBooter: %s", err)
+	}
+	spec, err := b.BootSpec(Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec with a failing primary booter: %s", err)
+	}
+	if spec.IpxeScript != "#!ipxe\nshell\n" {
+		t.Errorf("Wrong iPXE script %q", spec.IpxeScript)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bootIDWindow is how long a machine's boot ID lives after its last
+// request. Requests from the same MAC within the window are part of
+// the same boot.
+const bootIDWindow = 10 * time.Minute
+
+// maxTrackedBootIDs bounds the memory used by bootIDs, like
+// maxRateLimitedMACs.
+const maxTrackedBootIDs = 10000
+
+// bootIDHeader is the response header that carries the boot ID, and
+// the request header APIBooter passes it to the API server in.
+const bootIDHeader = "X-Pixiecore-Boot-ID"
+
+// bootIDs assigns correlation IDs to machine boots, so that the
+// requests a machine makes while booting can be traced in the logs.
+type bootIDs struct {
+	mu      sync.Mutex
+	boots   map[string]*bootIDEntry
+	timeNow func() time.Time
+}
+
+type bootIDEntry struct {
+	id   string
+	last time.Time
+}
+
+// forMAC returns the boot ID of mac's current boot, or starts a new
+// boot if mac hasn't been seen within bootIDWindow.
+func (b *bootIDs) forMAC(mac net.HardwareAddr) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.boots == nil {
+		b.boots = make(map[string]*bootIDEntry)
+	}
+	if b.timeNow == nil {
+		b.timeNow = time.Now
+	}
+	now := b.timeNow()
+	k := mac.String()
+	e := b.boots[k]
+	if e == nil || now.Sub(e.last) >= bootIDWindow {
+		if e == nil && len(b.boots) >= maxTrackedBootIDs {
+			b.evict(now)
+		}
+		e = &bootIDEntry{id: newBootID()}
+		b.boots[k] = e
+	}
+	e.last = now
+	return e.id
+}
+
+// evict forgets boots that are over, and arbitrary ones if that
+// doesn't free enough space.
+func (b *bootIDs) evict(now time.Time) {
+	for k, e := range b.boots {
+		if now.Sub(e.last) >= bootIDWindow {
+			delete(b.boots, k)
+		}
+	}
+	for k := range b.boots {
+		if len(b.boots) <= maxTrackedBootIDs/2 {
+			break
+		}
+		delete(b.boots, k)
+	}
+}
+
+func newBootID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Boot IDs only correlate log lines, a clock-derived ID
+		// is good enough if reading randomness fails.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+type bootIDContextKey struct{}
+
+// BootIDFromContext returns the boot ID of the machine whose request
+// ctx belongs to. Pixiecore passes it to ContextBooters, to correlate
+// Booter logs with Pixiecore's.
+func BootIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(bootIDContextKey{}).(string)
+	return id, ok
+}
+
+// withBootID tags r, and the response to it, with the boot ID of
+// mac's current boot.
+func (s *Server) withBootID(w http.ResponseWriter, r *http.Request, mac net.HardwareAddr) *http.Request {
+	id := s.bootIDs.forMAC(mac)
+	w.Header().Set(bootIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), bootIDContextKey{}, id))
+}
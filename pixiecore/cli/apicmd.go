@@ -15,7 +15,6 @@
 package cli
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -31,7 +30,10 @@ what to do. The API server can tell Pixiecore to ignore the machine,
 or tell it what to boot.
 
 It is your responsibility to implement or run a server that implements
-the Pixiecore boot API. The specification can be found at <TODO>.`,
+the Pixiecore boot API. The specification can be found at <TODO>.
+
+With --enable-ipv6, Pixiecore also boots machines over DHCPv6, asking
+the same API server what to boot.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) != 1 {
 			fatalf("you must specify an API URL")
@@ -49,12 +51,21 @@ the Pixiecore boot API. The specification can be found at <TODO>.`,
 		s := serverFromFlags(cmd)
 		s.Booter = booter
 
-		fmt.Println(s.Serve())
+		enableIPv6, err := cmd.Flags().GetBool("enable-ipv6")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if !enableIPv6 {
+			serve(cmd, s, server, timeout)
+			return
+		}
+		serveBoth(cmd, s, serverV6FromFlags(cmd, s, server, timeout), server, timeout)
 	}}
 
 func init() {
 	rootCmd.AddCommand(apiCmd)
 	serverConfigFlags(apiCmd)
+	dualStackFlags(apiCmd)
 	apiCmd.Flags().Duration("api-request-timeout", 5*time.Second, "Timeout for request to the API server")
 	// TODO: SSL cert flags for both client and server auth.
 }
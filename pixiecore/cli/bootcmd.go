@@ -15,8 +15,6 @@
 package cli
 
 import (
-	"fmt"
-
 	"github.com/spf13/cobra"
 	"go.universe.tf/netboot/pixiecore"
 )
@@ -56,7 +54,7 @@ var bootCmd = &cobra.Command{
 		s := serverFromFlags(cmd)
 		s.Booter = booter
 
-		fmt.Println(s.Serve())
+		serve(cmd, s, "", 0)
 	},
 }
 
@@ -1,7 +1,6 @@
 package cli
 
 import (
-	"fmt"
 	"net"
 	"strings"
 
@@ -40,8 +39,12 @@ var bootIPv6Cmd = &cobra.Command{
 			s.Debug = logWithStdFmt
 		}
 
-		if addr == "" {
-			fatalf("Please specify address to bind to")
+		iface, err := cmd.Flags().GetString("listen-interface")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if addr == "" && iface == "" {
+			fatalf("Please specify address or interface to bind to")
 		}
 		if ipxeURL == "" {
 			fatalf("Please specify ipxe config file url")
@@ -51,6 +54,7 @@ var bootIPv6Cmd = &cobra.Command{
 		}
 
 		s.Address = addr
+		s.Interface = iface
 		preference, err := cmd.Flags().GetUint8("preference")
 		if err != nil {
 			fatalf("Error reading flag: %s", err)
@@ -65,8 +69,42 @@ var bootIPv6Cmd = &cobra.Command{
 				dnsServerAddresses = append(dnsServerAddresses, net.ParseIP(dnsServerAddress))
 			}
 		}
-		s.BootConfig = pixiecore.MakeStaticBootConfiguration(httpBootURL, ipxeURL, preference,
+		bootConfig := pixiecore.MakeStaticBootConfiguration(httpBootURL, ipxeURL, preference,
 			cmd.Flags().Changed("preference"), dnsServerAddresses)
+		dnsSearch, err := cmd.Flags().GetString("dns-search")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if cmd.Flags().Changed("dns-search") {
+			bootConfig.DNSSearchList = strings.Split(dnsSearch, ",")
+		}
+		bootConfig.NTPServers = ntpServersFromFlags(cmd)
+		tftpServer, err := cmd.Flags().GetString("tftp-server")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		tftpBootFile, err := cmd.Flags().GetString("tftp-bootfile")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if (tftpServer == "") != (tftpBootFile == "") {
+			fatalf("--tftp-server and --tftp-bootfile must be set together")
+		}
+		if tftpServer != "" {
+			bootConfig.TFTPServer = net.ParseIP(tftpServer)
+			if bootConfig.TFTPServer == nil || bootConfig.TFTPServer.To4() != nil {
+				fatalf("Invalid TFTP server address %q, must be an IPv6 address", tftpServer)
+			}
+			bootConfig.TFTPBootFile = tftpBootFile
+		}
+		alternateURLs, err := cmd.Flags().GetStringArray("alternate-boot-url")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		for _, url := range alternateURLs {
+			bootConfig.AlternateBootURLs = append(bootConfig.AlternateBootURLs, []byte(url))
+		}
+		s.BootConfig = bootConfig
 
 		addressPoolStart, err := cmd.Flags().GetString("address-pool-start")
 		if err != nil {
@@ -83,12 +121,14 @@ var bootIPv6Cmd = &cobra.Command{
 		s.AddressPool = pool.NewRandomAddressPool(net.ParseIP(addressPoolStart), addressPoolSize, addressPoolValidLifetime)
 		s.PacketBuilder = dhcp6.MakePacketBuilder(addressPoolValidLifetime-addressPoolValidLifetime*3/100, addressPoolValidLifetime)
 
-		fmt.Println(s.Serve())
+		serveV6(cmd, s, "", 0)
 	},
 }
 
 func serverv6ConfigFlags(cmd *cobra.Command) {
+	dryRunFlag(cmd)
 	cmd.Flags().StringP("listen-addr", "", "", "IPv6 address to listen on")
+	cmd.Flags().StringP("listen-interface", "", "", "Name of the interface to listen on, e.g. eth0")
 	cmd.Flags().StringP("ipxe-url", "", "", "IPXE config file url, e.g. http://[2001:db8:f00f:cafe::4]/script.ipxe")
 	cmd.Flags().StringP("httpboot-url", "", "", "HTTPBoot url, e.g. http://[2001:db8:f00f:cafe::4]/bootx64.efi")
 	cmd.Flags().Bool("debug", false, "Enable debug-level logging")
@@ -97,6 +137,11 @@ func serverv6ConfigFlags(cmd *cobra.Command) {
 	cmd.Flags().Uint64("address-pool-size", 50, "Address pool size")
 	cmd.Flags().Uint32("address-pool-lifetime", 1850, "Address pool ip valid lifetime in seconds")
 	cmd.Flags().StringP("dns-servers", "", "", "Comma separated list of one or more dns server addresses")
+	cmd.Flags().StringP("dns-search", "", "", "Comma separated list of one or more dns search domains")
+	cmd.Flags().String("ntp-servers", "", "Comma separated list of one or more NTP server addresses")
+	cmd.Flags().String("tftp-server", "", "TFTP server address for legacy BIOS clients, which get the ipxe url otherwise")
+	cmd.Flags().String("tftp-bootfile", "", "Boot file legacy BIOS clients fetch from --tftp-server, e.g. undionly.kpxe")
+	cmd.Flags().StringArray("alternate-boot-url", nil, "Boot file url clients can fall back to, sent in a vendor-specific information option, can be repeated")
 }
 
 func init() {
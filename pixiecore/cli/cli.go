@@ -18,7 +18,9 @@ package cli // import "go.universe.tf/netboot/pixiecore/cli"
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -70,12 +72,24 @@ func staticConfigFlags(cmd *cobra.Command) {
 }
 
 func serverConfigFlags(cmd *cobra.Command) {
+	dryRunFlag(cmd)
 	cmd.Flags().BoolP("debug", "d", false, "Log more things that aren't directly related to booting a recognized client")
 	cmd.Flags().BoolP("log-timestamps", "t", false, "Add a timestamp to each log line")
 	cmd.Flags().StringP("listen-addr", "l", "0.0.0.0", "IPv4 address to listen on")
 	cmd.Flags().IntP("port", "p", 80, "Port to listen on for HTTP")
 	cmd.Flags().Int("status-port", 0, "HTTP port for status information (can be the same as --port)")
+	cmd.Flags().String("file-url-scheme", "http", "URL scheme iPXE uses to fetch kernels and initrds (http or https)")
+	cmd.Flags().String("public-host", "", "Host[:port] iPXE uses to fetch kernels and initrds, when behind a reverse proxy")
+	cmd.Flags().Bool("compress-files", false, "Gzip boot files on the fly for clients that support it, at the cost of CPU")
+	cmd.Flags().Bool("combine-initrds", false, "Concatenate the initrds of each boot into a single file, for clients that can only load one")
+	cmd.Flags().Int("max-file-transfers", 0, "Maximum number of boot files sent at once, 0 for no limit")
+	cmd.Flags().Duration("file-transfer-queue-timeout", 10*time.Second, "How long requests over --max-file-transfers wait for a transfer to finish, before being told to retry later")
+	cmd.Flags().Duration("shutdown-grace-period", 30*time.Second, "How long to wait for boot file transfers to finish when told to stop, negative to stop right away")
+	cmd.Flags().String("health-check-mac", "", "MAC address /_/healthz asks the booter to boot, 02:00:00:00:00:00 if empty")
+	cmd.Flags().StringArray("cors-allowed-origin", nil, "Origin of web pages allowed to query /_/clients, /_/healthz and /_/metrics from a browser, e.g. https://dashboard.example.com, or * for any. Can be repeated")
+	cmd.Flags().Bool("validate-specs", false, "Check that boot files exist before sending boot scripts, and refuse to boot machines when they don't")
 	cmd.Flags().Bool("dhcp-no-bind", false, "Handle DHCP traffic without binding to the DHCP server port")
+	cmd.Flags().Bool("reuse-port", false, "Share the DHCP, TFTP and PXE ports with other processes using SO_REUSEPORT (Linux only)")
 	cmd.Flags().String("ipxe-bios", "", "Path to an iPXE binary for BIOS/UNDI")
 	cmd.Flags().String("ipxe-ipxe", "", "Path to an iPXE binary for chainloading from another iPXE")
 	cmd.Flags().String("ipxe-efi32", "", "Path to an iPXE binary for 32-bit UEFI")
@@ -150,10 +164,54 @@ func serverFromFlags(cmd *cobra.Command) *pixiecore.Server {
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
 	}
+	fileURLScheme, err := cmd.Flags().GetString("file-url-scheme")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	publicHost, err := cmd.Flags().GetString("public-host")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	compressFiles, err := cmd.Flags().GetBool("compress-files")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	combineInitrds, err := cmd.Flags().GetBool("combine-initrds")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	validateSpecs, err := cmd.Flags().GetBool("validate-specs")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	healthCheckMAC, err := cmd.Flags().GetString("health-check-mac")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	corsAllowedOrigins, err := cmd.Flags().GetStringArray("cors-allowed-origin")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	maxFileTransfers, err := cmd.Flags().GetInt("max-file-transfers")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	fileTransferQueueTimeout, err := cmd.Flags().GetDuration("file-transfer-queue-timeout")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	shutdownGracePeriod, err := cmd.Flags().GetDuration("shutdown-grace-period")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
 	dhcpNoBind, err := cmd.Flags().GetBool("dhcp-no-bind")
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
 	}
+	reusePort, err := cmd.Flags().GetBool("reuse-port")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
 	ipxeBios, err := cmd.Flags().GetString("ipxe-bios")
 	if err != nil {
 		fatalf("Error reading flag: %s", err)
@@ -178,14 +236,36 @@ func serverFromFlags(cmd *cobra.Command) *pixiecore.Server {
 	if httpPort <= 0 {
 		fatalf("HTTP port must be >0")
 	}
+	if fileURLScheme != "http" && fileURLScheme != "https" {
+		fatalf("File URL scheme must be http or https")
+	}
+
+	var healthCheckMachine pixiecore.Machine
+	if healthCheckMAC != "" {
+		if healthCheckMachine.MAC, err = net.ParseMAC(healthCheckMAC); err != nil {
+			fatalf("Invalid health check MAC address %q: %s", healthCheckMAC, err)
+		}
+	}
 
 	ret := &pixiecore.Server{
 		Ipxe:           map[pixiecore.Firmware][]byte{},
 		Log:            logWithStdFmt,
 		HTTPPort:       httpPort,
 		HTTPStatusPort: httpStatusPort,
+		FileURLScheme:  fileURLScheme,
+		PublicHost:     publicHost,
+		CompressFiles:  compressFiles,
+		CombineInitrds: combineInitrds,
+		ValidateSpecs:  validateSpecs,
 		DHCPNoBind:     dhcpNoBind,
+		ReusePort:      reusePort,
 		UIAssetsDir:    uiAssetsDir,
+
+		MaxFileTransfers:         maxFileTransfers,
+		FileTransferQueueTimeout: fileTransferQueueTimeout,
+		ShutdownGracePeriod:      shutdownGracePeriod,
+		HealthCheckMachine:       healthCheckMachine,
+		CORSAllowedOrigins:       corsAllowedOrigins,
 	}
 	for fwtype, bs := range Ipxe {
 		ret.Ipxe[fwtype] = bs
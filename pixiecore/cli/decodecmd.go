@@ -0,0 +1,226 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.universe.tf/netboot/dhcp6"
+	"go.universe.tf/netboot/pcap"
+)
+
+// pcap link type of captures without a link layer, starting with the
+// IPv6 header, like the ones written by --pcap-file.
+const pcapLinkIPv6 pcap.LinkType = 229
+
+var decodeCmd = &cobra.Command{
+	Use:   "decode [file]",
+	Short: "Decode and print DHCPv6 packets",
+	Long: `Decode and print DHCPv6 packets, read from file or stdin. The input is
+either a pcap capture, in which DHCPv6 packets are found by UDP port, or the
+hex dump of a single DHCPv6 message, e.g. as copied from Wireshark.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			fatalf("decode takes at most one argument, the file to decode")
+		}
+		var (
+			input []byte
+			err   error
+		)
+		if len(args) == 1 {
+			input, err = ioutil.ReadFile(args[0])
+		} else {
+			input, err = ioutil.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			fatalf("Reading input: %s", err)
+		}
+		if err := decodeDHCPv6(os.Stdout, input); err != nil {
+			fatalf("%s", err)
+		}
+	},
+}
+
+// decodeDHCPv6 prints the DHCPv6 packets in input, a pcap capture or
+// a hex dump, to w.
+func decodeDHCPv6(w io.Writer, input []byte) error {
+	if !isPcap(input) {
+		bs, err := hex.DecodeString(strings.Join(strings.Fields(string(input)), ""))
+		if err != nil {
+			return fmt.Errorf("input is neither a pcap capture nor a hex dump: %s", err)
+		}
+		return printDHCPv6(w, bs)
+	}
+
+	r, err := pcap.NewReader(bytes.NewReader(input))
+	if err != nil {
+		return err
+	}
+	n, found := 0, 0
+	for r.Next() {
+		n++
+		payload := dhcpv6Payload(r.LinkType, r.Packet().Bytes)
+		if payload == nil {
+			continue
+		}
+		found++
+		fmt.Fprintf(w, "Packet %d, %s\n", n, r.Packet().Timestamp.UTC().Format("2006-01-02 15:04:05.000000"))
+		if err := printDHCPv6(w, payload); err != nil {
+			fmt.Fprintf(w, "  %s\n", err)
+		}
+		fmt.Fprintln(w)
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if found == 0 {
+		return errors.New("no DHCPv6 packets in the capture")
+	}
+	return nil
+}
+
+// isPcap returns true if input starts with a pcap file header, in
+// either byte order.
+func isPcap(input []byte) bool {
+	if len(input) < 4 {
+		return false
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if magic := order.Uint32(input); magic == 0xa1b2c3d4 || magic == 0xa1b23c4d {
+			return true
+		}
+	}
+	return false
+}
+
+// dhcpv6Payload returns the UDP payload of pkt, a captured packet of
+// the given link type, if it's a DHCPv6 packet. IPv6 extension
+// headers and VLAN tags aren't supported.
+func dhcpv6Payload(linkType pcap.LinkType, pkt []byte) []byte {
+	switch linkType {
+	case pcap.LinkEthernet:
+		if len(pkt) < 14 || binary.BigEndian.Uint16(pkt[12:14]) != 0x86dd {
+			return nil
+		}
+		pkt = pkt[14:]
+	case pcap.LinkRaw, pcapLinkIPv6:
+	default:
+		return nil
+	}
+	if len(pkt) < 48 || pkt[0]>>4 != 6 || pkt[6] != 17 {
+		return nil
+	}
+	udp := pkt[40:]
+	src, dst := binary.BigEndian.Uint16(udp[0:2]), binary.BigEndian.Uint16(udp[2:4])
+	if src != 546 && src != 547 && dst != 546 && dst != 547 {
+		return nil
+	}
+	return udp[8:]
+}
+
+// printDHCPv6 prints the DHCPv6 message bs to w, one line per
+// option.
+func printDHCPv6(w io.Writer, bs []byte) error {
+	pkt, err := dhcp6.ParsePacket(bs)
+	if err != nil {
+		return fmt.Errorf("malformed DHCPv6 packet: %s", err)
+	}
+	fmt.Fprintf(w, "%s, transaction ID %x\n", pkt.Type, pkt.TransactionID)
+	for _, relay := range pkt.Relays {
+		fmt.Fprintf(w, "  %s, hop count %d, link address %s, peer address %s\n",
+			relay.Type, relay.HopCount, relay.LinkAddress, relay.PeerAddress)
+	}
+
+	ids := make([]int, 0, len(pkt.Options))
+	for id := range pkt.Options {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	o := pkt.Options
+	for _, id := range ids {
+		switch uint16(id) {
+		case dhcp6.OptClientID:
+			fmt.Fprintf(w, "  Client ID: %x\n", o.ClientID())
+		case dhcp6.OptServerID:
+			fmt.Fprintf(w, "  Server ID: %x\n", o.ServerID())
+		case dhcp6.OptIaNa:
+			fmt.Fprintf(w, "  IA_NA: IAIDs %x, addresses %v\n", o.IaNaIDs(), o.IaNaAddresses())
+		case dhcp6.OptOro:
+			fmt.Fprintf(w, "  Option Request: %v\n", o.OptionRequest())
+		case dhcp6.OptElapsedTime:
+			elapsed, _ := o.ElapsedTime()
+			fmt.Fprintf(w, "  Elapsed Time: %s\n", elapsed)
+		case dhcp6.OptUnicast:
+			fmt.Fprintf(w, "  Server Unicast: %s\n", o.ServerUnicast())
+		case dhcp6.OptStatusCode:
+			code, msg, _ := o.StatusCode()
+			fmt.Fprintf(w, "  Status Code: %d %q\n", code, msg)
+		case dhcp6.OptRapidCommit:
+			fmt.Fprintf(w, "  Rapid Commit\n")
+		case dhcp6.OptVendorClass:
+			if enterpriseNumber, data, ok := o.VendorClass(); ok {
+				fmt.Fprintf(w, "  Vendor Class: enterprise %d, %q\n", enterpriseNumber, data)
+			} else {
+				printRawOption(w, o, uint16(id))
+			}
+		case dhcp6.OptVendorOpts:
+			if urls := o.AlternateBootFileURLs(); urls != nil {
+				fmt.Fprintf(w, "  Alternate Boot File URLs: %q\n", urls)
+			} else {
+				printRawOption(w, o, uint16(id))
+			}
+		case dhcp6.OptRecursiveDNS:
+			fmt.Fprintf(w, "  DNS Servers: %v\n", o.RecursiveDNS())
+		case dhcp6.OptDomainList:
+			fmt.Fprintf(w, "  Domain Search List: %v\n", o.DomainSearchList())
+		case dhcp6.OptIaPd:
+			fmt.Fprintf(w, "  IA_PD: IAIDs %x, prefixes %v\n", o.IaPdIDs(), o.IaPdPrefixes())
+		case dhcp6.OptClientFQDN:
+			if flags, name, ok := o.ClientFQDN(); ok {
+				fmt.Fprintf(w, "  Client FQDN: %q, flags %d\n", name, flags)
+			} else {
+				printRawOption(w, o, uint16(id))
+			}
+		case dhcp6.OptBootfileURL:
+			fmt.Fprintf(w, "  Boot File URL: %s\n", o.BootFileURL())
+		case dhcp6.OptClientArchType:
+			fmt.Fprintf(w, "  Client Architecture: %d\n", o.ClientArchType())
+		default:
+			printRawOption(w, o, uint16(id))
+		}
+	}
+	return nil
+}
+
+// printRawOption prints the options with the given ID in hex.
+func printRawOption(w io.Writer, o dhcp6.Options, id uint16) {
+	for _, option := range o[id] {
+		fmt.Fprintf(w, "  Option %d: %x\n", id, option.Value)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(decodeCmd)
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// The ADVERTISE of the capture in dhcp6/testdata/dhcp6.pcap.
+const capturedAdvertise = `
+02958a890003002844857b1d00000e1000001c200005001820010db8000100010000000000000099
+00093a8000278d0000010012000474c475b0d742d4ca3681fe4bc6f66c240002000e000100012071
+06ee8851fb6bd76d0017001020010db80001000100000000000002010018000e08696e7465726e61
+6c036c616e00
+`
+
+func TestDecodeDHCPv6Hex(t *testing.T) {
+	var out bytes.Buffer
+	if err := decodeDHCPv6(&out, []byte(capturedAdvertise)); err != nil {
+		t.Fatalf("Decoding packet: %s", err)
+	}
+
+	want := `ADVERTISE, transaction ID 958a89
+  Client ID: 000474c475b0d742d4ca3681fe4bc6f66c24
+  Server ID: 00010001207106ee8851fb6bd76d
+  IA_NA: IAIDs [44857b1d], addresses [2001:db8:1:1::99]
+  DNS Servers: [2001:db8:1:1::201]
+  Domain Search List: [internal.lan.]
+`
+	if out.String() != want {
+		t.Fatalf("Wrong decoded packet, got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	if err := decodeDHCPv6(&out, []byte("02958a")); err == nil {
+		t.Fatal("Truncated packet decoded without error")
+	}
+}
+
+func TestDecodeDHCPv6Pcap(t *testing.T) {
+	capture, err := ioutil.ReadFile("../../dhcp6/testdata/dhcp6.pcap")
+	if err != nil {
+		t.Fatalf("Reading capture: %s", err)
+	}
+	var out bytes.Buffer
+	if err := decodeDHCPv6(&out, capture); err != nil {
+		t.Fatalf("Decoding capture: %s", err)
+	}
+
+	for _, want := range []string{
+		"Packet 1, 2017-03-31 12:57:48.861433\nSOLICIT, transaction ID 958a89\n",
+		"Packet 2, ",
+		"ADVERTISE, transaction ID 958a89\n",
+		"REQUEST, transaction ID 0fa052\n",
+		"REPLY, transaction ID 0fa052\n",
+		"  Client FQDN: \"lucid-nonsense.appliedlogic.ca.\", flags 1\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("Decoded capture doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
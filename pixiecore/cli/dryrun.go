@@ -0,0 +1,150 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+// A dryRunCheck is the outcome of one of the checks made by --dry-run.
+type dryRunCheck struct {
+	what string
+	err  error
+}
+
+func dryRunFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("dry-run", false, "Check the configuration and the API server, print a summary and exit without serving")
+}
+
+// serve runs s, or with --dry-run, checks its configuration and
+// exits. apiURL is the API server s gets boot instructions from, if
+// any.
+func serve(cmd *cobra.Command, s *pixiecore.Server, apiURL string, apiTimeout time.Duration) {
+	if !dryRunRequested(cmd) {
+		fmt.Println(s.ServeContext(stopOnSignal()))
+		return
+	}
+	os.Exit(reportDryRun(os.Stdout, dryRunChecks(s, apiURL, apiTimeout)))
+}
+
+// dryRunChecks checks the configuration of s, and the API server at
+// apiURL if it's set.
+func dryRunChecks(s *pixiecore.Server, apiURL string, apiTimeout time.Duration) []dryRunCheck {
+	checks := []dryRunCheck{
+		{fmt.Sprintf("listen address %q", s.Address), checkListenAddress(s.Address, false)},
+	}
+	if apiURL != "" {
+		// A MAC address reserved for documentation, see RFC 7042.
+		reqURL := fmt.Sprintf("%s/v1/boot/00:00:5e:00:53:00", strings.TrimSuffix(apiURL, "/"))
+		checks = append(checks, dryRunCheck{fmt.Sprintf("API server %s", apiURL), probeAPI(reqURL, apiTimeout)})
+	}
+	return checks
+}
+
+// serveV6 is serve for DHCPv6 servers.
+func serveV6(cmd *cobra.Command, s *pixiecore.ServerV6, apiURL string, apiTimeout time.Duration) {
+	if !dryRunRequested(cmd) {
+		fmt.Println(s.Serve())
+		return
+	}
+	os.Exit(reportDryRun(os.Stdout, dryRunChecksV6(s, apiURL, apiTimeout)))
+}
+
+// dryRunChecksV6 is dryRunChecks for DHCPv6 servers.
+func dryRunChecksV6(s *pixiecore.ServerV6, apiURL string, apiTimeout time.Duration) []dryRunCheck {
+	var checks []dryRunCheck
+	if s.Address != "" {
+		checks = append(checks, dryRunCheck{fmt.Sprintf("listen address %q", s.Address), checkListenAddress(s.Address, true)})
+	}
+	if s.Interface != "" {
+		_, err := net.InterfaceByName(s.Interface)
+		checks = append(checks, dryRunCheck{fmt.Sprintf("listen interface %q", s.Interface), err})
+	}
+	if apiURL != "" {
+		// A link-layer address reserved for documentation, see RFC
+		// 7042, and the EFI x86-64 architecture type.
+		reqURL := fmt.Sprintf("%s/v1/boot/00005e005300/7", strings.TrimSuffix(apiURL, "/"))
+		checks = append(checks, dryRunCheck{fmt.Sprintf("API server %s", apiURL), probeAPI(reqURL, apiTimeout)})
+	}
+	return checks
+}
+
+func dryRunRequested(cmd *cobra.Command) bool {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	return dryRun
+}
+
+// checkListenAddress returns an error if addr isn't an IPv4 address,
+// or an IPv6 address if v6 is set.
+func checkListenAddress(addr string, v6 bool) error {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return fmt.Errorf("%q is not an IP address", addr)
+	case v6 && ip.To4() != nil:
+		return fmt.Errorf("%q is not an IPv6 address", addr)
+	case !v6 && ip.To4() == nil:
+		return fmt.Errorf("%q is not an IPv4 address", addr)
+	}
+	return nil
+}
+
+// probeAPI makes a test query to an API server. Any answer short of a
+// server error is fine, the API server likely doesn't know the
+// machine in the query.
+func probeAPI(reqURL string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(reqURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s: %s", reqURL, http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+// reportDryRun prints the outcome of checks to w, and returns the
+// process exit code.
+func reportDryRun(w io.Writer, checks []dryRunCheck) int {
+	failed := 0
+	for _, check := range checks {
+		if check.err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %s\n", check.what, check.err)
+		} else {
+			fmt.Fprintf(w, "OK   %s\n", check.what)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, "%d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	fmt.Fprintf(w, "Configuration is valid\n")
+	return 0
+}
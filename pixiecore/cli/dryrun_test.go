@@ -0,0 +1,84 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeAPI(t *testing.T) {
+	status := http.StatusNotFound
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer api.Close()
+
+	// An API server that doesn't know the test machine is healthy.
+	if err := probeAPI(api.URL+"/v1/boot/00:00:5e:00:53:00", time.Second); err != nil {
+		t.Fatalf("Unexpected error probing a good API server: %s", err)
+	}
+
+	status = http.StatusInternalServerError
+	if err := probeAPI(api.URL+"/v1/boot/00:00:5e:00:53:00", time.Second); err == nil {
+		t.Fatalf("Expected an error probing an API server that fails")
+	}
+
+	api.Close()
+	if err := probeAPI(api.URL+"/v1/boot/00:00:5e:00:53:00", time.Second); err == nil {
+		t.Fatalf("Expected an error probing an unreachable API server")
+	}
+}
+
+func TestCheckListenAddress(t *testing.T) {
+	tests := []struct {
+		addr  string
+		v6    bool
+		valid bool
+	}{
+		{"0.0.0.0", false, true},
+		{"192.168.0.1", false, true},
+		{"2001:db8::1", false, false},
+		{"2001:db8::1", true, true},
+		{"192.168.0.1", true, false},
+		{"not-an-ip", false, false},
+	}
+	for _, test := range tests {
+		if err := checkListenAddress(test.addr, test.v6); (err == nil) != test.valid {
+			t.Errorf("checkListenAddress(%q, %v) returned %v, expected valid=%v", test.addr, test.v6, err, test.valid)
+		}
+	}
+}
+
+func TestReportDryRun(t *testing.T) {
+	var out bytes.Buffer
+	if code := reportDryRun(&out, []dryRunCheck{{"listen address", nil}}); code != 0 {
+		t.Fatalf("Expected exit code 0 for passing checks, got %d", code)
+	}
+
+	out.Reset()
+	code := reportDryRun(&out, []dryRunCheck{{"listen address", nil}, {"API server", errors.New("unreachable")}})
+	if code == 0 {
+		t.Fatalf("Expected a non-zero exit code for failing checks")
+	}
+	if !strings.Contains(out.String(), "FAIL API server: unreachable") {
+		t.Fatalf("Expected the failing check in the summary, got %q", out.String())
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.universe.tf/netboot/dhcp6/pool"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+func dualStackFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("enable-ipv6", false, "Also boot machines over IPv6, using the same API server")
+	cmd.Flags().String("ipv6-listen-addr", "", "IPv6 address to listen on, with --enable-ipv6")
+	cmd.Flags().String("ipv6-listen-interface", "", "Name of the interface to listen on for DHCPv6, e.g. eth0, with --enable-ipv6")
+	cmd.Flags().String("ipv6-address-pool-start", "2001:db8:f00f:cafe:ffff::100", "Starting ip of the IPv6 address pool, with --enable-ipv6")
+	cmd.Flags().Uint64("ipv6-address-pool-size", 50, "IPv6 address pool size, with --enable-ipv6")
+}
+
+// serverV6FromFlags creates a DHCPv6 server that gets boot
+// instructions from the API server at apiURL, for commands with
+// dualStackFlags.
+func serverV6FromFlags(cmd *cobra.Command, s *pixiecore.Server, apiURL string, apiTimeout time.Duration) *pixiecore.ServerV6 {
+	addr, err := cmd.Flags().GetString("ipv6-listen-addr")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	iface, err := cmd.Flags().GetString("ipv6-listen-interface")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	poolStart, err := cmd.Flags().GetString("ipv6-address-pool-start")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	poolSize, err := cmd.Flags().GetUint64("ipv6-address-pool-size")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	if addr == "" && iface == "" {
+		fatalf("Please specify --ipv6-listen-addr or --ipv6-listen-interface with --enable-ipv6")
+	}
+
+	const poolLifetime = 1850
+	s6 := pixiecore.NewServerV6()
+	s6.Log = s.Log
+	s6.Debug = s.Debug
+	s6.Address = addr
+	s6.Interface = iface
+	s6.BootConfig = pixiecore.MakeAPIBootConfiguration(apiURL, apiTimeout, 0, false, nil)
+	s6.AddressPool = pool.NewRandomAddressPool(net.ParseIP(poolStart), poolSize, poolLifetime)
+	// Without the ipv6api lifetime flags, this is the pool lifetime.
+	s6.PacketBuilder, err = ipv6PacketBuilder(cmd, poolLifetime)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	return s6
+}
+
+// serveBoth runs s and s6 until the process is told to stop, or
+// either fails. With --dry-run, it checks their configuration and
+// exits instead. If the host has no addresses of one family, it warns
+// and serves only the other.
+func serveBoth(cmd *cobra.Command, s *pixiecore.Server, s6 *pixiecore.ServerV6, apiURL string, apiTimeout time.Duration) {
+	if dryRunRequested(cmd) {
+		checks := append(dryRunChecks(s, apiURL, apiTimeout), dryRunChecksV6(s6, apiURL, apiTimeout)...)
+		os.Exit(reportDryRun(os.Stdout, checks))
+	}
+
+	hasV4, hasV6 := hostAddressFamilies()
+	switch {
+	case !hasV4 && !hasV6:
+		fatalf("Host has neither IPv4 nor IPv6 addresses")
+	case !hasV4:
+		s.Log("Init", "Host has no IPv4 addresses, serving IPv6 only")
+		s = nil
+	case !hasV6:
+		s.Log("Init", "Host has no IPv6 addresses, serving IPv4 only")
+		s6 = nil
+	}
+
+	fmt.Println(serveDualStack(stopOnSignal(), s, s6))
+}
+
+// stopOnSignal returns a context that is canceled when the process is
+// told to stop with SIGINT or SIGTERM.
+func stopOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		cancel()
+	}()
+	return ctx
+}
+
+// serveDualStack runs s and s6, either of which may be nil, until ctx
+// is canceled or either of them fails. It returns the first error.
+func serveDualStack(ctx context.Context, s *pixiecore.Server, s6 *pixiecore.ServerV6) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	running := 0
+	if s != nil {
+		running++
+		go func() { errs <- s.ServeContext(ctx) }()
+	}
+	if s6 != nil {
+		running++
+		go func() { errs <- s6.ServeContext(ctx) }()
+	}
+
+	var err error
+	for ; running > 0; running-- {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+		// Whichever server stops first takes the other down with it.
+		cancel()
+	}
+	return err
+}
+
+// hostAddressFamilies returns whether the host has non-loopback IPv4
+// and IPv6 addresses.
+func hostAddressFamilies() (hasV4, hasV6 bool) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// Let the servers find out for themselves.
+		return true, true
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			hasV4 = true
+		} else {
+			hasV6 = true
+		}
+	}
+	return hasV4, hasV6
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+	"go.universe.tf/netboot/dhcp6/pool"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+// waitBound waits for a server to bind the UDP address addr.
+func waitBound(t *testing.T, network, addr string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Nothing listening on %s", addr)
+}
+
+func TestServeDualStack(t *testing.T) {
+	if conn, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skipf("No IPv6 loopback: %s", err)
+	} else {
+		conn.Close()
+	}
+
+	booter, err := pixiecore.StaticBooter(&pixiecore.Spec{Kernel: pixiecore.ID("kernel")})
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	s := &pixiecore.Server{
+		Booter:   booter,
+		Address:  "127.0.0.1",
+		DHCPPort: 16767,
+		TFTPPort: 16769,
+		PXEPort:  16011,
+		HTTPPort: 16080,
+	}
+	s6 := pixiecore.NewServerV6()
+	s6.Address = "::1"
+	s6.Port = "16547"
+	s6.BootConfig = pixiecore.MakeStaticBootConfiguration("http://[::1]/boot.ipxe", "", 0, false, nil)
+	s6.AddressPool = pool.NewRandomAddressPool(net.ParseIP("2001:db8::100"), 50, 1850)
+	s6.PacketBuilder = dhcp6.MakePacketBuilder(1795, 1850)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serveDualStack(ctx, s, s6) }()
+
+	waitBound(t, "udp4", "127.0.0.1:16769")
+	waitBound(t, "udp6", "[::1]:16547")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Serving: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Servers didn't shut down")
+	}
+}
+
+func TestServeDualStackStopsBothOnError(t *testing.T) {
+	// Not an IP address, so the IPv4 server fails right away.
+	s := &pixiecore.Server{Address: "invalid"}
+	s6 := pixiecore.NewServerV6()
+	s6.Address = "::1"
+	s6.Port = "16548"
+	s6.BootConfig = pixiecore.MakeStaticBootConfiguration("http://[::1]/boot.ipxe", "", 0, false, nil)
+	s6.AddressPool = pool.NewRandomAddressPool(net.ParseIP("2001:db8::100"), 50, 1850)
+	s6.PacketBuilder = dhcp6.MakePacketBuilder(1795, 1850)
+
+	done := make(chan error, 1)
+	go func() { done <- serveDualStack(context.Background(), s, s6) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected an error from the IPv4 server")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("IPv6 server kept running after the IPv4 server failed")
+	}
+}
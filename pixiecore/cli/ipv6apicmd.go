@@ -1,9 +1,15 @@
 package cli
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -41,29 +47,46 @@ var ipv6ApiCmd = &cobra.Command{
 			s.Debug = logWithStdFmt
 		}
 
-		if addr == "" {
-			fatalf("Please specify address to bind to")
+		iface, err := cmd.Flags().GetString("listen-interface")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if addr == "" && iface == "" {
+			fatalf("Please specify address or interface to bind to")
 		}
 		if apiURL == "" {
 			fatalf("Please specify ipxe config file url")
 		}
 		s.Address = addr
-		preference, err := cmd.Flags().GetUint8("preference")
+		s.Interface = iface
+		serverDUID, err := cmd.Flags().GetString("server-duid")
 		if err != nil {
 			fatalf("Error reading flag: %s", err)
 		}
-		dnsServers, err := cmd.Flags().GetString("dns-servers")
+		serverDUIDFile, err := cmd.Flags().GetString("server-duid-file")
 		if err != nil {
 			fatalf("Error reading flag: %s", err)
 		}
-		dnsServerAddresses := make([]net.IP, 0)
-		if cmd.Flags().Changed("dns-servers") {
-			for _, dnsServerAddress := range strings.Split(dnsServers, ",") {
-				dnsServerAddresses = append(dnsServerAddresses, net.ParseIP(dnsServerAddress))
+		if serverDUID != "" && serverDUIDFile != "" {
+			fatalf("Please specify at most one of --server-duid and --server-duid-file")
+		}
+		if serverDUID != "" {
+			duid, err := pixiecore.ParseDUID(serverDUID)
+			if err != nil {
+				fatalf("Invalid --server-duid: %s", err)
 			}
+			s.SetServerDUID(duid)
 		}
-		s.BootConfig = pixiecore.MakeAPIBootConfiguration(apiURL, apiTimeout, preference,
-			cmd.Flags().Changed("preference"), dnsServerAddresses)
+		s.DUIDFile = serverDUIDFile
+		s.PcapFile, err = cmd.Flags().GetString("pcap-file")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		s.PcapMaxSize, err = cmd.Flags().GetInt64("pcap-max-size")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		s.BootConfig = ipv6APIBootConfiguration(cmd, apiURL, apiTimeout)
 
 		addressPoolStart, err := cmd.Flags().GetString("address-pool-start")
 		if err != nil {
@@ -78,22 +101,290 @@ var ipv6ApiCmd = &cobra.Command{
 			fatalf("Error reading flag: %s", err)
 		}
 		s.AddressPool = pool.NewRandomAddressPool(net.ParseIP(addressPoolStart), addressPoolSize, addressPoolValidLifetime)
-		s.PacketBuilder = dhcp6.MakePacketBuilder(addressPoolValidLifetime-addressPoolValidLifetime*3/100, addressPoolValidLifetime)
+		eui64Prefix, err := cmd.Flags().GetString("eui64-prefix")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if eui64Prefix != "" {
+			_, prefix, err := net.ParseCIDR(eui64Prefix)
+			if err != nil {
+				fatalf("Invalid EUI-64 prefix %q: %s", eui64Prefix, err)
+			}
+			eui64Pool, err := pool.NewEUI64AddressPool(prefix, s.AddressPool,
+				time.Duration(addressPoolValidLifetime)*time.Second)
+			if err != nil {
+				fatalf("%s", err)
+			}
+			s.AddressPool = eui64Pool
+		}
+		staticAddresses, err := cmd.Flags().GetString("static-addresses")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		stateless, err := cmd.Flags().GetBool("stateless")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if stateless {
+			if staticAddresses != "" || eui64Prefix != "" {
+				fatalf("--static-addresses and --eui64-prefix can't be used with --stateless")
+			}
+			s.AddressPool = nil
+		} else if staticAddresses != "" {
+			staticPool, err := pool.NewStaticAddressPool(staticAddresses, s.AddressPool,
+				time.Duration(addressPoolValidLifetime)*time.Second)
+			if err != nil {
+				fatalf("%s", err)
+			}
+			reloadOnSIGHUP(staticPool)
+			s.AddressPool = staticPool
+		}
+		s.PacketBuilder, err = ipv6PacketBuilder(cmd, addressPoolValidLifetime)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		s.PacketBuilder.RapidCommit, err = cmd.Flags().GetBool("rapid-commit")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		s.PacketBuilder.StrictTransactionID, err = cmd.Flags().GetBool("strict-transaction-id")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		serverUnicast, err := cmd.Flags().GetBool("server-unicast")
+		if err != nil {
+			fatalf("Error reading flag: %s", err)
+		}
+		if serverUnicast {
+			unicastAddr := net.ParseIP(addr)
+			if unicastAddr == nil || unicastAddr.To4() != nil {
+				fatalf("--server-unicast needs an IPv6 --listen-addr for clients to unicast to")
+			}
+			s.PacketBuilder.ServerUnicastAddress = unicastAddr
+		}
 
-		fmt.Println(s.Serve())
+		serveV6(cmd, s, apiURL, apiTimeout)
 	},
 }
 
+// ipv6APIBootConfiguration creates the boot configuration querying the API server at apiURL, with the preference,
+// DNS, NTP and API client settings given by the flags. Boot File URLs are cached for --api-cache-ttl if it's set.
+func ipv6APIBootConfiguration(cmd *cobra.Command, apiURL string, apiTimeout time.Duration) dhcp6.BootConfiguration {
+	preference, err := cmd.Flags().GetUint8("preference")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	dnsServers, err := cmd.Flags().GetString("dns-servers")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	dnsServerAddresses := make([]net.IP, 0)
+	if cmd.Flags().Changed("dns-servers") {
+		for _, dnsServerAddress := range strings.Split(dnsServers, ",") {
+			dnsServerAddresses = append(dnsServerAddresses, net.ParseIP(dnsServerAddress))
+		}
+	}
+	bootConfig := pixiecore.MakeAPIBootConfiguration(apiURL, apiTimeout, preference,
+		cmd.Flags().Changed("preference"), dnsServerAddresses)
+	bootConfig.MaxRetries, err = cmd.Flags().GetInt("api-request-retries")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	dnsSearch, err := cmd.Flags().GetString("dns-search")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	if cmd.Flags().Changed("dns-search") {
+		bootConfig.DNSSearchList = strings.Split(dnsSearch, ",")
+	}
+	bootConfig.NTPServers = ntpServersFromFlags(cmd)
+	bootConfig.Authorization, bootConfig.Header = apiAuthFromFlags(cmd)
+	if tlsConfig := apiTLSConfigFromFlags(cmd); tlsConfig != nil {
+		bootConfig.SetTLSConfig(tlsConfig)
+	}
+	cacheTTL, err := cmd.Flags().GetDuration("api-cache-ttl")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	if cacheTTL > 0 {
+		return pixiecore.CacheAPIBootConfiguration(bootConfig, cacheTTL)
+	}
+	return bootConfig
+}
+
+// ipv6PacketBuilder creates a PacketBuilder with the lifetimes given by the --preferred-lifetime and
+// --valid-lifetime flags. The valid lifetime defaults to poolLifetime, the address pool's lifetime, and the
+// preferred lifetime to 97% of the valid lifetime.
+func ipv6PacketBuilder(cmd *cobra.Command, poolLifetime uint32) (*dhcp6.PacketBuilder, error) {
+	validLifetime := poolLifetime
+	if cmd.Flags().Changed("valid-lifetime") {
+		d, err := cmd.Flags().GetDuration("valid-lifetime")
+		if err != nil {
+			return nil, fmt.Errorf("Error reading flag: %s", err)
+		}
+		if d < time.Second || d.Seconds() > float64(poolLifetime) {
+			return nil, fmt.Errorf("Valid lifetime must be between 1s and the address pool lifetime (%ds), got %s", poolLifetime, d)
+		}
+		validLifetime = uint32(d.Seconds())
+	}
+	preferredLifetime := validLifetime - validLifetime*3/100
+	if cmd.Flags().Changed("preferred-lifetime") {
+		d, err := cmd.Flags().GetDuration("preferred-lifetime")
+		if err != nil {
+			return nil, fmt.Errorf("Error reading flag: %s", err)
+		}
+		if d < time.Second || d.Seconds() > float64(validLifetime) {
+			return nil, fmt.Errorf("Preferred lifetime must be between 1s and the valid lifetime (%ds), got %s", validLifetime, d)
+		}
+		preferredLifetime = uint32(d.Seconds())
+	}
+	return dhcp6.MakePacketBuilder(preferredLifetime, validLifetime), nil
+}
+
+// ntpServersFromFlags parses the --ntp-servers flag.
+func ntpServersFromFlags(cmd *cobra.Command) []net.IP {
+	ntpServers, err := cmd.Flags().GetString("ntp-servers")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	if ntpServers == "" {
+		return nil
+	}
+	var ret []net.IP
+	for _, addr := range strings.Split(ntpServers, ",") {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() != nil {
+			fatalf("Invalid NTP server address %q, must be an IPv6 address", addr)
+		}
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// apiAuthEnv is the environment variable holding the API server's
+// bearer token when --api-auth-token-file isn't set.
+const apiAuthEnv = "PIXIECORE_API_AUTH_TOKEN"
+
+// apiAuthFromFlags returns the Authorization header value and extra
+// headers for API server requests, from the --api-auth-token-file and
+// --api-header flags. The token file holds a bearer token, or a full
+// header value such as "Basic dXNlcjpwYXNzd29yZA==". Without the
+// flag, the token is read from $PIXIECORE_API_AUTH_TOKEN.
+func apiAuthFromFlags(cmd *cobra.Command) (string, http.Header) {
+	tokenFile, err := cmd.Flags().GetString("api-auth-token-file")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	token := os.Getenv(apiAuthEnv)
+	if tokenFile != "" {
+		bs, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			fatalf("Error reading API auth token: %s", err)
+		}
+		token = string(bs)
+	}
+	token = strings.TrimSpace(token)
+	authorization := ""
+	if token != "" {
+		authorization = token
+		if !strings.HasPrefix(token, "Bearer ") && !strings.HasPrefix(token, "Basic ") {
+			authorization = pixiecore.BearerAuthorization(token)
+		}
+	}
+
+	headers, err := cmd.Flags().GetStringArray("api-header")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	var header http.Header
+	for _, h := range headers {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			fatalf("Invalid --api-header %q, must be \"Name: value\"", h)
+		}
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return authorization, header
+}
+
+// apiTLSConfigFromFlags returns the TLS configuration for API server
+// requests given by the --api-client-cert, --api-client-key and
+// --api-ca flags, or nil if none are set.
+func apiTLSConfigFromFlags(cmd *cobra.Command) *tls.Config {
+	certFile, err := cmd.Flags().GetString("api-client-cert")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	keyFile, err := cmd.Flags().GetString("api-client-key")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	caFile, err := cmd.Flags().GetString("api-ca")
+	if err != nil {
+		fatalf("Error reading flag: %s", err)
+	}
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil
+	}
+	ret, err := pixiecore.LoadAPITLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	return ret
+}
+
+// reloadOnSIGHUP reloads the fixed addresses of staticPool when the
+// process receives SIGHUP.
+func reloadOnSIGHUP(staticPool *pool.StaticAddressPool) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := staticPool.Reload(); err != nil {
+				logWithStdFmt("dhcp", err.Error())
+				continue
+			}
+			logWithStdFmt("dhcp", "Reloaded static addresses")
+		}
+	}()
+}
+
 func serverv6APIConfigFlags(cmd *cobra.Command) {
+	dryRunFlag(cmd)
 	cmd.Flags().StringP("listen-addr", "", "", "IPv6 address to listen on")
+	cmd.Flags().StringP("listen-interface", "", "", "Name of the interface to listen on, e.g. eth0")
+	cmd.Flags().String("server-duid", "", "Server DUID in hex, e.g. 00:03:00:01:02:42:ac:11:00:02. Generated at startup if not set")
+	cmd.Flags().String("server-duid-file", "", "File to read the server DUID from, or to save the generated DUID to if it doesn't exist")
+	cmd.Flags().String("pcap-file", "", "File to capture DHCPv6 packets to in pcap format, for debugging")
+	cmd.Flags().Int64("pcap-max-size", 100<<20, "Size in bytes past which the --pcap-file is moved to <file>.1 and a new one started, 0 for no limit")
 	cmd.Flags().StringP("api-request-url", "", "", "Ipv6-specific API server url")
 	cmd.Flags().Duration("api-request-timeout", 5*time.Second, "Timeout for request to the API server")
+	cmd.Flags().Int("api-request-retries", 0, "Number of times to retry failed requests to the API server, within the request timeout")
+	cmd.Flags().Duration("api-cache-ttl", 0, "How long to reuse the API server's boot file URL for the same client and architecture, 0 to query the API server on every request")
+	cmd.Flags().String("api-auth-token-file", "", "File holding the bearer token, or full Authorization header value, for requests to the API server (default $"+apiAuthEnv+")")
+	cmd.Flags().String("api-client-cert", "", "PEM file of the client certificate presented to the API server, with --api-client-key")
+	cmd.Flags().String("api-client-key", "", "PEM file of the private key of --api-client-cert")
+	cmd.Flags().String("api-ca", "", "PEM file of the CA certificates the API server's certificate is checked against (default system CAs)")
+	cmd.Flags().StringArray("api-header", nil, "Extra \"Name: value\" header for requests to the API server, can be repeated")
 	cmd.Flags().Bool("debug", false, "Enable debug-level logging")
 	cmd.Flags().Uint8("preference", 255, "Set dhcp server preference value")
 	cmd.Flags().StringP("address-pool-start", "", "2001:db8:f00f:cafe:ffff::100", "Starting ip of the address pool, e.g. 2001:db8:f00f:cafe:ffff::100")
 	cmd.Flags().Uint64("address-pool-size", 50, "Address pool size")
 	cmd.Flags().Uint32("address-pool-lifetime", 1850, "Address pool ip address valid lifetime in seconds")
+	cmd.Flags().Bool("stateless", false, "Only answer Information-request messages with boot parameters and DNS, for statically addressed clients, without handing out addresses")
+	cmd.Flags().String("eui64-prefix", "", "IPv6 /64 prefix in which clients get addresses derived from their MAC address (EUI-64), before the address pool")
+	cmd.Flags().String("static-addresses", "", "File of fixed addresses, one \"<mac or DUID> <ip>\" pair per line, handed out before the address pool. Reloaded on SIGHUP")
+	cmd.Flags().Duration("valid-lifetime", 0, "Valid lifetime of leased addresses, at most --address-pool-lifetime (default --address-pool-lifetime)")
+	cmd.Flags().Duration("preferred-lifetime", 0, "Preferred lifetime of leased addresses, at most --valid-lifetime (default 97% of --valid-lifetime). Clients renew after half of it (T1), and rebind after 80% (T2)")
+	cmd.Flags().Bool("rapid-commit", false, "Commit addresses right away for clients asking for rapid commit, with a Solicit/Reply exchange")
+	cmd.Flags().Bool("strict-transaction-id", false, "Drop messages with an all-zero transaction ID, usually mangled by a buggy relay, instead of answering them")
+	cmd.Flags().Bool("server-unicast", false, "Tell clients on the local link to unicast their later messages, e.g. renewals, to --listen-addr")
 	cmd.Flags().StringP("dns-servers", "", "", "Comma separated list of one or more dns server addresses")
+	cmd.Flags().StringP("dns-search", "", "", "Comma separated list of one or more dns search domains")
+	cmd.Flags().String("ntp-servers", "", "Comma separated list of one or more NTP server addresses")
 }
 
 func init() {
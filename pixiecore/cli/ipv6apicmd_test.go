@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+func TestIpv6PacketBuilderLifetimes(t *testing.T) {
+	tests := []struct {
+		args              []string
+		preferredLifetime uint32
+		validLifetime     uint32
+	}{
+		{nil, 1795, 1850},
+		{[]string{"--valid-lifetime=10m"}, 582, 600},
+		{[]string{"--preferred-lifetime=5m"}, 300, 1850},
+		{[]string{"--preferred-lifetime=5m", "--valid-lifetime=10m"}, 300, 600},
+		{[]string{"--preferred-lifetime=10m", "--valid-lifetime=10m"}, 600, 600},
+	}
+
+	for _, test := range tests {
+		cmd := &cobra.Command{}
+		serverv6APIConfigFlags(cmd)
+		if err := cmd.ParseFlags(test.args); err != nil {
+			t.Fatalf("Parsing flags %v: %s", test.args, err)
+		}
+		builder, err := ipv6PacketBuilder(cmd, 1850)
+		if err != nil {
+			t.Fatalf("Unexpected error for flags %v: %s", test.args, err)
+		}
+		if builder.PreferredLifetime != test.preferredLifetime || builder.ValidLifetime != test.validLifetime {
+			t.Fatalf("Expected lifetimes %d/%d for flags %v, got %d/%d", test.preferredLifetime, test.validLifetime,
+				test.args, builder.PreferredLifetime, builder.ValidLifetime)
+		}
+	}
+}
+
+func TestIpv6PacketBuilderRejectsInvalidLifetimes(t *testing.T) {
+	for _, args := range [][]string{
+		{"--preferred-lifetime=20m", "--valid-lifetime=10m"},
+		{"--valid-lifetime=1h"},
+		{"--valid-lifetime=0s"},
+		{"--preferred-lifetime=500ms"},
+	} {
+		cmd := &cobra.Command{}
+		serverv6APIConfigFlags(cmd)
+		if err := cmd.ParseFlags(args); err != nil {
+			t.Fatalf("Parsing flags %v: %s", args, err)
+		}
+		if _, err := ipv6PacketBuilder(cmd, 1850); err == nil {
+			t.Fatalf("Expected an error for flags %v", args)
+		}
+	}
+}
+
+func TestIpv6APIBootConfigurationCache(t *testing.T) {
+	cmd := &cobra.Command{}
+	serverv6APIConfigFlags(cmd)
+	args := []string{"--preference=7", "--dns-servers=2001:db8::53"}
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatalf("Parsing flags %v: %s", args, err)
+	}
+	if _, ok := ipv6APIBootConfiguration(cmd, "http://[::1]:8888", time.Second).(*pixiecore.APIBootConfiguration); !ok {
+		t.Fatalf("Expected an uncached API boot configuration without --api-cache-ttl")
+	}
+
+	args = []string{"--api-cache-ttl=1m"}
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatalf("Parsing flags %v: %s", args, err)
+	}
+	bc, ok := ipv6APIBootConfiguration(cmd, "http://[::1]:8888", time.Second).(*pixiecore.CachedAPIBootConfiguration)
+	if !ok {
+		t.Fatalf("Expected a cached API boot configuration with --api-cache-ttl")
+	}
+	if bc.TTL != time.Minute {
+		t.Fatalf("Expected a cache TTL of 1m, got %s", bc.TTL)
+	}
+	if pref := bc.GetPreference(nil, 0); len(pref) != 1 || pref[0] != 7 {
+		t.Fatalf("Expected preference 7 to be kept with --api-cache-ttl, got %v", pref)
+	}
+	if dns, _ := bc.GetRecursiveDNS(nil, 0); len(dns) != 1 || !dns[0].Equal(net.ParseIP("2001:db8::53")) {
+		t.Fatalf("Expected DNS servers to be kept with --api-cache-ttl, got %v", dns)
+	}
+}
@@ -76,7 +76,7 @@ func debianRecipe(parent *cobra.Command) {
 			kernel := fmt.Sprintf("%s/dists/%s/main/installer-%s/current/images/netboot/debian-installer/%s/linux", mirror, version, arch, arch)
 			initrd := fmt.Sprintf("%s/dists/%s/main/installer-%s/current/images/netboot/debian-installer/%s/initrd.gz", mirror, version, arch, arch)
 
-			fmt.Println(staticFromFlags(cmd, kernel, []string{initrd}, "").Serve())
+			serve(cmd, staticFromFlags(cmd, kernel, []string{initrd}, ""), "", 0)
 		},
 	}
 
@@ -136,7 +136,7 @@ func ubuntuRecipe(parent *cobra.Command) {
 			kernel := fmt.Sprintf("%s/dists/%s/main/installer-%s/current/%s/netboot/ubuntu-installer/%s/linux", mirror, version, arch, imageDir, arch)
 			initrd := fmt.Sprintf("%s/dists/%s/main/installer-%s/current/%s/netboot/ubuntu-installer/%s/initrd.gz", mirror, version, arch, imageDir, arch)
 
-			fmt.Println(staticFromFlags(cmd, kernel, []string{initrd}, "").Serve())
+			serve(cmd, staticFromFlags(cmd, kernel, []string{initrd}, ""), "", 0)
 		},
 	}
 
@@ -188,7 +188,7 @@ func fedoraRecipe(parent *cobra.Command) {
 			initrd := fmt.Sprintf("%s/releases/%s/Server/%s/os/images/pxeboot/initrd.img", mirror, version, arch)
 			stage2 := fmt.Sprintf("inst.stage2=%s/releases/%s/Server/%s/os/", mirror, version, arch)
 
-			fmt.Println(staticFromFlags(cmd, kernel, []string{initrd}, stage2).Serve())
+			serve(cmd, staticFromFlags(cmd, kernel, []string{initrd}, stage2), "", 0)
 		},
 	}
 
@@ -240,7 +240,7 @@ func centosRecipe(parent *cobra.Command) {
 			initrd := fmt.Sprintf("%s/%s/os/%s/images/pxeboot/initrd.img", mirror, version, arch)
 			stage2 := fmt.Sprintf("inst.stage2=%s/%s/os/%s/", mirror, version, arch)
 
-			fmt.Println(staticFromFlags(cmd, kernel, []string{initrd}, stage2).Serve())
+			serve(cmd, staticFromFlags(cmd, kernel, []string{initrd}, stage2), "", 0)
 		},
 	}
 
@@ -285,7 +285,7 @@ func coreosRecipe(parent *cobra.Command) {
 			kernel := fmt.Sprintf("https://%s.release.core-os.net/%s-usr/current/coreos_production_pxe.vmlinuz", version, arch)
 			initrd := fmt.Sprintf("https://%s.release.core-os.net/%s-usr/current/coreos_production_pxe_image.cpio.gz", version, arch)
 
-			fmt.Println(staticFromFlags(cmd, kernel, []string{initrd}, "").Serve())
+			serve(cmd, staticFromFlags(cmd, kernel, []string{initrd}, ""), "", 0)
 		},
 	}
 
@@ -303,7 +303,7 @@ func netbootRecipe(parent *cobra.Command) {
 	systems and useful system utilities.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			kernel := "https://boot.netboot.xyz/ipxe/netboot.xyz.lkrn"
-			fmt.Println(staticFromFlags(cmd, kernel, []string{}, "").Serve())
+			serve(cmd, staticFromFlags(cmd, kernel, []string{}, ""), "", 0)
 		},
 	}
 	serverConfigFlags(netbootCmd)
@@ -334,7 +334,7 @@ version defaults to latest, can also be a YYYY.MM.DD iso release version`,
 			initrd := fmt.Sprintf("%s/arch/boot/%s/initramfs-linux.img", httpSrv, arch)
 			cmdline := fmt.Sprintf("archisobasedir=arch archiso_http_srv=%s/ ip=dhcp cms_verify=y net.ifnames=0", httpSrv)
 
-			fmt.Println(staticFromFlags(cmd, kernel, []string{initrd}, cmdline).Serve())
+			serve(cmd, staticFromFlags(cmd, kernel, []string{initrd}, cmdline), "", 0)
 		},
 	}
 	archCmd.Flags().String("mirror", "https://mirrors.kernel.org/archlinux", "Root of the archlinux mirror to use")
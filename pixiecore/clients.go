@@ -0,0 +1,131 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clientRecord is a machine's entry in /_/clients.
+type clientRecord struct {
+	MAC         string            `json:"mac"`
+	Arch        string            `json:"arch"`
+	UserClass   string            `json:"user_class,omitempty"`
+	VendorClass string            `json:"vendor_class,omitempty"`
+	Params      map[string]string `json:"params,omitempty"`
+	Spec        clientSpec        `json:"spec"`
+	Timestamp   time.Time         `json:"timestamp"`
+	LastFile    string            `json:"last_file,omitempty"`
+}
+
+// clientSpec summarizes the Spec a machine booted with.
+type clientSpec struct {
+	Kernel      ID     `json:"kernel"`
+	InitrdCount int    `json:"initrd_count"`
+	Cmdline     string `json:"cmdline"`
+}
+
+// clientHistory is the list of machines that recently got a boot
+// script, oldest first. Each machine is listed once, with its last
+// boot.
+type clientHistory struct {
+	mu      sync.Mutex
+	clients []*clientRecord
+}
+
+// clientHistorySize returns the number of machines /_/clients
+// reports.
+func (s *Server) clientHistorySize() int {
+	if s.ClientHistorySize == 0 {
+		return defaultClientHistorySize
+	}
+	return s.ClientHistorySize
+}
+
+// recordClient adds mach, which is booting spec, to the client
+// history.
+func (s *Server) recordClient(mach Machine, spec *Spec) {
+	size := s.clientHistorySize()
+	if size < 0 {
+		return
+	}
+	rec := &clientRecord{
+		MAC:         mach.MAC.String(),
+		Arch:        mach.Arch.String(),
+		UserClass:   mach.UserClass,
+		VendorClass: mach.VendorClass,
+		Params:      mach.Params,
+		Spec: clientSpec{
+			Kernel:      spec.Kernel,
+			InitrdCount: len(spec.Initrd),
+			Cmdline:     spec.Cmdline,
+		},
+		Timestamp: time.Now(),
+	}
+
+	h := &s.clients
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, c := range h.clients {
+		if c.MAC == rec.MAC {
+			h.clients = append(h.clients[:i], h.clients[i+1:]...)
+			break
+		}
+	}
+	h.clients = append(h.clients, rec)
+	if len(h.clients) > size {
+		h.clients = append([]*clientRecord(nil), h.clients[len(h.clients)-size:]...)
+	}
+}
+
+// recordFileFetch notes that mac fetched the file name, if mac is in
+// the client history.
+func (s *Server) recordFileFetch(mac net.HardwareAddr, name string) {
+	h := &s.clients
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.clients {
+		if c.MAC == mac.String() {
+			c.LastFile = name
+			return
+		}
+	}
+}
+
+// handleClients serves the client history as a JSON list, most
+// recent boot first.
+func (s *Server) handleClients(w http.ResponseWriter, r *http.Request) {
+	if s.clientHistorySize() < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	h := &s.clients
+	h.mu.Lock()
+	clients := make([]clientRecord, 0, len(h.clients))
+	for i := len(h.clients) - 1; i >= 0; i-- {
+		clients = append(clients, *h.clients[i])
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(clients); err != nil {
+		s.logHTTP(logLevelDebug, r, nil, "Failed to send client list to %s: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter:             readBootFile("stuff"),
+		Log:                log,
+		Debug:              log,
+		CORSAllowedOrigins: []string{"https://dashboard.example.com"},
+	}
+	h := s.Handler()
+
+	request := func(method, path, origin string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatalf("Constructing request: %s", err)
+		}
+		req.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "accept")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := request("OPTIONS", "/_/clients", "https://dashboard.example.com")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Preflight got HTTP %d, expected %d", rr.Code, http.StatusNoContent)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://dashboard.example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD",
+		"Access-Control-Allow-Headers": "accept",
+		"Vary":                         "Origin",
+	} {
+		if got := rr.Header().Get(header); got != want {
+			t.Errorf("Preflight got %s %q, expected %q", header, got, want)
+		}
+	}
+
+	rr = request("GET", "/_/clients", "https://dashboard.example.com")
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" {
+		t.Errorf("Request from an allowed origin got HTTP %d, Access-Control-Allow-Origin %q", rr.Code, rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	rr = request("OPTIONS", "/_/clients", "https://evil.example.com")
+	if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Preflight from another origin got Access-Control-Allow-Origin %q", origin)
+	}
+
+	for _, path := range []string{"/_/file?name=test", "/_/ipxe?mac=01:02:03:04:05:06&arch=0"} {
+		rr = request("GET", path, "https://dashboard.example.com")
+		if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+			t.Errorf("Boot endpoint %s got Access-Control-Allow-Origin %q", path, origin)
+		}
+	}
+
+	s.CORSAllowedOrigins = nil
+	rr = request("GET", "/_/clients", "https://dashboard.example.com")
+	if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Server without allowed origins got Access-Control-Allow-Origin %q", origin)
+	}
+}
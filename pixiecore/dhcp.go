@@ -125,6 +125,7 @@ func (s *Server) validateDHCP(pkt *dhcp4.Packet) (mach Machine, fwtype Firmware,
 	// to identify these as part of making the internal chainloading
 	// logic work properly.
 	if userClass, err := pkt.Options.String(77); err == nil {
+		mach.UserClass = userClass
 		// If the client has had iPXE burned into its ROM (or is a VM
 		// that uses iPXE as the PXE "ROM"), special handling is
 		// needed because in this mode the client is using iPXE native
@@ -146,18 +147,23 @@ func (s *Server) validateDHCP(pkt *dhcp4.Packet) (mach Machine, fwtype Firmware,
 	case 0:
 		// A missing GUID is invalid according to the spec, however
 		// there are PXE ROMs in the wild that omit the GUID and still
-		// expect to boot. The only thing we do with the GUID is
-		// mirror it back to the client if it's there, so we might as
-		// well accept these buggy ROMs.
+		// expect to boot. The GUID is only mirrored back to the client
+		// and passed to the Booter if it's there, so we might as well
+		// accept these buggy ROMs.
 	case 17:
 		if guid[0] != 0 {
 			return mach, 0, errors.New("malformed client GUID (option 97), leading byte must be zero")
 		}
+		mach.GUID = guid[1:]
 	default:
 		return mach, 0, errors.New("malformed client GUID (option 97), wrong size")
 	}
 
 	mach.MAC = pkt.HardwareAddr
+	if vendorClass, err := pkt.Options.String(dhcp4.OptVendorIdentifier); err == nil {
+		mach.VendorClass = vendorClass
+	}
+	mach.ClientID = pkt.Options[dhcp4.OptClientIdentifier]
 	return mach, fwtype, nil
 }
 
@@ -236,6 +242,9 @@ func (s *Server) offerDHCP(pkt *dhcp4.Packet, mach Machine, serverIP net.IP, fwt
 		// we can finally chainload to HTTP for the actual boot
 		// script.
 		resp.BootFilename = fmt.Sprintf("http://%s:%d/_/ipxe?arch=%d&mac=%s", serverIP, s.HTTPPort, mach.Arch, mach.MAC)
+		if mach.GUID != nil {
+			resp.BootFilename += fmt.Sprintf("&guid=%x", mach.GUID)
+		}
 
 	default:
 		return nil, fmt.Errorf("unknown firmware type %d", fwtype)
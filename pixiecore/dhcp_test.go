@@ -0,0 +1,209 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"go.universe.tf/netboot/dhcp4"
+)
+
+// Pixiecore only ever acts as a ProxyDHCP server: its offers carry
+// boot options, and leave address assignment to another DHCP server.
+func TestOfferDHCPIsProxyOnly(t *testing.T) {
+	s := &Server{HTTPPort: 80}
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	serverIP := net.IPv4(192, 168, 0, 1)
+	discover := &dhcp4.Packet{
+		Type:          dhcp4.MsgDiscover,
+		TransactionID: []byte{1, 2, 3, 4},
+		Broadcast:     true,
+		HardwareAddr:  mac,
+		Options: dhcp4.Options{
+			93: []byte{0, 0},
+		},
+	}
+
+	mach, fwtype, err := s.validateDHCP(discover)
+	if err != nil {
+		t.Fatalf("Validating DISCOVER: %s", err)
+	}
+	offer, err := s.offerDHCP(discover, mach, serverIP, fwtype)
+	if err != nil {
+		t.Fatalf("Building OFFER: %s", err)
+	}
+
+	if offer.Type != dhcp4.MsgOffer {
+		t.Fatalf("Got %s in reply to DISCOVER, expected %s", offer.Type, dhcp4.MsgOffer)
+	}
+	if offer.YourAddr != nil && !offer.YourAddr.IsUnspecified() {
+		t.Fatalf("ProxyDHCP OFFER assigns address %s", offer.YourAddr)
+	}
+	// PXE Boot Server Discovery Control, bypass discovery and boot
+	// from the filename.
+	if !bytes.Equal(offer.Options[43], []byte{6, 1, 8, 255}) {
+		t.Fatalf("Wrong PXE vendor options (option 43), want %v, got %v", []byte{6, 1, 8, 255}, offer.Options[43])
+	}
+	if offer.BootFilename != "01:02:03:04:05:06/0" {
+		t.Fatalf("Wrong boot filename %q", offer.BootFilename)
+	}
+
+	bs, err := offer.Marshal()
+	if err != nil {
+		t.Fatalf("Marshaling OFFER: %s", err)
+	}
+	if !bytes.Equal(bs[16:20], []byte{0, 0, 0, 0}) {
+		t.Fatalf("Marshaled OFFER has yiaddr %v, expected 0.0.0.0", net.IP(bs[16:20]))
+	}
+}
+
+func TestValidateDHCPClientClasses(t *testing.T) {
+	s := &Server{}
+	discover := &dhcp4.Packet{
+		Type:          dhcp4.MsgDiscover,
+		TransactionID: []byte{1, 2, 3, 4},
+		HardwareAddr:  net.HardwareAddr{1, 2, 3, 4, 5, 6},
+		Options: dhcp4.Options{
+			93:                        []byte{0, 0},
+			77:                        []byte("iPXE"),
+			dhcp4.OptVendorIdentifier: []byte("PXEClient:Arch:00000:UNDI:002001"),
+			dhcp4.OptClientIdentifier: []byte{1, 1, 2, 3, 4, 5, 6},
+		},
+	}
+
+	mach, fwtype, err := s.validateDHCP(discover)
+	if err != nil {
+		t.Fatalf("Validating DISCOVER: %s", err)
+	}
+	if fwtype != FirmwareX86Ipxe {
+		t.Fatalf("Got firmware type %d, expected %d", fwtype, FirmwareX86Ipxe)
+	}
+	if mach.UserClass != "iPXE" {
+		t.Fatalf("Got user class %q, expected %q", mach.UserClass, "iPXE")
+	}
+	if mach.VendorClass != "PXEClient:Arch:00000:UNDI:002001" {
+		t.Fatalf("Got vendor class %q, expected %q", mach.VendorClass, "PXEClient:Arch:00000:UNDI:002001")
+	}
+	if !bytes.Equal(mach.ClientID, []byte{1, 1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("Got client identifier %x, expected 01010203040506", mach.ClientID)
+	}
+}
+
+// The client GUID (option 97) reaches the Booter without its leading
+// type byte, via the chainload URL of Pixiecore's iPXE.
+func TestValidateDHCPClientGUID(t *testing.T) {
+	s := &Server{HTTPPort: 80}
+	serverIP := net.IPv4(192, 168, 0, 1)
+	// Captured from a QEMU/SeaBIOS iPXE DISCOVER.
+	guid := []byte{
+		0x00,
+		0x4c, 0x4c, 0x45, 0x44, 0x00, 0x4b, 0x10, 0x80,
+		0x80, 0x34, 0xb6, 0xc0, 0x4f, 0x39, 0x38, 0x32,
+	}
+	discover := &dhcp4.Packet{
+		Type:          dhcp4.MsgDiscover,
+		TransactionID: []byte{1, 2, 3, 4},
+		HardwareAddr:  net.HardwareAddr{1, 2, 3, 4, 5, 6},
+		Options: dhcp4.Options{
+			93: []byte{0, 0},
+			77: []byte("pixiecore"),
+			97: guid,
+		},
+	}
+
+	mach, fwtype, err := s.validateDHCP(discover)
+	if err != nil {
+		t.Fatalf("Validating DISCOVER: %s", err)
+	}
+	if !bytes.Equal(mach.GUID, guid[1:]) {
+		t.Fatalf("Got GUID %x, expected %x", mach.GUID, guid[1:])
+	}
+	offer, err := s.offerDHCP(discover, mach, serverIP, fwtype)
+	if err != nil {
+		t.Fatalf("Building OFFER: %s", err)
+	}
+	want := "http://192.168.0.1:80/_/ipxe?arch=0&mac=01:02:03:04:05:06&guid=4c4c4544004b10808034b6c04f393832"
+	if offer.BootFilename != want {
+		t.Fatalf("Wrong boot filename %q, expected %q", offer.BootFilename, want)
+	}
+
+	discover.Options[97] = append([]byte{1}, guid[1:]...)
+	if _, _, err := s.validateDHCP(discover); err == nil {
+		t.Fatal("GUID with non-zero type byte was accepted")
+	}
+}
+
+// On port 4011, EFI clients that were told to use a boot server get
+// a boot filename, still without an address.
+func TestOfferPXE(t *testing.T) {
+	s := &Server{
+		Ipxe: map[Firmware][]byte{FirmwareEFI64: []byte("ipxe")},
+	}
+	serverIP := net.IPv4(192, 168, 0, 1)
+	request := &dhcp4.Packet{
+		Type:          dhcp4.MsgRequest,
+		TransactionID: []byte{1, 2, 3, 4},
+		HardwareAddr:  net.HardwareAddr{1, 2, 3, 4, 5, 6},
+		ClientAddr:    net.IPv4(192, 168, 0, 10),
+		Options: dhcp4.Options{
+			93: []byte{0, 7},
+		},
+	}
+
+	fwtype, err := s.validatePXE(request)
+	if err != nil {
+		t.Fatalf("Validating PXE request: %s", err)
+	}
+	ack, err := s.offerPXE(request, serverIP, fwtype)
+	if err != nil {
+		t.Fatalf("Building PXE ACK: %s", err)
+	}
+
+	if ack.Type != dhcp4.MsgAck {
+		t.Fatalf("Got %s in reply to PXE request, expected %s", ack.Type, dhcp4.MsgAck)
+	}
+	if ack.YourAddr != nil && !ack.YourAddr.IsUnspecified() {
+		t.Fatalf("PXE ACK assigns address %s", ack.YourAddr)
+	}
+	if !ack.ClientAddr.Equal(request.ClientAddr) {
+		t.Fatalf("PXE ACK has client address %s, expected %s", ack.ClientAddr, request.ClientAddr)
+	}
+	if ack.BootFilename != "01:02:03:04:05:06/2" {
+		t.Fatalf("Wrong boot filename %q", ack.BootFilename)
+	}
+}
+
+func TestSetIpxeBinary(t *testing.T) {
+	s := &Server{}
+	signed := []byte("shim-signed ipxe.efi")
+	s.SetIpxeBinary(FirmwareEFI64, signed)
+
+	bs, ok := s.IpxeBinary(FirmwareEFI64)
+	if !ok || !bytes.Equal(bs, signed) {
+		t.Fatalf("Got iPXE binary %q (%v) for EFI64, expected the override %q", bs, ok, signed)
+	}
+	if bs, ok := s.IpxeBinary(FirmwareEFI32); ok {
+		t.Fatalf("Got iPXE binary %q for EFI32, which has none", bs)
+	}
+
+	if served := mustRead(s.handleTFTP("01:02:03:04:05:06/2", nil)); served != string(signed) {
+		t.Fatalf("TFTP served %q, expected the override %q", served, signed)
+	}
+	if _, _, err := s.handleTFTP("01:02:03:04:05:06/1", nil); err == nil {
+		t.Fatalf("TFTP served an iPXE binary for EFI32, which has none")
+	}
+}
@@ -1,50 +1,154 @@
 package pixiecore
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"time"
+
 	"go.universe.tf/netboot/dhcp6"
 )
 
 func (s *ServerV6) serveDHCP(conn *dhcp6.Conn) error {
 	s.debug("dhcpv6", "Waiting for packets...\n")
+	recvErrors := 0
 	for {
-		pkt, src, err := conn.RecvDHCP()
-		if err != nil {
-			return fmt.Errorf("Error receiving DHCP packet: %s", err)
+		pkt, src, err := conn.RecvPacket()
+		if errors.Is(err, dhcp6.ErrMalformedPacket) {
+			s.debug("dhcpv6", fmt.Sprintf("Discarding packet from %s: %s\n", src, err))
+			if s.MessageHook != nil {
+				s.MessageHook(0, nil, DHCPv6Malformed, 0)
+			}
+			continue
 		}
-		if err := pkt.ShouldDiscard(s.Duid); err != nil {
-			s.debug("dhcpv6", fmt.Sprintf("Discarding (%d) packet (%d): %s\n", pkt.Type, pkt.TransactionID, err))
+		if err != nil {
+			if s.closing(conn) || recvErrors >= maxRecvErrors {
+				return fmt.Errorf("Error receiving DHCP packet: %s", err)
+			}
+			recvErrors++
+			s.log("dhcpv6", "Error receiving DHCP packet, re-joining the multicast group: %s", err)
+			time.Sleep(recvErrorBackoff)
+			if err := s.rejoinGroup(conn, "a receive error"); err != nil {
+				return err
+			}
 			continue
 		}
+		recvErrors = 0
 
-		s.debug("dhcpv6", fmt.Sprintf("Received (%d) packet (%d): %s\n", pkt.Type, pkt.TransactionID, pkt.Options.HumanReadable()))
+		start := time.Now()
+		outcome := s.handleDHCP(conn, pkt, src)
+		if s.MessageHook != nil {
+			s.MessageHook(pkt.Type, pkt.Options.ClientID(), outcome, time.Since(start))
+		}
+	}
+}
 
-		response, err := s.PacketBuilder.BuildResponse(pkt, s.Duid, s.BootConfig, s.AddressPool)
-		if err != nil {
-			s.log("dhcpv6", fmt.Sprintf("Error creating response for transaction: %d: %s", pkt.TransactionID, err))
-			if response == nil {
-				s.log("dhcpv6", fmt.Sprintf("Dropping the packet"))
-				continue
-			} else {
-				s.log("dhcpv6", fmt.Sprintf("Will notify the client"))
+// maxRecvErrors is how many errors in a row serveDHCP recovers from
+// by re-joining the multicast group, before giving up.
+const maxRecvErrors = 5
+
+// recvErrorBackoff is how long serveDHCP waits after an error
+// receiving a packet, so that persistent errors don't spin.
+var recvErrorBackoff = 100 * time.Millisecond
+
+// closing returns true if ServeContext is closing conn.
+func (s *ServerV6) closing(conn *dhcp6.Conn) bool {
+	s.reconfigureMu.Lock()
+	defer s.reconfigureMu.Unlock()
+	return s.conn != conn
+}
+
+// rejoinGroup re-joins the DHCPv6 multicast group on conn's
+// interface.
+func (s *ServerV6) rejoinGroup(conn *dhcp6.Conn, reason string) error {
+	if err := conn.RejoinGroup(); err != nil {
+		return fmt.Errorf("Error re-joining the DHCPv6 multicast group after %s: %s", reason, err)
+	}
+	s.log("dhcpv6", "Re-joined the DHCPv6 multicast group on %s after %s", conn.InterfaceName(), reason)
+	return nil
+}
+
+// watchInterface re-joins the multicast group when conn's interface
+// comes back up, until stop is closed.
+func (s *ServerV6) watchInterface(conn *dhcp6.Conn, stop <-chan struct{}) {
+	interval := s.InterfaceCheckInterval
+	if interval == 0 {
+		interval = defaultInterfaceCheckInterval
+	}
+	if interval < 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wasUp := true
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ifi, err := net.InterfaceByName(conn.InterfaceName())
+		up := err == nil && ifi.Flags&net.FlagUp != 0
+		if up && !wasUp {
+			if err := s.rejoinGroup(conn, "the interface came back up"); err != nil {
+				s.log("dhcpv6", "%s", err)
+				// Try again on the next check.
+				up = false
 			}
+		} else if !up && wasUp {
+			s.log("dhcpv6", "Interface %s went down", conn.InterfaceName())
 		}
+		wasUp = up
+	}
+}
+
+// handleDHCP responds to pkt, and returns the outcome.
+func (s *ServerV6) handleDHCP(conn *dhcp6.Conn, pkt *dhcp6.Packet, src net.IP) string {
+	if err := pkt.ShouldDiscard(s.Duid); err != nil {
+		s.debug("dhcpv6", fmt.Sprintf("Discarding (%d) packet (%d): %s\n", pkt.Type, pkt.TransactionID, err))
+		return DHCPv6Discarded
+	}
+
+	s.debug("dhcpv6", fmt.Sprintf("Received (%d) packet (%d): %s\n", pkt.Type, pkt.TransactionID, pkt.Options.HumanReadable()))
+	if elapsed, exists := pkt.Options.ElapsedTime(); exists && elapsed > 0 {
+		s.debug("dhcpv6", fmt.Sprintf("Client %x has been booting for %s\n", pkt.Options.ClientID(), elapsed))
+	}
+
+	if s.AddressPool == nil && pkt.Type != dhcp6.MsgInformationRequest {
+		s.debug("dhcpv6", fmt.Sprintf("Stateless server, dropping (%d) packet (%d)\n", pkt.Type, pkt.TransactionID))
+		return DHCPv6Dropped
+	}
+
+	response, err := s.PacketBuilder.BuildResponse(pkt, s.Duid, s.BootConfig, s.AddressPool)
+	if err != nil {
+		s.log("dhcpv6", fmt.Sprintf("Error creating response for transaction: %d: %s", pkt.TransactionID, err))
 		if response == nil {
-			s.log("dhcpv6", fmt.Sprintf("Don't know how to respond to packet type: %d (transaction id %d)", pkt.Type, pkt.TransactionID))
-			continue
+			s.log("dhcpv6", fmt.Sprintf("Dropping the packet"))
+			return DHCPv6Dropped
 		}
+		s.log("dhcpv6", fmt.Sprintf("Will notify the client"))
+	}
+	if response == nil {
+		s.log("dhcpv6", fmt.Sprintf("Don't know how to respond to packet type: %d (transaction id %d)", pkt.Type, pkt.TransactionID))
+		return DHCPv6Dropped
+	}
 
-		marshalledResponse, err := response.Marshal()
-		if err != nil {
-			s.log("dhcpv6", fmt.Sprintf("Error marshalling response (%d) (%d): %s", response.Type, response.TransactionID, err))
-			continue
-		}
+	if err := s.acceptReconfigure(pkt, response, src); err != nil {
+		s.log("dhcpv6", fmt.Sprintf("Error accepting Reconfigure messages for client %x: %s", pkt.Options.ClientID(), err))
+	}
 
-		if err := conn.SendDHCP(src, marshalledResponse); err != nil {
-			s.log("dhcpv6", fmt.Sprintf("Error sending reply (%d) (%d): %s", response.Type, response.TransactionID, err))
-			continue
-		}
+	marshalledResponse, err := response.Marshal()
+	if err != nil {
+		s.log("dhcpv6", fmt.Sprintf("Error marshalling response (%d) (%d): %s", response.Type, response.TransactionID, err))
+		return DHCPv6Failed
+	}
 
-		s.debug("dhcpv6", fmt.Sprintf("Sent (%d) packet (%d): %s\n", response.Type, response.TransactionID, response.Options.HumanReadable()))
+	if err := conn.SendDHCPTo(pkt.ReplyAddress(src), marshalledResponse); err != nil {
+		s.log("dhcpv6", fmt.Sprintf("Error sending reply (%d) (%d): %s", response.Type, response.TransactionID, err))
+		return DHCPv6Failed
 	}
+
+	s.debug("dhcpv6", fmt.Sprintf("Sent (%d) packet (%d): %s\n", response.Type, response.TransactionID, response.Options.HumanReadable()))
+	return DHCPv6Replied
 }
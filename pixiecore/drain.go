@@ -0,0 +1,137 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default time ServeContext waits for boot file transfers to finish
+// when shutting down.
+const defaultShutdownGracePeriod = 30 * time.Second
+
+// fileTransfers keeps count of the boot files being sent, so that
+// shutting down can wait for them to finish rather than cut clients
+// off in the middle of an initrd. The zero value is ready to use.
+type fileTransfers struct {
+	mu       sync.Mutex
+	draining bool
+	active   int
+	// idle is closed when the last transfer finishes while
+	// draining.
+	idle chan struct{}
+}
+
+// start registers a new transfer, and returns false if the server is
+// draining and the transfer must be turned away.
+func (t *fileTransfers) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.active++
+	return true
+}
+
+// finish unregisters a transfer registered with start.
+func (t *fileTransfers) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	if t.active == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// isDraining returns true once drain has been called.
+func (t *fileTransfers) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain turns away new transfers, and waits until the active ones
+// finish or deadline passes. It returns the number of transfers still
+// active.
+func (t *fileTransfers) drain(deadline time.Time) int {
+	t.mu.Lock()
+	t.draining = true
+	if t.active == 0 {
+		t.mu.Unlock()
+		return 0
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-idle:
+	case <-timer.C:
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// reset lets transfers start again after a drain.
+func (t *fileTransfers) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = false
+}
+
+// refuseWhileDraining returns a handler that answers requests with a
+// 503 while the Server shuts down, and passes them to h otherwise.
+func (s *Server) refuseWhileDraining(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.transfers.isDraining() {
+			w.Header().Set("Retry-After", strconv.Itoa(fileTransferRetryAfter))
+			s.httpError(w, r, http.StatusServiceUnavailable, nil, "shutting down, retry later", "Shutting down, turning away request %q from %s", r.URL, r.RemoteAddr)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// shutdownHTTP stops srv, after waiting up to ShutdownGracePeriod
+// for boot file transfers to finish. New requests get a 503 in the
+// meantime.
+func (s *Server) shutdownHTTP(srv *http.Server) {
+	grace := httpTimeout(s.ShutdownGracePeriod, defaultShutdownGracePeriod)
+	if grace == 0 {
+		srv.Close()
+		return
+	}
+	deadline := time.Now().Add(grace)
+	if n := s.transfers.drain(deadline); n > 0 {
+		s.log("HTTP", "Shutting down with %d file transfers still in progress", n)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsFileTransfers(t *testing.T) {
+	booter := &blockingBootFile{
+		readBootFile: "stuff",
+		started:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter:              booter,
+		Log:                 log,
+		Debug:               log,
+		ShutdownGracePeriod: 10 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening: %s", err)
+	}
+	srv := s.httpServer(s.refuseWhileDraining(s.Handler()))
+	go serveHTTP(l, srv)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	url := "http://" + l.Addr().String() + "/_/file?name=test"
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := client.Get(url)
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		slow <- result{resp.StatusCode, string(body), err}
+	}()
+	<-booter.started
+
+	stopped := make(chan struct{})
+	go func() {
+		s.shutdownHTTP(srv)
+		close(stopped)
+	}()
+	for !s.transfers.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Request while draining: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Request while draining got status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Request while draining has no Retry-After header")
+	}
+
+	select {
+	case <-stopped:
+		t.Fatalf("Server shut down with a file transfer in progress")
+	default:
+	}
+
+	close(booter.release)
+	res := <-slow
+	if res.err != nil {
+		t.Fatalf("In-flight transfer failed: %s", res.err)
+	}
+	if res.status != http.StatusOK || res.body != "test stuff" {
+		t.Errorf("In-flight transfer got status %d body %q, want %d %q", res.status, res.body, http.StatusOK, "test stuff")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server didn't shut down after the transfer finished")
+	}
+}
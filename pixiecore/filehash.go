@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// errHashMismatch is the error of reads reaching the end of a file
+// that doesn't match its expected SHA-256 digest.
+var errHashMismatch = errors.New("file doesn't match its SHA-256 digest")
+
+// hashCheckingReader reads a file through, and fails at its end if
+// its SHA-256 digest isn't want. It holds back the data of its latest
+// read from the file until it knows that more data follows, or that
+// the digest matches, so that a client never gets the whole of a
+// corrupted file.
+type hashCheckingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+
+	out    []byte // released data, not returned yet
+	outBuf []byte
+	held   []byte // data of the latest read, not released yet
+	spare  []byte
+	err    error
+}
+
+func newHashCheckingReader(r io.Reader, want []byte) *hashCheckingReader {
+	return &hashCheckingReader{
+		r:     r,
+		h:     sha256.New(),
+		want:  want,
+		held:  make([]byte, 0, 32<<10),
+		spare: make([]byte, 32<<10),
+	}
+}
+
+func (c *hashCheckingReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		n, err := c.r.Read(c.spare[:cap(c.spare)])
+		if n > 0 {
+			c.h.Write(c.spare[:n])
+			// More data follows held, it's safe to release.
+			c.out = append(c.outBuf[:0], c.held...)
+			c.outBuf = c.out
+			c.held, c.spare = c.spare[:n], c.held[:0]
+		}
+		switch {
+		case err == io.EOF:
+			if sum := c.h.Sum(nil); !bytes.Equal(sum, c.want) {
+				c.err = fmt.Errorf("%w: got %x, want %x", errHashMismatch, sum, c.want)
+				break
+			}
+			c.out = append(c.out, c.held...)
+			c.held = nil
+			c.err = io.EOF
+		case err != nil:
+			c.err = err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// hashCheckedFile is a boot file read through hashCheckingReaders.
+type hashCheckedFile struct {
+	io.Reader
+	io.Closer
+}
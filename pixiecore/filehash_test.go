@@ -0,0 +1,112 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHashCheckingReader(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	sum := sha256.Sum256(data)
+
+	for _, r := range []*hashCheckingReader{
+		newHashCheckingReader(bytes.NewReader(data), sum[:]),
+		newHashCheckingReader(iotest.OneByteReader(bytes.NewReader(data)), sum[:]),
+		newHashCheckingReader(iotest.DataErrReader(bytes.NewReader(data)), sum[:]),
+	} {
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Reading a file matching its digest: %s", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Got %d bytes of a matching file, want all %d", len(got), len(data))
+		}
+	}
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-1] = 'x'
+	for _, r := range []*hashCheckingReader{
+		newHashCheckingReader(bytes.NewReader(corrupted), sum[:]),
+		newHashCheckingReader(iotest.OneByteReader(bytes.NewReader(corrupted)), sum[:]),
+		newHashCheckingReader(iotest.DataErrReader(bytes.NewReader(corrupted)), sum[:]),
+	} {
+		got, err := ioutil.ReadAll(r)
+		if !errors.Is(err, errHashMismatch) {
+			t.Fatalf("Expected an error wrapping %v for a corrupted file, got %v", errHashMismatch, err)
+		}
+		if len(got) >= len(corrupted) {
+			t.Fatalf("Got all %d bytes of a corrupted file, expected its end to be held back", len(got))
+		}
+	}
+}
+
+func TestFileHashCheck(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: readBootFile("stuff"),
+		Log:    log,
+		Debug:  log,
+	}
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	hash := func(data string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	}
+	get := func(name string, hashes ...string) (int, string, error) {
+		u := srv.URL + "/_/file?name=" + escapeID(ID(name))
+		for _, h := range hashes {
+			u += "&sha256=" + url.QueryEscape(h)
+		}
+		resp, err := http.Get(u)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+
+	if code, body, err := get("k", hash("k stuff")); err != nil || code != 200 || body != "k stuff" {
+		t.Fatalf("Wrong response for a file matching its digest, got HTTP %d %q, err %v", code, body, err)
+	}
+	if _, body, err := get("k", hash("k other stuff")); err == nil || body == "k stuff" {
+		t.Fatalf("Expected a failed transfer of a file not matching its digest, got %q", body)
+	}
+
+	combined := string(CombinedInitrd([]ID{"i1", "i2"}))
+	if code, body, err := get(combined, hash("i1 stuff"), hash("i2 stuff")); err != nil || code != 200 || body != "i1 stuffi2 stuff" {
+		t.Fatalf("Wrong response for a combined initrd matching its digests, got HTTP %d %q, err %v", code, body, err)
+	}
+	if _, body, err := get(combined, hash("i1 stuff"), hash("i2 other stuff")); err == nil || body == "i1 stuffi2 stuff" {
+		t.Fatalf("Expected a failed transfer of a combined initrd not matching its digests, got %q", body)
+	}
+
+	for _, hashes := range [][]string{{"abab"}, {hash("k stuff"), hash("k stuff")}} {
+		if code, _, _ := get("k", hashes...); code != http.StatusBadRequest {
+			t.Fatalf("Got HTTP %d for file request with SHA-256 digests %q, expected %d", code, hashes, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// defaultHealthCheckMAC is the MAC address HealthCheck boots if
+// Server.HealthCheckMachine doesn't set one. It's locally
+// administered, so it can't be a real machine's.
+var defaultHealthCheckMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0}
+
+// HealthCheck checks that s can boot machines, by asking the Booter
+// for HealthCheckMachine's spec and checking that its kernel can be
+// read. It returns the first failure it finds.
+func (s *Server) HealthCheck(ctx context.Context) error {
+	mach := s.HealthCheckMachine
+	if mach.MAC == nil {
+		mach.MAC = defaultHealthCheckMAC
+	}
+
+	spec, err := bootSpec(ctx, s.Booter, mach)
+	if err != nil {
+		return fmt.Errorf("getting boot spec for %s: %s", mach.MAC, err)
+	}
+	if spec == nil {
+		return fmt.Errorf("no boot spec for %s", mach.MAC)
+	}
+	if spec.IpxeScript != "" {
+		// Nothing we can check without running the script.
+		return nil
+	}
+
+	kernel := spec.Kernel
+	if len(spec.Menu) > 0 {
+		kernel = spec.Menu[0].Kernel
+	}
+	if kernel == "" {
+		return errors.New("boot spec is missing Kernel")
+	}
+	if err := checkBootFile(s.Booter, kernel); err != nil {
+		return fmt.Errorf("reading kernel %q: %s", kernel, err)
+	}
+	return nil
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := s.HealthCheck(r.Context()); err != nil {
+		s.httpError(w, r, http.StatusServiceUnavailable, nil, err.Error(), "Health check failed: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	booter := &specBooter{
+		fileSetBooter: fileSetBooter{files: map[ID]bool{"kernel": true}},
+		spec:          &Spec{Kernel: "kernel"},
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: booter,
+		Log:    log,
+		Debug:  log,
+	}
+
+	healthz := func() int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/healthz", nil)
+		if err != nil {
+			t.Fatalf("Constructing healthz request: %s", err)
+		}
+		s.handleHealthz(rr, req)
+		return rr.Code
+	}
+
+	if err := s.HealthCheck(context.Background()); err != nil {
+		t.Fatalf("Health check of a working booter failed: %s", err)
+	}
+	if code := healthz(); code != http.StatusOK {
+		t.Fatalf("Healthy server got HTTP %d, expected 200", code)
+	}
+
+	booter.spec = &Spec{Kernel: "missing"}
+	if err := s.HealthCheck(context.Background()); err == nil {
+		t.Fatalf("Health check with an unreadable kernel succeeded")
+	}
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Unhealthy server got HTTP %d, expected %d", code, http.StatusServiceUnavailable)
+	}
+
+	booter.spec = nil
+	if err := s.HealthCheck(context.Background()); err == nil {
+		t.Fatalf("Health check without a boot spec succeeded")
+	}
+
+	var probed Machine
+	s.Booter = booterFunc(func(m Machine) (*Spec, error) {
+		probed = m
+		return nil, errors.New("API server is down")
+	})
+	s.HealthCheckMachine = Machine{MAC: net.HardwareAddr{1, 2, 3, 4, 5, 6}, Arch: ArchX64}
+	if err := s.HealthCheck(context.Background()); err == nil {
+		t.Fatalf("Health check with a broken booter succeeded")
+	}
+	if probed.MAC.String() != "01:02:03:04:05:06" || probed.Arch != ArchX64 {
+		t.Fatalf("Health check probed %s/%s, expected 01:02:03:04:05:06/%s", probed.MAC, probed.Arch, ArchX64)
+	}
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Server with a broken booter got HTTP %d, expected %d", code, http.StatusServiceUnavailable)
+	}
+}
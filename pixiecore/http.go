@@ -15,7 +15,12 @@
 package pixiecore
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -23,142 +28,543 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"text/template"
+	"strings"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func serveHTTP(l net.Listener, handlers ...func(*http.ServeMux)) error {
-	mux := http.NewServeMux()
-	for _, h := range handlers {
-		h(mux)
-	}
-	if err := http.Serve(l, mux); err != nil {
+func serveHTTP(l net.Listener, srv *http.Server) error {
+	if err := srv.Serve(l); err != nil {
 		return fmt.Errorf("HTTP server shut down: %s", err)
 	}
 	return nil
 }
 
+// connContextKey is the context key of the net.Conn a request came
+// in on.
+type connContextKey struct{}
+
+// httpServer returns an HTTP server for handler, with the Server's
+// timeouts.
+func (s *Server) httpServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  httpTimeout(s.HTTPReadTimeout, defaultHTTPReadTimeout),
+		WriteTimeout: httpTimeout(s.HTTPWriteTimeout, defaultHTTPWriteTimeout),
+		IdleTimeout:  httpTimeout(s.HTTPIdleTimeout, defaultHTTPIdleTimeout),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+}
+
+// httpTimeout returns the http.Server timeout for a Server timeout
+// of d, which defaults to def. http.Server has no timeout if it's
+// zero.
+func httpTimeout(d, def time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return def
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
+// writeDeadlineExtender pushes back the connection's write deadline
+// before each write, so that the write timeout applies to each write
+// rather than the whole response.
+type writeDeadlineExtender struct {
+	http.ResponseWriter
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *writeDeadlineExtender) Write(b []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.ResponseWriter.Write(b)
+}
+
+// extendWriteDeadlines returns a ResponseWriter for r that only
+// times out writes that stall for longer than the write timeout.
+func (s *Server) extendWriteDeadlines(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	timeout := httpTimeout(s.HTTPWriteTimeout, defaultHTTPWriteTimeout)
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok || timeout == 0 {
+		return w
+	}
+	return &writeDeadlineExtender{w, conn, timeout}
+}
+
 func (s *Server) serveHTTP(mux *http.ServeMux) {
-	mux.HandleFunc("/_/ipxe", s.handleIpxe)
-	mux.HandleFunc("/_/file", s.handleFile)
+	if s.MetricsRegistry == nil {
+		mux.HandleFunc("/_/ipxe", s.handleIpxe)
+		mux.HandleFunc("/_/file", s.handleFile)
+	} else {
+		m := newMetrics(s.MetricsRegistry)
+		mux.HandleFunc("/_/ipxe", m.instrumentIpxe(s.handleIpxe))
+		mux.HandleFunc("/_/file", m.instrumentFile(s.handleFile))
+		mux.Handle("/_/metrics", s.allowCORS(promhttp.HandlerFor(s.MetricsRegistry, promhttp.HandlerOpts{})))
+	}
 	mux.HandleFunc("/_/booting", s.handleBooting)
+	mux.HandleFunc("/_/userdata", s.handleUserData)
+	mux.Handle("/_/clients", s.allowCORS(http.HandlerFunc(s.handleClients)))
+	mux.Handle("/_/healthz", s.allowCORS(http.HandlerFunc(s.handleHealthz)))
+	for pattern, handler := range s.handlers {
+		mux.Handle(pattern, handler)
+	}
+}
+
+// Handle registers handler for pattern on Pixiecore's HTTP server,
+// next to the routes Pixiecore uses to boot machines. Paths under
+// /_/ are reserved for Pixiecore. Handle must be called before Serve.
+func (s *Server) Handle(pattern string, handler http.Handler) error {
+	i := strings.Index(pattern, "/")
+	if i < 0 {
+		return fmt.Errorf("invalid pattern %q, must contain a path", pattern)
+	}
+	if path := pattern[i:]; path == "/_" || strings.HasPrefix(path, "/_/") {
+		return fmt.Errorf("pattern %q is reserved for Pixiecore", pattern)
+	}
+	if _, ok := s.handlers[pattern]; ok {
+		return fmt.Errorf("pattern %q is already registered", pattern)
+	}
+	if s.handlers == nil {
+		s.handlers = make(map[string]http.Handler)
+	}
+	s.handlers[pattern] = handler
+	return nil
 }
 
+// Handler returns the handler for Pixiecore's HTTP server, serving
+// both Pixiecore's routes and the ones registered with Handle.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.serveHTTP(mux)
+	return mux
+}
+
+// reservedIpxeParams are the query parameters of /_/ipxe requests
+// that handleIpxe interprets, and doesn't pass in Machine.Params.
+var reservedIpxeParams = map[string]bool{
+	"mac":         true,
+	"arch":        true,
+	"userclass":   true,
+	"vendorclass": true,
+	"clientid":    true,
+	"guid":        true,
+	"secureboot":  true,
+}
+
+// handleIpxe serves the iPXE boot script of the machine given by the
+// mac and arch query parameters. iPXE scripts can pass the client's
+// user class, vendor class, client identifier and machine GUID (both
+// in hex, dashes allowed) to the Booter with the optional userclass,
+// vendorclass, clientid and guid parameters, e.g.
+// /_/ipxe?arch=0&mac=${net0/mac}&userclass=${user-class}, and
+// secureboot=1 for clients running with Secure Boot enabled. Other
+// query parameters are passed to the Booter in Machine.Params.
+//
+// Scripts carry an ETag, so that retries can be answered with 304 Not
+// Modified, and large scripts are gzipped for clients that accept it.
 func (s *Server) handleIpxe(w http.ResponseWriter, r *http.Request) {
 	overallStart := time.Now()
 	macStr := r.URL.Query().Get("mac")
 	if macStr == "" {
-		s.debug("HTTP", "Bad request %q from %s, missing MAC address", r.URL, r.RemoteAddr)
-		http.Error(w, "missing MAC address parameter", http.StatusBadRequest)
+		s.httpError(w, r, http.StatusBadRequest, nil, "missing MAC address parameter", "Bad request %q from %s, missing MAC address", r.URL, r.RemoteAddr)
 		return
 	}
 	archStr := r.URL.Query().Get("arch")
 	if archStr == "" {
-		s.debug("HTTP", "Bad request %q from %s, missing architecture", r.URL, r.RemoteAddr)
-		http.Error(w, "missing architecture parameter", http.StatusBadRequest)
+		s.httpError(w, r, http.StatusBadRequest, logFields{"mac": macStr}, "missing architecture parameter", "Bad request %q from %s, missing architecture", r.URL, r.RemoteAddr)
 		return
 	}
 
 	mac, err := net.ParseMAC(macStr)
 	if err != nil {
-		s.debug("HTTP", "Bad request %q from %s, invalid MAC address %q (%s)", r.URL, r.RemoteAddr, macStr, err)
-		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		s.httpError(w, r, http.StatusBadRequest, logFields{"mac": macStr}, "invalid MAC address", "Bad request %q from %s, invalid MAC address %q (%s)", r.URL, r.RemoteAddr, macStr, err)
 		return
 	}
 
 	i, err := strconv.Atoi(archStr)
 	if err != nil {
-		s.debug("HTTP", "Bad request %q from %s, invalid architecture %q (%s)", r.URL, r.RemoteAddr, archStr, err)
-		http.Error(w, "invalid architecture", http.StatusBadRequest)
+		s.httpError(w, r, http.StatusBadRequest, logFields{"mac": mac.String(), "arch": archStr}, "invalid architecture", "Bad request %q from %s, invalid architecture %q (%s)", r.URL, r.RemoteAddr, archStr, err)
 		return
 	}
 	arch := Architecture(i)
 	switch arch {
-	case ArchIA32, ArchX64:
+	case ArchIA32, ArchX64, ArchArm32, ArchArm64:
 	default:
-		s.debug("HTTP", "Bad request %q from %s, unknown architecture %q", r.URL, r.RemoteAddr, arch)
-		http.Error(w, "unknown architecture", http.StatusBadRequest)
+		s.httpError(w, r, http.StatusBadRequest, logFields{"mac": mac.String(), "arch": archStr}, "unknown architecture", "Bad request %q from %s, unknown architecture %q", r.URL, r.RemoteAddr, arch)
+		return
+	}
+	r = s.withBootID(w, r, mac)
+	fields := logFields{"mac": mac.String(), "arch": arch.String()}
+
+	if s.ipxeLimiter != nil && !s.ipxeLimiter.allow(mac) {
+		s.httpError(w, r, http.StatusTooManyRequests, fields, "too many requests", "Rate limited ipxe request for %s (query %q from %s)", mac, r.URL, r.RemoteAddr)
 		return
 	}
 
 	mach := Machine{
-		MAC:  mac,
-		Arch: arch,
+		MAC:         mac,
+		Arch:        arch,
+		UserClass:   r.URL.Query().Get("userclass"),
+		VendorClass: r.URL.Query().Get("vendorclass"),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		mach.IP = net.ParseIP(host)
+	}
+	if secureBoot := r.URL.Query().Get("secureboot"); secureBoot != "" {
+		mach.SecureBoot, err = strconv.ParseBool(secureBoot)
+		if err != nil {
+			s.httpError(w, r, http.StatusBadRequest, fields, "invalid secureboot parameter", "Bad request %q from %s, invalid secureboot parameter %q (%s)", r.URL, r.RemoteAddr, secureBoot, err)
+			return
+		}
+	}
+	if clientID := r.URL.Query().Get("clientid"); clientID != "" {
+		mach.ClientID, err = hex.DecodeString(clientID)
+		if err != nil {
+			s.httpError(w, r, http.StatusBadRequest, fields, "invalid client identifier", "Bad request %q from %s, invalid client identifier %q (%s)", r.URL, r.RemoteAddr, clientID, err)
+			return
+		}
+	}
+	if guid := r.URL.Query().Get("guid"); guid != "" {
+		mach.GUID, err = hex.DecodeString(strings.Replace(guid, "-", "", -1))
+		if err != nil || len(mach.GUID) != 16 {
+			s.httpError(w, r, http.StatusBadRequest, fields, "invalid GUID", "Bad request %q from %s, invalid GUID %q", r.URL, r.RemoteAddr, guid)
+			return
+		}
+	}
+	for name, values := range r.URL.Query() {
+		if reservedIpxeParams[name] {
+			continue
+		}
+		if mach.Params == nil {
+			mach.Params = make(map[string]string)
+		}
+		mach.Params[name] = values[0]
 	}
 	start := time.Now()
-	spec, err := s.Booter.BootSpec(mach)
-	s.debug("HTTP", "Get bootspec for %s took %s", mac, time.Since(start))
+	spec, err := bootSpec(r.Context(), s.Booter, mach)
+	s.logHTTP(logLevelDebug, r, fields, "Get bootspec for %s took %s", mac, time.Since(start))
 	if err != nil {
-		s.log("HTTP", "Couldn't get a bootspec for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
-		http.Error(w, "couldn't get a bootspec", http.StatusInternalServerError)
+		s.httpError(w, r, http.StatusInternalServerError, fields, "couldn't get a bootspec", "Couldn't get a bootspec for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
 		return
 	}
 	if spec == nil {
 		// TODO: make ipxe abort netbooting so it can fall through to
 		// other boot options - unsure if that's possible.
-		s.debug("HTTP", "No boot spec for %s (query %q from %s), ignoring boot request", mac, r.URL, r.RemoteAddr)
-		http.Error(w, "you don't netboot", http.StatusNotFound)
+		s.httpError(w, r, http.StatusNotFound, fields, "you don't netboot", "No boot spec for %s (query %q from %s), ignoring boot request", mac, r.URL, r.RemoteAddr)
 		return
 	}
+	if s.ValidateSpecs {
+		start = time.Now()
+		err = spec.Validate(s.Booter)
+		s.logHTTP(logLevelDebug, r, fields, "Validate bootspec for %s took %s", mac, time.Since(start))
+		if err != nil {
+			s.httpError(w, r, http.StatusInternalServerError, fields, "invalid bootspec", "Invalid bootspec for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
+			return
+		}
+	}
+	if s.CombineInitrds {
+		spec = combineInitrds(spec)
+	}
 	start = time.Now()
-	script, err := ipxeScript(mach, spec, r.Host)
-	s.debug("HTTP", "Construct ipxe script for %s took %s", mac, time.Since(start))
+	var script []byte
+	if scripter, ok := s.Booter.(IpxeScripter); ok {
+		script, err = scripter.IpxeScript(spec, s.serverURL(r))
+	} else {
+		serverURL := s.serverURL(r)
+		script, err = ipxeScript(mach, spec, serverURL, s.fileURLs(serverURL), s.userDataURL(serverURL, mach))
+	}
+	s.logHTTP(logLevelDebug, r, fields, "Construct ipxe script for %s took %s", mac, time.Since(start))
 	if err != nil {
-		s.log("HTTP", "Failed to assemble ipxe script for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
-		http.Error(w, "couldn't get a boot script", http.StatusInternalServerError)
+		s.httpError(w, r, http.StatusInternalServerError, fields, "couldn't get a boot script", "Failed to assemble ipxe script for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
 		return
 	}
 
-	s.log("HTTP", "Sending ipxe boot script to %s", r.RemoteAddr)
-	start = time.Now()
+	// The ETag is derived from the script, so it changes whenever
+	// the Spec does, and clients must revalidate every time.
+	sum := sha256.Sum256(script)
+	etag := fmt.Sprintf(`"%x"`, sum[:16])
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept-Encoding")
 	s.machineEvent(mac, machineStateIpxeScript, "Sent iPXE boot script")
+	s.recordClient(mach, spec)
+	if notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		fields["status"] = http.StatusNotModified
+		s.logHTTP(logLevelDebug, r, fields, "ipxe boot script for %s not modified since last fetch", mac)
+		return
+	}
+
+	fields["status"] = http.StatusOK
+	s.logHTTP(logLevelInfo, r, fields, "Sending ipxe boot script to %s", r.RemoteAddr)
+	start = time.Now()
 	w.Header().Set("Content-Type", "text/plain")
-	w.Write(script)
-	s.debug("HTTP", "Writing ipxe script to %s took %s", mac, time.Since(start))
-	s.debug("HTTP", "handleIpxe for %s took %s", mac, time.Since(overallStart))
+	if len(script) >= minCompressedScriptSize && acceptsGzip(r) {
+		w.Header().Set("ETag", "W/"+etag)
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(script)
+		gz.Close()
+	} else {
+		w.Write(script)
+	}
+	s.logHTTP(logLevelDebug, r, fields, "Writing ipxe script to %s took %s", mac, time.Since(start))
+	s.logHTTP(logLevelDebug, r, fields, "handleIpxe for %s took %s", mac, time.Since(overallStart))
+}
+
+// notModified returns true if r's conditional headers match a file
+// with the given ETag and modification time, see RFC 7232.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	// If-None-Match takes precedence over If-Modified-Since when
+	// both are present.
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a resolution of one second.
+	return !modTime.Truncate(time.Second).After(ims)
 }
 
 func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
 	if name == "" {
-		s.debug("HTTP", "Bad request %q from %s, missing filename", r.URL, r.RemoteAddr)
-		http.Error(w, "missing filename", http.StatusBadRequest)
+		s.httpError(w, r, http.StatusBadRequest, nil, "missing filename", "Bad request %q from %s, missing filename", r.URL, r.RemoteAddr)
+		return
+	}
+
+	fields := logFields{"file": name}
+	if mac := r.URL.Query().Get("mac"); mac != "" {
+		fields["mac"] = mac
+		if hw, err := net.ParseMAC(mac); err == nil {
+			r = s.withBootID(w, r, hw)
+		}
+	}
+	if len(s.FileURLKey) > 0 {
+		if err := verifyFileName(name, r.URL.Query().Get("sig"), time.Now(), s.FileURLKey); err != nil {
+			s.httpError(w, r, http.StatusForbidden, fields, "invalid signature", "Bad signature for file %q (query %q from %s): %s", name, r.URL, r.RemoteAddr, err)
+			return
+		}
+	}
+
+	var hashes [][]byte
+	for _, h := range r.URL.Query()["sha256"] {
+		if !isSHA256(h) {
+			s.httpError(w, r, http.StatusBadRequest, fields, "invalid sha256 digest", "Bad request %q from %s, invalid SHA-256 digest %q", r.URL, r.RemoteAddr, h)
+			return
+		}
+		sum, _ := hex.DecodeString(h)
+		hashes = append(hashes, sum)
+	}
+	if len(hashes) > 0 && len(hashes) != initrdFiles(ID(name)) {
+		s.httpError(w, r, http.StatusBadRequest, fields, "wrong number of sha256 digests", "Bad request %q from %s, got %d SHA-256 digests for file %q", r.URL, r.RemoteAddr, len(hashes), name)
+		return
+	}
+
+	var modTime time.Time
+	if stater, ok := s.Booter.(BootFileStater); ok {
+		sz, mt, err := stater.Stat(ID(name))
+		switch {
+		case err != nil:
+			s.logHTTP(logLevelDebug, r, fields, "Couldn't stat file %q, serving it without caching headers: %s", name, err)
+		case mt.IsZero():
+			// Without a modification time, e.g. for files in an
+			// embed.FS, an ETag would only reflect the size, and a
+			// changed file of the same size would look unchanged.
+			s.logHTTP(logLevelDebug, r, fields, "File %q has no modification time, serving it without caching headers", name)
+		default:
+			modTime = mt
+			etag := fmt.Sprintf(`"%x-%x"`, sz, modTime.UnixNano())
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			if notModified(r, etag, modTime) {
+				w.WriteHeader(http.StatusNotModified)
+				fields["status"] = http.StatusNotModified
+				s.logHTTP(logLevelDebug, r, fields, "File %q not modified since last fetch by %s", name, r.RemoteAddr)
+				return
+			}
+		}
+	}
+
+	if !s.transfers.start() {
+		w.Header().Set("Retry-After", strconv.Itoa(fileTransferRetryAfter))
+		s.httpError(w, r, http.StatusServiceUnavailable, fields, "shutting down, retry later", "Shutting down, turning away request for %q from %s", name, r.RemoteAddr)
+		return
+	}
+	defer s.transfers.finish()
+
+	release, ok := s.acquireFileSlot(r)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(fileTransferRetryAfter))
+		s.httpError(w, r, http.StatusServiceUnavailable, fields, "too many file transfers, retry later", "Too many concurrent file transfers, turning away request for %q from %s", name, r.RemoteAddr)
+		return
 	}
+	defer release()
 
-	f, sz, err := s.Booter.ReadBootFile(ID(name))
+	f, sz, err := s.readBootFile(ID(name), hashes)
 	if err != nil {
-		s.log("HTTP", "Error getting file %q (query %q from %s): %s", name, r.URL, r.RemoteAddr, err)
-		http.Error(w, "couldn't get file", http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrBootFileNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrUpstream):
+			status = http.StatusBadGateway
+		}
+		s.httpError(w, r, status, fields, "couldn't get file", "Error getting file %q (query %q from %s): %s", name, r.URL, r.RemoteAddr, err)
 		return
 	}
 	defer f.Close()
-	if sz >= 0 {
-		w.Header().Set("Content-Length", strconv.FormatInt(sz, 10))
-	} else {
-		s.log("HTTP", "Unknown file size for %q, boot will be VERY slow (can your Booter provide file sizes?)", name)
+	if s.CompressFiles {
+		w.Header().Add("Vary", "Accept-Encoding")
 	}
-	if _, err = io.Copy(w, f); err != nil {
-		s.log("HTTP", "Copy of %q to %s (query %q) failed: %s", name, r.RemoteAddr, r.URL, err)
-		return
+	rec := &responseRecorder{ResponseWriter: s.extendWriteDeadlines(w, r)}
+	var sent int64
+	compress := s.compressFile(r)
+	if rs, ok := f.(io.ReadSeeker); ok && !compress {
+		// ServeContent handles Range requests, which lets clients
+		// resume a large download that failed partway.
+		http.ServeContent(rec, r, name, modTime, rs)
+		sent = rec.bytes
+	} else {
+		var body io.Reader = f
+		var gz *gzip.Writer
+		if compress {
+			br := bufio.NewReader(f)
+			if magic, _ := br.Peek(6); !isCompressed(magic) {
+				// The compressed body is a different representation
+				// of the file, so its validator can only be weak.
+				if etag := w.Header().Get("ETag"); etag != "" {
+					w.Header().Set("ETag", "W/"+etag)
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				gz = gzip.NewWriter(rec)
+			}
+			body = br
+		}
+		if sz < 0 {
+			s.logHTTP(logLevelInfo, r, fields, "Unknown file size for %q, boot will be VERY slow (can your Booter provide file sizes?)", name)
+		} else if gz == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(sz, 10))
+		}
+		if gz != nil {
+			if sent, err = io.Copy(gz, body); err == nil {
+				err = gz.Close()
+			}
+		} else {
+			sent, err = io.Copy(rec, body)
+		}
+		if errors.Is(err, errHashMismatch) {
+			s.logHTTP(logLevelInfo, r, fields, "File %q for %s (query %q) is corrupted: %s", name, r.RemoteAddr, r.URL, err)
+			// Drop the connection, so that the client sees a failed
+			// transfer even if it didn't get a Content-Length.
+			panic(http.ErrAbortHandler)
+		}
+		if err != nil {
+			s.logHTTP(logLevelInfo, r, fields, "Copy of %q to %s (query %q) failed: %s", name, r.RemoteAddr, r.URL, err)
+			return
+		}
 	}
-	s.log("HTTP", "Sent file %q to %s", name, r.RemoteAddr)
+	s.logHTTP(logLevelInfo, r, fields, "Sent file %q to %s", name, r.RemoteAddr)
+	completed := r.Method != "HEAD" && (rec.status == 0 || rec.status == http.StatusOK) && (sz < 0 || sent == sz)
 
+	mac, macErr := net.ParseMAC(r.URL.Query().Get("mac"))
+	if macErr == nil {
+		s.recordFileFetch(mac, name)
+	}
 	switch r.URL.Query().Get("type") {
 	case "kernel":
-		mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
-		if err != nil {
-			s.log("HTTP", "File fetch provided invalid MAC address %q", r.URL.Query().Get("mac"))
+		if macErr != nil {
+			s.logHTTP(logLevelInfo, r, fields, "File fetch provided invalid MAC address %q", r.URL.Query().Get("mac"))
 			return
 		}
 		s.machineEvent(mac, machineStateKernel, "Sent kernel %q", name)
 	case "initrd":
-		mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
-		if err != nil {
-			s.log("HTTP", "File fetch provided invalid MAC address %q", r.URL.Query().Get("mac"))
+		if macErr != nil {
+			s.logHTTP(logLevelInfo, r, fields, "File fetch provided invalid MAC address %q", r.URL.Query().Get("mac"))
 			return
 		}
 		s.machineEvent(mac, machineStateInitrd, "Sent initrd %q", name)
 	}
+
+	if completer, ok := s.Booter.(BootCompleter); ok && completed && macErr == nil {
+		completer.BootCompleted(mac, ID(name))
+	}
+}
+
+// minCompressedScriptSize is the size from which iPXE scripts are
+// gzipped for clients that accept it. Smaller scripts fit in a packet
+// or two anyway.
+const minCompressedScriptSize = 1024
+
+// compressFile returns true if the file requested by r should be
+// gzipped on the fly.
+func (s *Server) compressFile(r *http.Request) bool {
+	// Range offsets refer to the uncompressed file, which would
+	// make resumed downloads of a compressed body garbage.
+	if !s.CompressFiles || r.Header.Get("Range") != "" {
+		return false
+	}
+	return acceptsGzip(r)
+}
+
+// acceptsGzip returns true if r's Accept-Encoding allows a gzipped
+// response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.ToLower(strings.TrimSpace(parts[0])) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isCompressed returns true if magic, the first bytes of a file, is
+// the signature of a gzip, xz, zstd, bzip2 or lz4 compressed file.
+func isCompressed(magic []byte) bool {
+	for _, sig := range [][]byte{
+		{0x1f, 0x8b},                     // gzip
+		{0xfd, '7', 'z', 'X', 'Z', 0x00}, // xz
+		{0x28, 0xb5, 0x2f, 0xfd},         // zstd
+		{'B', 'Z', 'h'},                  // bzip2
+		{0x04, 0x22, 0x4d, 0x18},         // lz4
+		{0x02, 0x21, 0x4c, 0x18},         // legacy lz4, used by the Linux kernel
+	} {
+		if bytes.HasPrefix(magic, sig) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) handleBooting(w http.ResponseWriter, r *http.Request) {
@@ -169,53 +575,285 @@ func (s *Server) handleBooting(w http.ResponseWriter, r *http.Request) {
 
 	macStr := r.URL.Query().Get("mac")
 	if macStr == "" {
-		s.debug("HTTP", "Bad request %q from %s, missing MAC address", r.URL, r.RemoteAddr)
+		s.logHTTP(logLevelDebug, r, nil, "Bad request %q from %s, missing MAC address", r.URL, r.RemoteAddr)
 		return
 	}
 	mac, err := net.ParseMAC(macStr)
 	if err != nil {
-		s.debug("HTTP", "Bad request %q from %s, invalid MAC address %q (%s)", r.URL, r.RemoteAddr, macStr, err)
+		s.logHTTP(logLevelDebug, r, logFields{"mac": macStr}, "Bad request %q from %s, invalid MAC address %q (%s)", r.URL, r.RemoteAddr, macStr, err)
 		return
 	}
 	s.machineEvent(mac, machineStateBooted, "Booting into OS")
 }
 
-func ipxeScript(mach Machine, spec *Spec, serverHost string) ([]byte, error) {
+// handleUserData serves the user-data of the machine given by the mac
+// query parameter, and the optional arch parameter, if the Booter is
+// a UserDataBooter.
+func (s *Server) handleUserData(w http.ResponseWriter, r *http.Request) {
+	macStr := r.URL.Query().Get("mac")
+	if macStr == "" {
+		s.httpError(w, r, http.StatusBadRequest, nil, "missing MAC address parameter", "Bad request %q from %s, missing MAC address", r.URL, r.RemoteAddr)
+		return
+	}
+	mac, err := net.ParseMAC(macStr)
+	if err != nil {
+		s.httpError(w, r, http.StatusBadRequest, logFields{"mac": macStr}, "invalid MAC address", "Bad request %q from %s, invalid MAC address %q (%s)", r.URL, r.RemoteAddr, macStr, err)
+		return
+	}
+	mach := Machine{MAC: mac}
+	fields := logFields{"mac": mac.String()}
+	if len(s.FileURLKey) > 0 {
+		if err := verifyFileName(userDataName(mac), r.URL.Query().Get("sig"), time.Now(), s.FileURLKey); err != nil {
+			s.httpError(w, r, http.StatusForbidden, fields, "invalid signature", "Bad signature for user-data of %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
+			return
+		}
+	}
+	if s.userDataLimiter != nil && !s.userDataLimiter.allow(mac) {
+		s.httpError(w, r, http.StatusTooManyRequests, fields, "too many requests", "Rate limited user-data request for %s (query %q from %s)", mac, r.URL, r.RemoteAddr)
+		return
+	}
+	if archStr := r.URL.Query().Get("arch"); archStr != "" {
+		i, err := strconv.Atoi(archStr)
+		if err != nil {
+			s.httpError(w, r, http.StatusBadRequest, logFields{"mac": mac.String(), "arch": archStr}, "invalid architecture", "Bad request %q from %s, invalid architecture %q (%s)", r.URL, r.RemoteAddr, archStr, err)
+			return
+		}
+		mach.Arch = Architecture(i)
+		fields["arch"] = mach.Arch.String()
+	}
+
+	booter, ok := s.Booter.(UserDataBooter)
+	if !ok {
+		s.httpError(w, r, http.StatusNotFound, fields, "no user-data", "No user-data for %s (query %q from %s), booter doesn't provide any", mac, r.URL, r.RemoteAddr)
+		return
+	}
+	data, contentType, err := booter.UserData(mach)
+	if isNotFound(err) || (err == nil && data == nil) {
+		s.httpError(w, r, http.StatusNotFound, fields, "no user-data", "No user-data for %s (query %q from %s)", mac, r.URL, r.RemoteAddr)
+		return
+	}
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, fields, "couldn't get user-data", "Couldn't get user-data for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
+		return
+	}
+	defer data.Close()
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// User-data may change between boots, and carry secrets.
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := io.Copy(w, data); err != nil {
+		s.logHTTP(logLevelInfo, r, fields, "Error serving user-data to %s: %s", mac, err)
+		return
+	}
+	fields["status"] = http.StatusOK
+	s.logHTTP(logLevelInfo, r, fields, "Sent user-data to %s", mac)
+}
+
+// fileURLs returns a function that gives the URL of the file for an
+// ID on serverURL. The URLs are signed if FileURLKey is set.
+func (s *Server) fileURLs(serverURL string) func(ID) string {
+	expiry := time.Now().Add(s.fileURLTTL())
+	return func(id ID) string {
+		u := fmt.Sprintf("%s/_/file?name=%s", serverURL, escapeID(id))
+		if len(s.FileURLKey) > 0 {
+			u += "&sig=" + signFileName(string(id), expiry, s.FileURLKey)
+		}
+		return u
+	}
+}
+
+// userDataURL returns the URL of mach's user-data on serverURL,
+// signed like file URLs if FileURLKey is set.
+func (s *Server) userDataURL(serverURL string, mach Machine) string {
+	u := fmt.Sprintf("%s/_/userdata?mac=%s&arch=%d", serverURL, url.QueryEscape(mach.MAC.String()), int(mach.Arch))
+	if len(s.FileURLKey) > 0 {
+		u += "&sig=" + signFileName(userDataName(mach.MAC), time.Now().Add(s.fileURLTTL()), s.FileURLKey)
+	}
+	return u
+}
+
+func (s *Server) fileURLTTL() time.Duration {
+	if s.FileURLTTL <= 0 {
+		return defaultFileURLTTL
+	}
+	return s.FileURLTTL
+}
+
+// serverURL returns the scheme and host iPXE should use to reach
+// Pixiecore's HTTP server, as seen by the machine that made r.
+func (s *Server) serverURL(r *http.Request) string {
+	scheme := s.FileURLScheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	host := s.PublicHost
+	if host == "" {
+		host = r.Host
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// ipxeScript returns the iPXE script that boots spec. fileURL returns
+// the URL that serves the file for an ID, and userDataURL is the URL
+// of mach's user-data.
+func ipxeScript(mach Machine, spec *Spec, serverURL string, fileURL func(ID) string, userDataURL string) ([]byte, error) {
 	if spec.IpxeScript != "" {
 		return []byte(spec.IpxeScript), nil
 	}
 
-	if spec.Kernel == "" {
+	if spec.Kernel == "" && len(spec.Menu) == 0 {
 		return nil, errors.New("spec is missing Kernel")
 	}
 
-	urlTemplate := fmt.Sprintf("http://%s/_/file?name=%%s&type=%%s&mac=%%s", serverHost)
+	if strings.ContainsAny(spec.BootFlags, "\r\n") {
+		return nil, fmt.Errorf("iPXE boot flags %q contain a newline", spec.BootFlags)
+	}
+
 	var b bytes.Buffer
 	b.WriteString("#!ipxe\n")
-	u := fmt.Sprintf(urlTemplate, url.QueryEscape(string(spec.Kernel)), "kernel", url.QueryEscape(mach.MAC.String()))
-	fmt.Fprintf(&b, "kernel --name kernel %s\n", u)
-	for i, initrd := range spec.Initrd {
-		u = fmt.Sprintf(urlTemplate, url.QueryEscape(string(initrd)), "initrd", url.QueryEscape(mach.MAC.String()))
-		fmt.Fprintf(&b, "initrd --name initrd%d %s\n", i, u)
+	for _, cmd := range spec.IpxePreamble {
+		if strings.ContainsAny(cmd, "\r\n") {
+			return nil, fmt.Errorf("iPXE preamble command %q contains a newline", cmd)
+		}
+		b.WriteString(cmd)
+		b.WriteByte('\n')
 	}
 
-	fmt.Fprintf(&b, "imgfetch --name ready http://%s/_/booting?mac=%s ||\n", serverHost, url.QueryEscape(mach.MAC.String()))
-	b.WriteString("imgfree ready ||\n")
+	if len(spec.Menu) == 0 {
+		if err := checkBootHashes(spec.KernelHash, spec.InitrdHashes, spec.Initrd); err != nil {
+			return nil, err
+		}
+		if err := writeIpxeBoot(&b, mach, spec, spec.Kernel, spec.Initrd, spec.KernelHash, spec.InitrdHashes, spec.Cmdline, serverURL, fileURL, userDataURL); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
 
-	b.WriteString("boot kernel ")
-	for i := range spec.Initrd {
-		fmt.Fprintf(&b, "initrd=initrd%d ", i)
+	b.WriteString(":menu\n")
+	b.WriteString("menu Pixiecore boot menu\n")
+	for i, entry := range spec.Menu {
+		if entry.Kernel == "" {
+			return nil, fmt.Errorf("menu entry %q is missing Kernel", entry.Label)
+		}
+		if strings.ContainsAny(entry.Label, "\r\n") {
+			return nil, fmt.Errorf("menu entry label %q contains a newline", entry.Label)
+		}
+		if err := checkBootHashes(entry.KernelHash, entry.InitrdHashes, entry.Initrd); err != nil {
+			return nil, fmt.Errorf("menu entry %q: %s", entry.Label, err)
+		}
+		fmt.Fprintf(&b, "item entry%d %s\n", i, entry.Label)
+	}
+	b.WriteString("choose target && goto ${target} || exit\n")
+	for i, entry := range spec.Menu {
+		fmt.Fprintf(&b, ":entry%d\n", i)
+		if err := writeIpxeBoot(&b, mach, spec, entry.Kernel, entry.Initrd, entry.KernelHash, entry.InitrdHashes, entry.Cmdline, serverURL, fileURL, userDataURL); err != nil {
+			return nil, err
+		}
+		// Back to the menu if the boot fails.
+		b.WriteString("goto menu\n")
 	}
 
+	return b.Bytes(), nil
+}
+
+// hashHint returns the sha256= URL query parameters for hashes,
+// leaving out empty ones. handleFile checks the files it serves
+// against them.
+func hashHint(hashes ...string) string {
+	var ret strings.Builder
+	for _, h := range hashes {
+		if h != "" {
+			ret.WriteString("&sha256=" + strings.ToLower(h))
+		}
+	}
+	return ret.String()
+}
+
+// escapeID escapes id for use in a /_/file URL query.
+//
+// Spaces are escaped as %20 rather than "+", so that the URL has no
+// characters that iPXE or the kernel commandline might treat
+// specially, and decodes back to id whether the receiving end treats
+// "+" as a space or not.
+func escapeID(id ID) string {
+	return strings.Replace(url.QueryEscape(string(id)), "+", "%20", -1)
+}
+
+// checkBootHashes checks that kernelHash and initrdHashes are
+// well-formed SHA-256 digests, for a boot with initrds. Combined
+// initrds have one hash for each of their parts.
+func checkBootHashes(kernelHash string, initrdHashes []string, initrds []ID) error {
+	numInitrds := 0
+	for _, initrd := range initrds {
+		numInitrds += initrdFiles(initrd)
+	}
+	if kernelHash != "" && !isSHA256(kernelHash) {
+		return fmt.Errorf("kernel hash %q is not a hex SHA-256 digest", kernelHash)
+	}
+	if len(initrdHashes) > 0 && len(initrdHashes) != numInitrds {
+		return fmt.Errorf("got %d initrd hashes for %d initrds", len(initrdHashes), numInitrds)
+	}
+	for _, h := range initrdHashes {
+		if !isSHA256(h) {
+			return fmt.Errorf("initrd hash %q is not a hex SHA-256 digest", h)
+		}
+	}
+	return nil
+}
+
+func isSHA256(h string) bool {
+	bs, err := hex.DecodeString(h)
+	return err == nil && len(bs) == sha256.Size
+}
+
+// writeIpxeBoot writes iPXE commands that fetch and boot kernel and
+// initrds, with the BootFlags and CmdlineViaImgargs of spec.
+// kernelHash and initrdHashes, if set, must have been checked with
+// checkBootHashes.
+func writeIpxeBoot(b *bytes.Buffer, mach Machine, spec *Spec, kernel ID, initrds []ID, kernelHash string, initrdHashes []string, cmdlineTpl, serverURL string, fileURL func(ID) string, userDataURL string) error {
+	mac := url.QueryEscape(mach.MAC.String())
+	fmt.Fprintf(b, "kernel --name kernel %s&type=kernel&mac=%s%s\n", fileURL(kernel), mac, hashHint(kernelHash))
+	for i, initrd := range initrds {
+		var hashes []string
+		if len(initrdHashes) > 0 {
+			n := initrdFiles(initrd)
+			hashes, initrdHashes = initrdHashes[:n], initrdHashes[n:]
+		}
+		fmt.Fprintf(b, "initrd --name initrd%d %s&type=initrd&mac=%s%s\n", i, fileURL(initrd), mac, hashHint(hashes...))
+	}
+
+	fmt.Fprintf(b, "imgfetch --name ready %s/_/booting?mac=%s ||\n", serverURL, url.QueryEscape(mach.MAC.String()))
+	b.WriteString("imgfree ready ||\n")
+
 	f := func(id string) string {
-		return fmt.Sprintf("http://%s/_/file?name=%s", serverHost, url.QueryEscape(id))
+		return fileURL(ID(id))
 	}
-	cmdline, err := expandCmdline(spec.Cmdline, template.FuncMap{"ID": f})
+	funcs := machineFuncs(mach)
+	funcs["ID"] = f
+	funcs["USERDATA"] = func() string { return userDataURL }
+	cmdline, err := expandCmdline(cmdlineTpl, funcs)
 	if err != nil {
-		return nil, fmt.Errorf("expanding cmdline %q: %s", spec.Cmdline, err)
+		return fmt.Errorf("expanding cmdline %q: %s", cmdlineTpl, err)
+	}
+
+	boot := "boot "
+	if spec.BootFlags != "" {
+		boot += spec.BootFlags + " "
+	}
+	if spec.CmdlineViaImgargs {
+		b.WriteString("imgargs kernel ")
+	} else {
+		b.WriteString(boot + "kernel ")
+	}
+	for i := range initrds {
+		fmt.Fprintf(b, "initrd=initrd%d ", i)
 	}
 	b.WriteString(cmdline)
 	b.WriteByte('\n')
-
-	return b.Bytes(), nil
+	if spec.CmdlineViaImgargs {
+		b.WriteString(boot + "kernel\n")
+	}
+	return nil
 }
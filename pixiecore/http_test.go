@@ -16,13 +16,22 @@ package pixiecore
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 type booterFunc func(Machine) (*Spec, error)
@@ -103,6 +112,31 @@ boot kernel initrd=initrd0 initrd=initrd1 thing=http://localhost:1234/_/file?nam
 		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
 	}
 
+	// ARM64 boot
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/ipxe?mac=fe:fe:fe:fe:fe:fe&arch=11", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+
+	expected = `#!ipxe
+kernel --name kernel http://localhost:1234/_/file?name=k-fe%3Afe%3Afe%3Afe%3Afe%3Afe-11&type=kernel&mac=fe%3Afe%3Afe%3Afe%3Afe%3Afe
+initrd --name initrd0 http://localhost:1234/_/file?name=i1-fe%3Afe%3Afe%3Afe%3Afe%3Afe-11&type=initrd&mac=fe%3Afe%3Afe%3Afe%3Afe%3Afe
+initrd --name initrd1 http://localhost:1234/_/file?name=i2-fe%3Afe%3Afe%3Afe%3Afe%3Afe-11&type=initrd&mac=fe%3Afe%3Afe%3Afe%3Afe%3Afe
+imgfetch --name ready http://localhost:1234/_/booting?mac=fe%3Afe%3Afe%3Afe%3Afe%3Afe ||
+imgfree ready ||
+boot kernel initrd=initrd0 initrd=initrd1 thing=http://localhost:1234/_/file?name=f-fe%3Afe%3Afe%3Afe%3Afe%3Afe-11 foo=bar
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
 	// Invalid requests
 	for _, url := range []string{
 		"/_/ipxe?mac=any&arch=1",
@@ -150,51 +184,1543 @@ boot kernel initrd=initrd0 initrd=initrd1 thing=http://localhost:1234/_/file?nam
 	}
 }
 
-type readBootFile string
+func TestIpxeClientClasses(t *testing.T) {
+	var got Machine
+	booter := func(m Machine) (*Spec, error) {
+		got = m
+		return &Spec{Kernel: ID("k")}, nil
+	}
+	s := &Server{
+		Booter: booterFunc(booter),
+		events: make(map[string][]machineEvent),
+	}
 
-func (b readBootFile) BootSpec(m Machine) (*Spec, error) { return nil, nil }
-func (b readBootFile) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
-	d := fmt.Sprintf("%s %s", id, b)
-	return ioutil.NopCloser(bytes.NewBuffer([]byte(d))), int64(len(d)), nil
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0&userclass=iPXE&vendorclass=PXEClient%3AArch%3A00000&clientid=0101020304", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	s.handleIpxe(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	if got.UserClass != "iPXE" {
+		t.Fatalf("Booter got user class %q, expected %q", got.UserClass, "iPXE")
+	}
+	if got.VendorClass != "PXEClient:Arch:00000" {
+		t.Fatalf("Booter got vendor class %q, expected %q", got.VendorClass, "PXEClient:Arch:00000")
+	}
+	if !bytes.Equal(got.ClientID, []byte{1, 1, 2, 3, 4}) {
+		t.Fatalf("Booter got client identifier %x, expected 0101020304", got.ClientID)
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0&clientid=zz", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	s.handleIpxe(rr, req)
+
+	if rr.Code != 400 {
+		t.Fatalf("Got HTTP %d from request with a malformed client identifier, expected 400", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0&guid=4c4c4544-004b-1080-8034-b6c04f393832", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	s.handleIpxe(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	wantGUID := []byte{0x4c, 0x4c, 0x45, 0x44, 0x00, 0x4b, 0x10, 0x80, 0x80, 0x34, 0xb6, 0xc0, 0x4f, 0x39, 0x38, 0x32}
+	if !bytes.Equal(got.GUID, wantGUID) {
+		t.Fatalf("Booter got GUID %x, expected %x", got.GUID, wantGUID)
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0&guid=0102", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	s.handleIpxe(rr, req)
+
+	if rr.Code != 400 {
+		t.Fatalf("Got HTTP %d from request with a short GUID, expected 400", rr.Code)
+	}
 }
-func (b readBootFile) WriteBootFile(id ID, r io.Reader) error { return errors.New("no") }
 
-func TestFile(t *testing.T) {
-	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+func TestIpxeSecureBoot(t *testing.T) {
+	booter := func(m Machine) (*Spec, error) {
+		if m.SecureBoot {
+			return &Spec{Kernel: ID("vmlinuz.signed")}, nil
+		}
+		return &Spec{Kernel: ID("vmlinuz")}, nil
+	}
 	s := &Server{
-		Booter: readBootFile("stuff"),
-		Log:    log,
-		Debug:  log,
+		Booter: booterFunc(booter),
+		events: make(map[string][]machineEvent),
+	}
+
+	for query, expectedKernel := range map[string]string{
+		"":               "name=vmlinuz&",
+		"&secureboot=0":  "name=vmlinuz&",
+		"&secureboot=1":  "name=vmlinuz.signed&",
+		"&secureboot=ok": "",
+	} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1"+query, nil)
+		if err != nil {
+			t.Fatalf("Constructing ipxe request: %s", err)
+		}
+		s.handleIpxe(rr, req)
+
+		if expectedKernel == "" {
+			if rr.Code != 400 {
+				t.Fatalf("Got HTTP %d from request with %q, expected 400", rr.Code, query)
+			}
+			continue
+		}
+		if rr.Code != 200 {
+			t.Fatalf("Got HTTP %d from request with %q, expected 200", rr.Code, query)
+		}
+		if !strings.Contains(rr.Body.String(), expectedKernel) {
+			t.Fatalf("iPXE script for request with %q doesn't boot %q:\n%s", query, expectedKernel, rr.Body.String())
+		}
+	}
+}
+
+func TestIpxeParams(t *testing.T) {
+	var params map[string]string
+	booter := func(m Machine) (*Spec, error) {
+		params = m.Params
+		if m.Params["flow"] == "rescue" {
+			return &Spec{Kernel: ID("rescue")}, nil
+		}
+		return &Spec{Kernel: ID("vmlinuz")}, nil
+	}
+	s := &Server{
+		Booter: booterFunc(booter),
+		events: make(map[string][]machineEvent),
+	}
+
+	for _, test := range []struct {
+		query          string
+		expectedKernel string
+		expectedParams map[string]string
+	}{
+		{"", "name=vmlinuz&", nil},
+		{"&flow=rescue", "name=rescue&", map[string]string{"flow": "rescue"}},
+		{"&flow=install&flow=rescue&disk=sda&secureboot=0", "name=vmlinuz&", map[string]string{"flow": "install", "disk": "sda"}},
+	} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1"+test.query, nil)
+		if err != nil {
+			t.Fatalf("Constructing ipxe request: %s", err)
+		}
+		s.handleIpxe(rr, req)
+
+		if rr.Code != 200 {
+			t.Fatalf("Got HTTP %d from request with %q, expected 200", rr.Code, test.query)
+		}
+		if diff := cmp.Diff(test.expectedParams, params); diff != "" {
+			t.Errorf("Wrong params for request with %q (-want +got):\n%s", test.query, diff)
+		}
+		if !strings.Contains(rr.Body.String(), test.expectedKernel) {
+			t.Fatalf("iPXE script for request with %q doesn't boot %q:\n%s", test.query, test.expectedKernel, rr.Body.String())
+		}
 	}
+}
+
+func TestIpxeFileURLSchemeAndPublicHost(t *testing.T) {
+	booter := func(m Machine) (*Spec, error) {
+		return &Spec{
+			Kernel:  ID("k"),
+			Initrd:  []ID{ID("i")},
+			Cmdline: `thing={{ ID "f" }}`,
+		}, nil
+	}
+	s := &Server{
+		Booter:        booterFunc(booter),
+		FileURLScheme: "https",
+		PublicHost:    "boot.example.com",
+		events:        make(map[string][]machineEvent),
+	}
+
 	rr := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/_/file?name=test", nil)
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1", nil)
 	if err != nil {
-		t.Fatalf("Constructing file request: %s", err)
+		t.Fatalf("Constructing ipxe request: %s", err)
 	}
-	s.handleFile(rr, req)
+	req.Host = "10.0.0.1:8080"
+	s.handleIpxe(rr, req)
 
 	if rr.Code != 200 {
 		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
 	}
 
-	expected := "test stuff"
+	expected := `#!ipxe
+kernel --name kernel https://boot.example.com/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06
+initrd --name initrd0 https://boot.example.com/_/file?name=i&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06
+imgfetch --name ready https://boot.example.com/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot kernel initrd=initrd0 thing=https://boot.example.com/_/file?name=f
+`
 	if rr.Body.String() != expected {
-		t.Fatalf("Wrong file contents, want %q, got %q", expected, rr.Body.Bytes())
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
 	}
+}
 
-	rr = httptest.NewRecorder()
-	req, err = http.NewRequest("GET", "/_/file?name=quux", nil)
+func TestIpxeStructuredLog(t *testing.T) {
+	booter := func(m Machine) (*Spec, error) {
+		return &Spec{Kernel: "k"}, nil
+	}
+	type entry struct {
+		level  string
+		msg    string
+		fields map[string]interface{}
+	}
+	var entries []entry
+	s := &Server{
+		Booter: booterFunc(booter),
+		Log: func(subsystem, msg string) {
+			t.Errorf("Unexpected plain log with StructuredLog set: [%s] %s", subsystem, msg)
+		},
+		StructuredLog: func(level, msg string, fields map[string]interface{}) {
+			entries = append(entries, entry{level, msg, fields})
+		},
+		events: make(map[string][]machineEvent),
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1", nil)
 	if err != nil {
-		t.Fatalf("Constructing file request: %s", err)
+		t.Fatalf("Constructing ipxe request: %s", err)
 	}
-	s.handleFile(rr, req)
+	req.RemoteAddr = "192.168.0.10:4242"
+	s.handleIpxe(rr, req)
 
 	if rr.Code != 200 {
 		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
 	}
 
-	expected = "quux stuff"
-	if rr.Body.String() != expected {
-		t.Fatalf("Wrong file contents, want %q, got %q", expected, rr.Body.Bytes())
+	var sent *entry
+	for i := range entries {
+		if entries[i].level == "info" {
+			sent = &entries[i]
+		}
+	}
+	if sent == nil {
+		t.Fatalf("No info-level log for ipxe request, got %v", entries)
+	}
+	expected := map[string]interface{}{
+		"subsystem":   "HTTP",
+		"boot_id":     rr.Header().Get("X-Pixiecore-Boot-ID"),
+		"mac":         "01:02:03:04:05:06",
+		"arch":        "X64",
+		"remote_addr": "192.168.0.10:4242",
+		"status":      http.StatusOK,
+		"path":        "/_/ipxe",
+	}
+	if diff := cmp.Diff(expected, sent.fields); diff != "" {
+		t.Fatalf("Wrong log fields (-want +got):\n%s", diff)
+	}
+
+	// Errors carry the HTTP status.
+	entries = nil
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=42", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	s.handleIpxe(rr, req)
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry for bad request, got %v", entries)
+	}
+	if entries[0].level != "debug" || entries[0].fields["status"] != http.StatusBadRequest || entries[0].fields["arch"] != "42" {
+		t.Fatalf("Wrong log entry for bad request: %v", entries[0])
+	}
+}
+
+func TestIpxeCaching(t *testing.T) {
+	kernel := ID("k1")
+	entries := 0
+	booter := func(m Machine) (*Spec, error) {
+		spec := &Spec{Kernel: kernel}
+		for i := 0; i < entries; i++ {
+			spec.Menu = append(spec.Menu, MenuEntry{Label: fmt.Sprintf("Entry %d", i), Kernel: kernel})
+		}
+		return spec, nil
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: booterFunc(booter),
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+		if err != nil {
+			t.Fatalf("Constructing ipxe request: %s", err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		s.handleIpxe(rr, req)
+		return rr
+	}
+
+	rr := get(nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("No ETag on ipxe script")
+	}
+	if got := rr.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Fatalf("Wrong Cache-Control, want %q, got %q", "no-cache", got)
+	}
+	if got := get(nil).Header().Get("ETag"); got != etag {
+		t.Fatalf("Identical requests got different ETags %s and %s", etag, got)
+	}
+
+	rr = get(http.Header{"If-None-Match": {etag}})
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("Got HTTP %d for matching If-None-Match, expected 304", rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Fatalf("Unexpected body in 304 response: %q", rr.Body.String())
+	}
+
+	kernel = "k2"
+	rr = get(http.Header{"If-None-Match": {etag}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got HTTP %d after the spec changed, expected 200", rr.Code)
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Fatalf("ETag %s didn't change with the spec", etag)
+	}
+
+	// Large scripts are gzipped for clients that accept it.
+	entries = 100
+	plain := get(nil)
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Script gzipped for a client that doesn't accept it")
+	}
+	rr = get(http.Header{"Accept-Encoding": {"gzip"}})
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Large script not gzipped for a client that accepts it")
+	}
+	if want := "W/" + plain.Header().Get("ETag"); rr.Header().Get("ETag") != want {
+		t.Fatalf("Wrong ETag for gzipped script, want %s, got %s", want, rr.Header().Get("ETag"))
+	}
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("Reading gzipped script: %s", err)
+	}
+	script, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Reading gzipped script: %s", err)
+	}
+	if string(script) != plain.Body.String() {
+		t.Fatalf("Gzipped script differs from the plain one")
+	}
+}
+
+func TestIpxePreamble(t *testing.T) {
+	mach := Machine{MAC: []byte{1, 2, 3, 4, 5, 6}, Arch: ArchX64}
+	spec := &Spec{
+		Kernel:  "k",
+		Initrd:  []ID{"i"},
+		Cmdline: "foo=bar",
+	}
+	withoutPreamble, err := ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+
+	spec.IpxePreamble = []string{}
+	got, err := ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+	if !bytes.Equal(got, withoutPreamble) {
+		t.Fatalf("Empty preamble changed the iPXE script\nwant: %s\ngot:  %s", withoutPreamble, got)
+	}
+
+	spec.IpxePreamble = []string{"set net0/ip 192.168.0.10", `echo "a & b" ${net0/mac}`}
+	got, err = ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+	expected := "#!ipxe\nset net0/ip 192.168.0.10\necho \"a & b\" ${net0/mac}\n" + string(withoutPreamble[len("#!ipxe\n"):])
+	if string(got) != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, got)
+	}
+
+	spec.IpxePreamble = []string{"set foo bar\nshell"}
+	if _, err = ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), ""); err == nil {
+		t.Fatalf("Preamble command with a newline was accepted")
+	}
+}
+
+func TestIpxeBootFlags(t *testing.T) {
+	mach := Machine{MAC: []byte{1, 2, 3, 4, 5, 6}, Arch: ArchX64}
+	spec := &Spec{
+		Kernel:  "k",
+		Initrd:  []ID{"i"},
+		Cmdline: "foo=bar",
+	}
+	fileURLs := (&Server{}).fileURLs("http://localhost:1234")
+	lastLines := func(script []byte, n int) string {
+		lines := strings.Split(strings.TrimSuffix(string(script), "\n"), "\n")
+		return strings.Join(lines[len(lines)-n:], "\n")
+	}
+
+	got, err := ipxeScript(mach, spec, "http://localhost:1234", fileURLs, "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+	if want := "imgfree ready ||\nboot kernel initrd=initrd0 foo=bar"; lastLines(got, 2) != want {
+		t.Fatalf("Wrong default boot line\nwant: %s\ngot:  %s", want, got)
+	}
+
+	spec.BootFlags = "--replace --autofree"
+	got, err = ipxeScript(mach, spec, "http://localhost:1234", fileURLs, "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+	if want := "imgfree ready ||\nboot --replace --autofree kernel initrd=initrd0 foo=bar"; lastLines(got, 2) != want {
+		t.Fatalf("Wrong boot line with flags\nwant: %s\ngot:  %s", want, got)
+	}
+
+	spec.CmdlineViaImgargs = true
+	got, err = ipxeScript(mach, spec, "http://localhost:1234", fileURLs, "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+	if want := "imgfree ready ||\nimgargs kernel initrd=initrd0 foo=bar\nboot --replace --autofree kernel"; lastLines(got, 3) != want {
+		t.Fatalf("Wrong imgargs boot lines\nwant: %s\ngot:  %s", want, got)
+	}
+
+	spec.BootFlags = "--replace\nshell"
+	if _, err = ipxeScript(mach, spec, "http://localhost:1234", fileURLs, ""); err == nil {
+		t.Fatalf("Boot flags with a newline were accepted")
+	}
+	if err := spec.Validate(booterFunc(func(Machine) (*Spec, error) { return nil, nil })); err == nil || !strings.Contains(err.Error(), "boot flags") {
+		t.Fatalf("Spec with boot flags containing a newline validated, got %v", err)
+	}
+}
+
+func TestIpxeMenu(t *testing.T) {
+	mach := Machine{MAC: []byte{1, 2, 3, 4, 5, 6}, Arch: ArchX64}
+	spec := &Spec{
+		Menu: []MenuEntry{
+			{
+				Label:   "Install",
+				Kernel:  "k1",
+				Initrd:  []ID{"i1"},
+				Cmdline: `ks={{ ID "ks" }}`,
+			},
+			{
+				Label:  "Rescue shell",
+				Kernel: "k2",
+			},
+		},
+	}
+	got, err := ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+
+	expected := `#!ipxe
+:menu
+menu Pixiecore boot menu
+item entry0 Install
+item entry1 Rescue shell
+choose target && goto ${target} || exit
+:entry0
+kernel --name kernel http://localhost:1234/_/file?name=k1&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06
+initrd --name initrd0 http://localhost:1234/_/file?name=i1&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06
+imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot kernel initrd=initrd0 ks=http://localhost:1234/_/file?name=ks
+goto menu
+:entry1
+kernel --name kernel http://localhost:1234/_/file?name=k2&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06
+imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot kernel 
+goto menu
+`
+	if string(got) != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, got)
+	}
+
+	spec.Menu[1].Kernel = ""
+	if _, err = ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), ""); err == nil {
+		t.Fatalf("Menu entry without a kernel was accepted")
+	}
+}
+
+func TestIpxeMachineFuncs(t *testing.T) {
+	booter, err := StaticBooter(&Spec{
+		Kernel:  "/kernel",
+		Cmdline: `hostname=node-{{ MAC "-" }} mac={{ MAC }} arch={{ ARCH }} ip={{ IP }} cfg={{ ID "/config" }}`,
+	})
+	if err != nil {
+		t.Fatalf("Creating static booter: %s", err)
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: booter,
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:0a&arch=1", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	req.RemoteAddr = "192.168.0.42:1234"
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+
+	expected := "boot kernel hostname=node-01-02-03-04-05-0a mac=01:02:03:04:05:0a arch=X64 ip=192.168.0.42 cfg=http://localhost:1234/_/file?name=other-0\n"
+	if !strings.HasSuffix(rr.Body.String(), expected) {
+		t.Fatalf("Wrong boot command, want it to end with %q, got:\n%s", expected, rr.Body.String())
+	}
+}
+
+func TestIpxeHashes(t *testing.T) {
+	var (
+		kernelHash = strings.Repeat("ab", 32)
+		initrdHash = strings.Repeat("CD", 32)
+	)
+	mach := Machine{MAC: []byte{1, 2, 3, 4, 5, 6}, Arch: ArchX64}
+	spec := &Spec{
+		Kernel:       "k",
+		Initrd:       []ID{"i1", "i2"},
+		KernelHash:   kernelHash,
+		InitrdHashes: []string{"", initrdHash},
+	}
+	if _, err := ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), ""); err == nil {
+		t.Fatalf("Empty initrd hash was accepted")
+	}
+
+	spec.InitrdHashes = []string{initrdHash, initrdHash}
+	got, err := ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+	expected := `#!ipxe
+kernel --name kernel http://localhost:1234/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06&sha256=abababababababababababababababababababababababababababababababab
+initrd --name initrd0 http://localhost:1234/_/file?name=i1&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06&sha256=cdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcd
+initrd --name initrd1 http://localhost:1234/_/file?name=i2&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06&sha256=cdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcd
+imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot kernel initrd=initrd0 initrd=initrd1 
+`
+	if string(got) != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, got)
+	}
+
+	spec.KernelHash = "abab"
+	if _, err = ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), ""); err == nil {
+		t.Fatalf("Truncated kernel hash was accepted")
+	}
+	spec.KernelHash = ""
+	spec.InitrdHashes = []string{initrdHash}
+	if _, err = ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), ""); err == nil {
+		t.Fatalf("Initrd hashes not matching the initrds were accepted")
+	}
+
+	// Combined initrds are checked part by part.
+	spec = combineInitrds(&Spec{Kernel: "k", Initrd: []ID{"i1", "i2"}, InitrdHashes: []string{initrdHash, kernelHash}})
+	got, err = ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+	if hint := "&sha256=" + strings.ToLower(initrdHash) + "&sha256=" + kernelHash + "\n"; !strings.Contains(string(got), hint) {
+		t.Fatalf("Combined initrd URL lacks the hashes of its parts %q, got:\n%s", hint, got)
+	}
+
+	spec = &Spec{Menu: []MenuEntry{{Label: "a", Kernel: "k", KernelHash: kernelHash}}}
+	got, err = ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), "")
+	if err != nil {
+		t.Fatalf("Building iPXE script: %s", err)
+	}
+	if hint := "&sha256=" + kernelHash + "\n"; !strings.Contains(string(got), hint) {
+		t.Fatalf("Menu entry kernel URL lacks its hash %q, got:\n%s", hint, got)
+	}
+	spec.Menu[0].KernelHash = "abab"
+	if _, err = ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), ""); err == nil {
+		t.Fatalf("Truncated menu entry kernel hash was accepted")
+	}
+}
+
+func TestIpxeIDEscaping(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: readBootFile("stuff"),
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+	mach := Machine{MAC: []byte{1, 2, 3, 4, 5, 6}, Arch: ArchX64}
+
+	for _, id := range []ID{"my kernel", "kernel+1", "ядро ${x}.img", "a&b=c%20"} {
+		spec := &Spec{
+			Kernel:  id,
+			Cmdline: fmt.Sprintf(`file={{ ID %q }}`, id),
+		}
+		script, err := ipxeScript(mach, spec, "http://localhost:1234", (&Server{}).fileURLs("http://localhost:1234"), "")
+		if err != nil {
+			t.Fatalf("Building iPXE script for %q: %s", id, err)
+		}
+
+		var urls []string
+		for _, line := range strings.Split(string(script), "\n") {
+			fs := strings.Fields(line)
+			switch {
+			case len(fs) == 4 && fs[0] == "kernel":
+				urls = append(urls, fs[3])
+			case len(fs) > 0 && fs[0] == "boot":
+				urls = append(urls, strings.TrimPrefix(fs[len(fs)-1], "file="))
+			}
+		}
+		if len(urls) != 2 {
+			t.Fatalf("Couldn't find file URLs for %q in iPXE script:\n%s", id, script)
+		}
+
+		for _, u := range urls {
+			if strings.ContainsAny(u, " +${}") {
+				t.Errorf("URL %q for %q contains characters that need escaping", u, id)
+			}
+			rr := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", u, nil)
+			if err != nil {
+				t.Fatalf("Constructing file request for %q: %s", u, err)
+			}
+			s.handleFile(rr, req)
+
+			if rr.Code != 200 {
+				t.Fatalf("Got HTTP %d from request for %q, expected 200", rr.Code, u)
+			}
+			expected := fmt.Sprintf("%s stuff", id)
+			if rr.Body.String() != expected {
+				t.Errorf("Wrong file contents for %q, want %q, got %q", u, expected, rr.Body.String())
+			}
+		}
+	}
+}
+
+type scriptBooter struct {
+	booterFunc
+}
+
+func (b scriptBooter) IpxeScript(spec *Spec, host string) ([]byte, error) {
+	return []byte(fmt.Sprintf("#!ipxe\nsanboot %s/_/file?name=%s\n", host, spec.Kernel)), nil
+}
+
+func TestIpxeCustomScript(t *testing.T) {
+	booter := func(m Machine) (*Spec, error) {
+		return &Spec{Kernel: "disk.img"}, nil
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: scriptBooter{booterFunc(booter)},
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	expected := "#!ipxe\nsanboot http://localhost:1234/_/file?name=disk.img\n"
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+}
+
+type readBootFile string
+
+func (b readBootFile) BootSpec(m Machine) (*Spec, error) { return nil, nil }
+func (b readBootFile) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	d := fmt.Sprintf("%s %s", id, b)
+	return ioutil.NopCloser(bytes.NewBuffer([]byte(d))), int64(len(d)), nil
+}
+func (b readBootFile) WriteBootFile(id ID, r io.Reader) error { return errors.New("no") }
+
+func TestFile(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: readBootFile("stuff"),
+		Log:    log,
+		Debug:  log,
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/file?name=test", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	s.handleFile(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+
+	expected := "test stuff"
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong file contents, want %q, got %q", expected, rr.Body.Bytes())
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/file?name=quux", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	s.handleFile(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+
+	expected = "quux stuff"
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong file contents, want %q, got %q", expected, rr.Body.Bytes())
+	}
+}
+
+func TestCombinedInitrd(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: readBootFile("stuff"),
+		Log:    log,
+		Debug:  log,
+	}
+	id := CombinedInitrd([]ID{"i1", "i2", "i3"})
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/file?name="+escapeID(id), nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	s.handleFile(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	expected := "i1 stuffi2 stuffi3 stuff"
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong combined initrd, want %q, got %q", expected, rr.Body.Bytes())
+	}
+	if got, want := rr.Header().Get("Content-Length"), strconv.Itoa(len(expected)); got != want {
+		t.Fatalf("Wrong Content-Length, want %s, got %s", want, got)
+	}
+
+	spec := combineInitrds(&Spec{Kernel: "k", Initrd: []ID{"i1", "i2", "i3"}})
+	if len(spec.Initrd) != 1 || spec.Initrd[0] != id {
+		t.Fatalf("Spec initrds not combined, got %q", spec.Initrd)
+	}
+}
+
+// bootIDBooter records the boot ID its BootSpecContext gets.
+type bootIDBooter struct {
+	readBootFile
+	bootID string
+}
+
+func (b *bootIDBooter) BootSpecContext(ctx context.Context, m Machine) (*Spec, error) {
+	b.bootID, _ = BootIDFromContext(ctx)
+	return &Spec{Kernel: "k"}, nil
+}
+
+func TestBootIDCorrelatesRequests(t *testing.T) {
+	var logged []string
+	booter := &bootIDBooter{readBootFile: "stuff"}
+	s := &Server{
+		Booter: booter,
+		StructuredLog: func(level, msg string, fields map[string]interface{}) {
+			if id, ok := fields["boot_id"].(string); ok {
+				logged = append(logged, id)
+			}
+		},
+		events: make(map[string][]machineEvent),
+	}
+
+	get := func(handler http.HandlerFunc, url string) string {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatalf("Constructing request: %s", err)
+		}
+		handler(rr, req)
+		if rr.Code != 200 {
+			t.Fatalf("Got HTTP %d from %s, expected 200", rr.Code, url)
+		}
+		return rr.Header().Get("X-Pixiecore-Boot-ID")
+	}
+
+	bootID := get(s.handleIpxe, "/_/ipxe?mac=01:02:03:04:05:06&arch=0")
+	if bootID == "" {
+		t.Fatalf("No boot ID in ipxe response")
+	}
+	if booter.bootID != bootID {
+		t.Fatalf("Booter got boot ID %q, want %q", booter.bootID, bootID)
+	}
+	if got := get(s.handleFile, "/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06"); got != bootID {
+		t.Fatalf("File request got boot ID %q, want %q", got, bootID)
+	}
+	if len(logged) == 0 {
+		t.Fatalf("No log entries carry the boot ID")
+	}
+	for _, id := range logged {
+		if id != bootID {
+			t.Fatalf("Log entry has boot ID %q, want %q", id, bootID)
+		}
+	}
+
+	if other := get(s.handleIpxe, "/_/ipxe?mac=fe:fe:fe:fe:fe:fe&arch=0"); other == bootID {
+		t.Fatalf("Different machines got the same boot ID %q", bootID)
+	}
+
+	// Requests after the window are a new boot.
+	now := time.Now().Add(bootIDWindow)
+	s.bootIDs.timeNow = func() time.Time { return now }
+	if got := get(s.handleIpxe, "/_/ipxe?mac=01:02:03:04:05:06&arch=0"); got == bootID {
+		t.Fatalf("Boot ID %q was reused after the boot ID window", bootID)
+	}
+}
+
+func TestClients(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter:            &bootIDBooter{readBootFile: "stuff"},
+		Log:               log,
+		Debug:             log,
+		ClientHistorySize: 2,
+		events:            make(map[string][]machineEvent),
+	}
+	handler := s.Handler()
+	get := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatalf("Constructing request: %s", err)
+		}
+		handler.ServeHTTP(rr, req)
+		if rr.Code != 200 {
+			t.Fatalf("Got HTTP %d from %s, expected 200", rr.Code, url)
+		}
+		return rr
+	}
+	clients := func() []clientRecord {
+		var ret []clientRecord
+		if err := json.Unmarshal(get("/_/clients").Body.Bytes(), &ret); err != nil {
+			t.Fatalf("Decoding client list: %s", err)
+		}
+		for i := range ret {
+			ret[i].Timestamp = time.Time{}
+		}
+		return ret
+	}
+
+	if got := clients(); len(got) != 0 {
+		t.Fatalf("Expected no clients before any boot, got %v", got)
+	}
+
+	get("/_/ipxe?mac=01:02:03:04:05:06&arch=0&flow=rescue")
+	get("/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06")
+	expected := []clientRecord{
+		{
+			MAC:      "01:02:03:04:05:06",
+			Arch:     "IA32",
+			Params:   map[string]string{"flow": "rescue"},
+			Spec:     clientSpec{Kernel: "k"},
+			LastFile: "k",
+		},
+	}
+	if diff := cmp.Diff(expected, clients()); diff != "" {
+		t.Fatalf("Wrong client list (-want +got):\n%s", diff)
+	}
+
+	// The history is capped, most recent boot first.
+	get("/_/ipxe?mac=fe:fe:fe:fe:fe:fe&arch=0")
+	get("/_/ipxe?mac=aa:aa:aa:aa:aa:aa&arch=0")
+	var macs []string
+	for _, c := range clients() {
+		macs = append(macs, c.MAC)
+	}
+	if diff := cmp.Diff([]string{"aa:aa:aa:aa:aa:aa", "fe:fe:fe:fe:fe:fe"}, macs); diff != "" {
+		t.Fatalf("Wrong clients after exceeding history size (-want +got):\n%s", diff)
+	}
+}
+
+type statBootFile struct {
+	readBootFile
+	modTime time.Time
+}
+
+func (b statBootFile) Stat(id ID) (int64, time.Time, error) {
+	return int64(len(id) + 1 + len(b.readBootFile)), b.modTime, nil
+}
+
+func TestFileNotModified(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	modTime := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	s := &Server{
+		Booter: statBootFile{readBootFile("stuff"), modTime},
+		Log:    log,
+		Debug:  log,
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/file?name=test", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	s.handleFile(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	if rr.Body.String() != "test stuff" {
+		t.Fatalf("Wrong file contents, want %q, got %q", "test stuff", rr.Body.Bytes())
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("Response has no ETag")
+	}
+	if got := rr.Header().Get("Last-Modified"); got != "Mon, 01 Aug 2016 12:00:00 GMT" {
+		t.Fatalf("Wrong Last-Modified, want %q, got %q", "Mon, 01 Aug 2016 12:00:00 GMT", got)
+	}
+
+	tests := []struct {
+		header string
+		value  string
+		code   int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other", ` + etag, http.StatusNotModified},
+		{"If-None-Match", "W/" + etag, http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", "Mon, 01 Aug 2016 12:00:00 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Tue, 02 Aug 2016 12:00:00 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Sun, 31 Jul 2016 12:00:00 GMT", http.StatusOK},
+		{"If-Modified-Since", "garbage", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		rr = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/_/file?name=test", nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		req.Header.Set(test.header, test.value)
+		s.handleFile(rr, req)
+
+		if rr.Code != test.code {
+			t.Errorf("%s: %s: got HTTP %d, expected %d", test.header, test.value, rr.Code, test.code)
+			continue
+		}
+		if test.code == http.StatusNotModified && rr.Body.Len() != 0 {
+			t.Errorf("%s: %s: 304 response has a body: %q", test.header, test.value, rr.Body.Bytes())
+		}
+	}
+
+	// Files without a modification time, like those in an embed.FS,
+	// can't be told apart from a same-size replacement, and must be
+	// sent in full every time.
+	s.Booter = statBootFile{readBootFile("stuff"), time.Time{}}
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/file?name=test", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	s.handleFile(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("File without a modification time got HTTP %d, expected 200", rr.Code)
+	}
+	if got := rr.Header().Get("ETag"); got != "" {
+		t.Errorf("File without a modification time got ETag %q", got)
+	}
+}
+
+type seekBootFile []byte
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func (b seekBootFile) BootSpec(m Machine) (*Spec, error) { return nil, nil }
+func (b seekBootFile) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	return nopSeekCloser{bytes.NewReader(b)}, int64(len(b)), nil
+}
+func (b seekBootFile) WriteBootFile(id ID, r io.Reader) error { return errors.New("no") }
+
+func TestFileRange(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	contents := make([]byte, 1000)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	s := &Server{
+		Booter: seekBootFile(contents),
+		Log:    log,
+		Debug:  log,
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/file?name=test", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	req.Header.Set("Range", "bytes=100-199")
+	s.handleFile(rr, req)
+
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("Got HTTP %d from request, expected %d", rr.Code, http.StatusPartialContent)
+	}
+	if got := rr.Header().Get("Content-Range"); got != "bytes 100-199/1000" {
+		t.Fatalf("Wrong Content-Range, want %q, got %q", "bytes 100-199/1000", got)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), contents[100:200]) {
+		t.Fatalf("Wrong file contents, want %v, got %v", contents[100:200], rr.Body.Bytes())
+	}
+
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/file?name=test", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	s.handleFile(rr, req)
+
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), contents) {
+		t.Fatalf("Wrong file contents for full request")
+	}
+}
+
+type completedBooter struct {
+	seekBootFile
+	completed []string
+}
+
+func (b *completedBooter) BootCompleted(mac net.HardwareAddr, id ID) {
+	b.completed = append(b.completed, fmt.Sprintf("%s %s", mac, id))
+}
+
+func TestFileBootCompleted(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	booter := &completedBooter{seekBootFile: seekBootFile("kernel contents")}
+	s := &Server{
+		Booter: booter,
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		rnge   string
+	}{
+		{"GET", "/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06", ""},
+		{"GET", "/_/file?name=i&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06", ""},
+		// Not reported: partial downloads, HEAD requests, and fetches
+		// that don't identify the machine.
+		{"GET", "/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06", "bytes=0-3"},
+		{"HEAD", "/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06", ""},
+		{"GET", "/_/file?name=k&type=kernel", ""},
+		{"GET", "/_/file?name=k", ""},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		if test.rnge != "" {
+			req.Header.Set("Range", test.rnge)
+		}
+		s.handleFile(rr, req)
+		if rr.Code != http.StatusOK && rr.Code != http.StatusPartialContent {
+			t.Fatalf("%s %s: got HTTP %d", test.method, test.url, rr.Code)
+		}
+	}
+
+	want := []string{"01:02:03:04:05:06 k", "01:02:03:04:05:06 i"}
+	if diff := cmp.Diff(want, booter.completed); diff != "" {
+		t.Fatalf("Wrong completed boot files (-want +got):\n%s", diff)
+	}
+}
+
+func TestFileCompression(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	contents := bytes.Repeat([]byte("uncompressed initrd "), 100)
+	gzipped := append([]byte{0x1f, 0x8b}, contents...)
+
+	tests := []struct {
+		booter         Booter
+		acceptEncoding string
+		rnge           string
+		compressed     bool
+		want           []byte
+	}{
+		{seekBootFile(contents), "gzip", "", true, contents},
+		{readBootFile("stuff"), "deflate, gzip;q=0.5", "", true, []byte("test stuff")},
+		{seekBootFile(contents), "", "", false, contents},
+		{seekBootFile(contents), "gzip;q=0", "", false, contents},
+		{seekBootFile(contents), "gzip", "bytes=0-9", false, contents[:10]},
+		{seekBootFile(gzipped), "gzip", "", false, gzipped},
+	}
+
+	for _, test := range tests {
+		s := &Server{
+			Booter:        test.booter,
+			Log:           log,
+			Debug:         log,
+			CompressFiles: true,
+		}
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/file?name=test", nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		if test.rnge != "" {
+			req.Header.Set("Range", test.rnge)
+		}
+		s.handleFile(rr, req)
+
+		if rr.Code != http.StatusOK && rr.Code != http.StatusPartialContent {
+			t.Fatalf("Accept-Encoding %q, Range %q: got HTTP %d", test.acceptEncoding, test.rnge, rr.Code)
+		}
+		body := rr.Body.Bytes()
+		if test.compressed {
+			if got := rr.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("Accept-Encoding %q: wrong Content-Encoding, want %q, got %q", test.acceptEncoding, "gzip", got)
+			}
+			gz, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatalf("Accept-Encoding %q: response isn't gzipped: %s", test.acceptEncoding, err)
+			}
+			if body, err = ioutil.ReadAll(gz); err != nil {
+				t.Fatalf("Accept-Encoding %q: decompressing response: %s", test.acceptEncoding, err)
+			}
+		} else if got := rr.Header().Get("Content-Encoding"); got != "" {
+			t.Fatalf("Accept-Encoding %q, Range %q: unexpected Content-Encoding %q", test.acceptEncoding, test.rnge, got)
+		}
+		if !bytes.Equal(body, test.want) {
+			t.Fatalf("Accept-Encoding %q, Range %q: wrong file contents, want %q, got %q", test.acceptEncoding, test.rnge, test.want, body)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	booter := func(m Machine) (*Spec, error) {
+		return &Spec{Kernel: "k"}, nil
+	}
+	s := &Server{
+		Booter: booterFunc(booter),
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+
+	status := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "all good")
+	})
+	if err := s.Handle("/status", status); err != nil {
+		t.Fatalf("Registering /status: %s", err)
+	}
+	for _, pattern := range []string{"/_/ipxe", "/_/", "/_", "example.com/_/file", "/status", "status"} {
+		if err := s.Handle(pattern, status); err == nil {
+			t.Fatalf("Expected an error registering %q", pattern)
+		}
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatalf("Fetching /status: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "all good" {
+		t.Fatalf("Wrong /status response, got HTTP %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(srv.URL + "/_/ipxe?mac=01:02:03:04:05:06&arch=0")
+	if err != nil {
+		t.Fatalf("Fetching /_/ipxe: %s", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "#!ipxe\n") {
+		t.Fatalf("Wrong /_/ipxe response, got HTTP %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestIpxeCanceledBootSpec(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	unblock := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer api.Close()
+	defer close(unblock)
+
+	booter, err := APIBooter(api.URL, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create API booter: %s", err)
+	}
+	s := &Server{
+		Booter: booter,
+		Log:    log,
+		Debug:  log,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		s.handleIpxe(rr, req)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handleIpxe didn't return after the request was canceled")
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("Got HTTP %d from canceled request, expected %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestFileSignedURL(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter:     readBootFile("stuff"),
+		Log:        log,
+		Debug:      log,
+		FileURLKey: []byte("0123456789abcdef0123456789abcdef"),
+		events:     make(map[string][]machineEvent),
+	}
+
+	script, err := ipxeScript(Machine{MAC: mustMAC("01:02:03:04:05:06")}, &Spec{Kernel: "k"}, "http://localhost:1234",
+		s.fileURLs("http://localhost:1234"), "")
+	if err != nil {
+		t.Fatalf("Building ipxe script: %s", err)
+	}
+	fields := strings.Fields(strings.Split(string(script), "\n")[1])
+	kernelURL := strings.TrimPrefix(fields[len(fields)-1], "http://localhost:1234")
+	if !strings.Contains(kernelURL, "&sig=") {
+		t.Fatalf("Kernel URL %q isn't signed", kernelURL)
+	}
+
+	expired := "/_/file?name=k&sig=" + signFileName("k", time.Now().Add(-time.Minute), s.FileURLKey)
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{kernelURL, http.StatusOK},
+		{"/_/file?name=k", http.StatusForbidden},
+		{strings.Replace(kernelURL, "name=k", "name=other", 1), http.StatusForbidden},
+		{expired, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		s.handleFile(rr, req)
+		if rr.Code != test.code {
+			t.Errorf("%s: got HTTP %d, expected %d", test.url, rr.Code, test.code)
+		}
+	}
+}
+
+func TestFileErrorStatus(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+	booter, err := ProxyBooter(&Spec{Kernel: "k"}, upstream.URL, nil, nil)
+	if err != nil {
+		t.Fatalf("Constructing ProxyBooter: %s", err)
+	}
+	s := &Server{
+		Booter: booter,
+		Log:    log,
+		Debug:  log,
+	}
+
+	for name, code := range map[string]int{"missing": http.StatusNotFound, "broken": http.StatusBadGateway} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/file?name="+name, nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		s.handleFile(rr, req)
+		if rr.Code != code {
+			t.Errorf("%s: got HTTP %d, expected %d", name, rr.Code, code)
+		}
+	}
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	s := &Server{}
+	srv := s.httpServer(s.Handler())
+	if srv.ReadTimeout != defaultHTTPReadTimeout || srv.WriteTimeout != defaultHTTPWriteTimeout || srv.IdleTimeout != defaultHTTPIdleTimeout {
+		t.Errorf("Expected default timeouts, got read %s, write %s, idle %s", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	s = &Server{
+		HTTPReadTimeout:  time.Second,
+		HTTPWriteTimeout: 2 * time.Second,
+		HTTPIdleTimeout:  -1,
+	}
+	srv = s.httpServer(s.Handler())
+	if srv.ReadTimeout != time.Second || srv.WriteTimeout != 2*time.Second || srv.IdleTimeout != 0 {
+		t.Errorf("Expected timeouts 1s, 2s and none, got read %s, write %s, idle %s", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
+
+// slowFileBooter serves files that take 5*delay to read.
+type slowFileBooter struct {
+	booterFunc
+	delay time.Duration
+}
+
+type slowReader struct {
+	chunks int
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if r.chunks == 0 {
+		return 0, io.EOF
+	}
+	r.chunks--
+	time.Sleep(r.delay)
+	if len(b) > 8192 {
+		b = b[:8192]
+	}
+	return len(b), nil
+}
+
+func (b slowFileBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	return ioutil.NopCloser(&slowReader{5, b.delay}), -1, nil
+}
+
+func TestHTTPWriteTimeoutSparesSlowFiles(t *testing.T) {
+	s := &Server{
+		Booter:           slowFileBooter{delay: 50 * time.Millisecond},
+		HTTPWriteTimeout: 100 * time.Millisecond,
+		events:           make(map[string][]machineEvent),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveHTTP(l, s.httpServer(s.Handler()))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/_/file?name=slow", l.Addr()))
+	if err != nil {
+		t.Fatalf("Fetching file: %s", err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading file: %s", err)
+	}
+	if len(bs) != 5*8192 {
+		t.Fatalf("Expected %d bytes, got %d", 5*8192, len(bs))
+	}
+}
+
+type userDataBooter struct {
+	booterFunc
+	userData map[string]string
+}
+
+func (b userDataBooter) UserData(m Machine) (io.ReadCloser, string, error) {
+	data, ok := b.userData[m.MAC.String()]
+	if !ok {
+		return nil, "", nil
+	}
+	return ioutil.NopCloser(strings.NewReader(data)), "text/cloud-config", nil
+}
+
+func TestUserData(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: userDataBooter{
+			userData: map[string]string{
+				"01:02:03:04:05:06": "#cloud-config\nhostname: first\n",
+				"01:02:03:04:05:07": "#cloud-config\nhostname: second\n",
+			},
+		},
+		Log:   log,
+		Debug: log,
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/userdata?"+query, nil)
+		if err != nil {
+			t.Fatalf("Constructing user-data request: %s", err)
+		}
+		s.handleUserData(rr, req)
+		return rr
+	}
+
+	rr := get("mac=01:02:03:04:05:07")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got HTTP %d for a machine with user-data, expected 200", rr.Code)
+	}
+	if got, want := rr.Body.String(), "#cloud-config\nhostname: second\n"; got != want {
+		t.Errorf("Wrong user-data\nwant: %q\ngot:  %q", want, got)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/cloud-config" {
+		t.Errorf("Got Content-Type %q, expected %q", ct, "text/cloud-config")
+	}
+
+	for query, code := range map[string]int{
+		"mac=01:02:03:04:05:08":        http.StatusNotFound,
+		"":                             http.StatusBadRequest,
+		"mac=bogus":                    http.StatusBadRequest,
+		"mac=01:02:03:04:05:06&arch=x": http.StatusBadRequest,
+	} {
+		if rr := get(query); rr.Code != code {
+			t.Errorf("Got HTTP %d for query %q, expected %d", rr.Code, query, code)
+		}
+	}
+
+	s.Booter = readBootFile("stuff")
+	if rr := get("mac=01:02:03:04:05:06"); rr.Code != http.StatusNotFound {
+		t.Errorf("Got HTTP %d from a booter without user-data, expected 404", rr.Code)
+	}
+}
+
+func TestUserDataSigned(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: userDataBooter{
+			userData: map[string]string{
+				"01:02:03:04:05:06": "#cloud-config\nhostname: first\n",
+				"01:02:03:04:05:07": "#cloud-config\nhostname: second\n",
+			},
+		},
+		Log:        log,
+		Debug:      log,
+		FileURLKey: []byte("0123456789abcdef0123456789abcdef"),
+	}
+	get := func(uri string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatalf("Constructing user-data request: %s", err)
+		}
+		s.handleUserData(rr, req)
+		return rr.Code
+	}
+
+	mach := Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: ArchX64}
+	spec := &Spec{Kernel: "k", Cmdline: "cloud-config-url={{ USERDATA }}"}
+	script, err := ipxeScript(mach, spec, "http://localhost:1234", s.fileURLs("http://localhost:1234"), s.userDataURL("http://localhost:1234", mach))
+	if err != nil {
+		t.Fatalf("Building ipxe script: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(script)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	userDataURL := strings.TrimPrefix(fields[len(fields)-1], "cloud-config-url=http://localhost:1234")
+	if !strings.HasPrefix(userDataURL, "/_/userdata?mac=01%3A02%3A03%3A04%3A05%3A06&arch=1&sig=") {
+		t.Fatalf("Wrong user-data URL %q in script:\n%s", userDataURL, script)
+	}
+
+	if code := get(userDataURL); code != http.StatusOK {
+		t.Errorf("Got HTTP %d for the signed user-data URL, expected 200", code)
+	}
+	sig := userDataURL[strings.Index(userDataURL, "&sig="):]
+	for _, uri := range []string{
+		"/_/userdata?mac=01:02:03:04:05:06",
+		"/_/userdata?mac=01:02:03:04:05:06&sig=bogus",
+		"/_/userdata?mac=01:02:03:04:05:07" + sig,
+	} {
+		if code := get(uri); code != http.StatusForbidden {
+			t.Errorf("Got HTTP %d for %q, expected 403", code, uri)
+		}
+	}
+}
+
+func TestUserDataRateLimit(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: userDataBooter{
+			userData: map[string]string{"01:02:03:04:05:06": "#cloud-config\n"},
+		},
+		Log:   log,
+		Debug: log,
+	}
+	s.SetRateLimit(0.001, 1)
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/userdata?mac=01:02:03:04:05:06", nil)
+		if err != nil {
+			t.Fatalf("Constructing user-data request: %s", err)
+		}
+		s.handleUserData(rr, req)
+		if rr.Code != want {
+			t.Errorf("Request %d: got HTTP %d, expected %d", i, rr.Code, want)
+		}
 	}
 }
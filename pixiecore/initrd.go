@@ -0,0 +1,143 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// combinedInitrdPrefix starts the IDs of the initrds that Pixiecore
+// assembles from other boot files.
+const combinedInitrdPrefix = "pixiecore-combined-initrd:"
+
+// CombinedInitrd returns the ID of a boot file that is the
+// concatenation of initrds, in order. The Linux kernel unpacks every
+// cpio archive in a concatenated initrd, so it boots the same way as
+// the separate initrds, on clients that can only load one file.
+func CombinedInitrd(initrds []ID) ID {
+	bs, err := json.Marshal(initrds)
+	if err != nil {
+		// Marshaling a slice of strings can't fail.
+		panic(err)
+	}
+	return ID(combinedInitrdPrefix + base64.RawURLEncoding.EncodeToString(bs))
+}
+
+// parseCombinedInitrd returns the initrds that make up id, or false
+// if id isn't a combined initrd.
+func parseCombinedInitrd(id ID) ([]ID, bool) {
+	if !strings.HasPrefix(string(id), combinedInitrdPrefix) {
+		return nil, false
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(string(id[len(combinedInitrdPrefix):]))
+	if err != nil {
+		return nil, false
+	}
+	var initrds []ID
+	if err := json.Unmarshal(bs, &initrds); err != nil || len(initrds) == 0 {
+		return nil, false
+	}
+	return initrds, true
+}
+
+// initrdFiles returns how many files make up the initrd id, more than
+// one for combined initrds.
+func initrdFiles(id ID) int {
+	if initrds, ok := parseCombinedInitrd(id); ok {
+		return len(initrds)
+	}
+	return 1
+}
+
+// combineInitrds returns a copy of spec that boots with a single
+// combined initrd, or spec itself if it has nothing to combine. The
+// initrd hashes stay those of the parts, which are checked one by one
+// when the combined initrd is served.
+func combineInitrds(spec *Spec) *Spec {
+	ret := *spec
+	if len(spec.Initrd) > 1 {
+		ret.Initrd = []ID{CombinedInitrd(spec.Initrd)}
+	}
+	if len(spec.Menu) > 0 {
+		ret.Menu = make([]MenuEntry, len(spec.Menu))
+		for i, entry := range spec.Menu {
+			if len(entry.Initrd) > 1 {
+				entry.Initrd = []ID{CombinedInitrd(entry.Initrd)}
+			}
+			ret.Menu[i] = entry
+		}
+	}
+	return &ret
+}
+
+// readBootFile reads id from the Booter, assembling combined initrds
+// from their parts. If hashes are given, one per file that id is made
+// of, reads fail at the end of a file that doesn't match its SHA-256
+// digest.
+func (s *Server) readBootFile(id ID, hashes [][]byte) (io.ReadCloser, int64, error) {
+	initrds, ok := parseCombinedInitrd(id)
+	if !ok {
+		f, sz, err := s.Booter.ReadBootFile(id)
+		if err != nil || len(hashes) == 0 {
+			return f, sz, err
+		}
+		return &hashCheckedFile{newHashCheckingReader(f, hashes[0]), f}, sz, nil
+	}
+
+	ret := &concatenatedFile{}
+	var size int64
+	for _, initrd := range initrds {
+		f, sz, err := s.Booter.ReadBootFile(initrd)
+		if err != nil {
+			ret.Close()
+			return nil, -1, fmt.Errorf("reading initrd %q: %w", initrd, err)
+		}
+		ret.files = append(ret.files, f)
+		if sz < 0 || size < 0 {
+			size = -1
+		} else {
+			size += sz
+		}
+	}
+	readers := make([]io.Reader, len(ret.files))
+	for i, f := range ret.files {
+		readers[i] = f
+		if len(hashes) > 0 {
+			readers[i] = newHashCheckingReader(f, hashes[i])
+		}
+	}
+	ret.Reader = io.MultiReader(readers...)
+	return ret, size, nil
+}
+
+// concatenatedFile reads several files one after the other.
+type concatenatedFile struct {
+	io.Reader
+	files []io.ReadCloser
+}
+
+func (f *concatenatedFile) Close() error {
+	var ret error
+	for _, file := range f.files {
+		if err := file.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
@@ -18,6 +18,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net"
+	"net/http"
 	"time"
 )
 
@@ -81,6 +82,10 @@ func (s *Server) machineEvent(mac net.HardwareAddr, state machineState, format s
 
 	s.eventsMu.Lock()
 	defer s.eventsMu.Unlock()
+	if s.events == nil {
+		// Handler used without ServeContext.
+		s.events = make(map[string][]machineEvent)
+	}
 	s.events[k] = append(s.events[k], evt)
 	if len(s.events[k]) > savedEventsPerMachine {
 		s.events[k] = s.events[k][len(s.events[k])-savedEventsPerMachine:]
@@ -107,3 +112,59 @@ func (s *Server) debugPacket(subsystem string, layer int, packet []byte) {
 	}
 	s.Debug(subsystem, fmt.Sprintf("PKT %d %s END", layer, base64.StdEncoding.EncodeToString(packet)))
 }
+
+// Levels passed to Server.StructuredLog.
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+)
+
+type logFields map[string]interface{}
+
+// logHTTP logs an event about the HTTP request r. If StructuredLog is
+// set, it gets the message along with fields describing the request,
+// otherwise the message goes to Log or Debug. Messages about requests
+// from a booting machine carry its boot ID.
+func (s *Server) logHTTP(level string, r *http.Request, fields logFields, format string, args ...interface{}) {
+	bootID, hasBootID := BootIDFromContext(r.Context())
+	if s.StructuredLog == nil {
+		if hasBootID {
+			format = "[boot %s] " + format
+			args = append([]interface{}{bootID}, args...)
+		}
+		if level == logLevelDebug {
+			s.debug("HTTP", format, args...)
+		} else {
+			s.log("HTTP", format, args...)
+		}
+		return
+	}
+
+	all := map[string]interface{}{
+		"subsystem":   "HTTP",
+		"remote_addr": r.RemoteAddr,
+		"path":        r.URL.Path,
+	}
+	if hasBootID {
+		all["boot_id"] = bootID
+	}
+	for k, v := range fields {
+		all[k] = v
+	}
+	s.StructuredLog(level, fmt.Sprintf(format, args...), all)
+}
+
+// httpError replies to r with an HTTP error, and logs it. Server
+// errors are logged at info level, client errors at debug level.
+func (s *Server) httpError(w http.ResponseWriter, r *http.Request, status int, fields logFields, errMsg string, format string, args ...interface{}) {
+	withStatus := logFields{"status": status}
+	for k, v := range fields {
+		withStatus[k] = v
+	}
+	level := logLevelDebug
+	if status >= 500 {
+		level = logLevelInfo
+	}
+	s.logHTTP(level, r, withStatus, format, args...)
+	http.Error(w, errMsg, status)
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of HTTP boot requests, as reported in metrics.
+const (
+	outcomeSuccess  = "success"
+	outcomeNotFound = "not-found"
+	outcomeError    = "error"
+)
+
+type metrics struct {
+	ipxeRequests *prometheus.CounterVec
+	fileRequests *prometheus.CounterVec
+	fileDuration prometheus.Histogram
+	fileBytes    prometheus.Counter
+}
+
+func newMetrics(reg *prometheus.Registry) *metrics {
+	m := &metrics{
+		ipxeRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pixiecore",
+			Name:      "ipxe_requests_total",
+			Help:      "iPXE boot script requests, by architecture and outcome.",
+		}, []string{"arch", "outcome"}),
+		fileRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pixiecore",
+			Name:      "file_requests_total",
+			Help:      "Boot file requests, by outcome.",
+		}, []string{"outcome"}),
+		fileDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "pixiecore",
+			Name:      "file_duration_seconds",
+			Help:      "Time taken to serve boot files.",
+			// Boot files range from tiny scripts to initrds of
+			// hundreds of megabytes over slow links.
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		}),
+		fileBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "pixiecore",
+			Name:      "file_bytes_total",
+			Help:      "Bytes of boot files sent to clients.",
+		}),
+	}
+	reg.MustRegister(m.ipxeRequests, m.fileRequests, m.fileDuration, m.fileBytes)
+	return m
+}
+
+// instrumentIpxe wraps handleIpxe to count requests by architecture
+// and outcome.
+func (m *metrics) instrumentIpxe(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		h(rec, r)
+
+		// Only label with known architectures, to keep the number of
+		// metric series bounded.
+		arch := "unknown"
+		if i, err := strconv.Atoi(r.URL.Query().Get("arch")); err == nil {
+			switch a := Architecture(i); a {
+			case ArchIA32, ArchX64, ArchArm32, ArchArm64:
+				arch = a.String()
+			}
+		}
+		m.ipxeRequests.WithLabelValues(arch, rec.outcome()).Inc()
+	}
+}
+
+// instrumentFile wraps handleFile to count requests by outcome, and
+// measure the time taken and bytes sent.
+func (m *metrics) instrumentFile(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		h(rec, r)
+
+		outcome := rec.outcome()
+		m.fileRequests.WithLabelValues(outcome).Inc()
+		if outcome == outcomeSuccess {
+			m.fileDuration.Observe(time.Since(start).Seconds())
+		}
+		m.fileBytes.Add(float64(rec.bytes))
+	}
+}
+
+// responseRecorder records the status code and body size of an HTTP
+// response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) outcome() string {
+	switch {
+	case r.status == 0, r.status < 400:
+		return outcomeSuccess
+	case r.status == http.StatusNotFound:
+		return outcomeNotFound
+	default:
+		return outcomeError
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metricsBooter struct {
+	readBootFile
+}
+
+func (b metricsBooter) BootSpec(m Machine) (*Spec, error) {
+	if m.MAC.String() == "01:02:03:04:05:06" {
+		return &Spec{Kernel: "kernel"}, nil
+	}
+	return nil, nil
+}
+
+func TestMetrics(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter:          metricsBooter{readBootFile("stuff")},
+		Log:             log,
+		Debug:           log,
+		MetricsRegistry: prometheus.NewRegistry(),
+		events:          make(map[string][]machineEvent),
+	}
+	mux := http.NewServeMux()
+	s.serveHTTP(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/_/ipxe?mac=01:02:03:04:05:06&arch=11",
+		"/_/ipxe?mac=01:02:03:04:05:07&arch=11",
+		"/_/ipxe?mac=01:02:03:04:05:06&arch=42",
+		"/_/file?name=kernel&type=kernel&mac=01:02:03:04:05:06",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Getting %q: %s", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(srv.URL + "/_/metrics")
+	if err != nil {
+		t.Fatalf("Getting metrics: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Got HTTP %d from metrics request, expected 200", resp.StatusCode)
+	}
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading metrics: %s", err)
+	}
+	body := string(bs)
+
+	for _, expected := range []string{
+		`pixiecore_ipxe_requests_total{arch="ARM64",outcome="success"} 1`,
+		`pixiecore_ipxe_requests_total{arch="ARM64",outcome="not-found"} 1`,
+		`pixiecore_ipxe_requests_total{arch="unknown",outcome="error"} 1`,
+		`pixiecore_file_requests_total{outcome="success"} 1`,
+		`pixiecore_file_bytes_total 12`,
+		`pixiecore_file_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Metric %q missing from metrics output:\n%s", expected, body)
+		}
+	}
+}
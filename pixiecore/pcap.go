@@ -0,0 +1,168 @@
+package pixiecore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcap file format constants, see
+// https://www.tcpdump.org/manpages/pcap-savefile.5.txt. Packets are
+// captured with made up IPv6 and UDP headers, so that Wireshark
+// decodes them as DHCPv6 as is.
+const (
+	pcapMagic           = 0xa1b2c3d4
+	pcapLinkTypeIPv6    = 229
+	pcapSnapLen         = 65535
+	pcapHeaderLen       = 24
+	pcapRecordLen       = 16
+	ipv6HeaderLen       = 40
+	udpHeaderLen        = 8
+	ipv6NextHeaderUDP   = 17
+	ipv6DefaultHopLimit = 64
+)
+
+// pcapWriter writes DHCPv6 packets to a pcap file. When the file
+// grows past maxSize bytes, it's moved aside to path.1, replacing the
+// previous one, and a new file is started, so that captures take at
+// most twice maxSize bytes of disk.
+type pcapWriter struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// newPcapWriter creates a pcapWriter writing to path. A maxSize of 0
+// means no limit.
+func newPcapWriter(path string, maxSize int64) (*pcapWriter, error) {
+	w := &pcapWriter{path: path, maxSize: maxSize}
+	if err := w.create(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// create starts a new capture file.
+func (w *pcapWriter) create() error {
+	f, err := os.Create(w.path)
+	if err != nil {
+		return fmt.Errorf("creating packet capture file: %s", err)
+	}
+	hdr := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeIPv6)
+	if _, err := f.Write(hdr); err != nil {
+		f.Close()
+		return fmt.Errorf("writing packet capture file: %s", err)
+	}
+	w.f = f
+	w.size = pcapHeaderLen
+	return nil
+}
+
+// writePacket captures a UDP packet from src to dst, sent or received
+// at t.
+func (w *pcapWriter) writePacket(t time.Time, src, dst *net.UDPAddr, payload []byte) error {
+	pkt := makeIPv6UDPPacket(src, dst, payload)
+	rec := make([]byte, pcapRecordLen, pcapRecordLen+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	rec = append(rec, pkt...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return fmt.Errorf("packet capture file is closed")
+	}
+	if w.maxSize > 0 && w.size > pcapHeaderLen && w.size+int64(len(rec)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(rec)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("writing packet capture file: %s", err)
+	}
+	return nil
+}
+
+// rotate moves the capture file aside, and starts a new one.
+func (w *pcapWriter) rotate() error {
+	w.f.Close()
+	w.f = nil
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return fmt.Errorf("rotating packet capture file: %s", err)
+	}
+	return w.create()
+}
+
+// Close closes the capture file.
+func (w *pcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// makeIPv6UDPPacket wraps payload in IPv6 and UDP headers.
+func makeIPv6UDPPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	udpLen := udpHeaderLen + len(payload)
+	pkt := make([]byte, ipv6HeaderLen+udpLen)
+	pkt[0] = 6 << 4
+	binary.BigEndian.PutUint16(pkt[4:], uint16(udpLen))
+	pkt[6] = ipv6NextHeaderUDP
+	pkt[7] = ipv6DefaultHopLimit
+	copy(pkt[8:24], src.IP.To16())
+	copy(pkt[24:40], dst.IP.To16())
+
+	udp := pkt[ipv6HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[udpHeaderLen:], payload)
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(pkt[8:40], udp))
+	return pkt
+}
+
+// udpChecksum computes the checksum of an IPv6 UDP packet, given the
+// source and destination addresses and the UDP header and payload,
+// see RFC 8200, section 8.1.
+func udpChecksum(addrs, udp []byte) uint16 {
+	var sum uint32
+	add := func(bs []byte) {
+		for i := 0; i+1 < len(bs); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(bs[i:]))
+		}
+		if len(bs)%2 == 1 {
+			sum += uint32(bs[len(bs)-1]) << 8
+		}
+	}
+	add(addrs)
+	sum += uint32(len(udp)) + ipv6NextHeaderUDP
+	add(udp)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	csum := ^uint16(sum)
+	if csum == 0 {
+		// Zero means no checksum, which IPv6 doesn't allow.
+		csum = 0xffff
+	}
+	return csum
+}
@@ -0,0 +1,137 @@
+package pixiecore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type capturedPacket struct {
+	t        time.Time
+	src, dst *net.UDPAddr
+	payload  []byte
+}
+
+// readPcap reads back the packets written by pcapWriter.
+func readPcap(t *testing.T, path string) []capturedPacket {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading capture: %s", err)
+	}
+	if len(bs) < pcapHeaderLen || binary.LittleEndian.Uint32(bs) != pcapMagic || binary.LittleEndian.Uint32(bs[20:]) != pcapLinkTypeIPv6 {
+		t.Fatalf("Capture has no valid pcap header: %x", bs)
+	}
+	bs = bs[pcapHeaderLen:]
+
+	var ret []capturedPacket
+	for len(bs) > 0 {
+		if len(bs) < pcapRecordLen {
+			t.Fatalf("Truncated record header: %x", bs)
+		}
+		ts := time.Unix(int64(binary.LittleEndian.Uint32(bs)), int64(binary.LittleEndian.Uint32(bs[4:]))*1000)
+		l := int(binary.LittleEndian.Uint32(bs[8:]))
+		pkt := bs[pcapRecordLen : pcapRecordLen+l]
+		bs = bs[pcapRecordLen+l:]
+
+		if pkt[0]>>4 != 6 || pkt[6] != ipv6NextHeaderUDP || int(binary.BigEndian.Uint16(pkt[4:])) != l-ipv6HeaderLen {
+			t.Fatalf("Bad IPv6 header: %x", pkt[:ipv6HeaderLen])
+		}
+		udp := pkt[ipv6HeaderLen:]
+		// Packets with a valid checksum sum to all ones, which
+		// complements to 0, reported as 0xffff.
+		if udpChecksum(pkt[8:40], udp) != 0xffff {
+			t.Fatalf("Bad UDP checksum in %x", udp)
+		}
+		ret = append(ret, capturedPacket{
+			t:       ts,
+			src:     &net.UDPAddr{IP: net.IP(pkt[8:24]), Port: int(binary.BigEndian.Uint16(udp[0:]))},
+			dst:     &net.UDPAddr{IP: net.IP(pkt[24:40]), Port: int(binary.BigEndian.Uint16(udp[2:]))},
+			payload: udp[udpHeaderLen:],
+		})
+	}
+	return ret
+}
+
+func TestPcapWriterRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dhcpv6.pcap")
+
+	w, err := newPcapWriter(path, 0)
+	if err != nil {
+		t.Fatalf("Creating capture: %s", err)
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}
+	server := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 547}
+	solicit := []byte{1, 'a', 'b', 'c', 0, 1, 0, 3, 'f', 'o', 'o'}
+	advertise := []byte{2, 'a', 'b', 'c', 0, 2, 0, 3, 'b', 'a', 'r', 0}
+	now := time.Unix(1600000000, 123456000)
+	if err := w.writePacket(now, client, server, solicit); err != nil {
+		t.Fatalf("Capturing packet: %s", err)
+	}
+	if err := w.writePacket(now.Add(time.Millisecond), server, client, advertise); err != nil {
+		t.Fatalf("Capturing packet: %s", err)
+	}
+	w.Close()
+
+	packets := readPcap(t, path)
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 captured packets, got %d", len(packets))
+	}
+	for i, want := range []capturedPacket{
+		{now, client, server, solicit},
+		{now.Add(time.Millisecond), server, client, advertise},
+	} {
+		got := packets[i]
+		if !got.t.Equal(want.t) || got.src.String() != want.src.String() || got.dst.String() != want.dst.String() || !bytes.Equal(got.payload, want.payload) {
+			t.Fatalf("Packet %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+}
+
+func TestPcapWriterRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dhcpv6.pcap")
+
+	payload := make([]byte, 100)
+	recordLen := int64(pcapRecordLen + ipv6HeaderLen + udpHeaderLen + len(payload))
+	// Room for 2 packets per file.
+	w, err := newPcapWriter(path, pcapHeaderLen+2*recordLen)
+	if err != nil {
+		t.Fatalf("Creating capture: %s", err)
+	}
+	defer w.Close()
+	addr := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}
+	for i := 0; i < 5; i++ {
+		payload[0] = byte(i)
+		if err := w.writePacket(time.Now(), addr, addr, payload); err != nil {
+			t.Fatalf("Capturing packet %d: %s", i, err)
+		}
+	}
+
+	for _, test := range []struct {
+		path  string
+		first byte
+		count int
+	}{
+		{path + ".1", 2, 2},
+		{path, 4, 1},
+	} {
+		packets := readPcap(t, test.path)
+		if len(packets) != test.count || packets[0].payload[0] != test.first {
+			t.Fatalf("Expected %d packets starting with packet %d in %s, got %d", test.count, test.first, test.path, len(packets))
+		}
+	}
+}
@@ -1,9 +1,15 @@
 package pixiecore
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"go.universe.tf/netboot/dhcp6"
@@ -14,17 +20,78 @@ type ServerV6 struct {
 	Address string
 	Port    string
 	Duid    []byte
+	// Name of the interface to listen on. It must have an IPv6
+	// link-local address. If empty, the interface is the one
+	// Address is assigned to.
+	Interface string
+	// Path of a file holding the server DUID in hex, used when Duid
+	// isn't set. If the file doesn't exist, the generated DUID is
+	// written to it, so that the DUID survives restarts.
+	DUIDFile string
+
+	// Path of a file to capture the DHCPv6 packets the server
+	// receives and sends to, in pcap format, for offline analysis in
+	// e.g. Wireshark. Packets are captured with their source and
+	// destination addresses and ports, which tell received packets
+	// from sent ones. When the file grows past PcapMaxSize bytes, if
+	// set, it's moved to PcapFile.1 and a new file is started.
+	PcapFile    string
+	PcapMaxSize int64
 
 	BootConfig    dhcp6.BootConfiguration
 	PacketBuilder *dhcp6.PacketBuilder
-	AddressPool   dhcp6.AddressPool
+	// AddressPool hands out addresses to clients. If nil, the
+	// server is stateless: it only answers Information-request
+	// messages, for statically addressed clients that just need
+	// boot parameters and DNS, and drops Solicit and Request ones.
+	AddressPool dhcp6.AddressPool
+
+	// How often the listening interface is checked for coming back
+	// up after going down, which loses its multicast memberships.
+	// The server then re-joins the DHCPv6 multicast group, as it
+	// does after errors receiving packets. 10 seconds if zero, a
+	// negative interval disables the checks.
+	InterfaceCheckInterval time.Duration
 
 	errs chan error
 
+	// Clients that accepted Reconfigure messages, keyed by client ID,
+	// the connection to send them on while serving, and the replay
+	// detection counter of the reconfigure authentication protocol.
+	reconfigureMu  sync.Mutex
+	reconfigurable map[string]*reconfigurableClient
+	conn           *dhcp6.Conn
+	replay         uint64
+
 	Log   func(subsystem, msg string)
 	Debug func(subsystem, msg string)
+	// MessageHook, if set, is called for each DHCPv6 message the
+	// server receives, with the message type, client ID, one of the
+	// DHCPv6 outcomes and how long the message took to handle,
+	// BootConfig lookups included. Messages that can't be decoded
+	// have type 0 and no client ID. It's called from the serving
+	// goroutine, and should return quickly.
+	MessageHook func(msgType dhcp6.MessageType, clientID []byte, outcome string, d time.Duration)
 }
 
+// Outcomes of DHCPv6 messages, as reported to ServerV6.MessageHook.
+const (
+	// A response was sent to the client.
+	DHCPv6Replied = "replied"
+	// The message was meant for another server.
+	DHCPv6Discarded = "discarded"
+	// The server had no response for the message.
+	DHCPv6Dropped = "dropped"
+	// The response couldn't be sent.
+	DHCPv6Failed = "failed"
+	// The message couldn't be decoded.
+	DHCPv6Malformed = "malformed"
+)
+
+// How often ServerV6 checks its interface if InterfaceCheckInterval
+// isn't set.
+const defaultInterfaceCheckInterval = 10 * time.Second
+
 // NewServerV6 returns a new ServerV6.
 func NewServerV6() *ServerV6 {
 	ret := &ServerV6{
@@ -36,9 +103,21 @@ func NewServerV6() *ServerV6 {
 // Serve listens for machines attempting to boot, and responds to
 // their DHCPv6 requests.
 func (s *ServerV6) Serve() error {
+	return s.ServeContext(context.Background())
+}
+
+// ServeContext is like Serve, but also stops serving when ctx is
+// canceled. The DHCPv6 socket is closed by the time it returns.
+func (s *ServerV6) ServeContext(ctx context.Context) error {
 	s.log("dhcp", "starting...")
 
-	dhcp, err := dhcp6.NewConn(s.Address, s.Port)
+	var dhcp *dhcp6.Conn
+	var err error
+	if s.Interface != "" {
+		dhcp, err = dhcp6.NewConnOnInterface(s.Interface, s.Address, s.Port)
+	} else {
+		dhcp, err = dhcp6.NewConn(s.Address, s.Port)
+	}
 	if err != nil {
 		return err
 	}
@@ -52,13 +131,59 @@ func (s *ServerV6) Serve() error {
 	// blocking.
 	s.errs = make(chan error, 6)
 
-	s.setDUID(dhcp.SourceHardwareAddress())
+	if s.PcapFile != "" {
+		capture, err := newPcapWriter(s.PcapFile, s.PcapMaxSize)
+		if err != nil {
+			dhcp.Close()
+			return err
+		}
+		defer capture.Close()
+		dhcp.SetPacketTap(func(received bool, src, dst *net.UDPAddr, bs []byte) {
+			if err := capture.writePacket(time.Now(), src, dst, bs); err != nil {
+				s.log("dhcp", "Error capturing packet: %s", err)
+			}
+		})
+	}
+
+	if s.Duid == nil && s.DUIDFile != "" {
+		if err = s.loadDUIDFile(dhcp.SourceHardwareAddress()); err != nil {
+			dhcp.Close()
+			return err
+		}
+	}
+	if s.Duid == nil {
+		s.setDUID(dhcp.SourceHardwareAddress())
+	}
+
+	s.reconfigureMu.Lock()
+	s.conn = dhcp
+	s.reconfigureMu.Unlock()
 
-	go func() { s.errs <- s.serveDHCP(dhcp) }()
+	serveDone := make(chan struct{})
+	go func() {
+		s.errs <- s.serveDHCP(dhcp)
+		close(serveDone)
+	}()
+	stopWatching := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		s.watchInterface(dhcp, stopWatching)
+		close(watchDone)
+	}()
 
-	// Wait for either a fatal error, or Shutdown().
-	err = <-s.errs
+	// Wait for either a fatal error, Shutdown(), or the context
+	// being canceled.
+	select {
+	case err = <-s.errs:
+	case <-ctx.Done():
+	}
+	s.reconfigureMu.Lock()
+	s.conn = nil
+	s.reconfigureMu.Unlock()
+	close(stopWatching)
+	<-watchDone
 	dhcp.Close()
+	<-serveDone
 
 	s.log("dhcp", "stopped...")
 	return err
@@ -72,6 +197,62 @@ func (s *ServerV6) Shutdown() {
 	}
 }
 
+// ServerDUID returns the DUID the server identifies itself with to
+// DHCPv6 clients. Unless pinned with SetServerDUID, it's a DUID-LLT
+// (RFC 8415, section 11.2) generated from the hardware address of the
+// listening interface when the server first starts serving, and kept
+// for the lifetime of the process: 2 bytes of DUID type (1), 2 bytes
+// of hardware type (1, Ethernet), 4 bytes of seconds since midnight
+// UTC, January 1st 2000, followed by the hardware address.
+func (s *ServerV6) ServerDUID() []byte {
+	return s.Duid
+}
+
+// SetServerDUID pins the DUID the server identifies itself with, so
+// that it stays stable across restarts. Clients remember the server
+// DUID in their bindings. It must be called before Serve.
+func (s *ServerV6) SetServerDUID(duid []byte) {
+	s.Duid = duid
+}
+
+// ParseDUID parses a DUID written in hex, with or without colons
+// between bytes, e.g. "00:03:00:01:02:42:ac:11:00:02". A DUID is a 2
+// byte type followed by 1 to 128 bytes, see RFC 8415, section 11.1.
+func ParseDUID(str string) ([]byte, error) {
+	duid, err := hex.DecodeString(strings.Replace(strings.TrimSpace(str), ":", "", -1))
+	if err != nil {
+		return nil, fmt.Errorf("DUID %q isn't a hex string: %s", str, err)
+	}
+	if len(duid) < 3 || len(duid) > 130 {
+		return nil, fmt.Errorf("DUID %q must be 3 to 130 bytes long, got %d bytes", str, len(duid))
+	}
+	return duid, nil
+}
+
+// loadDUIDFile reads the server DUID from DUIDFile, or generates one
+// from addr and writes it to DUIDFile if the file doesn't exist.
+func (s *ServerV6) loadDUIDFile(addr net.HardwareAddr) error {
+	bs, err := ioutil.ReadFile(s.DUIDFile)
+	if err == nil {
+		duid, err := ParseDUID(string(bs))
+		if err != nil {
+			return fmt.Errorf("reading DUID file %s: %s", s.DUIDFile, err)
+		}
+		s.Duid = duid
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("reading DUID file %s: %s", s.DUIDFile, err)
+	}
+
+	s.setDUID(addr)
+	if err := ioutil.WriteFile(s.DUIDFile, []byte(hex.EncodeToString(s.Duid)+"\n"), 0644); err != nil {
+		return fmt.Errorf("writing DUID file %s: %s", s.DUIDFile, err)
+	}
+	s.log("dhcp", "Generated server DUID %x, saved to %s", s.Duid, s.DUIDFile)
+	return nil
+}
+
 func (s *ServerV6) log(subsystem, format string, args ...interface{}) {
 	if s.Log == nil {
 		return
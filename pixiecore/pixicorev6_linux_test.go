@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package pixiecore
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeContextRejoinsGroupAfterReceiveError(t *testing.T) {
+	l, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	port := strconv.Itoa(l.LocalAddr().(*net.UDPAddr).Port)
+	l.Close()
+
+	rejoined := make(chan string, 1)
+	s := NewServerV6()
+	s.Address = "::1"
+	s.Port = port
+	s.InterfaceCheckInterval = -1
+	s.Log = func(subsystem, msg string) {
+		t.Logf("[%s] %s", subsystem, msg)
+		switch {
+		case strings.HasPrefix(msg, "Error receiving"):
+			// Undo the forced error, so that re-joining fixes it.
+			s.reconfigureMu.Lock()
+			s.conn.SetReadDeadline(time.Time{})
+			s.reconfigureMu.Unlock()
+		case strings.HasPrefix(msg, "Re-joined"):
+			rejoined <- msg
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.ServeContext(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			t.Skipf("Can't listen for DHCPv6 on the loopback interface: %s", err)
+		default:
+		}
+		s.reconfigureMu.Lock()
+		conn := s.conn
+		s.reconfigureMu.Unlock()
+		if conn != nil {
+			// Fail the pending read.
+			conn.SetReadDeadline(time.Now())
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server didn't start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case msg := <-rejoined:
+		if !strings.Contains(msg, "after a receive error") {
+			t.Fatalf("Unexpected re-join message %q", msg)
+		}
+	case err := <-done:
+		t.Fatalf("Server stopped instead of re-joining the multicast group: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server didn't re-join the multicast group")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected no error after the context was canceled, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ServeContext didn't return after the context was canceled")
+	}
+}
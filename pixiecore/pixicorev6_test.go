@@ -0,0 +1,290 @@
+package pixiecore
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+	"go.universe.tf/netboot/dhcp6/pool"
+)
+
+func TestServeContextReleasesSocket(t *testing.T) {
+	l, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	port := strconv.Itoa(l.LocalAddr().(*net.UDPAddr).Port)
+	l.Close()
+
+	for i := 0; i < 2; i++ {
+		s := NewServerV6()
+		s.Address = "::1"
+		s.Port = port
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- s.ServeContext(ctx) }()
+
+		select {
+		case err := <-done:
+			cancel()
+			if i == 0 {
+				t.Skipf("Can't listen for DHCPv6 on the loopback interface: %s", err)
+			}
+			t.Fatalf("Serving again on the same port failed: %s", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Expected no error after the context was canceled, got %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ServeContext didn't return after the context was canceled")
+		}
+	}
+}
+
+func TestSetServerDUID(t *testing.T) {
+	expectedDUID := []byte{0, 3, 0, 1, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	s := NewServerV6()
+	s.SetServerDUID(expectedDUID)
+
+	if duid := s.ServerDUID(); string(duid) != string(expectedDUID) {
+		t.Fatalf("Expected server DUID %x, got %x", expectedDUID, duid)
+	}
+}
+
+func TestGeneratedServerDUIDIsLLT(t *testing.T) {
+	s := NewServerV6()
+	s.setDUID(net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02})
+
+	duid := s.ServerDUID()
+	if len(duid) != 14 {
+		t.Fatalf("Expected a 14 byte DUID-LLT, got %x", duid)
+	}
+	if string(duid[0:4]) != string([]byte{0, 1, 0, 1}) {
+		t.Fatalf("Expected DUID-LLT with Ethernet hardware type, got %x", duid[0:4])
+	}
+	if string(duid[8:]) != string([]byte{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}) {
+		t.Fatalf("Expected DUID-LLT to end with the hardware address, got %x", duid[8:])
+	}
+}
+
+func TestParseDUID(t *testing.T) {
+	expectedDUID := []byte{0, 3, 0, 1, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	for _, str := range []string{"000300010242ac110002", "00:03:00:01:02:42:ac:11:00:02", "00:03:00:01:02:42:AC:11:00:02\n"} {
+		duid, err := ParseDUID(str)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %s", str, err)
+		}
+		if string(duid) != string(expectedDUID) {
+			t.Fatalf("Expected DUID %x parsing %q, got %x", expectedDUID, str, duid)
+		}
+	}
+
+	for _, str := range []string{"", "0003", "00:03:00:0", "00:03:zz:01", strings.Repeat("ab", 131)} {
+		if duid, err := ParseDUID(str); err == nil {
+			t.Fatalf("Expected an error parsing %q, got %x", str, duid)
+		}
+	}
+}
+
+func TestLoadDUIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-duid")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServerV6()
+	s.DUIDFile = filepath.Join(dir, "duid")
+	if err := s.loadDUIDFile(net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}); err != nil {
+		t.Fatalf("Unexpected error generating DUID: %s", err)
+	}
+	generated := s.ServerDUID()
+
+	s = NewServerV6()
+	s.DUIDFile = filepath.Join(dir, "duid")
+	if err := s.loadDUIDFile(net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x03}); err != nil {
+		t.Fatalf("Unexpected error loading DUID: %s", err)
+	}
+	if duid := s.ServerDUID(); string(duid) != string(generated) {
+		t.Fatalf("Expected DUID %x saved by the first server, got %x", generated, duid)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	s := NewServerV6()
+	s.Duid = []byte("serverid")
+	s.PacketBuilder = dhcp6.MakePacketBuilder(90, 100)
+	src := net.ParseIP("fe80::1")
+
+	request := func(clientID string, reconfAccept bool) *dhcp6.Packet {
+		options := make(dhcp6.Options)
+		options.Add(dhcp6.MakeOption(dhcp6.OptClientID, []byte(clientID)))
+		if reconfAccept {
+			options.Add(dhcp6.MakeOption(dhcp6.OptReconfAccept, nil))
+		}
+		return &dhcp6.Packet{Type: dhcp6.MsgRequest, Options: options}
+	}
+	reply := func() *dhcp6.Packet {
+		return &dhcp6.Packet{Type: dhcp6.MsgReply, Options: make(dhcp6.Options)}
+	}
+
+	// Clients lacking a Reconfigure Accept option are skipped.
+	response := reply()
+	if err := s.acceptReconfigure(request("skipped", false), response, src); err != nil {
+		t.Fatalf("acceptReconfigure: %s", err)
+	}
+	if response.Options.HasReconfigureAccept() || len(response.Options[dhcp6.OptAuth]) != 0 {
+		t.Fatalf("Reply to a client lacking Reconfigure Accept has reconfigure options: %v", response.Options)
+	}
+	if _, _, err := s.reconfigureMessage([]byte("skipped")); err == nil {
+		t.Fatalf("Built a Reconfigure for a client that didn't accept them")
+	}
+	if err := s.Reconfigure([]byte("skipped")); err == nil {
+		t.Fatalf("Reconfigured a client that didn't accept Reconfigure messages")
+	}
+
+	response = reply()
+	if err := s.acceptReconfigure(request("accepted", true), response, src); err != nil {
+		t.Fatalf("acceptReconfigure: %s", err)
+	}
+	if !response.Options.HasReconfigureAccept() {
+		t.Fatalf("Reply to a client accepting Reconfigure messages has no Reconfigure Accept option")
+	}
+	auth := response.Options[dhcp6.OptAuth]
+	if len(auth) != 1 || len(auth[0].Value) != 12+dhcp6.ReconfigureKeyLength || auth[0].Value[11] != 1 {
+		t.Fatalf("Reply doesn't hand out a reconfigure key: %v", auth)
+	}
+
+	dst, bs, err := s.reconfigureMessage([]byte("accepted"))
+	if err != nil {
+		t.Fatalf("Building Reconfigure: %s", err)
+	}
+	if !dst.Equal(src) {
+		t.Fatalf("Reconfigure goes to %s, want %s", dst, src)
+	}
+	pkt, err := dhcp6.ParsePacket(bs)
+	if err != nil {
+		t.Fatalf("Parsing Reconfigure: %s", err)
+	}
+	if pkt.Type != dhcp6.MsgReconfigure || string(pkt.Options.ClientID()) != "accepted" || string(pkt.Options.ServerID()) != "serverid" {
+		t.Fatalf("Unexpected Reconfigure: type %d, options %v", pkt.Type, pkt.Options)
+	}
+	if err := s.Reconfigure([]byte("accepted")); err == nil {
+		t.Fatalf("Reconfigure succeeded while the server isn't serving")
+	}
+
+	release := request("accepted", false)
+	release.Type = dhcp6.MsgRelease
+	if err := s.acceptReconfigure(release, reply(), src); err != nil {
+		t.Fatalf("acceptReconfigure: %s", err)
+	}
+	if _, _, err := s.reconfigureMessage([]byte("accepted")); err == nil {
+		t.Fatalf("Built a Reconfigure for a client that released its lease")
+	}
+}
+
+type hookedMessage struct {
+	msgType  dhcp6.MessageType
+	clientID string
+	outcome  string
+}
+
+func TestMessageHook(t *testing.T) {
+	l, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	messages := make(chan hookedMessage, 10)
+	s := NewServerV6()
+	s.Address = "::1"
+	s.Port = strconv.Itoa(port)
+	s.Duid = []byte("serverid")
+	s.BootConfig = MakeStaticBootConfiguration("http://[::1]/boot.ipxe", "", 0, false, nil)
+	s.PacketBuilder = dhcp6.MakePacketBuilder(90, 100)
+	s.AddressPool = pool.NewRandomAddressPool(net.ParseIP("2001:db8::100"), 10, 100)
+	s.MessageHook = func(msgType dhcp6.MessageType, clientID []byte, outcome string, d time.Duration) {
+		messages <- hookedMessage{msgType, string(clientID), outcome}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.ServeContext(ctx) }()
+
+	client, err := net.DialUDP("udp6", nil, &net.UDPAddr{IP: net.IPv6loopback, Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Relay the messages, so that the server takes them from a
+	// unicast address.
+	options := make(dhcp6.Options)
+	options.Add(dhcp6.MakeOption(dhcp6.OptClientID, []byte("clientid")))
+	options.Add(dhcp6.MakeOption(dhcp6.OptOro, []byte{0, dhcp6.OptBootfileURL}))
+	options.Add(dhcp6.MakeOption(dhcp6.OptIaNa, make([]byte, 12)))
+	solicit := &dhcp6.Packet{
+		Type:    dhcp6.MsgSolicit,
+		Options: options,
+		Relays: []*dhcp6.RelayMessage{{
+			Type:        dhcp6.MsgRelayForw,
+			LinkAddress: net.ParseIP("2001:db8::1"),
+			PeerAddress: net.ParseIP("fe80::1"),
+			Options:     make(dhcp6.Options),
+		}},
+	}
+	bs, err := solicit.Marshal()
+	if err != nil {
+		t.Fatalf("Marshalling Solicit: %s", err)
+	}
+	// A Relay-forward message without the relayed message.
+	garbage := make([]byte, 34)
+	garbage[0] = byte(dhcp6.MsgRelayForw)
+
+	for _, test := range []struct {
+		bs   []byte
+		want hookedMessage
+	}{
+		{bs, hookedMessage{dhcp6.MsgSolicit, "clientid", DHCPv6Replied}},
+		{garbage, hookedMessage{0, "", DHCPv6Malformed}},
+	} {
+		// The server may not be listening yet, send until it
+		// reports the message.
+		var got hookedMessage
+	wait:
+		for i := 0; i < 50; i++ {
+			// Writes fail while nothing listens on the port.
+			client.Write(test.bs)
+			select {
+			case got = <-messages:
+				break wait
+			case err := <-done:
+				t.Skipf("Can't listen for DHCPv6 on the loopback interface: %s", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		if got != test.want {
+			t.Fatalf("Expected hook call %+v, got %+v", test.want, got)
+		}
+		// Drain hook calls for retransmissions.
+		for len(messages) > 0 {
+			<-messages
+		}
+	}
+}
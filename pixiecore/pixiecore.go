@@ -16,16 +16,36 @@ package pixiecore // import "go.universe.tf/netboot/pixiecore"
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.universe.tf/netboot/dhcp4"
 )
 
+// HTTP server timeouts if the Server doesn't set them.
+const (
+	defaultHTTPReadTimeout  = 30 * time.Second
+	defaultHTTPWriteTimeout = 30 * time.Second
+	defaultHTTPIdleTimeout  = 2 * time.Minute
+)
+
+// How long signed boot file URLs stay valid if Server.FileURLTTL
+// isn't set.
+const defaultFileURLTTL = time.Hour
+
+// How many machines /_/clients reports if Server.ClientHistorySize
+// isn't set.
+const defaultClientHistorySize = 100
+
 const (
 	portDHCP = 67
 	portTFTP = 69
@@ -51,6 +71,15 @@ const (
 	ArchIA32 Architecture = iota
 	// ArchX64 is a 64-bit x86 machine (aka amd64 aka X64).
 	ArchX64
+
+	// ARM architectures are numbered after their UEFI client
+	// architecture types, see RFC 4578 and the IANA "Processor
+	// Architecture Types" registry.
+
+	// ArchArm32 is a 32-bit ARM machine running UEFI.
+	ArchArm32 Architecture = 10
+	// ArchArm64 is a 64-bit ARM machine (aka aarch64) running UEFI.
+	ArchArm64 Architecture = 11
 )
 
 func (a Architecture) String() string {
@@ -59,6 +88,10 @@ func (a Architecture) String() string {
 		return "IA32"
 	case ArchX64:
 		return "X64"
+	case ArchArm32:
+		return "ARM32"
+	case ArchArm64:
+		return "ARM64"
 	default:
 		return "Unknown architecture"
 	}
@@ -68,6 +101,40 @@ func (a Architecture) String() string {
 type Machine struct {
 	MAC  net.HardwareAddr
 	Arch Architecture
+
+	// The following are only set if the client supplied them, in its
+	// DHCP request, or as query parameters of its /_/ipxe request.
+
+	// UserClass is the client's user class (DHCP option 77), e.g.
+	// "iPXE" for clients with iPXE in ROM, or "pixiecore" for clients
+	// running Pixiecore's own iPXE.
+	UserClass string
+	// VendorClass is the client's vendor class identifier (DHCP
+	// option 60), e.g. "PXEClient:Arch:00007:UNDI:003016".
+	VendorClass string
+	// ClientID is the client identifier (DHCP option 61).
+	ClientID []byte
+	// GUID is the client's 16 byte machine identifier (DHCP option
+	// 97), usually its SMBIOS UUID, without the option's leading type
+	// byte. Unlike the MAC address, it doesn't change when the
+	// machine boots from another NIC.
+	GUID []byte
+	// SecureBoot is true if the client runs with UEFI Secure Boot
+	// enabled, and needs signed boot files. DHCP requests don't tell
+	// whether Secure Boot is enabled: firmwares send the same options
+	// either way. It's only set by clients saying so with the
+	// secureboot=1 query parameter of their /_/ipxe request, e.g. from
+	// the embedded script of a signed iPXE build.
+	SecureBoot bool
+	// IP is the address the client's /_/ipxe request came from.
+	IP net.IP
+	// Params holds the query parameters of the client's /_/ipxe
+	// request other than the ones Pixiecore reserves (mac, arch,
+	// userclass, vendorclass, clientid, guid and secureboot), e.g.
+	// "flow": "rescue" for /_/ipxe?mac=...&arch=...&flow=rescue, so
+	// that chainloaded scripts can select between boot flows. Only
+	// the first value of repeated parameters is kept.
+	Params map[string]string
 }
 
 // A Spec describes a kernel and associated configuration.
@@ -79,10 +146,38 @@ type Spec struct {
 	// Optional kernel commandline. This string is evaluated as a
 	// text/template template, in which "ID(x)" function is
 	// available. Invoking ID(x) returns a URL that will call
-	// Booter.ReadBootFile(x) when fetched.
+	// Booter.ReadBootFile(x) when fetched. The MAC, ARCH and IP
+	// functions describe the booting machine, e.g.
+	// "hostname=node-{{ MAC "-" }}", see machineFuncs. USERDATA
+	// returns the URL of the machine's user-data, see
+	// UserDataBooter.
 	Cmdline string
+	// Optional SHA-256 digests of Kernel and of each Initrd, in
+	// order, as hex strings. They're passed along in the file URLs,
+	// and Pixiecore checks the files it serves against them. A file
+	// that doesn't match is cut off before its end, so that iPXE
+	// fails to fetch it rather than boot a corrupted image.
+	KernelHash   string
+	InitrdHashes []string
 	// Message to print on the client machine before booting.
 	Message string
+	// Optional iPXE commands to run before fetching the kernel, one
+	// per string, e.g. "set net0/ip 192.168.0.10" or "console
+	// --x 1024 --y 768". Commands are emitted verbatim, and can't
+	// contain newlines.
+	IpxePreamble []string
+	// Optional flags for the iPXE boot command, e.g. "--replace" or
+	// "--autofree", emitted verbatim. They can't contain newlines.
+	BootFlags string
+	// If set, the initrds and kernel commandline are given to the
+	// kernel with a separate "imgargs kernel ..." command, rather
+	// than on the boot line. BootFlags and CmdlineViaImgargs apply to
+	// menu entries too.
+	CmdlineViaImgargs bool
+	// Optional boot menu. If set, iPXE lets the user pick one of
+	// the entries to boot, and Kernel, Initrd, Cmdline and their
+	// hashes are ignored.
+	Menu []MenuEntry
 
 	// A raw iPXE script to run. Overrides all of the above.
 	//
@@ -95,6 +190,69 @@ type Spec struct {
 	IpxeScript string
 }
 
+// A MenuEntry is one choice in an iPXE boot menu.
+type MenuEntry struct {
+	// The text shown for this entry in the menu.
+	Label string
+	// The kernel to boot
+	Kernel ID
+	// Optional init ramdisks for linux kernels
+	Initrd []ID
+	// Optional kernel commandline, evaluated like Spec.Cmdline.
+	Cmdline string
+	// Optional SHA-256 digests of Kernel and of each Initrd, checked
+	// like Spec.KernelHash and Spec.InitrdHashes.
+	KernelHash   string
+	InitrdHashes []string
+}
+
+// machineFuncs returns the cmdline template functions that describe
+// mach:
+//
+//   - MAC is the MAC address, in lowercase hex with colons between
+//     bytes, e.g. 01:02:03:04:05:06. {{ MAC "-" }} separates bytes
+//     with the given string instead, e.g. 01-02-03-04-05-06.
+//   - ARCH is the architecture, e.g. X64.
+//   - IP is the address of the machine's iPXE script request, empty
+//     if unknown.
+//
+// None of them expands to characters that iPXE or the kernel treat
+// specially.
+func machineFuncs(mach Machine) template.FuncMap {
+	return template.FuncMap{
+		"MAC": func(sep ...string) string {
+			if len(sep) == 0 {
+				return mach.MAC.String()
+			}
+			return strings.Replace(mach.MAC.String(), ":", sep[0], -1)
+		},
+		"ARCH": func() string { return mach.Arch.String() },
+		"IP": func() string {
+			if mach.IP == nil {
+				return ""
+			}
+			return mach.IP.String()
+		},
+	}
+}
+
+// machineFuncPlaceholders returns cmdline template functions that
+// expand the calls of machineFuncs and USERDATA back to themselves,
+// for booters that expand cmdlines before knowing which machine boots.
+func machineFuncPlaceholders() template.FuncMap {
+	return template.FuncMap{
+		"MAC": func(sep ...string) string {
+			if len(sep) == 0 {
+				return "{{ MAC }}"
+			}
+			return fmt.Sprintf("{{ MAC %q }}", sep[0])
+		},
+		"ARCH":     func() string { return "{{ ARCH }}" },
+		"IP":       func() string { return "{{ IP }}" },
+		"USERDATA": func() string { return "{{ USERDATA }}" },
+	}
+}
+
 func expandCmdline(tpl string, funcs template.FuncMap) (string, error) {
 	tmpl, err := template.New("cmdline").Option("missingkey=error").Funcs(funcs).Parse(tpl)
 	if err != nil {
@@ -129,11 +287,114 @@ type Booter interface {
 	// ReadCloser, or -1 if the size is unknown. Be warned, returning
 	// -1 will make the boot process orders of magnitude slower due to
 	// poor ipxe behavior.
+	//
+	// If the ReadCloser is also an io.Seeker, clients can fetch
+	// byte ranges of the file and resume interrupted downloads.
 	ReadBootFile(id ID) (io.ReadCloser, int64, error)
 	// Write the given Reader to an ID given in Spec.
 	WriteBootFile(id ID, body io.Reader) error
 }
 
+// Errors that Booters can wrap in the errors ReadBootFile returns, to
+// pick the HTTP status of failed boot file requests. Other errors
+// make requests fail with 500 Internal Server Error.
+var (
+	// The ID doesn't name a file, requests fail with 404 Not Found.
+	ErrBootFileNotFound = errors.New("boot file not found")
+	// The file is on another server, which couldn't be reached or
+	// failed. Requests fail with 502 Bad Gateway.
+	ErrUpstream = errors.New("upstream server failed")
+)
+
+// A ContextBooter is a Booter that can abandon BootSpec lookups,
+// e.g. when the booting machine hangs up while waiting for its iPXE
+// script.
+type ContextBooter interface {
+	// Like BootSpec, but gives up and returns an error once ctx is
+	// done.
+	BootSpecContext(ctx context.Context, m Machine) (*Spec, error)
+}
+
+// bootSpec calls BootSpecContext if the booter implements it, or
+// BootSpec otherwise.
+func bootSpec(ctx context.Context, booter Booter, m Machine) (*Spec, error) {
+	if cb, ok := booter.(ContextBooter); ok {
+		return cb.BootSpecContext(ctx, m)
+	}
+	return booter.BootSpec(m)
+}
+
+// logFunc logs like Server.log.
+type logFunc func(subsystem, format string, args ...interface{})
+
+// A logBooter is a Booter that logs through the Server it's used by,
+// e.g. to report falling back from a failing booter.
+type logBooter interface {
+	setLog(log logFunc)
+}
+
+// A BootFileStater is a Booter that can describe its files without
+// reading them.
+//
+// Booters that implement it let HTTP clients cache boot files, and
+// skip re-downloading them when retrying a boot.
+type BootFileStater interface {
+	// Get the size and modification time of the file for an ID
+	// given in Spec.
+	Stat(id ID) (size int64, modTime time.Time, err error)
+}
+
+// An IpxeScripter is a Booter that generates its own iPXE boot
+// scripts, rather than use Pixiecore's built-in one.
+type IpxeScripter interface {
+	// Return the iPXE script that boots spec, which BootSpec
+	// returned. All of spec's fields are available, but Pixiecore
+	// only interprets them when building its own script, so
+	// IpxeScript must load Kernel and Initrd, expand Cmdline, and
+	// print Message itself if it wants to use them.
+	//
+	// host is the scheme and host of Pixiecore's HTTP server, as
+	// seen by the booting machine, e.g. "http://192.168.0.1:80". The
+	// file for an ID is served at host + "/_/file?name=" + the
+	// query-escaped ID.
+	IpxeScript(spec *Spec, host string) ([]byte, error)
+}
+
+// A BootCompleter is a Booter that wants to know when a machine has
+// finished downloading a boot file, e.g. to track which machines
+// booted successfully.
+type BootCompleter interface {
+	// Called after the machine with the given MAC address has
+	// downloaded all of the file for an ID given in Spec. Partial
+	// downloads and cache revalidations don't count. Only files
+	// fetched by Pixiecore's iPXE script, or by URLs that carry the
+	// machine's MAC address, are reported.
+	BootCompleted(mac net.HardwareAddr, id ID)
+}
+
+// A UserDataBooter is a Booter that provides machine-specific
+// configuration for the booted OS, e.g. cloud-init user-data or an
+// Ignition config, served at /_/userdata?mac=<MAC>. Cmdlines
+// reference it with the USERDATA function, like
+// "ignition.config.url={{ USERDATA }}" or
+// "cloud-config-url={{ USERDATA }}".
+//
+// User-data often carries secrets. Without Server.FileURLKey, anyone
+// who can reach Pixiecore's HTTP server can fetch any machine's
+// user-data by its MAC address. With it, requests need the signature
+// that USERDATA adds to the URL, which expires like those of boot
+// files. Server.SetRateLimit limits requests per MAC address.
+type UserDataBooter interface {
+	// Get the configuration document of the given machine, and its
+	// MIME type, e.g. "text/cloud-config" or "application/json". A
+	// nil ReadCloser, or an error wrapping ErrBootFileNotFound or
+	// os.ErrNotExist, means the machine has no user-data.
+	//
+	// Only the MAC address, and the architecture if the request
+	// gives one, are set in m.
+	UserData(m Machine) (data io.ReadCloser, contentType string, err error)
+}
+
 // Firmware describes a kind of firmware attempting to boot.
 //
 // This should only be used for selecting the right bootloader within
@@ -163,6 +424,87 @@ type Server struct {
 	// HTTPPort.
 	HTTPStatusPort int
 
+	// URL scheme iPXE uses to fetch kernels and initrds, "http" if
+	// empty. Set to "https" when TLS is terminated in front of
+	// Pixiecore, iPXE must then be built with HTTPS support.
+	FileURLScheme string
+	// Host (and optional port) iPXE uses to fetch kernels and
+	// initrds, for when Pixiecore sits behind a reverse proxy. If
+	// empty, the Host of the iPXE script request is used.
+	PublicHost string
+
+	// If set, the URLs of boot files in iPXE scripts are signed with
+	// this HMAC-SHA256 key, and expire after FileURLTTL (1 hour if
+	// zero). Requests for boot files without a valid signature are
+	// refused, so that the HTTP server doesn't hand out files to
+	// anyone who can guess their name. The same goes for user-data,
+	// see UserDataBooter. Booters that implement
+	// IpxeScripter don't get signed URLs, and can't be used with
+	// FileURLKey.
+	FileURLKey []byte
+	FileURLTTL time.Duration
+
+	// Timeouts of the HTTP server: for reading a request, writing a
+	// response, and keeping an idle connection open for the next
+	// request. Zero means the defaults, 30 seconds for reading and
+	// writing and 2 minutes when idle, and a negative duration means
+	// no timeout. Boot files can take much longer than that to send
+	// over a slow link, so for them HTTPWriteTimeout only bounds each
+	// write, and only stalled transfers are cut off.
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+
+	// Number of recently booted machines reported by the /_/clients
+	// endpoint, 100 if zero. A negative size disables the endpoint.
+	ClientHistorySize int
+
+	// Machine that HealthCheck and the /_/healthz endpoint ask the
+	// Booter to boot. If its MAC is nil, 02:00:00:00:00:00 is
+	// used. The Booter must give it a spec with a readable kernel
+	// for Pixiecore to be healthy.
+	HealthCheckMachine Machine
+
+	// Origins of web pages allowed to query the informational
+	// endpoints, /_/clients, /_/healthz and /_/metrics, from a
+	// browser with CORS, e.g. "https://dashboard.example.com", or
+	// "*" for any page. The boot endpoints never allow other
+	// origins. If empty, no CORS headers are sent.
+	CORSAllowedOrigins []string
+
+	// Gzip boot files on the fly when the client accepts it, unless
+	// they are already compressed. Saves bandwidth on slow networks,
+	// at the cost of CPU time on the server.
+	CompressFiles bool
+
+	// Concatenate the initrds of each boot into one file, for
+	// clients that can only load a single initrd. See
+	// CombinedInitrd.
+	CombineInitrds bool
+
+	// Check Specs with Spec.Validate before sending boot scripts,
+	// and refuse to boot machines whose Spec refers to files the
+	// Booter can't serve, rather than let them fail while booting.
+	// This looks up every boot file of every boot, which can be
+	// slow with Booters that don't implement BootFileStater.
+	ValidateSpecs bool
+
+	// Maximum number of boot files sent at once, 0 for no limit.
+	// Limiting transfers keeps a boot storm, e.g. after a power
+	// outage, from saturating the disk or network. Requests over
+	// the limit wait up to FileTransferQueueTimeout for a transfer
+	// to finish, and then get a 503 response with a Retry-After
+	// header, which iPXE retries.
+	MaxFileTransfers         int
+	FileTransferQueueTimeout time.Duration
+
+	// When shutting down, ServeContext waits up to this long for
+	// boot file transfers to finish, so that redeploying Pixiecore
+	// doesn't cut clients off in the middle of an initrd. New HTTP
+	// requests get a 503 in the meantime. Defaults to 30s, negative
+	// values close the HTTP server right away.
+	ShutdownGracePeriod time.Duration
+
 	// Ipxe lists the supported bootable Firmwares, and their
 	// associated ipxe binary.
 	Ipxe map[Firmware][]byte
@@ -173,6 +515,11 @@ type Server struct {
 	// Debug receives extensive logging on Pixiecore's internals. Very
 	// useful for debugging, but very verbose.
 	Debug func(subsystem, msg string)
+	// StructuredLog, if set, receives logs about HTTP boot requests
+	// instead of Log and Debug, with details of the request such as
+	// "mac", "arch", "remote_addr", "status" and "path" as
+	// fields. level is "info" or "debug".
+	StructuredLog func(level, msg string, fields map[string]interface{})
 
 	// These ports can technically be set for testing, but the
 	// protocols burned in firmware on the client side hardcode these,
@@ -187,12 +534,37 @@ type Server struct {
 	// Currently only supported on Linux.
 	DHCPNoBind bool
 
+	// Set SO_REUSEADDR and SO_REUSEPORT on the DHCP, TFTP and PXE
+	// sockets, so that several Pixiecore instances on the same host
+	// can share the ports, e.g. for high availability behind a
+	// load-balanced address. Only supported on Linux, other OSes
+	// bind the sockets exclusively.
+	ReusePort bool
+
 	// Read UI assets from this path, rather than use the builtin UI
 	// assets. Used for development of Pixiecore.
 	UIAssetsDir string
 
+	// If set, HTTP boot requests are instrumented with metrics
+	// registered in MetricsRegistry, and the metrics are served at
+	// /_/metrics. If nil, no metrics are collected.
+	MetricsRegistry *prometheus.Registry
+
 	errs chan error
 
+	// Extra HTTP handlers, registered with Handle.
+	handlers map[string]http.Handler
+
+	ipxeLimiter     *macRateLimiter
+	userDataLimiter *macRateLimiter
+
+	fileSlotsOnce sync.Once
+	fileSlots     chan struct{}
+	transfers     fileTransfers
+
+	bootIDs bootIDs
+	clients clientHistory
+
 	eventsMu sync.Mutex
 	events   map[string][]machineEvent
 }
@@ -200,6 +572,13 @@ type Server struct {
 // Serve listens for machines attempting to boot, and uses Booter to
 // help them.
 func (s *Server) Serve() error {
+	return s.ServeContext(context.Background())
+}
+
+// ServeContext is like Serve, but also stops serving when ctx is
+// canceled. All sockets are closed by the time it returns, after
+// in-flight boot file transfers finish, see ShutdownGracePeriod.
+func (s *Server) ServeContext(ctx context.Context) error {
 	if s.DHCPPort == 0 {
 		s.DHCPPort = portDHCP
 	}
@@ -213,7 +592,10 @@ func (s *Server) Serve() error {
 		s.HTTPPort = portHTTP
 	}
 
-	newDHCP := dhcp4.NewConn
+	lc := s.listenConfig()
+	newDHCP := func(addr string) (*dhcp4.Conn, error) {
+		return dhcp4.NewConnWithConfig(addr, lc)
+	}
 	if s.DHCPNoBind {
 		newDHCP = dhcp4.NewSnooperConn
 	}
@@ -222,12 +604,12 @@ func (s *Server) Serve() error {
 	if err != nil {
 		return err
 	}
-	tftp, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", s.Address, s.TFTPPort))
+	tftp, err := lc.ListenPacket(ctx, "udp", fmt.Sprintf("%s:%d", s.Address, s.TFTPPort))
 	if err != nil {
 		dhcp.Close()
 		return err
 	}
-	pxe, err := net.ListenPacket("udp4", fmt.Sprintf("%s:%d", s.Address, s.PXEPort))
+	pxe, err := lc.ListenPacket(ctx, "udp4", fmt.Sprintf("%s:%d", s.Address, s.PXEPort))
 	if err != nil {
 		dhcp.Close()
 		tftp.Close()
@@ -242,6 +624,10 @@ func (s *Server) Serve() error {
 	}
 
 	s.events = make(map[string][]machineEvent)
+	s.transfers.reset()
+	if lb, ok := s.Booter.(logBooter); ok {
+		lb.setLog(s.log)
+	}
 	// 5 buffer slots, one for each goroutine, plus one for
 	// Shutdown(). We only ever pull the first error out, but shutdown
 	// will likely generate some spurious errors from the other
@@ -254,17 +640,35 @@ func (s *Server) Serve() error {
 	go func() { s.errs <- s.serveDHCP(dhcp) }()
 	go func() { s.errs <- s.servePXE(pxe) }()
 	go func() { s.errs <- s.serveTFTP(tftp) }()
-	go func() { s.errs <- serveHTTP(http, s.serveHTTP) }()
+	srv := s.httpServer(s.refuseWhileDraining(s.Handler()))
+	go func() { s.errs <- serveHTTP(http, srv) }()
 
-	// Wait for either a fatal error, or Shutdown().
-	err = <-s.errs
+	// Wait for either a fatal error, Shutdown(), or the context
+	// being canceled.
+	select {
+	case err = <-s.errs:
+	case <-ctx.Done():
+	}
 	dhcp.Close()
 	tftp.Close()
 	pxe.Close()
+	s.shutdownHTTP(srv)
 	http.Close()
 	return err
 }
 
+// listenConfig returns the ListenConfig of the Server's UDP sockets.
+func (s *Server) listenConfig() *net.ListenConfig {
+	if !s.ReusePort {
+		return &net.ListenConfig{}
+	}
+	if !reusePortSupported {
+		s.log("Init", "SO_REUSEPORT is not supported on this OS, binding ports exclusively")
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: reusePortControl}
+}
+
 // Shutdown causes Serve() to exit, cleaning up behind itself.
 func (s *Server) Shutdown() {
 	select {
@@ -272,3 +676,23 @@ func (s *Server) Shutdown() {
 	default:
 	}
 }
+
+// IpxeBinary returns the iPXE binary that clients with firmware fw
+// are chainloaded to, and whether there is one, i.e. whether such
+// clients can be booted.
+func (s *Server) IpxeBinary(fw Firmware) ([]byte, bool) {
+	bs := s.Ipxe[fw]
+	return bs, bs != nil
+}
+
+// SetIpxeBinary sets the iPXE binary that clients with firmware fw
+// are chainloaded to, e.g. a signed build for Secure Boot clients.
+// FirmwareEFIBC clients usually run the same binary as FirmwareEFI64
+// clients, and need it set separately. It must be called before
+// Serve.
+func (s *Server) SetIpxeBinary(fw Firmware, bs []byte) {
+	if s.Ipxe == nil {
+		s.Ipxe = make(map[Firmware][]byte)
+	}
+	s.Ipxe[fw] = bs
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedMACs bounds the memory used by a macRateLimiter, so
+// that a flood of requests with spoofed MACs can't exhaust memory.
+const maxRateLimitedMACs = 10000
+
+// macRateLimiter is a set of token buckets, one per client MAC.
+type macRateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket size
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	timeNow func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newMACRateLimiter(rps float64, burst int) *macRateLimiter {
+	return &macRateLimiter{
+		rate:    rps,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		timeNow: time.Now,
+	}
+}
+
+// SetRateLimit limits each client MAC to rps iPXE script requests per
+// second on average, with bursts of up to burst requests, and
+// separately to as many user-data requests. Requests over the limit
+// get HTTP 429 responses. A rps of zero or less
+// removes the limit. A burst below 1 is raised to 1, smaller buckets
+// would never hold a whole request.
+//
+// SetRateLimit must be called before Serve.
+func (s *Server) SetRateLimit(rps float64, burst int) {
+	if rps <= 0 {
+		s.ipxeLimiter = nil
+		s.userDataLimiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	s.ipxeLimiter = newMACRateLimiter(rps, burst)
+	s.userDataLimiter = newMACRateLimiter(rps, burst)
+}
+
+// fileTransferRetryAfter is the Retry-After of responses to file
+// requests over Server.MaxFileTransfers, in seconds.
+const fileTransferRetryAfter = 5
+
+// acquireFileSlot waits for one of the MaxFileTransfers transfer
+// slots to free up, for at most FileTransferQueueTimeout or until r
+// is canceled, and returns the function that releases it. ok is false
+// if no slot freed up in time.
+func (s *Server) acquireFileSlot(r *http.Request) (release func(), ok bool) {
+	if s.MaxFileTransfers <= 0 {
+		return func() {}, true
+	}
+	s.fileSlotsOnce.Do(func() {
+		s.fileSlots = make(chan struct{}, s.MaxFileTransfers)
+	})
+	release = func() { <-s.fileSlots }
+
+	select {
+	case s.fileSlots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if s.FileTransferQueueTimeout <= 0 {
+		return nil, false
+	}
+	timer := time.NewTimer(s.FileTransferQueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.fileSlots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	case <-r.Context().Done():
+		return nil, false
+	}
+}
+
+// allow takes a token from mac's bucket, and returns false if there
+// were none left.
+func (l *macRateLimiter) allow(mac net.HardwareAddr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.timeNow()
+	k := mac.String()
+	b := l.buckets[k]
+	if b == nil {
+		if len(l.buckets) >= maxRateLimitedMACs {
+			l.evict(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[k] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict forgets MACs whose buckets have refilled, which is the same
+// as never having seen them. If that doesn't free enough space, it
+// forgets arbitrary MACs until the limiter is half full.
+func (l *macRateLimiter) evict(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	for k := range l.buckets {
+		if len(l.buckets) <= maxRateLimitedMACs/2 {
+			break
+		}
+		delete(l.buckets, k)
+	}
+}
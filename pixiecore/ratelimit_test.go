@@ -0,0 +1,200 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIpxeRateLimit(t *testing.T) {
+	booter := func(m Machine) (*Spec, error) {
+		return &Spec{Kernel: "k"}, nil
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: booterFunc(booter),
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+	s.SetRateLimit(1, 3)
+	now := time.Now()
+	s.ipxeLimiter.timeNow = func() time.Time { return now }
+
+	get := func(mac string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", fmt.Sprintf("/_/ipxe?mac=%s&arch=0", mac), nil)
+		if err != nil {
+			t.Fatalf("Constructing ipxe request: %s", err)
+		}
+		s.handleIpxe(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := get("01:02:03:04:05:06"); code != 200 {
+			t.Fatalf("Request %d got HTTP %d, expected 200", i, code)
+		}
+	}
+	if code := get("01:02:03:04:05:06"); code != http.StatusTooManyRequests {
+		t.Fatalf("Request over the burst got HTTP %d, expected %d", code, http.StatusTooManyRequests)
+	}
+	if code := get("01:02:03:04:05:07"); code != 200 {
+		t.Fatalf("Request from another MAC got HTTP %d, expected 200", code)
+	}
+
+	now = now.Add(time.Second)
+	if code := get("01:02:03:04:05:06"); code != 200 {
+		t.Fatalf("Request after refill got HTTP %d, expected 200", code)
+	}
+	if code := get("01:02:03:04:05:06"); code != http.StatusTooManyRequests {
+		t.Fatalf("Second request after refill got HTTP %d, expected %d", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestIpxeRateLimitMinimumBurst(t *testing.T) {
+	booter := func(m Machine) (*Spec, error) {
+		return &Spec{Kernel: "k"}, nil
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: booterFunc(booter),
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+	// A zero burst still lets one request through per refill.
+	s.SetRateLimit(1, 0)
+	now := time.Now()
+	s.ipxeLimiter.timeNow = func() time.Time { return now }
+
+	for i, want := range []int{200, http.StatusTooManyRequests} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+		if err != nil {
+			t.Fatalf("Constructing ipxe request: %s", err)
+		}
+		s.handleIpxe(rr, req)
+		if rr.Code != want {
+			t.Fatalf("Request %d with a zero burst got HTTP %d, expected %d", i, rr.Code, want)
+		}
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	fill := func(l *macRateLimiter, n int) {
+		for i := 0; i < n; i++ {
+			l.allow(net.HardwareAddr{0, 0, byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)})
+		}
+	}
+
+	l := newMACRateLimiter(1, 1)
+	now := time.Now()
+	l.timeNow = func() time.Time { return now }
+	fill(l, maxRateLimitedMACs+1)
+	if len(l.buckets) > maxRateLimitedMACs {
+		t.Fatalf("Rate limiter tracks %d MACs, expected at most %d", len(l.buckets), maxRateLimitedMACs)
+	}
+
+	// Once buckets refill, their MACs are forgotten first.
+	l = newMACRateLimiter(1, 1)
+	l.timeNow = func() time.Time { return now }
+	fill(l, maxRateLimitedMACs)
+	now = now.Add(time.Second)
+	l.allow(net.HardwareAddr{1, 2, 3, 4, 5, 6})
+	if len(l.buckets) != 1 {
+		t.Fatalf("Rate limiter tracks %d MACs after eviction of idle MACs, expected 1", len(l.buckets))
+	}
+}
+
+// blockingBootFile serves files once release is closed, signaling
+// started as each transfer begins.
+type blockingBootFile struct {
+	readBootFile
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBootFile) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.readBootFile.ReadBootFile(id)
+}
+
+func TestMaxFileTransfers(t *testing.T) {
+	booter := &blockingBootFile{
+		readBootFile: "stuff",
+		started:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter:           booter,
+		Log:              log,
+		Debug:            log,
+		MaxFileTransfers: 2,
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/file?name=test", nil)
+		if err != nil {
+			t.Errorf("Constructing file request: %s", err)
+			return rr
+		}
+		s.handleFile(rr, req)
+		return rr
+	}
+
+	done := make(chan int, 3)
+	for i := 0; i < 2; i++ {
+		go func() { done <- get().Code }()
+		<-booter.started
+	}
+
+	rr := get()
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Transfer over the limit got HTTP %d, expected %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got, want := rr.Header().Get("Retry-After"), fmt.Sprint(fileTransferRetryAfter); got != want {
+		t.Fatalf("Wrong Retry-After, want %q, got %q", want, got)
+	}
+
+	// With a queue timeout, the next transfer waits for a slot
+	// instead of being turned away.
+	s.FileTransferQueueTimeout = time.Minute
+	go func() { done <- get().Code }()
+	select {
+	case <-booter.started:
+		t.Fatal("Queued transfer started while both slots were busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(booter.release)
+	for i := 0; i < 3; i++ {
+		if code := <-done; code != 200 {
+			t.Fatalf("Transfer got HTTP %d, expected 200", code)
+		}
+		if i == 0 {
+			<-booter.started
+		}
+	}
+}
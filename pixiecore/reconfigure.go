@@ -0,0 +1,115 @@
+package pixiecore
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+
+	"go.universe.tf/netboot/dhcp6"
+)
+
+// reconfigurableClient is a client that accepted Reconfigure
+// messages, along with where to send them and the key to authenticate
+// them with.
+type reconfigurableClient struct {
+	addr   net.IP
+	relays []*dhcp6.RelayMessage
+	key    []byte
+}
+
+// acceptReconfigure honors clients that include a Reconfigure Accept
+// option in their messages: the server advertises that it may send
+// Reconfigure messages, and hands out a reconfigure key in its Replies
+// (RFC 8415, section 20.4). Clients releasing their lease are
+// forgotten.
+func (s *ServerV6) acceptReconfigure(pkt, response *dhcp6.Packet, src net.IP) error {
+	s.reconfigureMu.Lock()
+	defer s.reconfigureMu.Unlock()
+
+	clientID := string(pkt.Options.ClientID())
+	if pkt.Type == dhcp6.MsgRelease {
+		delete(s.reconfigurable, clientID)
+		return nil
+	}
+	if !pkt.Options.HasReconfigureAccept() {
+		return nil
+	}
+	switch {
+	case response.Type == dhcp6.MsgAdvertise:
+		response.Options.Add(dhcp6.MakeOption(dhcp6.OptReconfAccept, nil))
+		return nil
+	// Solicits get a Reply with rapid commit.
+	case response.Type == dhcp6.MsgReply && (pkt.Type == dhcp6.MsgRequest || pkt.Type == dhcp6.MsgRenew ||
+		pkt.Type == dhcp6.MsgRebind || pkt.Type == dhcp6.MsgSolicit):
+	default:
+		return nil
+	}
+
+	client, ok := s.reconfigurable[clientID]
+	if !ok {
+		key := make([]byte, dhcp6.ReconfigureKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("generating reconfigure key: %s", err)
+		}
+		client = &reconfigurableClient{key: key}
+		if s.reconfigurable == nil {
+			s.reconfigurable = make(map[string]*reconfigurableClient)
+		}
+		s.reconfigurable[clientID] = client
+	}
+	client.addr = src
+	client.relays = response.Relays
+
+	s.replay++
+	response.Options.Add(dhcp6.MakeOption(dhcp6.OptReconfAccept, nil))
+	response.Options.Add(dhcp6.MakeReconfigureKeyOption(client.key, s.replay))
+	return nil
+}
+
+// Reconfigure asks the client identified by clientID to renew its
+// lease, so that it picks up boot configuration changes without
+// waiting for its lease to expire. Only clients that included a
+// Reconfigure Accept option in their messages, and got a lease from
+// this server since it started, can be reconfigured: for others,
+// Reconfigure does nothing and returns an error. The server must be
+// serving.
+func (s *ServerV6) Reconfigure(clientID []byte) error {
+	dst, bs, err := s.reconfigureMessage(clientID)
+	if err != nil {
+		return err
+	}
+	s.reconfigureMu.Lock()
+	conn := s.conn
+	s.reconfigureMu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("can't reconfigure client %x, the server isn't serving", clientID)
+	}
+	if err := conn.SendDHCP(dst, bs); err != nil {
+		return err
+	}
+	s.debug("dhcpv6", "Sent Reconfigure to client %x\n", clientID)
+	return nil
+}
+
+// reconfigureMessage returns the authenticated Reconfigure message for
+// clientID, and the address to send it to.
+func (s *ServerV6) reconfigureMessage(clientID []byte) (net.IP, []byte, error) {
+	s.reconfigureMu.Lock()
+	client, ok := s.reconfigurable[string(clientID)]
+	if !ok {
+		s.reconfigureMu.Unlock()
+		return nil, nil, fmt.Errorf("client %x didn't accept Reconfigure messages", clientID)
+	}
+	dst, relays, key := client.addr, client.relays, client.key
+	s.replay++
+	replay := s.replay
+	s.reconfigureMu.Unlock()
+
+	pkt := s.PacketBuilder.MakeMsgReconfigure([3]byte{}, s.Duid, clientID, dhcp6.MsgRenew)
+	pkt.Relays = relays
+	bs, err := pkt.MarshalReconfigure(key, replay)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshalling Reconfigure for client %x: %s", clientID, err)
+	}
+	return dst, bs, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package pixiecore
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	s := &Server{ReusePort: true}
+	lc := s.listenConfig()
+
+	first, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening: %s", err)
+	}
+	defer first.Close()
+	addr := first.LocalAddr().String()
+
+	second, err := lc.ListenPacket(context.Background(), "udp4", addr)
+	if err != nil {
+		t.Fatalf("Second listener couldn't bind %s with ReusePort: %s", addr, err)
+	}
+	second.Close()
+
+	// Without the option, the port is still exclusive.
+	exclusive, err := (&Server{}).listenConfig().ListenPacket(context.Background(), "udp4", addr)
+	if err == nil {
+		exclusive.Close()
+		t.Fatalf("Listener without ReusePort could bind %s", addr)
+	}
+	if _, ok := err.(*net.OpError); !ok {
+		t.Fatalf("Unexpected error binding %s without ReusePort: %s", addr, err)
+	}
+}
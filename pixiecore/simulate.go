@@ -0,0 +1,168 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BootResult is the outcome of a boot simulated by SimulateBoot.
+type BootResult struct {
+	// Script is the iPXE script the machine got.
+	Script string
+	// Files are the files the script references on Pixiecore's HTTP
+	// server, in the order they appear in the script.
+	Files []BootFile
+}
+
+// BootFile is a file fetched by SimulateBoot.
+type BootFile struct {
+	// URL the script references the file with.
+	URL string
+	// Size is the number of bytes received.
+	Size int64
+	// Err is set if the file couldn't be fetched.
+	Err error
+}
+
+// Err returns the first error fetching the result's files, if any.
+func (r *BootResult) Err() error {
+	for _, f := range r.Files {
+		if f.Err != nil {
+			return fmt.Errorf("fetching %s: %s", f.URL, f.Err)
+		}
+	}
+	return nil
+}
+
+// SimulateBoot runs the HTTP part of a boot of the machine with the
+// given MAC address and architecture against server, without a
+// network or a real machine, e.g. to test a Booter in CI. It requests
+// the machine's iPXE script from server's Handler, then fetches every
+// file the script references on Pixiecore's HTTP server, including
+// URLs in the kernel commandline. Other URLs are left alone, and so
+// is the script's /_/booting notification, so a simulated machine is
+// never reported as booted into its OS.
+//
+// An error is returned if the script can't be had. Errors fetching
+// files are reported in the BootResult. Simulated boots show up in
+// server's machine events and client history like real ones, and if
+// server's Booter is a BootCompleter, its BootCompleted is called for
+// the files fetched, as for a real boot.
+func SimulateBoot(server *Server, mac net.HardwareAddr, arch Architecture) (*BootResult, error) {
+	h := server.Handler()
+	script, err := simulateRequest(h, fmt.Sprintf("/_/ipxe?mac=%s&arch=%d", url.QueryEscape(mac.String()), int(arch)), true)
+	if err != nil {
+		return nil, fmt.Errorf("getting iPXE script: %s", err)
+	}
+
+	ret := &BootResult{Script: script.body.String()}
+	for _, u := range scriptURLs(ret.Script) {
+		if u.Path == "/_/booting" {
+			continue
+		}
+		f := BootFile{URL: u.String()}
+		resp, err := simulateRequest(h, u.RequestURI(), false)
+		if err != nil {
+			f.Err = err
+		} else {
+			f.Size = resp.size
+		}
+		ret.Files = append(ret.Files, f)
+	}
+	return ret, nil
+}
+
+// scriptURLs returns the distinct URLs in an iPXE script that point
+// to Pixiecore's own routes.
+func scriptURLs(script string) []*url.URL {
+	var ret []*url.URL
+	seen := map[string]bool{}
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			i := strings.Index(field, "http://")
+			if i < 0 {
+				i = strings.Index(field, "https://")
+			}
+			if i < 0 {
+				continue
+			}
+			u, err := url.Parse(field[i:])
+			if err != nil || !strings.HasPrefix(u.Path, "/_/") || seen[u.String()] {
+				continue
+			}
+			seen[u.String()] = true
+			ret = append(ret, u)
+		}
+	}
+	return ret
+}
+
+// simulatedResponse is an http.ResponseWriter that counts the bytes
+// of the response, and keeps them if keepBody is set or the response
+// is an error.
+type simulatedResponse struct {
+	header   http.Header
+	status   int
+	keepBody bool
+	body     bytes.Buffer
+	size     int64
+}
+
+func (r *simulatedResponse) Header() http.Header { return r.header }
+
+func (r *simulatedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *simulatedResponse) Write(bs []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	r.size += int64(len(bs))
+	if r.keepBody || r.status != http.StatusOK {
+		r.body.Write(bs)
+	}
+	return len(bs), nil
+}
+
+// simulateRequest makes a GET request for uri to h, and returns the
+// response if it's a 200 OK.
+func simulateRequest(h http.Handler, uri string, keepBody bool) (*simulatedResponse, error) {
+	req, err := http.NewRequest("GET", "http://localhost"+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	resp := &simulatedResponse{header: make(http.Header), keepBody: keepBody}
+	h.ServeHTTP(resp, req)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	if resp.status != http.StatusOK {
+		msg, _ := ioutil.ReadAll(&resp.body)
+		return nil, fmt.Errorf("%s: %s", http.StatusText(resp.status), strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
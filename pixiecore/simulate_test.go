@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type simulateCompleter struct {
+	Booter
+	completed []ID
+}
+
+func (b *simulateCompleter) BootCompleted(mac net.HardwareAddr, id ID) {
+	b.completed = append(b.completed, id)
+}
+
+func TestSimulateBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-simulate-boot-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mustWrite(dir, "kernel", "kernel file")
+	mustWrite(dir, "initrd-a", "first initrd file")
+	mustWrite(dir, "initrd-b", "second initrd")
+	mustWrite(dir, "config", "config file")
+
+	dirBooter, err := DirectoryBooter(dir, `config={{ ID "config" }} missing={{ ID "missing" }}`)
+	if err != nil {
+		t.Fatalf("Constructing DirectoryBooter: %s", err)
+	}
+	booter := &simulateCompleter{Booter: dirBooter}
+	logf := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{Booter: booter, Log: logf, Debug: logf}
+
+	res, err := SimulateBoot(s, mustMAC("01:02:03:04:05:06"), ArchX64)
+	if err != nil {
+		t.Fatalf("Simulating boot: %s", err)
+	}
+	if !strings.HasPrefix(res.Script, "#!ipxe\n") {
+		t.Errorf("Expected an iPXE script, got %q", res.Script)
+	}
+
+	expected := []struct {
+		name string
+		size int64
+		ok   bool
+	}{
+		{"kernel", 11, true},
+		{"initrd-a", 17, true},
+		{"initrd-b", 13, true},
+		{"config", 11, true},
+		{"missing", 0, false},
+	}
+	if len(res.Files) != len(expected) {
+		t.Fatalf("Expected %d files, got %d: %+v", len(expected), len(res.Files), res.Files)
+	}
+	for i, want := range expected {
+		got := res.Files[i]
+		if !strings.Contains(got.URL, want.name) {
+			t.Errorf("File %d: expected URL of %q, got %q", i, want.name, got.URL)
+		}
+		if got.Size != want.size || (got.Err == nil) != want.ok {
+			t.Errorf("File %q: expected size %d, ok %v, got size %d, error %v", want.name, want.size, want.ok, got.Size, got.Err)
+		}
+	}
+	if err := res.Err(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected the result's error to be about the missing file, got %v", err)
+	}
+
+	if want := []ID{"kernel", "initrd-a", "initrd-b"}; !reflect.DeepEqual(booter.completed, want) {
+		t.Errorf("Expected BootCompleted for %q, got %q", want, booter.completed)
+	}
+	for _, evt := range s.events["01:02:03:04:05:06"] {
+		if evt.State == machineStateBooted {
+			t.Errorf("Simulated boot reported the machine as booted: %q", evt.Message)
+		}
+	}
+
+	if _, err := SimulateBoot(&Server{Booter: readBootFile("nothing"), Log: logf}, mustMAC("01:02:03:04:05:06"), ArchX64); err == nil {
+		t.Errorf("Expected an error simulating the boot of a machine without a boot spec")
+	}
+}
@@ -79,7 +79,7 @@ func (s *Server) handleTFTP(path string, clientAddr net.Addr) (io.ReadCloser, in
 		return nil, 0, fmt.Errorf("unknown path %q", path)
 	}
 
-	bs, ok := s.Ipxe[Firmware(i)]
+	bs, ok := s.IpxeBinary(Firmware(i))
 	if !ok {
 		return nil, 0, fmt.Errorf("unknown firmware type %d", i)
 	}
@@ -15,11 +15,17 @@
 package pixiecore
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/nacl/secretbox"
 )
@@ -64,3 +70,50 @@ func getURL(id ID, key *[32]byte) (string, error) {
 	}
 	return string(out), nil
 }
+
+// signFileName returns a signature that lets the holder fetch the
+// file called name from /_/file until expiry. The signature is the
+// expiry in Unix seconds, a dot, and an HMAC-SHA256 with key of both
+// name and expiry.
+func signFileName(name string, expiry time.Time, key []byte) string {
+	exp := strconv.FormatInt(expiry.Unix(), 10)
+	return exp + "." + base64.RawURLEncoding.EncodeToString(fileNameMAC(name, exp, key))
+}
+
+// verifyFileName returns an error if sig isn't a signature made by
+// signFileName for name with key, or if it expired before now.
+func verifyFileName(name, sig string, now time.Time, key []byte) error {
+	if sig == "" {
+		return errors.New("missing signature")
+	}
+	i := strings.Index(sig, ".")
+	if i < 0 {
+		return errors.New("malformed signature")
+	}
+	exp, mac := sig[:i], sig[i+1:]
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature expiry")
+	}
+	got, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil || !hmac.Equal(got, fileNameMAC(name, exp, key)) {
+		return errors.New("signature verification failed")
+	}
+	if now.Unix() > expiry {
+		return fmt.Errorf("signature expired at %s", time.Unix(expiry, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// userDataName is the name signed with signFileName for the user-data
+// of mac. The prefix keeps it apart from boot file IDs.
+func userDataName(mac net.HardwareAddr) string {
+	return "/_/userdata?mac=" + mac.String()
+}
+
+func fileNameMAC(name, exp string, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	// The expiry has no newlines, so the message is unambiguous.
+	fmt.Fprintf(h, "%s\n%s", exp, name)
+	return h.Sum(nil)
+}
@@ -18,6 +18,7 @@ import (
 	"crypto/rand"
 	"io"
 	"testing"
+	"time"
 )
 
 func TestSignURL(t *testing.T) {
@@ -49,3 +50,34 @@ func TestSignURL(t *testing.T) {
 		t.Fatalf("Corrupted id %q decoded correctly", id)
 	}
 }
+
+func TestSignFileName(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	sig := signFileName("kernel", now.Add(time.Hour), key)
+
+	if err := verifyFileName("kernel", sig, now, key); err != nil {
+		t.Fatalf("Valid signature %q failed verification: %s", sig, err)
+	}
+
+	tests := []struct {
+		desc string
+		name string
+		sig  string
+		now  time.Time
+		key  []byte
+	}{
+		{"tampered name", "initrd", sig, now, key},
+		{"tampered expiry", "kernel", "9" + sig, now, key},
+		{"tampered mac", "kernel", sig[:len(sig)-2] + "AA", now, key},
+		{"expired", "kernel", sig, now.Add(2 * time.Hour), key},
+		{"wrong key", "kernel", sig, now, []byte("another key")},
+		{"missing", "kernel", "", now, key},
+		{"malformed", "kernel", "garbage", now, key},
+	}
+	for _, test := range tests {
+		if err := verifyFileName(test.name, test.sig, test.now, test.key); err == nil {
+			t.Errorf("%s: signature %q for %q passed verification", test.desc, test.sig, test.name)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A SpecError lists the problems Spec.Validate found in a Spec.
+type SpecError struct {
+	Errors []error
+}
+
+func (e *SpecError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("invalid spec: %s", strings.Join(msgs, "; "))
+}
+
+// Validate checks that booter can serve the files that s refers to:
+// the kernel, initrds and IDs in the cmdline of s or of its menu
+// entries, and that the cmdlines are valid templates. Files are
+// looked up with Stat if booter implements BootFileStater, and read
+// otherwise. Validate returns a *SpecError listing all the problems
+// it found, or nil if there are none.
+//
+// Specs with an IpxeScript aren't interpreted by Pixiecore, and are
+// always valid.
+func (s *Spec) Validate(booter Booter) error {
+	if s.IpxeScript != "" {
+		return nil
+	}
+
+	var errs []error
+	for _, cmd := range s.IpxePreamble {
+		if strings.ContainsAny(cmd, "\r\n") {
+			errs = append(errs, fmt.Errorf("iPXE preamble command %q contains a newline", cmd))
+		}
+	}
+	if strings.ContainsAny(s.BootFlags, "\r\n") {
+		errs = append(errs, fmt.Errorf("iPXE boot flags %q contain a newline", s.BootFlags))
+	}
+	if len(s.Menu) == 0 {
+		if s.Kernel == "" {
+			errs = append(errs, fmt.Errorf("spec is missing Kernel"))
+		} else {
+			errs = append(errs, validateBoot(booter, "", s.Kernel, s.Initrd, s.Cmdline)...)
+		}
+		if err := checkBootHashes(s.KernelHash, s.InitrdHashes, s.Initrd); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, entry := range s.Menu {
+		prefix := fmt.Sprintf("menu entry %q: ", entry.Label)
+		if strings.ContainsAny(entry.Label, "\r\n") {
+			errs = append(errs, fmt.Errorf("menu entry label %q contains a newline", entry.Label))
+		}
+		if entry.Kernel == "" {
+			errs = append(errs, fmt.Errorf("%smissing Kernel", prefix))
+			continue
+		}
+		errs = append(errs, validateBoot(booter, prefix, entry.Kernel, entry.Initrd, entry.Cmdline)...)
+		if err := checkBootHashes(entry.KernelHash, entry.InitrdHashes, entry.Initrd); err != nil {
+			errs = append(errs, fmt.Errorf("%s%s", prefix, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &SpecError{errs}
+	}
+	return nil
+}
+
+// validateBoot checks the files and cmdline of a boot, and returns
+// its problems, prefixed with prefix.
+func validateBoot(booter Booter, prefix string, kernel ID, initrds []ID, cmdlineTpl string) []error {
+	var errs []error
+	if err := checkBootFile(booter, kernel); err != nil {
+		errs = append(errs, fmt.Errorf("%skernel %q: %s", prefix, kernel, err))
+	}
+	for _, initrd := range initrds {
+		if err := checkBootFile(booter, initrd); err != nil {
+			errs = append(errs, fmt.Errorf("%sinitrd %q: %s", prefix, initrd, err))
+		}
+	}
+
+	var ids []ID
+	record := func(id string) string {
+		ids = append(ids, ID(id))
+		return ""
+	}
+	funcs := machineFuncs(Machine{})
+	funcs["ID"] = record
+	funcs["USERDATA"] = func() string { return "" }
+	if _, err := expandCmdline(cmdlineTpl, funcs); err != nil {
+		return append(errs, fmt.Errorf("%s%s", prefix, err))
+	}
+	for _, id := range ids {
+		if err := checkBootFile(booter, id); err != nil {
+			errs = append(errs, fmt.Errorf("%scmdline file %q: %s", prefix, id, err))
+		}
+	}
+	return errs
+}
+
+// checkBootFile returns an error if booter can't serve the file for
+// id.
+func checkBootFile(booter Booter, id ID) error {
+	if stater, ok := booter.(BootFileStater); ok {
+		_, _, err := stater.Stat(id)
+		return err
+	}
+	f, _, err := booter.ReadBootFile(id)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pixiecore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fileSetBooter serves the files in it, and counts the files read.
+type fileSetBooter struct {
+	files map[ID]bool
+	reads int
+}
+
+func (b *fileSetBooter) BootSpec(m Machine) (*Spec, error) { return nil, nil }
+func (b *fileSetBooter) ReadBootFile(id ID) (io.ReadCloser, int64, error) {
+	if !b.files[id] {
+		return nil, -1, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	b.reads++
+	return ioutil.NopCloser(strings.NewReader("")), 0, nil
+}
+func (b *fileSetBooter) WriteBootFile(id ID, r io.Reader) error { return errors.New("no") }
+
+// statFileSetBooter stats files rather than read them.
+type statFileSetBooter struct {
+	fileSetBooter
+}
+
+func (b *statFileSetBooter) Stat(id ID) (int64, time.Time, error) {
+	if !b.files[id] {
+		return -1, time.Time{}, fmt.Errorf("no file with ID %q: %w", id, ErrBootFileNotFound)
+	}
+	return 0, time.Time{}, nil
+}
+
+func TestSpecValidate(t *testing.T) {
+	files := map[ID]bool{"kernel": true, "initrd": true, "config": true}
+	for _, test := range []struct {
+		name   string
+		spec   Spec
+		errors []string // substrings of the expected errors, in order
+	}{
+		{
+			name: "valid",
+			spec: Spec{Kernel: "kernel", Initrd: []ID{"initrd"}, Cmdline: `config={{ ID "config" }}`},
+		},
+		{
+			name: "custom script",
+			spec: Spec{IpxeScript: "#!ipxe\nboot"},
+		},
+		{
+			name:   "missing kernel",
+			spec:   Spec{Initrd: []ID{"initrd"}},
+			errors: []string{"spec is missing Kernel"},
+		},
+		{
+			name:   "unknown kernel",
+			spec:   Spec{Kernel: "nope"},
+			errors: []string{`kernel "nope": no file with ID "nope"`},
+		},
+		{
+			name: "unknown initrds",
+			spec: Spec{Kernel: "kernel", Initrd: []ID{"initrd", "nope1", "nope2"}},
+			errors: []string{
+				`initrd "nope1": no file with ID "nope1"`,
+				`initrd "nope2": no file with ID "nope2"`,
+			},
+		},
+		{
+			name:   "unknown cmdline ID",
+			spec:   Spec{Kernel: "kernel", Cmdline: `config={{ ID "config" }} ks={{ ID "nope" }}`},
+			errors: []string{`cmdline file "nope": no file with ID "nope"`},
+		},
+		{
+			name:   "malformed cmdline",
+			spec:   Spec{Kernel: "kernel", Cmdline: `config={{ ID "config" `},
+			errors: []string{"parsing cmdline"},
+		},
+		{
+			name:   "preamble with newline",
+			spec:   Spec{Kernel: "kernel", IpxePreamble: []string{"echo a\necho b"}},
+			errors: []string{"iPXE preamble command \"echo a\\necho b\" contains a newline"},
+		},
+		{
+			name: "menu",
+			spec: Spec{Menu: []MenuEntry{
+				{Label: "Good", Kernel: "kernel", Initrd: []ID{"initrd"}},
+				{Label: "No kernel"},
+				{Label: "Bad initrd", Kernel: "kernel", Initrd: []ID{"nope"}},
+			}},
+			errors: []string{
+				`menu entry "No kernel": missing Kernel`,
+				`menu entry "Bad initrd": initrd "nope"`,
+			},
+		},
+	} {
+		for _, booter := range []Booter{&fileSetBooter{files: files}, &statFileSetBooter{fileSetBooter{files: files}}} {
+			err := test.spec.Validate(booter)
+			if len(test.errors) == 0 {
+				if err != nil {
+					t.Errorf("%s (%T): unexpected error: %s", test.name, booter, err)
+				}
+				continue
+			}
+			var specErr *SpecError
+			if !errors.As(err, &specErr) {
+				t.Errorf("%s (%T): expected a SpecError, got %v", test.name, booter, err)
+				continue
+			}
+			if len(specErr.Errors) != len(test.errors) {
+				t.Errorf("%s (%T): expected %d errors, got %s", test.name, booter, len(test.errors), err)
+				continue
+			}
+			for i, want := range test.errors {
+				if got := specErr.Errors[i].Error(); !strings.Contains(got, want) {
+					t.Errorf("%s (%T): expected error %q, got %q", test.name, booter, want, got)
+				}
+			}
+		}
+	}
+
+	// Stat is used rather than reading files when possible.
+	booter := &statFileSetBooter{fileSetBooter{files: files}}
+	spec := Spec{Kernel: "kernel", Initrd: []ID{"initrd"}}
+	if err := spec.Validate(booter); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if booter.reads != 0 {
+		t.Fatalf("Validate read %d files from a BootFileStater", booter.reads)
+	}
+}
+
+func TestIpxeValidateSpecs(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	var logged []string
+	s := &Server{
+		Booter: &specBooter{
+			fileSetBooter: fileSetBooter{files: map[ID]bool{"kernel": true}},
+			spec:          &Spec{Kernel: "kernel", Initrd: []ID{"missing"}},
+		},
+		Log:           func(subsystem, msg string) { logged = append(logged, msg) },
+		Debug:         log,
+		ValidateSpecs: true,
+		events:        make(map[string][]machineEvent),
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	s.handleIpxe(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("Got HTTP %d for an invalid spec, expected 500", rr.Code)
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], `initrd "missing"`) {
+		t.Fatalf("Expected the invalid initrd to be logged, got %q", logged)
+	}
+
+	// Without ValidateSpecs, the machine gets a boot script.
+	s.ValidateSpecs = false
+	rr = httptest.NewRecorder()
+	s.handleIpxe(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got HTTP %d without spec validation, expected 200", rr.Code)
+	}
+}
+
+// specBooter boots every machine with spec.
+type specBooter struct {
+	fileSetBooter
+	spec *Spec
+}
+
+func (b *specBooter) BootSpec(m Machine) (*Spec, error) { return b.spec, nil }
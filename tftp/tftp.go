@@ -23,6 +23,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -41,6 +42,13 @@ const (
 	// DefaultBlockSize. This can be overridden by setting
 	// Server.MaxBlockSize.
 	DefaultBlockSize = 1450
+	// DefaultWindowSize is the maximum number of data packets sent
+	// to clients before waiting for an acknowledgement (RFC 7440). The
+	// server will respect a request for a smaller window size, but
+	// requests for larger window sizes will be clamped to
+	// DefaultWindowSize. This can be overridden by setting
+	// Server.MaxWindowSize.
+	DefaultWindowSize = 16
 
 	// maxErrorSize is the largest error message string that will be
 	// sent to the client without truncation.
@@ -73,6 +81,9 @@ type Server struct {
 	// MaxBlockSize sets the maximum block size used for file
 	// transfers. If 0, uses DefaultBlockSize.
 	MaxBlockSize int64
+	// MaxWindowSize sets the maximum window size used for file
+	// transfers. If 0, uses DefaultWindowSize.
+	MaxWindowSize int64
 
 	// InfoLog specifies an optional logger for informational
 	// messages. If nil, informational messages are suppressed.
@@ -173,7 +184,7 @@ func (s *Server) transfer(addr net.Addr, req *rrq) error {
 	defer file.Close()
 
 	var b bytes.Buffer
-	if req.BlockSize != 0 || (req.WantSize && size != 0) {
+	if req.BlockSize != 0 || (req.WantSize && size != 0) || req.WindowSize != 0 {
 		// Client requested options, need to OACK them before sending
 		// data.
 		b.WriteByte(0)
@@ -202,7 +213,23 @@ func (s *Server) transfer(addr net.Addr, req *rrq) error {
 			b.WriteByte(0)
 		}
 
-		if err := s.send(conn, b.Bytes(), 0); err != nil {
+		if req.WindowSize != 0 {
+			maxWindowSize := s.MaxWindowSize
+			if maxWindowSize <= 0 {
+				maxWindowSize = DefaultWindowSize
+			}
+			if req.WindowSize > maxWindowSize {
+				s.infoLog("clamping windowsize to %q: %d -> %d", addr, req.WindowSize, maxWindowSize)
+				req.WindowSize = maxWindowSize
+			}
+
+			b.WriteString("windowsize")
+			b.WriteByte(0)
+			b.WriteString(strconv.FormatInt(req.WindowSize, 10))
+			b.WriteByte(0)
+		}
+
+		if _, err := s.send(conn, [][]byte{b.Bytes()}, 0); err != nil {
 			return fmt.Errorf("sending OACK: %s", err)
 		}
 		b.Reset()
@@ -211,35 +238,56 @@ func (s *Server) transfer(addr net.Addr, req *rrq) error {
 		// Client didn't negotiate, use classic blocksize from RFC.
 		req.BlockSize = 512
 	}
+	if req.WindowSize == 0 {
+		// Client didn't negotiate, use lockstep transfer from RFC.
+		req.WindowSize = 1
+	}
 
-	seq := uint16(1)
-	b.Grow(int(req.BlockSize + 4))
-	b.WriteByte(0)
-	b.WriteByte(3)
+	// window holds the data packets sent but not yet acknowledged,
+	// starting at block seq.
+	var (
+		seq    = uint16(1)
+		window [][]byte
+		eof    bool
+	)
 	for {
-		b.Truncate(2)
-		if err = binary.Write(&b, binary.BigEndian, seq); err != nil {
-			conn.Write(tftpError("internal server error"))
-			return fmt.Errorf("writing seqnum: %s", err)
-		}
-		n, err := io.CopyN(&b, file, req.BlockSize)
-		if err != nil && err != io.EOF {
-			conn.Write(tftpError("internal server error"))
-			return fmt.Errorf("reading bytes for block %d: %s", seq, err)
+		for !eof && int64(len(window)) < req.WindowSize {
+			var pkt bytes.Buffer
+			pkt.Grow(int(req.BlockSize + 4))
+			pkt.Write([]byte{0, 3})
+			if err = binary.Write(&pkt, binary.BigEndian, seq+uint16(len(window))); err != nil {
+				conn.Write(tftpError("internal server error"))
+				return fmt.Errorf("writing seqnum: %s", err)
+			}
+			n, err := io.CopyN(&pkt, file, req.BlockSize)
+			if err != nil && err != io.EOF {
+				conn.Write(tftpError("internal server error"))
+				return fmt.Errorf("reading bytes for block %d: %s", seq+uint16(len(window)), err)
+			}
+			window = append(window, pkt.Bytes())
+			if n < req.BlockSize {
+				eof = true
+			}
 		}
-		if err = s.send(conn, b.Bytes(), seq); err != nil {
+
+		acked, err := s.send(conn, window, seq)
+		if err != nil {
 			conn.Write(tftpError("timeout"))
-			return fmt.Errorf("sending data packet %d: %s", seq, err)
+			return fmt.Errorf("sending data packets %d-%d: %s", seq, seq+uint16(len(window)-1), err)
 		}
-		seq++
-		if n < req.BlockSize {
+		window = window[acked:]
+		seq += uint16(acked)
+		if eof && len(window) == 0 {
 			// Transfer complete
 			return nil
 		}
 	}
 }
 
-func (s *Server) send(conn net.Conn, b []byte, seq uint16) error {
+// send sends pkts, numbered from seq, and waits for the client to
+// acknowledge at least the first of them. It returns the number of
+// packets acknowledged.
+func (s *Server) send(conn net.Conn, pkts [][]byte, seq uint16) (int, error) {
 	timeout := s.WriteTimeout
 	if timeout <= 0 {
 		timeout = DefaultWriteTimeout
@@ -251,8 +299,10 @@ func (s *Server) send(conn net.Conn, b []byte, seq uint16) error {
 
 Attempt:
 	for attempt := 0; attempt < attempts; attempt++ {
-		if _, err := conn.Write(b); err != nil {
-			return err
+		for _, b := range pkts {
+			if _, err := conn.Write(b); err != nil {
+				return 0, err
+			}
 		}
 
 		conn.SetReadDeadline(time.Now().Add(timeout))
@@ -264,7 +314,7 @@ Attempt:
 				if t, ok := err.(net.Error); ok && t.Timeout() {
 					continue Attempt
 				}
-				return err
+				return 0, err
 			}
 
 			if n < 4 { // packet too small
@@ -272,23 +322,27 @@ Attempt:
 			}
 			switch binary.BigEndian.Uint16(recv[:2]) {
 			case 4:
-				if binary.BigEndian.Uint16(recv[2:4]) == seq {
-					return nil
+				// With a window, the client acknowledges the last
+				// block it received in sequence, which may be before
+				// the end of the window.
+				if acked := int(binary.BigEndian.Uint16(recv[2:4])-seq) + 1; acked <= len(pkts) {
+					return acked, nil
 				}
 			case 5:
 				msg, _, _ := tftpStr(recv[4:])
-				return fmt.Errorf("client aborted transfer: %s", msg)
+				return 0, fmt.Errorf("client aborted transfer: %s", msg)
 			}
 		}
 	}
 
-	return errors.New("timeout waiting for ACK")
+	return 0, errors.New("timeout waiting for ACK")
 }
 
 type rrq struct {
-	Filename  string
-	BlockSize int64
-	WantSize  bool
+	Filename   string
+	BlockSize  int64
+	WantSize   bool
+	WindowSize int64
 }
 
 func parseRRQ(bs []byte) (*rrq, error) {
@@ -328,20 +382,29 @@ func parseRRQ(bs []byte) (*rrq, error) {
 			return nil, fmt.Errorf("reading option %q value: %s", opt, err)
 		}
 		bs = rest
-		if opt != "blksize" {
-			if opt == "tsize" {
-				req.WantSize = true
+		// Option names are case insensitive, see RFC 2347.
+		switch strings.ToLower(opt) {
+		case "blksize":
+			size, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("non-integer block size value %q", val)
 			}
-			continue
-		}
-		size, err := strconv.ParseInt(val, 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("non-integer block size value %q", val)
-		}
-		if size < 8 || size > 65464 {
-			return nil, fmt.Errorf("unsupported block size %q", size)
+			if size < 8 || size > 65464 {
+				return nil, fmt.Errorf("unsupported block size %q", size)
+			}
+			req.BlockSize = size
+		case "tsize":
+			req.WantSize = true
+		case "windowsize":
+			size, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("non-integer window size value %q", val)
+			}
+			if size < 1 || size > 65535 {
+				return nil, fmt.Errorf("unsupported window size %d", size)
+			}
+			req.WindowSize = size
 		}
-		req.BlockSize = size
 	}
 
 	return req, nil
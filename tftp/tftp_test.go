@@ -0,0 +1,174 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRRQ(t *testing.T) {
+	tests := []struct {
+		pkt string
+		req *rrq
+	}{
+		{"\x00\x01foo\x00octet\x00", &rrq{Filename: "foo"}},
+		{
+			"\x00\x01foo\x00octet\x00blksize\x001468\x00tsize\x000\x00windowsize\x004\x00",
+			&rrq{Filename: "foo", BlockSize: 1468, WantSize: true, WindowSize: 4},
+		},
+		{
+			"\x00\x01foo\x00octet\x00BLKSIZE\x00512\x00WindowSize\x008\x00",
+			&rrq{Filename: "foo", BlockSize: 512, WindowSize: 8},
+		},
+		{"\x00\x01foo\x00octet\x00unknown\x00value\x00", &rrq{Filename: "foo"}},
+		{"\x00\x01foo\x00netascii\x00", nil},
+		{"\x00\x01foo\x00octet\x00windowsize\x000\x00", nil},
+		{"\x00\x01foo\x00octet\x00blksize\x00big\x00", nil},
+	}
+
+	for _, test := range tests {
+		req, err := parseRRQ([]byte(test.pkt))
+		if test.req == nil {
+			if err == nil {
+				t.Errorf("parseRRQ(%q) succeeded, expected an error", test.pkt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRRQ(%q): %s", test.pkt, err)
+			continue
+		}
+		if !reflect.DeepEqual(req, test.req) {
+			t.Errorf("parseRRQ(%q) = %#v, expected %#v", test.pkt, req, test.req)
+		}
+	}
+}
+
+// fetch runs a transfer of file to a test client that sends rrqOpts,
+// and returns the OACK (if any) and the file contents received.
+func fetch(t *testing.T, s *Server, file []byte, rrqOpts string) (oack string, received []byte) {
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("creating client socket: %s", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, err := parseRRQ([]byte("\x00\x01foo\x00octet\x00" + rrqOpts))
+	if err != nil {
+		t.Fatalf("parsing RRQ: %s", err)
+	}
+	s.Handler = ConstantHandler(file)
+	errs := make(chan error, 1)
+	go func() { errs <- s.transfer(client.LocalAddr(), req) }()
+
+	ack := func(addr net.Addr, seq uint16) {
+		pkt := []byte{0, 4, 0, 0}
+		binary.BigEndian.PutUint16(pkt[2:], seq)
+		if _, err := client.WriteTo(pkt, addr); err != nil {
+			t.Fatalf("sending ACK %d: %s", seq, err)
+		}
+	}
+
+	buf := make([]byte, 65536)
+	blockSize, window, unacked := 512, 1, 0
+	for {
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("reading from server: %s", err)
+		}
+		pkt := buf[:n]
+		switch binary.BigEndian.Uint16(pkt[:2]) {
+		case 6:
+			oack = string(pkt[2:])
+			fs := strings.Split(oack, "\x00")
+			for i := 0; i+1 < len(fs); i += 2 {
+				v, err := strconv.Atoi(fs[i+1])
+				if err != nil {
+					t.Fatalf("bad OACK value %q: %s", fs[i+1], err)
+				}
+				switch fs[i] {
+				case "blksize":
+					blockSize = v
+				case "windowsize":
+					window = v
+				}
+			}
+			ack(addr, 0)
+		case 3:
+			seq := binary.BigEndian.Uint16(pkt[2:4])
+			if int(seq) != len(received)/blockSize+1 {
+				// Retransmission of a block we already have.
+				continue
+			}
+			received = append(received, pkt[4:]...)
+			unacked++
+			last := n-4 < blockSize
+			// Only acknowledge the end of each window (or the
+			// file), as a windowing client would.
+			if last || unacked == window {
+				ack(addr, seq)
+				unacked = 0
+			}
+			if last {
+				if err := <-errs; err != nil {
+					t.Fatalf("transfer failed: %s", err)
+				}
+				return oack, received
+			}
+		default:
+			t.Fatalf("unexpected packet from server: %q", pkt)
+		}
+	}
+}
+
+func TestTransferWithoutOptions(t *testing.T) {
+	file := bytes.Repeat([]byte("0123456789"), 200)
+	oack, received := fetch(t, &Server{}, file, "")
+	if oack != "" {
+		t.Fatalf("server sent OACK %q to client that requested no options", oack)
+	}
+	if !bytes.Equal(received, file) {
+		t.Fatalf("received file doesn't match file served")
+	}
+}
+
+func TestTransferWithOptions(t *testing.T) {
+	file := bytes.Repeat([]byte("0123456789"), 2000)
+	oack, received := fetch(t, &Server{}, file, "blksize\x0065464\x00tsize\x000\x00windowsize\x004\x00")
+	expected := "blksize\x001450\x00tsize\x0020000\x00windowsize\x004\x00"
+	if oack != expected {
+		t.Fatalf("wrong OACK, got %q, expected %q", oack, expected)
+	}
+	if !bytes.Equal(received, file) {
+		t.Fatalf("received file doesn't match file served")
+	}
+
+	s := &Server{MaxWindowSize: 2}
+	oack, received = fetch(t, s, file, "windowsize\x00100\x00")
+	if oack != "windowsize\x002\x00" {
+		t.Fatalf("wrong OACK, got %q, expected %q", oack, "windowsize\x002\x00")
+	}
+	if !bytes.Equal(received, file) {
+		t.Fatalf("received file doesn't match file served")
+	}
+}